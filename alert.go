@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Alert kinds.
+const (
+	AlertErrorRate      = "error_rate"
+	AlertListenerFailed = "listener_failed"
+	AlertCertExpiring   = "cert_expiring"
+	AlertCircuitOpen    = "circuit_open"
+)
+
+// Alert is the JSON body POSTed to the alert webhook.
+type Alert struct {
+	Time    time.Time `json:"time"`
+	Host    string    `json:"host"`
+	Kind    string    `json:"kind"`
+	Message string    `json:"message"`
+}
+
+// alerter, if set, is told about every response and POSTs alerts to a
+// webhook when something looks wrong.
+var alerter *Alerter
+
+// Alerter watches the server and POSTs an Alert to a webhook when the rate
+// of 5xx responses crosses a threshold, a listener fails to start, or a
+// certificate is close to expiring.
+type Alerter struct {
+	webhook     string
+	errorRate   float64       // percentage of 5xx responses (0=don't check)
+	window      time.Duration // period the error rate is measured over
+	minRequests uint64        // requests needed in a window before alerting
+	certExpiry  time.Duration // warn when certs expire within this (0=don't)
+	client      *http.Client
+
+	total  uint64 // responses in the current window
+	errors uint64 // 5xx responses in the current window
+}
+
+// NewAlerter creates an Alerter posting to the given webhook URL.
+func NewAlerter(webhook string, errorRate float64, window time.Duration, minRequests int, certExpiry time.Duration) *Alerter {
+	return &Alerter{
+		webhook:     webhook,
+		errorRate:   errorRate,
+		window:      window,
+		minRequests: uint64(minRequests),
+		certExpiry:  certExpiry,
+		client:      &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// record counts a response towards the error rate.
+func (a *Alerter) record(status int) {
+	atomic.AddUint64(&a.total, 1)
+	if status >= 500 && status < 600 {
+		atomic.AddUint64(&a.errors, 1)
+	}
+}
+
+// watch starts checking the error rate and the expiry of the given
+// certificate files, until the function returned is called.
+func (a *Alerter) watch(certFiles []string) (stop func()) {
+	done := make(chan struct{})
+	go a.watchErrorRate(done)
+	go a.watchCerts(certFiles, done)
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(done) })
+	}
+}
+
+// watchErrorRate checks the error rate at the end of every window, alerting
+// once when it rises above the threshold and again only after it has
+// dropped back below, until done is closed.
+func (a *Alerter) watchErrorRate(done <-chan struct{}) {
+	if a.errorRate <= 0 {
+		return
+	}
+	t := time.NewTicker(a.window)
+	defer t.Stop()
+	firing := false
+	for {
+		select {
+		case <-t.C:
+		case <-done:
+			return
+		}
+		total := atomic.SwapUint64(&a.total, 0)
+		errors := atomic.SwapUint64(&a.errors, 0)
+		if total < a.minRequests || total == 0 {
+			firing = false
+			continue
+		}
+		rate := float64(errors) * 100 / float64(total)
+		if rate <= a.errorRate {
+			firing = false
+			continue
+		}
+		if !firing {
+			a.send(AlertErrorRate, fmt.Sprintf(
+				"%.1f%% of %d responses were 5xx errors in the last %s",
+				rate, total, a.window))
+		}
+		firing = true
+	}
+}
+
+// watchCerts checks the given certificate files once a day, alerting for
+// each that expires within the configured period, until done is closed.
+func (a *Alerter) watchCerts(certFiles []string, done <-chan struct{}) {
+	if a.certExpiry <= 0 || len(certFiles) == 0 {
+		return
+	}
+	t := time.NewTicker(24 * time.Hour)
+	defer t.Stop()
+	for {
+		for _, f := range certFiles {
+			a.checkCert(f)
+		}
+		select {
+		case <-t.C:
+		case <-done:
+			return
+		}
+	}
+}
+
+// checkCert alerts if the first certificate in the PEM file expires soon.
+func (a *Alerter) checkCert(certFile string) {
+	leaf, err := readLeafCert(certFile)
+	if err != nil {
+		log.Printf("Couldn't check expiry of %s: %s", pemLabel(certFile), err)
+		return
+	}
+	if time.Until(leaf.NotAfter) < a.certExpiry {
+		a.send(AlertCertExpiring, fmt.Sprintf(
+			"certificate %s (%s) expires at %s",
+			pemLabel(certFile), leaf.Subject.CommonName,
+			leaf.NotAfter.UTC().Format(time.RFC3339)))
+	}
+}
+
+// readLeafCert returns the first certificate in PEM data from a source
+// understood by readPEM.
+func readLeafCert(certFile string) (*x509.Certificate, error) {
+	data, err := readPEM(certFile)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("no certificate found")
+		}
+		if block.Type == "CERTIFICATE" {
+			return x509.ParseCertificate(block.Bytes)
+		}
+	}
+}
+
+// send POSTs an alert to the webhook. It blocks until the webhook responds
+// so that it can be used just before exiting.
+func (a *Alerter) send(kind, message string) {
+	host, _ := os.Hostname()
+	body, _ := json.Marshal(Alert{
+		Time:    time.Now().UTC(),
+		Host:    host,
+		Kind:    kind,
+		Message: message,
+	})
+	log.Printf("Alert (%s): %s", kind, message)
+	resp, err := a.client.Post(a.webhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Println("Couldn't send alert:", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		log.Printf("Alert webhook returned %s", resp.Status)
+	}
+}
+
+// alert sends an alert if alerting is enabled.
+func alert(kind, message string) {
+	if alerter != nil {
+		alerter.send(kind, message)
+	}
+}
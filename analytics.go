@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	maxAnalyticsPaths = 10000 // distinct paths counted per day
+	analyticsDay      = "2006-01-02"
+)
+
+// analytics, if set, counts page views.
+var analytics *Analytics
+
+// analyticsData is the page views per day and path. No information about
+// visitors is kept.
+type analyticsData struct {
+	Days   map[string]map[string]uint64 `json:"days"`             // day -> path -> views
+	Pushed string                       `json:"pushed,omitempty"` // last day sent to the webhook
+}
+
+// Analytics aggregates page views per path and day, optionally persisting
+// them to a file and sending each day's views to a webhook once it's over.
+type Analytics struct {
+	file    string
+	include []string      // glob patterns of paths to count (empty=HTML pages)
+	webhook string        // URL to POST each day's views to
+	retain  time.Duration // how long views are kept (0=forever)
+	client  *http.Client
+
+	mu    sync.Mutex
+	data  analyticsData
+	dirty bool
+}
+
+// NewAnalytics creates an Analytics, loading the views already saved to the
+// file, if given.
+func NewAnalytics(file string, include []string, webhook string, retain time.Duration) (*Analytics, error) {
+	a := &Analytics{
+		file:    file,
+		include: include,
+		webhook: webhook,
+		retain:  retain,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		data:    analyticsData{Days: make(map[string]map[string]uint64)},
+	}
+	if file == "" {
+		return a, nil
+	}
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return a, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &a.data); err != nil {
+		return nil, err
+	}
+	if a.data.Days == nil {
+		a.data.Days = make(map[string]map[string]uint64)
+	}
+	return a, nil
+}
+
+// isBot returns true if the user agent looks like a crawler.
+func isBot(ua string) bool {
+	ua = strings.ToLower(ua)
+	for _, s := range []string{"bot", "crawl", "spider", "slurp"} {
+		if strings.Contains(ua, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// record counts a response as a page view if it's a successful GET of a
+// page, by a client that doesn't identify as a crawler. Pages are HTML
+// responses, or those matching the include patterns if given.
+func (a *Analytics) record(r *http.Request, status int, contentType string) {
+	if r.Method != http.MethodGet || status != http.StatusOK || isBot(r.UserAgent()) {
+		return
+	}
+	p := r.URL.Path
+	if len(a.include) > 0 {
+		if !matchAny(a.include, p) {
+			return
+		}
+	} else if t, _, _ := mime.ParseMediaType(contentType); t != "text/html" {
+		return
+	}
+	day := time.Now().UTC().Format(analyticsDay)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	views := a.data.Days[day]
+	if views == nil {
+		views = make(map[string]uint64)
+		a.data.Days[day] = views
+	}
+	if _, ok := views[p]; ok || len(views) < maxAnalyticsPaths {
+		views[p]++
+		a.dirty = true
+	}
+}
+
+// run periodically discards views older than the retention period, sends
+// finished days to the webhook and saves the views to the file, until the
+// function returned is called.
+func (a *Analytics) run(interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				a.prune()
+				a.push()
+				a.save()
+			case <-done:
+				return
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(done) })
+	}
+}
+
+// prune discards views older than the retention period.
+func (a *Analytics) prune() {
+	if a.retain <= 0 {
+		return
+	}
+	oldest := time.Now().UTC().Add(-a.retain).Format(analyticsDay)
+	a.mu.Lock()
+	for day := range a.data.Days {
+		if day < oldest {
+			delete(a.data.Days, day)
+			a.dirty = true
+		}
+	}
+	a.mu.Unlock()
+}
+
+// analyticsDayViews is the page views of a day, as sent to the webhook.
+type analyticsDayViews struct {
+	Day   string           `json:"day"`
+	Views []analyticsViews `json:"views"`
+}
+
+type analyticsViews struct {
+	Day   string `json:"day"`
+	Path  string `json:"path"`
+	Views uint64 `json:"views"`
+}
+
+// push POSTs the views of each finished day not yet sent to the webhook,
+// oldest first, stopping at the first failure to retry later.
+func (a *Analytics) push() {
+	if a.webhook == "" {
+		return
+	}
+	today := time.Now().UTC().Format(analyticsDay)
+	a.mu.Lock()
+	var days []string
+	for day := range a.data.Days {
+		if day > a.data.Pushed && day < today {
+			days = append(days, day)
+		}
+	}
+	a.mu.Unlock()
+	sort.Strings(days)
+
+	for _, day := range days {
+		body, _ := json.Marshal(analyticsDayViews{day, a.views(day, day)})
+		resp, err := a.client.Post(a.webhook, "application/json", bytes.NewReader(body))
+		if err != nil {
+			log.Println("Couldn't send analytics:", err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			log.Printf("Analytics webhook returned %s", resp.Status)
+			return
+		}
+		a.mu.Lock()
+		a.data.Pushed = day
+		a.dirty = true
+		a.mu.Unlock()
+	}
+}
+
+// save writes the views to the file, atomically, if they've changed.
+func (a *Analytics) save() {
+	if a == nil || a.file == "" {
+		return
+	}
+	a.mu.Lock()
+	if !a.dirty {
+		a.mu.Unlock()
+		return
+	}
+	data, err := json.Marshal(a.data)
+	a.dirty = false
+	a.mu.Unlock()
+	if err != nil {
+		log.Println("Couldn't encode analytics:", err)
+		return
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(a.file), ".tmp-")
+	if err == nil {
+		_, err = tmp.Write(data)
+		tmp.Close()
+		if err == nil {
+			err = os.Rename(tmp.Name(), a.file)
+		}
+		if err != nil {
+			os.Remove(tmp.Name())
+		}
+	}
+	if err != nil {
+		log.Printf("Couldn't save analytics to %s: %s", a.file, err)
+	}
+}
+
+// views returns the views of each path on the days from and to inclusive,
+// given as YYYY-MM-DD (empty=unbounded), ordered by day then most viewed.
+func (a *Analytics) views(from, to string) []analyticsViews {
+	list := []analyticsViews{}
+	a.mu.Lock()
+	for day, views := range a.data.Days {
+		if (from != "" && day < from) || (to != "" && day > to) {
+			continue
+		}
+		for p, n := range views {
+			list = append(list, analyticsViews{day, p, n})
+		}
+	}
+	a.mu.Unlock()
+	sort.Slice(list, func(i, j int) bool {
+		x, y := list[i], list[j]
+		if x.Day != y.Day {
+			return x.Day < y.Day
+		}
+		return x.Views > y.Views || (x.Views == y.Views && x.Path < y.Path)
+	})
+	return list
+}
+
+// ServeHTTP exports the page views as JSON, or as CSV when given
+// `format=csv`. The `from` and `to` query parameters limit them to a range
+// of days, given as YYYY-MM-DD.
+func (a *Analytics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	from, to := q.Get("from"), q.Get("to")
+	for _, d := range []string{from, to} {
+		if _, err := time.Parse(analyticsDay, d); d != "" && err != nil {
+			http.Error(w, "Invalid day `"+d+"`; expected YYYY-MM-DD", http.StatusBadRequest)
+			return
+		}
+	}
+	list := a.views(from, to)
+	w.Header().Set("Cache-Control", "no-store")
+
+	if q.Get("format") == "csv" {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="analytics.csv"`)
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"day", "path", "views"})
+		for _, v := range list {
+			cw.Write([]string{v.Day, v.Path, strconv.FormatUint(v.Views, 10)})
+		}
+		cw.Flush()
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
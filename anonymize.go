@@ -0,0 +1,66 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"sync"
+	"time"
+)
+
+// IP anonymization modes.
+const (
+	AnonymizeMask = "mask" // zero the last octet (IPv4) or last 80 bits (IPv6)
+	AnonymizeHash = "hash" // replace with a keyed hash, rekeyed daily
+)
+
+// validAnonymize returns true if the mode is empty or a known mode.
+func validAnonymize(mode string) bool {
+	return mode == "" || mode == AnonymizeMask || mode == AnonymizeHash
+}
+
+var (
+	ipv4Mask = net.CIDRMask(24, 32)
+	ipv6Mask = net.CIDRMask(48, 128)
+)
+
+// anonymizeIP anonymizes an IP address according to the mode. Strings that
+// aren't IP addresses are returned as-is when masking.
+func anonymizeIP(addr, mode string) string {
+	if mode == AnonymizeHash {
+		return hashIP(addr)
+	}
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return addr
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(ipv4Mask).String()
+	}
+	return ip.Mask(ipv6Mask).String()
+}
+
+// The salt used for hashing is randomly generated and replaced every day, so
+// that hashes can be correlated within a day but not beyond it, and can't be
+// reversed by hashing all possible addresses.
+var (
+	saltMu  sync.Mutex
+	salt    []byte
+	saltDay string
+)
+
+func hashIP(addr string) string {
+	day := time.Now().UTC().Format("2006-01-02")
+	saltMu.Lock()
+	if day != saltDay {
+		salt = make([]byte, 32)
+		rand.Read(salt)
+		saltDay = day
+	}
+	mac := hmac.New(sha256.New, salt)
+	saltMu.Unlock()
+	mac.Write([]byte(addr))
+	return hex.EncodeToString(mac.Sum(nil)[:8])
+}
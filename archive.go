@@ -0,0 +1,311 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"html"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// archiveSep separates the path of an archive from that of an entry within
+// it, e.g. "/dist/build.zip!/index.html".
+const archiveSep = "!/"
+
+// archiveExts are the extensions of archives that can be browsed.
+var archiveExts = []string{".zip", ".tar", ".tar.gz", ".tgz"}
+
+// isArchive returns true if the file name has the extension of an archive
+// that can be browsed.
+func isArchive(name string) bool {
+	name = strings.ToLower(name)
+	for _, ext := range archiveExts {
+		if strings.HasSuffix(name, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// splitArchivePath splits a path such as "/a/b.zip!/c/d" into the path of
+// the archive ("/a/b.zip") and that of the entry within it ("c/d"). A path
+// ending at the archive and separator, such as "/a/b.zip!", has an empty
+// entry, and ok is false for paths that don't refer into an archive.
+func splitArchivePath(p string) (archive, entry string, ok bool) {
+	for i := 0; i < len(p); {
+		j := strings.Index(p[i:], "!")
+		if j < 0 {
+			return "", "", false
+		}
+		j += i
+		rest := p[j+1:]
+		if isArchive(p[:j]) && (rest == "" || rest[0] == '/') {
+			return p[:j], strings.TrimPrefix(rest, "/"), true
+		}
+		i = j + 1
+	}
+	return "", "", false
+}
+
+// archiveEntry is a file within an archive.
+type archiveEntry struct {
+	info os.FileInfo
+	open func() (io.Reader, error)
+}
+
+// seekReaderAt reads from offsets of a file that can only be read by seeking
+// to them first.
+type seekReaderAt struct {
+	mu sync.Mutex
+	f  io.ReadSeeker
+}
+
+func (r *seekReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, err := r.f.Seek(off, io.SeekStart); err != nil {
+		return 0, err
+	}
+	n, err := io.ReadFull(r.f, p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// readArchive calls fn for each entry of the archive, in order, until it
+// returns false. Entry readers are only valid during the call.
+func readArchive(f http.File, name string, size int64, fn func(name string, e archiveEntry) bool) error {
+	if strings.HasSuffix(strings.ToLower(name), ".zip") {
+		ra, ok := f.(io.ReaderAt)
+		if !ok {
+			// As with files wrapped by other file systems
+			ra = &seekReaderAt{f: f}
+		}
+		zr, err := zip.NewReader(ra, size)
+		if err != nil {
+			return err
+		}
+		for _, zf := range zr.File {
+			zf := zf
+			e := archiveEntry{zf.FileInfo(), func() (io.Reader, error) { return zf.Open() }}
+			if !fn(zf.Name, e) {
+				break
+			}
+		}
+		return nil
+	}
+
+	var r io.Reader = f
+	if !strings.HasSuffix(strings.ToLower(name), ".tar") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeDir {
+			continue
+		}
+		e := archiveEntry{hdr.FileInfo(), func() (io.Reader, error) { return tr, nil }}
+		if !fn(hdr.Name, e) {
+			return nil
+		}
+	}
+}
+
+// archiveDir is a directory that's only implied by the paths of entries.
+type archiveDir string
+
+func (d archiveDir) Name() string       { return string(d) }
+func (d archiveDir) Size() int64        { return 0 }
+func (d archiveDir) Mode() os.FileMode  { return os.ModeDir | 0755 }
+func (d archiveDir) ModTime() time.Time { return time.Time{} }
+func (d archiveDir) IsDir() bool        { return true }
+func (d archiveDir) Sys() interface{}   { return nil }
+
+// ArchiveHandler lists and serves the entries of zip and tar archives, at
+// paths such as "/build.zip!/" and "/build.zip!/index.html", without
+// unpacking them to disk. Other requests are passed to the next handler.
+// Requests must have had the serve's prefix stripped from their path.
+// Directories within archives more than maxDepth levels below the root,
+// counting the archive's own directories, aren't listed unless it's 0.
+func ArchiveHandler(h http.Handler, fs http.FileSystem, maxDepth int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		archive, entry, ok := splitArchivePath(r.URL.Path)
+		if !ok {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		f, err := requestFileSystem(fs, r).Open(path.Clean("/" + archive))
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		defer f.Close()
+		fi, err := f.Stat()
+		if err != nil || fi.IsDir() {
+			http.NotFound(w, r)
+			return
+		}
+		if entry == "" && !strings.HasSuffix(r.URL.Path, "/") {
+			redirectArchive(w, r, path.Base(archive)+archiveSep)
+			return
+		}
+		dir := strings.HasSuffix(entry, "/") || entry == ""
+		entry = strings.TrimPrefix(path.Clean("/"+entry), "/")
+
+		if dir {
+			if maxDepth > 0 && pathDepth(archive)+pathDepth(entry) > maxDepth {
+				http.NotFound(w, r)
+				return
+			}
+			serveArchiveListing(w, r, f, archive, fi, entry)
+			return
+		}
+		served, isDir := false, false
+		err = readArchive(f, archive, fi.Size(), func(name string, e archiveEntry) bool {
+			if r.Context().Err() != nil {
+				return false
+			}
+			name = strings.TrimPrefix(path.Clean("/"+name), "/")
+			if name == entry && !e.info.IsDir() {
+				served = true
+				serveArchiveEntry(w, r, name, e, fi.ModTime())
+				return false
+			}
+			if strings.HasPrefix(name, entry+"/") {
+				isDir = true
+				return false
+			}
+			return true
+		})
+		switch {
+		case served:
+		case err != nil:
+			http.Error(w, "Couldn't read archive", http.StatusUnsupportedMediaType)
+		case isDir:
+			redirectArchive(w, r, path.Base(entry)+"/")
+		default:
+			http.NotFound(w, r)
+		}
+	})
+}
+
+// redirectArchive redirects to a path relative to the requested one,
+// keeping the query. The Location is left relative, as the request's path
+// has had the serve's prefix stripped.
+func redirectArchive(w http.ResponseWriter, r *http.Request, target string) {
+	u := url.URL{Path: "./" + target, RawQuery: r.URL.RawQuery}
+	w.Header().Set("Location", u.String())
+	w.WriteHeader(http.StatusMovedPermanently)
+}
+
+// serveArchiveEntry streams the content of an entry. As entries can't be
+// seeked, range requests aren't supported.
+func serveArchiveEntry(w http.ResponseWriter, r *http.Request, name string, e archiveEntry, modTime time.Time) {
+	if t, err := time.Parse(http.TimeFormat, r.Header.Get("If-Modified-Since")); err == nil &&
+		!modTime.Truncate(time.Second).After(t) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	rd, err := e.open()
+	if err != nil {
+		http.Error(w, "Couldn't read archive", http.StatusUnsupportedMediaType)
+		return
+	}
+	hdr := w.Header()
+	ctype := mime.TypeByExtension(path.Ext(name))
+	if ctype == "" {
+		ctype = "application/octet-stream"
+	}
+	hdr.Set("Content-Type", ctype)
+	hdr.Set("Content-Length", strconv.FormatInt(e.info.Size(), 10))
+	hdr.Set("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusOK)
+	if r.Method != http.MethodHead {
+		io.CopyN(w, contextReader{r.Context(), rd}, e.info.Size())
+	}
+}
+
+// serveArchiveListing lists the entries within a directory of an archive,
+// including directories only implied by the paths of entries within them.
+func serveArchiveListing(w http.ResponseWriter, r *http.Request, f http.File, archive string, fi os.FileInfo, dir string) {
+	prefix := dir
+	if prefix != "" {
+		prefix += "/"
+	}
+	children := make(map[string]os.FileInfo)
+	err := readArchive(f, archive, fi.Size(), func(name string, e archiveEntry) bool {
+		if r.Context().Err() != nil {
+			return false
+		}
+		name = strings.TrimPrefix(path.Clean("/"+name), "/")
+		if !strings.HasPrefix(name, prefix) || name == dir {
+			return true
+		}
+		rest := name[len(prefix):]
+		if i := strings.Index(rest, "/"); i >= 0 {
+			children[rest[:i]] = archiveDir(rest[:i])
+		} else if _, ok := children[rest]; !ok || !e.info.IsDir() {
+			children[rest] = e.info
+		}
+		return true
+	})
+	if err != nil {
+		http.Error(w, "Couldn't read archive", http.StatusUnsupportedMediaType)
+		return
+	}
+	if dir != "" && len(children) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	fis := make([]os.FileInfo, 0, len(children))
+	for _, c := range children {
+		fis = append(fis, c)
+	}
+	sort.Slice(fis, func(i, j int) bool { return fis[i].Name() < fis[j].Name() })
+
+	var buf bytes.Buffer
+	buf.WriteString("<!doctype html>\n")
+	buf.WriteString("<meta name=\"viewport\" content=\"width=device-width\">\n")
+	fmt.Fprintf(&buf, "<h1>%s</h1>\n", html.EscapeString(path.Base(archive)+archiveSep+dir))
+	buf.WriteString("<pre>\n<a href=\"../\">../</a>\n")
+	for _, fi := range fis {
+		name := fi.Name()
+		if fi.IsDir() {
+			name += "/"
+		}
+		u := url.URL{Path: "./" + name}
+		fmt.Fprintf(&buf, "<a href=\"%s\">%s</a>\n", u.String(), html.EscapeString(name))
+	}
+	buf.WriteString("</pre>\n")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	http.ServeContent(w, r, "", fi.ModTime(), bytes.NewReader(buf.Bytes()))
+}
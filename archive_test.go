@@ -0,0 +1,51 @@
+package main
+
+import (
+	"archive/zip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// archiveTestDir returns a directory holding a zip file, test.zip, with a
+// single entry, hello.txt.
+func archiveTestDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "goserve-archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Create(filepath.Join(dir, "test.zip"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw := zip.NewWriter(f)
+	w, _ := zw.Create("hello.txt")
+	w.Write([]byte("Hello, world"))
+	zw.Close()
+	f.Close()
+	return dir
+}
+
+func TestArchiveHandlerWrappedFileSystems(t *testing.T) {
+	dir := archiveTestDir(t)
+	defer os.RemoveAll(dir)
+
+	modTime := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	for name, fs := range map[string]http.FileSystem{
+		"last_modified": ModTimeFileSystem(http.Dir(dir), modTime, false),
+		"fs_timeout":    TimeoutFileSystem(http.Dir(dir), 5*time.Second),
+	} {
+		h := ArchiveHandler(http.NotFoundHandler(), fs, 0)
+		for _, p := range []string{"/test.zip!/", "/test.zip!/hello.txt"} {
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, p, nil))
+			if w.Code != http.StatusOK {
+				t.Errorf("%s: %s: status %d, want %d", name, p, w.Code, http.StatusOK)
+			}
+		}
+	}
+}
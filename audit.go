@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Audit event outcomes.
+const (
+	AuditAllow = "allow"
+	AuditDeny  = "deny"
+)
+
+// AuditEvent records an access control decision.
+type AuditEvent struct {
+	Time    time.Time `json:"time"`
+	Event   string    `json:"event"`          // kind of decision, e.g. "acl"
+	Outcome string    `json:"outcome"`        // AuditAllow or AuditDeny
+	Rule    string    `json:"rule,omitempty"` // rule that made the decision
+	User    string    `json:"user,omitempty"` // authenticated user, if any
+	Client  string    `json:"client"`
+	Method  string    `json:"method"`
+	Path    string    `json:"path"`
+}
+
+// auditLog, if set, receives a JSON line for every access control decision.
+// It is kept separate from the access log so it can be retained and
+// reviewed independently.
+var auditLog *auditWriter
+
+type auditWriter struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+func newAuditWriter(w io.Writer) *auditWriter {
+	return &auditWriter{enc: json.NewEncoder(w)}
+}
+
+// audit records an access control decision about the request.
+func audit(r *http.Request, event, outcome, rule, user string) {
+	if auditLog == nil {
+		return
+	}
+	client, _, _ := net.SplitHostPort(r.RemoteAddr)
+	e := AuditEvent{
+		Time:    time.Now().UTC(),
+		Event:   event,
+		Outcome: outcome,
+		Rule:    rule,
+		User:    user,
+		Client:  client,
+		Method:  r.Method,
+		Path:    r.URL.Path,
+	}
+	auditLog.mu.Lock()
+	defer auditLog.mu.Unlock()
+	if err := auditLog.enc.Encode(e); err != nil {
+		log.Println("Couldn't write audit log:", err)
+	}
+}
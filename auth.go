@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// AuthRealm is a set of users who may authenticate with HTTP Basic auth,
+// and tokens that may be given instead.
+type AuthRealm struct {
+	name   string
+	mu     sync.RWMutex
+	users  map[string]string     // user -> password hash
+	tokens map[string]*authToken // hex SHA-256 digest of token -> token
+}
+
+// authToken is a token that may be used to authenticate, for example in a
+// shared download link.
+type authToken struct {
+	name  string
+	quota *Quota // nil=unlimited
+}
+
+// authRealms are the realms defined in the configuration, by name.
+var authRealms = map[string]*AuthRealm{}
+
+// validPasswordHash returns true if the hash is in a supported format:
+// "{SHA}" followed by the base64 SHA-1 digest (as written by `htpasswd -s`),
+// or "sha256:" followed by the hex SHA-256 digest.
+func validPasswordHash(hash string) bool {
+	switch {
+	case strings.HasPrefix(hash, "{SHA}"):
+		b, err := base64.StdEncoding.DecodeString(hash[5:])
+		return err == nil && len(b) == sha1.Size
+	case strings.HasPrefix(hash, "sha256:"):
+		b, err := hex.DecodeString(hash[7:])
+		return err == nil && len(b) == sha256.Size
+	}
+	return false
+}
+
+// checkPassword returns true if the password matches the hash.
+func checkPassword(hash, password string) bool {
+	var want, got []byte
+	switch {
+	case strings.HasPrefix(hash, "{SHA}"):
+		want, _ = base64.StdEncoding.DecodeString(hash[5:])
+		sum := sha1.Sum([]byte(password))
+		got = sum[:]
+	case strings.HasPrefix(hash, "sha256:"):
+		want, _ = hex.DecodeString(hash[7:])
+		sum := sha256.Sum256([]byte(password))
+		got = sum[:]
+	default:
+		return false
+	}
+	return subtle.ConstantTimeCompare(want, got) == 1
+}
+
+// readHtpasswd reads users and password hashes from an htpasswd file.
+func readHtpasswd(file string) (map[string]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	users := make(map[string]string)
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.Index(line, ":")
+		if i < 0 || !validPasswordHash(line[i+1:]) {
+			return nil, fmt.Errorf("%s:%d: expected user:{SHA}... or user:sha256:...", file, n)
+		}
+		users[line[:i]] = line[i+1:]
+	}
+	return users, s.Err()
+}
+
+// NewAuthRealm creates a realm of the given users, and those in the
+// htpasswd file if given.
+func NewAuthRealm(name string, users map[string]string, htpasswd string) (*AuthRealm, error) {
+	a := &AuthRealm{name: name, users: make(map[string]string),
+		tokens: make(map[string]*authToken)}
+	if htpasswd != "" {
+		fileUsers, err := readHtpasswd(htpasswd)
+		if err != nil {
+			return nil, err
+		}
+		for u, h := range fileUsers {
+			a.users[u] = h
+		}
+	}
+	for u, h := range users {
+		a.users[u] = h
+	}
+	return a, nil
+}
+
+// reload replaces the realm's users with the given users, and those in the
+// htpasswd file.
+func (a *AuthRealm) reload(users map[string]string, htpasswd string) error {
+	b, err := NewAuthRealm(a.name, users, htpasswd)
+	if err != nil {
+		return err
+	}
+	a.mu.Lock()
+	a.users = b.users
+	a.mu.Unlock()
+	return nil
+}
+
+// AddToken allows requests to authenticate with a token, given as its
+// "sha256:" hash. Requests using it are limited by the quota, if given.
+func (a *AuthRealm) AddToken(hash, name string, quota *Quota) {
+	a.tokens[strings.ToLower(strings.TrimPrefix(hash, "sha256:"))] = &authToken{name, quota}
+}
+
+// requestToken returns the token given in the request's Authorization
+// header or `token` query parameter, if any.
+func requestToken(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); len(auth) > 7 &&
+		strings.EqualFold(auth[:7], "Bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+	return r.URL.Query().Get("token")
+}
+
+// redactToken replaces the value of any `token` query parameter in a
+// request URI, so that tokens aren't written to logs.
+func redactToken(uri string) string {
+	i := strings.Index(uri, "?")
+	if i < 0 || !strings.Contains(uri[i:], "token=") {
+		return uri
+	}
+	params := strings.Split(uri[i+1:], "&")
+	for j, p := range params {
+		if strings.HasPrefix(p, "token=") {
+			params[j] = "token=REDACTED"
+		}
+	}
+	return uri[:i+1] + strings.Join(params, "&")
+}
+
+type authUserKey struct{}
+
+// authUser returns the user the request was authenticated as, if any.
+func authUser(r *http.Request) string {
+	user, _ := r.Context().Value(authUserKey{}).(string)
+	return user
+}
+
+// authenticate returns the request with the user it authenticates as, if
+// its credentials are valid for the realm, and the token it used, if any.
+func (a *AuthRealm) authenticate(r *http.Request) (*http.Request, *authToken, bool) {
+	if token := requestToken(r); token != "" && len(a.tokens) > 0 {
+		sum := sha256.Sum256([]byte(token))
+		t := a.tokens[hex.EncodeToString(sum[:])]
+		if t == nil {
+			return r, nil, false
+		}
+		return r.WithContext(context.WithValue(r.Context(), authUserKey{}, "token:"+t.name)), t, true
+	}
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		return r, nil, false
+	}
+	a.mu.RLock()
+	hash, known := a.users[user]
+	a.mu.RUnlock()
+	if !known {
+		// Take as long as for a known user, so users can't be enumerated
+		checkPassword("sha256:"+strings.Repeat("0", 2*sha256.Size), password)
+		return r, nil, false
+	}
+	if !checkPassword(hash, password) {
+		return r, nil, false
+	}
+	return r.WithContext(context.WithValue(r.Context(), authUserKey{}, user)), nil, true
+}
+
+// challenge responds asking the client to authenticate with the realm.
+func (a *AuthRealm) challenge(w http.ResponseWriter, r *http.Request) {
+	rule := "auth " + a.name
+	setDenyRule(r, rule)
+	user, _, _ := r.BasicAuth()
+	audit(r, "auth", AuditDeny, rule, user)
+	a.mu.RLock()
+	hasUsers := len(a.users) > 0
+	a.mu.RUnlock()
+	if hasUsers {
+		w.Header().Add("WWW-Authenticate", "Basic realm="+strconv.Quote(a.name)+`, charset="UTF-8"`)
+	}
+	if len(a.tokens) > 0 {
+		w.Header().Add("WWW-Authenticate", "Bearer realm="+strconv.Quote(a.name))
+	}
+	http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+}
+
+// serve passes the request to the handler if it authenticates with the
+// realm, and is within its token's quota.
+func (a *AuthRealm) serve(w http.ResponseWriter, r *http.Request, h http.Handler) {
+	r, t, ok := a.authenticate(r)
+	if !ok {
+		a.challenge(w, r)
+		return
+	}
+	audit(r, "auth", AuditAllow, "auth "+a.name, authUser(r))
+	if t != nil && t.quota != nil {
+		if w, ok = quotas.limit(w, r, a.name+"/"+t.name, *t.quota); !ok {
+			return
+		}
+	}
+	h.ServeHTTP(w, r)
+}
+
+// AuthHandler requires requests to authenticate as a user of the realm, or
+// with one of its tokens.
+func AuthHandler(h http.Handler, a *AuthRealm) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		a.serve(w, r, h)
+	})
+}
@@ -0,0 +1,231 @@
+// Package backend provides the storage goserve serves files from: a
+// directory, a zip archive, memory, an HTTP server or object store, or a git
+// repository. A serve's target names the backend and its location as
+// "scheme:location", such as "zip:/srv/site.zip". Other storage, such as
+// database blobs, can be added with Register, and is then listed, cached and
+// served just as directories are.
+package backend
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Backend opens the file system a serve's files are stored in, given the
+// location in the serve's target after the backend's scheme, e.g. the path
+// of the archive in "zip:/srv/site.zip". File systems that implement
+// io.Closer are closed once no serve uses them.
+type Backend func(location string) (http.FileSystem, error)
+
+var (
+	mu sync.Mutex
+	// The http and https backends are registered by http.go
+	backends = map[string]Backend{"dir": Dir, "zip": Zip, "mem": Memory, "git": Git}
+	shared   = map[string]*sharedFS{} // by target
+)
+
+// sharedFS is an open file system, and the number of serves using it.
+type sharedFS struct {
+	fs   http.FileSystem
+	refs int
+}
+
+// Register makes a backend available to serves whose targets start with the
+// scheme and a colon. It's intended to be called from init functions.
+// Schemes must be at least two characters, so that Windows drive letters
+// aren't mistaken for them.
+func Register(scheme string, b Backend) {
+	mu.Lock()
+	defer mu.Unlock()
+	if len(scheme) < 2 || strings.ContainsAny(scheme, ":/\\") {
+		panic("invalid backend scheme " + scheme)
+	}
+	if _, ok := backends[scheme]; ok {
+		panic("backend " + scheme + " registered twice")
+	}
+	backends[scheme] = b
+}
+
+// FS adapts a function opening an io/fs file system to a Backend. The file
+// system's files must implement io.Seeker to be served.
+func FS(open func(location string) (fs.FS, error)) Backend {
+	return func(location string) (http.FileSystem, error) {
+		fsys, err := open(location)
+		if err != nil {
+			return nil, err
+		}
+		return http.FS(fsys), nil
+	}
+}
+
+// Lookup returns the backend a target of the form "scheme:location" names,
+// and the location, or nil if the target is a path.
+func Lookup(target string) (Backend, string) {
+	i := strings.Index(target, ":")
+	if i < 2 {
+		return nil, ""
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	return backends[target[:i]], target[i+1:]
+}
+
+// Open returns the file system of a target naming a backend, opening it if
+// it isn't already open, and a function releasing it. File systems are
+// shared by everything using the same target, and closed once all have
+// released them.
+func Open(target string) (fsys http.FileSystem, release func(), err error) {
+	b, location := Lookup(target)
+	if b == nil {
+		return nil, nil, fmt.Errorf("no backend for `%s`", target)
+	}
+	mu.Lock()
+	s, ok := shared[target]
+	if ok {
+		s.refs++
+	}
+	mu.Unlock()
+	if !ok {
+		if fsys, err = b(location); err != nil {
+			return nil, nil, err
+		}
+		mu.Lock()
+		if s, ok = shared[target]; ok {
+			// Opened concurrently
+			s.refs++
+			closeFS(fsys)
+		} else {
+			s = &sharedFS{fs: fsys, refs: 1}
+			shared[target] = s
+		}
+		mu.Unlock()
+	}
+	var once sync.Once
+	return s.fs, func() { once.Do(func() { releaseFS(target, s) }) }, nil
+}
+
+// releaseFS drops a reference to a shared file system, closing it if it was
+// the last.
+func releaseFS(target string, s *sharedFS) {
+	mu.Lock()
+	s.refs--
+	last := s.refs == 0
+	if last {
+		delete(shared, target)
+	}
+	mu.Unlock()
+	if last {
+		closeFS(s.fs)
+	}
+}
+
+// closeFS closes a file system, if it can be.
+func closeFS(fsys http.FileSystem) {
+	if c, ok := fsys.(io.Closer); ok {
+		c.Close()
+	}
+}
+
+// Dir serves files from a directory, as a target without a scheme does.
+// Requests receive "404 Not Found" until the directory exists.
+func Dir(location string) (http.FileSystem, error) {
+	if location == "" {
+		return nil, errors.New("no directory given")
+	}
+	return http.Dir(location), nil
+}
+
+// fileInfo describes a file or directory of a backend.
+type fileInfo struct {
+	name    string
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+}
+
+func (fi *fileInfo) Name() string       { return fi.name }
+func (fi *fileInfo) Size() int64        { return fi.size }
+func (fi *fileInfo) Mode() os.FileMode  { return fi.mode }
+func (fi *fileInfo) ModTime() time.Time { return fi.modTime }
+func (fi *fileInfo) IsDir() bool        { return fi.mode.IsDir() }
+func (fi *fileInfo) Sys() interface{}   { return nil }
+
+// dirInfo describes a directory that's only implied by the paths of files.
+func dirInfo(name string, modTime time.Time) os.FileInfo {
+	return &fileInfo{name: name, mode: os.ModeDir | 0755, modTime: modTime}
+}
+
+// parentDir returns the directory of a path without a leading slash, where
+// "" is the root.
+func parentDir(name string) string {
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		return name[:i]
+	}
+	return ""
+}
+
+// dirFile is a directory of a backend, with its children already known.
+type dirFile struct {
+	info     os.FileInfo
+	children []os.FileInfo
+	read     int
+}
+
+// newDirFile returns an open directory with the given children, which are
+// copied, as listings may sort them.
+func newDirFile(info os.FileInfo, children []os.FileInfo) *dirFile {
+	return &dirFile{info: info, children: append([]os.FileInfo(nil), children...)}
+}
+
+func (d *dirFile) Read(p []byte) (int, error) {
+	return 0, errors.New("is a directory")
+}
+
+func (d *dirFile) Seek(offset int64, whence int) (int64, error) {
+	return 0, errors.New("is a directory")
+}
+
+func (d *dirFile) Close() error {
+	return nil
+}
+
+func (d *dirFile) Readdir(count int) ([]os.FileInfo, error) {
+	rest := d.children[d.read:]
+	if count <= 0 {
+		d.read = len(d.children)
+		return rest, nil
+	}
+	if len(rest) == 0 {
+		return nil, io.EOF
+	}
+	if count > len(rest) {
+		count = len(rest)
+	}
+	d.read += count
+	return rest[:count], nil
+}
+
+func (d *dirFile) Stat() (os.FileInfo, error) {
+	return d.info, nil
+}
+
+// seekOffset returns the offset a seek moves a file of the given size to.
+func seekOffset(offset int64, whence int, current, size int64) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += current
+	case io.SeekEnd:
+		offset += size
+	}
+	if offset < 0 {
+		return 0, errors.New("negative offset")
+	}
+	return offset, nil
+}
@@ -0,0 +1,184 @@
+package backend
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// closingFS is a file system recording whether it's been closed.
+type closingFS struct {
+	http.Dir
+	closed bool
+}
+
+func (c *closingFS) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestOpenShares(t *testing.T) {
+	var opened []*closingFS
+	Register("test-shares", func(location string) (http.FileSystem, error) {
+		c := &closingFS{Dir: http.Dir(location)}
+		opened = append(opened, c)
+		return c, nil
+	})
+
+	fs1, release1, err := Open("test-shares:/srv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs2, release2, err := Open("test-shares:/srv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fs1 != fs2 || len(opened) != 1 {
+		t.Fatalf("opened %d file systems, want 1 shared", len(opened))
+	}
+
+	release1()
+	release1() // releasing twice drops one reference
+	if opened[0].closed {
+		t.Fatal("closed while still in use")
+	}
+	release2()
+	if !opened[0].closed {
+		t.Fatal("not closed once released")
+	}
+
+	if _, release, err := Open("test-shares:/srv"); err != nil || len(opened) != 2 {
+		t.Errorf("not opened again once closed (err %v)", err)
+	} else {
+		release()
+	}
+}
+
+// readFile reads a file from a file system.
+func readFile(t *testing.T, fs http.FileSystem, name string) string {
+	f, err := fs.Open(name)
+	if err != nil {
+		t.Fatalf("%s: %s", name, err)
+	}
+	defer f.Close()
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatalf("%s: %s", name, err)
+	}
+	return string(data)
+}
+
+func TestGit(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git isn't installed")
+	}
+	dir, err := ioutil.TempDir("", "goserve-git")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	git := func(args ...string) {
+		cmd := exec.Command("git", append([]string{"-C", dir}, args...)...)
+		cmd.Env = append(os.Environ(),
+			"GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com",
+			"GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %s: %s", strings.Join(args, " "), out)
+		}
+	}
+	git("init", "-q", "-b", "main")
+	os.MkdirAll(filepath.Join(dir, "docs"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "docs", "index.html"), []byte("first"), 0644)
+	git("add", ".")
+	git("commit", "-q", "-m", "first")
+	git("tag", "v1")
+	ioutil.WriteFile(filepath.Join(dir, "docs", "index.html"), []byte("second"), 0644)
+	git("commit", "-q", "-a", "-m", "second")
+
+	fs, err := Git(dir + "#v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, fs, "/docs/index.html"); got != "first" {
+		t.Errorf("v1: read %q, want %q", got, "first")
+	}
+	if fs, err = Git(dir); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, fs, "/docs/index.html"); got != "second" {
+		t.Errorf("HEAD: read %q, want %q", got, "second")
+	}
+
+	d, err := fs.Open("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	children, _ := d.Readdir(0)
+	if len(children) != 1 || children[0].Name() != "docs" || !children[0].IsDir() {
+		t.Errorf("root lists %v, want the docs directory", children)
+	}
+	if _, err := fs.Open("/missing"); !os.IsNotExist(err) {
+		t.Errorf("missing file: %v, want not found", err)
+	}
+	if _, err := Git(dir + "#nonexistent"); err == nil {
+		t.Error("opened a ref that doesn't exist")
+	}
+}
+
+func TestHTTP(t *testing.T) {
+	const listing = `<ListBucketResult>
+<Contents><Key>site/index.html</Key><Size>5</Size></Contents>
+<CommonPrefixes><Prefix>site/docs/</Prefix></CommonPrefixes>
+</ListBucketResult>`
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/" && r.URL.Query().Get("list-type") == "2":
+			if r.URL.Query().Get("prefix") == "site/" {
+				w.Write([]byte(listing))
+			} else {
+				w.Write([]byte("<ListBucketResult></ListBucketResult>"))
+			}
+		case r.URL.Path == "/site/index.html":
+			http.ServeContent(w, r, "index.html", time.Time{}, strings.NewReader("hello"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	fs, err := HTTP(srv.URL + "/site")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := fs.Open("/index.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.Seek(1, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadAll(f)
+	if string(data) != "ello" {
+		t.Errorf("read %q after seeking, want %q", data, "ello")
+	}
+
+	d, err := fs.Open("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	children, _ := d.Readdir(0)
+	if len(children) != 2 || children[0].Name() != "docs" || children[1].Name() != "index.html" {
+		t.Errorf("root lists %v, want docs and index.html", children)
+	}
+	if _, err := fs.Open("/missing.html"); !os.IsNotExist(err) {
+		t.Errorf("missing file: %v, want not found", err)
+	}
+}
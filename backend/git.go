@@ -0,0 +1,188 @@
+package backend
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// gitInterval is how often the ref of a git backend is resolved again.
+const gitInterval = time.Second
+
+// Git serves the files of a commit in a git repository, given as its
+// directory and, optionally, the branch, tag or commit to serve, such as
+// "/srv/site.git#main". HEAD is served if no ref is given. The ref is
+// resolved again at most once a second, so pushes to a branch are served as
+// soon as they arrive. Files are read with the git command, which must be
+// installed, and are read whole when opened; their modification time is that
+// of the commit. Symlinks and submodules are left out.
+func Git(location string) (http.FileSystem, error) {
+	dir, ref := location, "HEAD"
+	if i := strings.LastIndex(location, "#"); i >= 0 {
+		dir, ref = location[:i], location[i+1:]
+	}
+	if dir == "" || ref == "" || strings.HasPrefix(ref, "-") {
+		return nil, fmt.Errorf("invalid git location `%s`", location)
+	}
+	g := &gitFileSystem{dir: dir, ref: ref}
+	if _, err := g.tree(); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// gitFileSystem is a file system of the files of a commit.
+type gitFileSystem struct {
+	dir string // of the repository
+	ref string
+
+	mu       sync.Mutex
+	current  *gitTree
+	resolved time.Time // when the ref was last resolved
+}
+
+// gitTree is the index of the files of a commit.
+type gitTree struct {
+	commit  string
+	modTime time.Time
+	files   map[string]gitBlob       // by path, without a leading slash
+	dirs    map[string][]os.FileInfo // children, by directory path ("" is the root)
+}
+
+// gitBlob is a file of a commit.
+type gitBlob struct {
+	hash string
+	info os.FileInfo
+}
+
+// git runs a git command in the repository, returning its output.
+func (g *gitFileSystem) git(args ...string) ([]byte, error) {
+	out, err := exec.Command("git", append([]string{"-C", g.dir}, args...)...).Output()
+	if ee, ok := err.(*exec.ExitError); ok && len(ee.Stderr) > 0 {
+		return nil, fmt.Errorf("git %s: %s", args[0], bytes.TrimSpace(ee.Stderr))
+	}
+	return out, err
+}
+
+// tree returns the index of the commit the ref names, reading it again if
+// the ref has moved. The previous commit continues to be served if the ref
+// can no longer be resolved.
+func (g *gitFileSystem) tree() (*gitTree, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.current != nil && time.Since(g.resolved) < gitInterval {
+		return g.current, nil
+	}
+	g.resolved = time.Now()
+	out, err := g.git("rev-parse", "--verify", "--quiet", g.ref+"^{commit}")
+	if err != nil {
+		if g.current != nil {
+			return g.current, nil
+		}
+		return nil, fmt.Errorf("couldn't resolve %s in %s: %v", g.ref, g.dir, err)
+	}
+	commit := string(bytes.TrimSpace(out))
+	if g.current != nil && g.current.commit == commit {
+		return g.current, nil
+	}
+	t, err := g.readTree(commit)
+	if err != nil {
+		if g.current != nil {
+			return g.current, nil
+		}
+		return nil, err
+	}
+	g.current = t
+	return t, nil
+}
+
+// readTree reads the index of the files of a commit.
+func (g *gitFileSystem) readTree(commit string) (*gitTree, error) {
+	out, err := g.git("show", "-s", "--format=%ct", commit)
+	if err != nil {
+		return nil, err
+	}
+	secs, err := strconv.ParseInt(string(bytes.TrimSpace(out)), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid commit time of %s: %s", commit, out)
+	}
+	modTime := time.Unix(secs, 0)
+	if out, err = g.git("ls-tree", "-r", "-l", "-z", "--full-tree", commit); err != nil {
+		return nil, err
+	}
+
+	t := &gitTree{
+		commit:  commit,
+		modTime: modTime,
+		files:   make(map[string]gitBlob),
+		dirs:    map[string][]os.FileInfo{"": {}},
+	}
+	for _, record := range strings.Split(string(out), "\x00") {
+		// <mode> <type> <hash> <size>\t<path>
+		i := strings.IndexByte(record, '\t')
+		if i < 0 {
+			continue
+		}
+		fields, name := strings.Fields(record[:i]), record[i+1:]
+		if len(fields) != 4 || fields[1] != "blob" {
+			continue
+		}
+		mode := os.FileMode(0644)
+		switch fields[0] {
+		case "100644":
+		case "100755":
+			mode = 0755
+		default:
+			continue // symlinks
+		}
+		size, _ := strconv.ParseInt(fields[3], 10, 64)
+		info := &fileInfo{name: path.Base(name), size: size, mode: mode, modTime: modTime}
+		t.files[name] = gitBlob{hash: fields[2], info: info}
+		dir := parentDir(name)
+		t.addDir(dir)
+		t.dirs[dir] = append(t.dirs[dir], info)
+	}
+	for _, children := range t.dirs {
+		sort.Slice(children, func(i, j int) bool { return children[i].Name() < children[j].Name() })
+	}
+	return t, nil
+}
+
+// addDir adds a directory, and any of its parents not yet known, to the
+// index.
+func (t *gitTree) addDir(dir string) {
+	if _, ok := t.dirs[dir]; ok {
+		return
+	}
+	t.dirs[dir] = []os.FileInfo{}
+	parent := parentDir(dir)
+	t.addDir(parent)
+	t.dirs[parent] = append(t.dirs[parent], dirInfo(path.Base(dir), t.modTime))
+}
+
+func (g *gitFileSystem) Open(name string) (http.File, error) {
+	t, err := g.tree()
+	if err != nil {
+		return nil, err
+	}
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	if b, ok := t.files[name]; ok {
+		data, err := g.git("cat-file", "blob", b.hash)
+		if err != nil {
+			return nil, err
+		}
+		return &memFile{bytes.NewReader(data), b.info}, nil
+	}
+	if children, ok := t.dirs[name]; ok {
+		return newDirFile(dirInfo(path.Base("/"+name), t.modTime), children), nil
+	}
+	return nil, os.ErrNotExist
+}
@@ -0,0 +1,252 @@
+package backend
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// maxListPages limits the pages of a directory listing that are requested,
+// so that a misbehaving server can't keep a listing going forever.
+const maxListPages = 100
+
+func init() {
+	for _, scheme := range []string{"http", "https"} {
+		scheme := scheme
+		backends[scheme] = func(location string) (http.FileSystem, error) {
+			return HTTP(scheme + ":" + location)
+		}
+	}
+}
+
+// HTTP serves files from an HTTP server, such as a public object storage
+// bucket, given the URL the files' paths are relative to, such as
+// "https://bucket.s3.amazonaws.com/site/". Files are requested as they're
+// read, with range requests after seeking, so they should be cached if
+// they're requested often. Directories other than the root are only known
+// if the server lists objects as S3's ListObjectsV2 does, at the root of the
+// URL's host, as S3, Google Cloud Storage, MinIO and others do for
+// virtual-hosted buckets.
+func HTTP(base string) (http.FileSystem, error) {
+	u, err := url.Parse(base)
+	if err != nil {
+		return nil, err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid URL `%s`", base)
+	}
+	u.RawQuery, u.Fragment = "", ""
+	if !strings.HasSuffix(u.Path, "/") {
+		u.Path += "/"
+	}
+	return &httpFileSystem{base: u, client: http.DefaultClient}, nil
+}
+
+// httpFileSystem is a file system of the files of an HTTP server.
+type httpFileSystem struct {
+	base   *url.URL // with a trailing slash
+	client *http.Client
+}
+
+// url returns the URL of the file with the path, without a leading slash.
+func (h *httpFileSystem) url(name string) string {
+	u := *h.base
+	u.Path += name
+	return u.String()
+}
+
+func (h *httpFileSystem) Open(name string) (http.File, error) {
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	if name == "" {
+		// Served even if the server doesn't list objects, for index files
+		children, _ := h.list("")
+		return newDirFile(dirInfo("/", time.Time{}), children), nil
+	}
+
+	u := h.url(name)
+	resp, err := h.client.Head(u)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound, http.StatusForbidden:
+		// Object stores deny requests for missing objects if they can't
+		// be listed
+		if children, err := h.list(name + "/"); err == nil && len(children) > 0 {
+			return newDirFile(dirInfo(path.Base(name), time.Time{}), children), nil
+		}
+		return nil, os.ErrNotExist
+	default:
+		return nil, fmt.Errorf("%s: %s", u, resp.Status)
+	}
+
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	info := &fileInfo{name: path.Base(name), size: resp.ContentLength, mode: 0644, modTime: modTime}
+	if info.size < 0 {
+		// Without a length, the file can't be sought in, so it's read whole
+		data, err := h.get(u, 0)
+		if err == nil {
+			defer data.Close()
+			var b []byte
+			if b, err = ioutil.ReadAll(data); err == nil {
+				info.size = int64(len(b))
+				return &memFile{bytes.NewReader(b), info}, nil
+			}
+		}
+		return nil, err
+	}
+	return &httpFile{fs: h, url: u, info: info}, nil
+}
+
+// get requests a file from the offset.
+func (h *httpFileSystem) get(u string, offset int64) (io.ReadCloser, error) {
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && offset > 0:
+		return resp.Body, nil
+	case resp.StatusCode == http.StatusOK:
+		// The range was ignored
+		if _, err := io.CopyN(ioutil.Discard, resp.Body, offset); err != nil {
+			resp.Body.Close()
+			return nil, err
+		}
+		return resp.Body, nil
+	}
+	resp.Body.Close()
+	return nil, fmt.Errorf("%s: %s", u, resp.Status)
+}
+
+// listBucketResult is a page of an S3 ListObjectsV2 response.
+type listBucketResult struct {
+	Contents []struct {
+		Key          string
+		Size         int64
+		LastModified time.Time
+	}
+	CommonPrefixes []struct {
+		Prefix string
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+// list returns the files and directories in the directory with the prefix,
+// which is "" or ends with a slash, as listed by the server.
+func (h *httpFileSystem) list(prefix string) ([]os.FileInfo, error) {
+	prefix = strings.TrimPrefix(h.base.Path, "/") + prefix
+	var children []os.FileInfo
+	token := ""
+	for page := 0; page < maxListPages; page++ {
+		q := url.Values{"list-type": {"2"}, "prefix": {prefix}, "delimiter": {"/"}}
+		if token != "" {
+			q.Set("continuation-token", token)
+		}
+		u := url.URL{Scheme: h.base.Scheme, Host: h.base.Host, Path: "/", RawQuery: q.Encode()}
+		resp, err := h.client.Get(u.String())
+		if err != nil {
+			return nil, err
+		}
+		var result listBucketResult
+		if resp.StatusCode != http.StatusOK {
+			err = fmt.Errorf("%s: %s", u.String(), resp.Status)
+		} else {
+			err = xml.NewDecoder(resp.Body).Decode(&result)
+		}
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range result.Contents {
+			if name := strings.TrimPrefix(c.Key, prefix); name != "" && !strings.Contains(name, "/") {
+				children = append(children, &fileInfo{name: name, size: c.Size, mode: 0644, modTime: c.LastModified})
+			}
+		}
+		for _, p := range result.CommonPrefixes {
+			if name := strings.TrimSuffix(strings.TrimPrefix(p.Prefix, prefix), "/"); name != "" {
+				children = append(children, dirInfo(name, time.Time{}))
+			}
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			break
+		}
+		token = result.NextContinuationToken
+	}
+	sort.Slice(children, func(i, j int) bool { return children[i].Name() < children[j].Name() })
+	return children, nil
+}
+
+// httpFile is a file of an HTTP server, requested from the current offset
+// when it's read.
+type httpFile struct {
+	fs   *httpFileSystem
+	url  string
+	info *fileInfo
+	rd   io.ReadCloser // nil until read, or after seeking
+	off  int64
+}
+
+func (f *httpFile) Read(p []byte) (int, error) {
+	if f.rd == nil {
+		if f.off >= f.info.size {
+			return 0, io.EOF
+		}
+		rd, err := f.fs.get(f.url, f.off)
+		if err != nil {
+			return 0, err
+		}
+		f.rd = rd
+	}
+	n, err := f.rd.Read(p)
+	f.off += int64(n)
+	return n, err
+}
+
+func (f *httpFile) Seek(offset int64, whence int) (int64, error) {
+	offset, err := seekOffset(offset, whence, f.off, f.info.size)
+	if err != nil {
+		return 0, err
+	}
+	if offset != f.off && f.rd != nil {
+		f.rd.Close()
+		f.rd = nil
+	}
+	f.off = offset
+	return offset, nil
+}
+
+func (f *httpFile) Close() error {
+	if f.rd != nil {
+		return f.rd.Close()
+	}
+	return nil
+}
+
+func (f *httpFile) Readdir(count int) ([]os.FileInfo, error) {
+	return nil, errors.New("not a directory")
+}
+
+func (f *httpFile) Stat() (os.FileInfo, error) {
+	return f.info, nil
+}
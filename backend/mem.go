@@ -0,0 +1,107 @@
+package backend
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Memory serves files from memory, read from a directory once, when the
+// backend is opened, so that requests never wait on the disk. Changes to the
+// directory aren't seen until it's opened again. Symlinks to files are
+// followed; other special files are left out.
+func Memory(location string) (http.FileSystem, error) {
+	location, err := filepath.EvalSymlinks(location)
+	if err != nil {
+		return nil, err
+	}
+	m := memFileSystem{}
+	err = filepath.Walk(location, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(location, p)
+		if err != nil {
+			return err
+		}
+		name := strings.TrimPrefix(path.Clean("/"+filepath.ToSlash(rel)), "/")
+		if fi.Mode()&os.ModeSymlink != 0 {
+			if fi, err = os.Stat(p); err != nil || fi.IsDir() {
+				return nil
+			}
+		}
+		var e memEntry
+		switch {
+		case fi.IsDir():
+			e = memEntry{info: fi}
+		case fi.Mode().IsRegular():
+			data, err := ioutil.ReadFile(p)
+			if err != nil {
+				return err
+			}
+			e = memEntry{info: fi, data: data}
+		default:
+			return nil
+		}
+		m[name] = &e
+		if name != "" {
+			// Walked in lexical order, so children are sorted by name
+			parent := m[parentDir(name)]
+			parent.children = append(parent.children, fi)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if root, ok := m[""]; !ok || !root.info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", location)
+	}
+	return m, nil
+}
+
+// memFileSystem is a file system held in memory, by path without a leading
+// slash ("" is the root).
+type memFileSystem map[string]*memEntry
+
+// memEntry is a file or directory held in memory.
+type memEntry struct {
+	info     os.FileInfo
+	data     []byte
+	children []os.FileInfo // of a directory
+}
+
+func (m memFileSystem) Open(name string) (http.File, error) {
+	e, ok := m[strings.TrimPrefix(path.Clean("/"+name), "/")]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	if e.info.IsDir() {
+		return newDirFile(e.info, e.children), nil
+	}
+	return &memFile{bytes.NewReader(e.data), e.info}, nil
+}
+
+// memFile is a file held in memory.
+type memFile struct {
+	*bytes.Reader
+	info os.FileInfo
+}
+
+func (f *memFile) Close() error {
+	return nil
+}
+
+func (f *memFile) Readdir(count int) ([]os.FileInfo, error) {
+	return nil, errors.New("not a directory")
+}
+
+func (f *memFile) Stat() (os.FileInfo, error) {
+	return f.info, nil
+}
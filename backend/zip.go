@@ -0,0 +1,191 @@
+package backend
+
+import (
+	"archive/zip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Zip serves files from within a zip archive, which is read again whenever
+// it's replaced, so a site can be deployed by replacing a single file.
+// Entries that are stored uncompressed are read directly from the archive;
+// seeking within compressed entries, for range requests, reads them from the
+// start.
+func Zip(location string) (http.FileSystem, error) {
+	z := &zipFileSystem{name: location}
+	if _, err := z.archive(); err != nil {
+		return nil, err
+	}
+	return z, nil
+}
+
+// zipFileSystem is a file system of the entries of a zip archive.
+type zipFileSystem struct {
+	name string
+
+	mu      sync.Mutex
+	current *zipArchive
+}
+
+// zipArchive is the index of an open zip archive.
+type zipArchive struct {
+	modTime time.Time
+	size    int64
+	files   map[string]*zip.File     // by path, without a leading slash
+	dirs    map[string][]os.FileInfo // children, by directory path ("" is the root)
+}
+
+// archive returns the index of the archive, reopening it if it's changed
+// since it was last read. Files opened from the previous archive remain
+// readable until closed.
+func (z *zipFileSystem) archive() (*zipArchive, error) {
+	fi, err := os.Stat(z.name)
+	if err != nil {
+		return nil, err
+	}
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	if a := z.current; a != nil && a.modTime.Equal(fi.ModTime()) && a.size == fi.Size() {
+		return a, nil
+	}
+	zr, err := zip.OpenReader(z.name)
+	if err != nil {
+		return nil, err
+	}
+	// The reader is left for the garbage collector to close, once no files
+	// opened from it remain
+	a := &zipArchive{
+		modTime: fi.ModTime(),
+		size:    fi.Size(),
+		files:   make(map[string]*zip.File),
+		dirs:    map[string][]os.FileInfo{"": {}},
+	}
+	for _, zf := range zr.File {
+		name := strings.TrimPrefix(path.Clean("/"+zf.Name), "/")
+		switch {
+		case name == "":
+		case strings.HasSuffix(zf.Name, "/"):
+			a.addDir(name)
+		case a.files[name] == nil:
+			a.files[name] = zf
+			dir := parentDir(name)
+			a.addDir(dir)
+			a.dirs[dir] = append(a.dirs[dir], zf.FileInfo())
+		}
+	}
+	for _, children := range a.dirs {
+		sort.Slice(children, func(i, j int) bool { return children[i].Name() < children[j].Name() })
+	}
+	z.current = a
+	return a, nil
+}
+
+// addDir adds a directory, and any of its parents not yet known, to the
+// index.
+func (a *zipArchive) addDir(dir string) {
+	if _, ok := a.dirs[dir]; ok {
+		return
+	}
+	a.dirs[dir] = []os.FileInfo{}
+	parent := parentDir(dir)
+	a.addDir(parent)
+	a.dirs[parent] = append(a.dirs[parent], dirInfo(path.Base(dir), time.Time{}))
+}
+
+func (z *zipFileSystem) Open(name string) (http.File, error) {
+	a, err := z.archive()
+	if err != nil {
+		return nil, err
+	}
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	if zf, ok := a.files[name]; ok {
+		return &zipEntryFile{zf: zf}, nil
+	}
+	if children, ok := a.dirs[name]; ok {
+		return newDirFile(dirInfo(path.Base("/"+name), time.Time{}), children), nil
+	}
+	return nil, os.ErrNotExist
+}
+
+// zipEntryFile is a file within a zip archive.
+type zipEntryFile struct {
+	zf  *zip.File
+	rd  io.ReadCloser // nil until read, or after seeking
+	off int64
+}
+
+func (f *zipEntryFile) Read(p []byte) (int, error) {
+	if f.rd == nil {
+		if f.off >= int64(f.zf.UncompressedSize64) {
+			return 0, io.EOF
+		}
+		if err := f.open(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.rd.Read(p)
+	f.off += int64(n)
+	return n, err
+}
+
+// open opens the entry for reading at the current offset.
+func (f *zipEntryFile) open() error {
+	size := int64(f.zf.UncompressedSize64)
+	if f.zf.Method == zip.Store {
+		// The raw data is the content, and can be read from any offset
+		raw, err := f.zf.OpenRaw()
+		if err != nil {
+			return err
+		}
+		if ra, ok := raw.(io.ReaderAt); ok {
+			f.rd = ioutil.NopCloser(io.NewSectionReader(ra, f.off, size-f.off))
+			return nil
+		}
+	}
+	rd, err := f.zf.Open()
+	if err != nil {
+		return err
+	}
+	if _, err := io.CopyN(ioutil.Discard, rd, f.off); err != nil {
+		rd.Close()
+		return err
+	}
+	f.rd = rd
+	return nil
+}
+
+func (f *zipEntryFile) Seek(offset int64, whence int) (int64, error) {
+	offset, err := seekOffset(offset, whence, f.off, int64(f.zf.UncompressedSize64))
+	if err != nil {
+		return 0, err
+	}
+	if offset != f.off && f.rd != nil {
+		f.rd.Close()
+		f.rd = nil
+	}
+	f.off = offset
+	return offset, nil
+}
+
+func (f *zipEntryFile) Close() error {
+	if f.rd != nil {
+		return f.rd.Close()
+	}
+	return nil
+}
+
+func (f *zipEntryFile) Readdir(count int) ([]os.FileInfo, error) {
+	return nil, errors.New("not a directory")
+}
+
+func (f *zipEntryFile) Stat() (os.FileInfo, error) {
+	return f.zf.FileInfo(), nil
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// maxBatchRequest limits the size of the list of files POSTed for a batch
+// download.
+const maxBatchRequest = 1 << 20
+
+// maxBatchDepth limits how deep selected directories are walked when the
+// serve doesn't, guarding against symlink cycles.
+const maxBatchDepth = 32
+
+// BatchOptions limit batch downloads.
+type BatchOptions struct {
+	Exclude  []string // glob patterns of files to leave out
+	MaxFiles int      // most files in a download
+	MaxSize  int64    // most bytes of files in a download
+	MaxDepth int      // levels of directories walked (0=unlimited)
+}
+
+// batchFile is a file selected for a batch download.
+type batchFile struct {
+	name string // path in the file system
+	rel  string // path in the archive
+	fi   os.FileInfo
+}
+
+// batchPath returns true if selections can be downloaded from the path,
+// which must be that of a directory.
+func batchPath(p string) bool {
+	return strings.HasSuffix(p, "/") || path.Clean("/"+p) == "/"
+}
+
+// BatchHandler responds to requests for directories that select files in
+// them, with `file` query parameters or a POSTed list, with a zip or tar
+// archive (as `format` asks) of the files, streamed as they're read.
+// Selected directories are included with their contents. Each file is
+// checked by passing a HEAD request for it to the handler, with the
+// original request's credentials, so files that couldn't be downloaded
+// individually are left out. Requests must have had the serve's prefix
+// stripped from their path.
+func BatchHandler(h http.Handler, fs http.FileSystem, opts BatchOptions) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		dir := path.Clean("/" + r.URL.Path)
+		isDir := batchPath(r.URL.Path)
+		if !isDir && r.Method == http.MethodPost {
+			// Selections are only POSTed to directories
+			w.Header().Set("Allow", "GET, HEAD, OPTIONS")
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed),
+				http.StatusMethodNotAllowed)
+			return
+		}
+		if !isDir || (r.Method != http.MethodPost && !(r.Method == http.MethodGet && r.URL.Query().Has("file"))) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		selected, err := batchSelection(w, r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		format := r.URL.Query().Get("format")
+		if format == "" {
+			format = r.PostFormValue("format")
+		}
+		if format == "" {
+			format = "zip"
+		}
+		if format != "zip" && format != "tar" {
+			http.Error(w, "Unsupported archive format", http.StatusBadRequest)
+			return
+		}
+
+		b := &batch{h: h, r: r, fs: requestFileSystem(fs, r), opts: opts, seen: make(map[string]bool)}
+		for _, p := range selected {
+			rel := strings.TrimPrefix(path.Clean("/"+p), "/")
+			if rel == "" {
+				continue
+			}
+			if err := b.add(path.Join(dir, rel), rel); err != nil {
+				http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+				return
+			}
+		}
+		if len(b.files) == 0 {
+			http.NotFound(w, r)
+			return
+		}
+
+		base := path.Base(dir)
+		if base == "/" {
+			base = "download"
+		}
+		hdr := w.Header()
+		hdr.Set("Content-Disposition", mime.FormatMediaType("attachment",
+			map[string]string{"filename": base + "." + format}))
+		if format == "zip" {
+			hdr.Set("Content-Type", "application/zip")
+		} else {
+			hdr.Set("Content-Type", "application/x-tar")
+		}
+		hdr.Set("Cache-Control", "no-store")
+		if err := b.write(w, format); err != nil && r.Context().Err() == nil {
+			// The response is under way, so it can only be cut short
+			log.Printf("Batch download of %s failed: %s", dir, err)
+		}
+	})
+}
+
+// batchSelection returns the paths of the files selected, relative to the
+// requested directory. POSTed lists may be form-encoded `file` fields, a JSON
+// array, or one path per line.
+func batchSelection(w http.ResponseWriter, r *http.Request) ([]string, error) {
+	if r.Method != http.MethodPost {
+		return r.URL.Query()["file"], nil
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxBatchRequest)
+	ctype, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch ctype {
+	case "application/x-www-form-urlencoded", "multipart/form-data":
+		if err := r.ParseMultipartForm(maxBatchRequest); err != nil && err != http.ErrNotMultipart {
+			return nil, err
+		}
+		return r.PostForm["file"], nil
+	case "application/json":
+		var paths []string
+		if err := json.NewDecoder(r.Body).Decode(&paths); err != nil {
+			return nil, fmt.Errorf("Expected a JSON array of paths: %s", err)
+		}
+		return paths, nil
+	}
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			paths = append(paths, line)
+		}
+	}
+	return paths, nil
+}
+
+// batch collects the files of a batch download.
+type batch struct {
+	h     http.Handler
+	r     *http.Request
+	fs    http.FileSystem
+	opts  BatchOptions
+	files []batchFile
+	size  int64
+	seen  map[string]bool
+}
+
+// add adds the file or directory at the path, which is rel in the archive.
+// Files that can't be read, are excluded or are denied to the client are
+// skipped; an error is only returned if the download would be too large.
+func (b *batch) add(name, rel string) error {
+	if b.seen[name] || matchAny(b.opts.Exclude, rel) {
+		return nil
+	}
+	b.seen[name] = true
+	f, err := b.fs.Open(name)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil
+	}
+
+	if fi.IsDir() {
+		if b.opts.MaxDepth > 0 && pathDepth(name) > b.opts.MaxDepth || pathDepth(rel) > maxBatchDepth {
+			return nil
+		}
+		fis, err := f.Readdir(-1)
+		if err != nil {
+			return nil
+		}
+		sort.Slice(fis, func(i, j int) bool { return fis[i].Name() < fis[j].Name() })
+		for _, sub := range fis {
+			if err := b.add(path.Join(name, sub.Name()), path.Join(rel, sub.Name())); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if !fi.Mode().IsRegular() || headRequest(b.h, b.r, name).status != http.StatusOK {
+		return nil
+	}
+	b.files = append(b.files, batchFile{name, rel, fi})
+	b.size += fi.Size()
+	if b.opts.MaxFiles > 0 && len(b.files) > b.opts.MaxFiles {
+		return fmt.Errorf("Too many files (the limit is %d)", b.opts.MaxFiles)
+	}
+	if b.opts.MaxSize > 0 && b.size > b.opts.MaxSize {
+		return fmt.Errorf("Too large (the limit is %d bytes)", b.opts.MaxSize)
+	}
+	return nil
+}
+
+// write writes the files as an archive of the format.
+func (b *batch) write(w io.Writer, format string) error {
+	var zw *zip.Writer
+	var tw *tar.Writer
+	if format == "zip" {
+		zw = zip.NewWriter(w)
+	} else {
+		tw = tar.NewWriter(w)
+	}
+	for _, bf := range b.files {
+		f, err := b.fs.Open(bf.name)
+		if err != nil {
+			return err
+		}
+		var dst io.Writer
+		if zw != nil {
+			zh, _ := zip.FileInfoHeader(bf.fi)
+			// Files are often already compressed, so are stored as they are
+			zh.Name, zh.Method = bf.rel, zip.Store
+			dst, err = zw.CreateHeader(zh)
+		} else {
+			th, _ := tar.FileInfoHeader(bf.fi, "")
+			th.Name = bf.rel
+			if err = tw.WriteHeader(th); err == nil {
+				dst = tw
+			}
+		}
+		if err == nil {
+			// Copy exactly the size in the header, in case the file changed
+			_, err = io.CopyN(dst, contextReader{b.r.Context(), f}, bf.fi.Size())
+		}
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	if zw != nil {
+		return zw.Close()
+	}
+	return tw.Close()
+}
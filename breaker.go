@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// BreakerOptions describes when a circuit to an upstream opens.
+type BreakerOptions struct {
+	ErrorRate   float64       // percentage of failed requests that opens the circuit
+	Window      time.Duration // period the error rate is measured over
+	MinRequests int           // requests needed in a window before opening
+	OpenFor     time.Duration // time before a request is let through to probe the upstream
+}
+
+// Circuit states.
+const (
+	circuitClosed   = iota // requests are forwarded
+	circuitOpen            // requests fail immediately
+	circuitHalfOpen        // a single probe request is forwarded
+)
+
+// CircuitBreaker tracks the failures of requests to an upstream, and stops
+// forwarding requests to it for a while once too many fail, so that clients
+// of a dead upstream fail fast rather than each waiting for a timeout. Once
+// the circuit has been open for long enough, a single request is let
+// through; its success closes the circuit again, and its failure keeps it
+// open.
+type CircuitBreaker struct {
+	name string
+	opts BreakerOptions
+
+	mu       sync.Mutex
+	state    int
+	opened   time.Time // when the circuit last opened
+	start    time.Time // start of the current window
+	total    int       // requests in the current window
+	failures int       // failed requests in the current window
+}
+
+// NewCircuitBreaker creates a closed CircuitBreaker for the named upstream.
+func NewCircuitBreaker(name string, opts BreakerOptions) *CircuitBreaker {
+	return &CircuitBreaker{name: name, opts: opts, start: time.Now()}
+}
+
+// allow returns true if a request may be forwarded to the upstream. Every
+// allowed request must be followed by a call to record.
+func (b *CircuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case circuitOpen:
+		if time.Since(b.opened) < b.opts.OpenFor {
+			return false
+		}
+		b.state = circuitHalfOpen
+		return true
+	case circuitHalfOpen:
+		return false // already probing
+	}
+	return true
+}
+
+// record counts the outcome of a request forwarded to the upstream.
+func (b *CircuitBreaker) record(failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	if b.state == circuitHalfOpen {
+		if failed {
+			b.state = circuitOpen
+			b.opened = now
+			return
+		}
+		log.Printf("Circuit to %s closed", b.name)
+		b.state = circuitClosed
+		b.start, b.total, b.failures = now, 0, 0
+		return
+	}
+	if b.state == circuitOpen {
+		return // a request allowed before the circuit opened
+	}
+	if now.Sub(b.start) >= b.opts.Window {
+		b.start, b.total, b.failures = now, 0, 0
+	}
+	b.total++
+	if failed {
+		b.failures++
+	}
+	if b.total < b.opts.MinRequests || b.failures == 0 {
+		return
+	}
+	rate := float64(b.failures) * 100 / float64(b.total)
+	if rate < b.opts.ErrorRate {
+		return
+	}
+	b.state = circuitOpen
+	b.opened = now
+	msg := fmt.Sprintf("%d of %d requests failed", b.failures, b.total)
+	log.Printf("Circuit to %s opened: %s", b.name, msg)
+	alert(AlertCircuitOpen, fmt.Sprintf("circuit to %s opened: %s", b.name, msg))
+}
+
+// cancel forgets a request forwarded to the upstream that was abandoned by
+// the client before its outcome was known. If it was probing the upstream,
+// the next request probes it instead.
+func (b *CircuitBreaker) cancel() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == circuitHalfOpen {
+		b.state = circuitOpen
+	}
+}
+
+// breakerTransport records the outcome of each round trip in a circuit
+// breaker. Connection errors, timeouts and "502 Bad Gateway", "503 Service
+// Unavailable" and "504 Gateway Timeout" responses are failures.
+type breakerTransport struct {
+	http.RoundTripper
+	breaker *CircuitBreaker
+}
+
+func (t breakerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.RoundTripper.RoundTrip(req)
+	switch {
+	case err != nil && req.Context().Err() == context.Canceled:
+		t.breaker.cancel()
+	case err != nil:
+		t.breaker.record(true)
+	default:
+		t.breaker.record(resp.StatusCode >= 502 && resp.StatusCode <= 504)
+	}
+	return resp, err
+}
+
+// retryAfter returns the time until a request will next be let through.
+func (b *CircuitBreaker) retryAfter() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if d := b.opts.OpenFor - time.Since(b.opened); d > 0 {
+		return d
+	}
+	return 0
+}
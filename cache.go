@@ -0,0 +1,414 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"container/list"
+	"context"
+	"errors"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// FileCache is an http.FileSystem that keeps the contents of recently used
+// files in memory. Cached files are revalidated against the underlying file's
+// size and modification time on every open, so changes are picked up
+// immediately. The least recently used files are evicted once the cache
+// exceeds its maximum size.
+type FileCache struct {
+	fs          http.FileSystem
+	maxSize     int64 // total bytes of file data held
+	maxFile     int64 // largest file that will be cached
+	precompress bool  // also hold a gzipped copy of each file
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List // of *cacheEntry, most recently used first
+	size    int64
+	fills   map[string]*cacheFill // files being read into the cache
+
+	hits      int64
+	misses    int64
+	coalesced int64 // misses that waited for another request's fill
+}
+
+type cacheEntry struct {
+	name string
+	info os.FileInfo
+	data []byte
+	gz   []byte // gzipped data, if precompressing
+}
+
+func (e *cacheEntry) cost() int64 {
+	return int64(len(e.data) + len(e.gz))
+}
+
+// cacheFill is a file being read into the cache, which other requests for
+// the same version of the file wait for rather than reading it themselves.
+type cacheFill struct {
+	info os.FileInfo
+	done chan struct{} // closed once e or err is set
+	e    *cacheEntry
+	err  error
+}
+
+// NewFileCache creates a cache of files from the given file system.
+func NewFileCache(fs http.FileSystem, maxSize, maxFile int64, precompress bool) *FileCache {
+	return &FileCache{
+		fs:          fs,
+		maxSize:     maxSize,
+		maxFile:     maxFile,
+		precompress: precompress,
+		entries:     make(map[string]*list.Element),
+		lru:         list.New(),
+		fills:       make(map[string]*cacheFill),
+	}
+}
+
+// Open opens the named file, from the cache if it's present and up to date.
+func (c *FileCache) Open(name string) (http.File, error) {
+	f, _, err := c.open(context.Background(), name)
+	return f, err
+}
+
+// open opens the named file, also returning whether it came from the cache.
+// Filling the cache is abandoned if the context is cancelled.
+func (c *FileCache) open(ctx context.Context, name string) (http.File, string, error) {
+	f, err := c.fs.Open(name)
+	if err != nil {
+		return nil, "", err
+	}
+	fi, err := f.Stat()
+	if err != nil || fi.IsDir() || fi.Size() > c.maxFile {
+		return f, CacheBypass, err
+	}
+
+	if e := c.get(name, fi); e != nil {
+		f.Close()
+		atomic.AddInt64(&c.hits, 1)
+		return newMemFile(e), CacheHit, nil
+	}
+
+	// Wait for a request already reading the file, so that a popular file
+	// missing from the cache is only read once
+	c.mu.Lock()
+	fill, filling := c.fills[name]
+	if filling && sameFile(fill.info, fi) {
+		c.mu.Unlock()
+		atomic.AddInt64(&c.coalesced, 1)
+		select {
+		case <-fill.done:
+		case <-ctx.Done():
+			f.Close()
+			return nil, "", ctx.Err()
+		}
+		if fill.err == nil {
+			f.Close()
+			return newMemFile(fill.e), CacheMiss, nil
+		}
+		// The other request's fill failed, perhaps as its client went away,
+		// so read the file for this one
+		atomic.AddInt64(&c.misses, 1)
+		e, err := c.fill(ctx, name, f, fi)
+		f.Close()
+		if err != nil {
+			return nil, "", err
+		}
+		return newMemFile(e), CacheMiss, nil
+	}
+	fill = &cacheFill{info: fi, done: make(chan struct{})}
+	if !filling {
+		c.fills[name] = fill
+	}
+	c.mu.Unlock()
+	atomic.AddInt64(&c.misses, 1)
+
+	fill.e, fill.err = c.fill(ctx, name, f, fi)
+	f.Close()
+	c.mu.Lock()
+	if c.fills[name] == fill {
+		delete(c.fills, name)
+	}
+	c.mu.Unlock()
+	close(fill.done)
+	if fill.err != nil {
+		return nil, "", fill.err
+	}
+	return newMemFile(fill.e), CacheMiss, nil
+}
+
+// sameFile returns true if two stats are of the same version of a file, as
+// far as the cache is concerned.
+func sameFile(a, b os.FileInfo) bool {
+	return a.Size() == b.Size() && a.ModTime().Equal(b.ModTime())
+}
+
+// requestFileCache opens files from a cache on behalf of a request, so that
+// filling the cache stops if the request is cancelled.
+type requestFileCache struct {
+	c   *FileCache
+	ctx context.Context
+}
+
+func (fs requestFileCache) Open(name string) (http.File, error) {
+	f, _, err := fs.c.open(fs.ctx, name)
+	return f, err
+}
+
+func (fs requestFileCache) open(name string) (http.File, string, error) {
+	return fs.c.open(fs.ctx, name)
+}
+
+// get returns the cached entry for the file, if it's still valid.
+func (c *FileCache) get(name string, fi os.FileInfo) *cacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[name]
+	if !ok {
+		return nil
+	}
+	e := el.Value.(*cacheEntry)
+	if !sameFile(e.info, fi) {
+		c.remove(el)
+		return nil
+	}
+	c.lru.MoveToFront(el)
+	return e
+}
+
+// fill reads the open file into a new cache entry, unless the context is
+// cancelled first.
+func (c *FileCache) fill(ctx context.Context, name string, f http.File, fi os.FileInfo) (*cacheEntry, error) {
+	data, err := ioutil.ReadAll(contextReader{ctx, f})
+	if err != nil {
+		return nil, err
+	}
+	e := &cacheEntry{name: name, info: fi, data: data}
+	if c.precompress {
+		e.gz = c.sidecar(name, fi)
+	}
+	if c.precompress && e.gz == nil {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		var buf bytes.Buffer
+		gz, _ := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+		gz.Write(data)
+		gz.Close()
+		e.gz = buf.Bytes()
+	}
+	c.put(e)
+	return e, nil
+}
+
+// sidecar returns the contents of the gzipped copy of the file written
+// alongside it by `goserve compress`, if there is one with the same
+// modification time.
+func (c *FileCache) sidecar(name string, fi os.FileInfo) []byte {
+	f, err := c.fs.Open(name + ".gz")
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	gzi, err := f.Stat()
+	if err != nil || gzi.IsDir() || !gzi.ModTime().Equal(fi.ModTime()) {
+		return nil
+	}
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil
+	}
+	return data
+}
+
+// put adds an entry to the cache, evicting others as necessary.
+func (c *FileCache) put(e *cacheEntry) {
+	if e.cost() > c.maxSize {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[e.name]; ok {
+		c.remove(el)
+	}
+	for c.size+e.cost() > c.maxSize && c.lru.Len() > 0 {
+		c.remove(c.lru.Back())
+	}
+	c.entries[e.name] = c.lru.PushFront(e)
+	c.size += e.cost()
+}
+
+// remove evicts an element. The caller must hold the lock.
+func (c *FileCache) remove(el *list.Element) {
+	e := c.lru.Remove(el).(*cacheEntry)
+	delete(c.entries, e.name)
+	c.size -= e.cost()
+}
+
+// Flush empties the cache.
+func (c *FileCache) Flush() {
+	c.mu.Lock()
+	c.entries = make(map[string]*list.Element)
+	c.lru.Init()
+	c.size = 0
+	c.mu.Unlock()
+}
+
+// Preload reads all files under root (the directory the cache's file system
+// serves) matching the glob patterns into the cache.
+func (c *FileCache) Preload(root string, patterns []string) {
+	for _, pattern := range patterns {
+		matches, err := filepath.Glob(filepath.Join(root, filepath.FromSlash(pattern)))
+		if err != nil {
+			log.Printf("Invalid preload pattern `%s`: %s", pattern, err)
+			continue
+		}
+		for _, m := range matches {
+			rel, err := filepath.Rel(root, m)
+			if err != nil {
+				continue
+			}
+			f, err := c.Open("/" + filepath.ToSlash(rel))
+			if err != nil {
+				log.Printf("Couldn't preload %s: %s", m, err)
+				continue
+			}
+			f.Close()
+		}
+	}
+	if settings().Verbose {
+		c.mu.Lock()
+		log.Printf("Preloaded %d files (%d bytes) from %s", c.lru.Len(), c.size, root)
+		c.mu.Unlock()
+	}
+}
+
+// Gzipped returns the precompressed content of the named file, if it's cached
+// and up to date.
+func (c *FileCache) Gzipped(name string) ([]byte, os.FileInfo, bool) {
+	if !c.precompress {
+		return nil, nil, false
+	}
+	f, err := c.Open(name)
+	if err != nil {
+		return nil, nil, false
+	}
+	defer f.Close()
+	mf, ok := f.(*memFile)
+	if !ok || mf.e.gz == nil {
+		return nil, nil, false
+	}
+	return mf.e.gz, mf.e.info, true
+}
+
+// memFile is an http.File reading from a cache entry.
+type memFile struct {
+	*bytes.Reader
+	e *cacheEntry
+}
+
+func newMemFile(e *cacheEntry) *memFile {
+	return &memFile{bytes.NewReader(e.data), e}
+}
+
+func (f *memFile) Close() error {
+	return nil
+}
+
+func (f *memFile) Readdir(count int) ([]os.FileInfo, error) {
+	return nil, errors.New("not a directory")
+}
+
+func (f *memFile) Stat() (os.FileInfo, error) {
+	return f.e.info, nil
+}
+
+var (
+	fileCachesMu sync.Mutex
+	fileCaches   = map[string]*FileCache{}
+)
+
+// sharedFileCache returns the cache with the given key (identifying the serve
+// and directory), creating it with the given function if it doesn't exist. Caches are shared so that
+// handlers created per request or per release reuse the same cache.
+func sharedFileCache(key string, create func() *FileCache) *FileCache {
+	fileCachesMu.Lock()
+	defer fileCachesMu.Unlock()
+	c, ok := fileCaches[key]
+	if !ok {
+		c = create()
+		fileCaches[key] = c
+	}
+	return c
+}
+
+// fileCacheStats returns the total hits and misses of all current caches,
+// and the misses coalesced with another request's.
+func fileCacheStats() (hits, misses, coalesced int64) {
+	fileCachesMu.Lock()
+	defer fileCachesMu.Unlock()
+	for _, c := range fileCaches {
+		hits += atomic.LoadInt64(&c.hits)
+		misses += atomic.LoadInt64(&c.misses)
+		coalesced += atomic.LoadInt64(&c.coalesced)
+	}
+	return
+}
+
+// dropFileCaches flushes and forgets the caches whose keys the function
+// selects.
+func dropFileCaches(drop func(key string) bool) {
+	fileCachesMu.Lock()
+	defer fileCachesMu.Unlock()
+	for key, c := range fileCaches {
+		if drop(key) {
+			c.Flush()
+			delete(fileCaches, key)
+		}
+	}
+}
+
+// PrecompressedHandler serves gzipped content directly from the cache to
+// clients that accept it, falling back to the given handler otherwise.
+// Requests must have had the serve's prefix stripped from their path.
+func PrecompressedHandler(h http.Handler, cache func() *FileCache) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") ||
+			r.Header.Get("Range") != "" ||
+			(r.Method != http.MethodGet && r.Method != http.MethodHead) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		name := path.Clean("/" + r.URL.Path)
+		start := time.Now()
+		gz, fi, ok := cache().Gzipped(name)
+		if !ok {
+			h.ServeHTTP(w, r)
+			return
+		}
+		traceFrom(r).opened(time.Since(start), CacheHit)
+		// The type can't be sniffed from compressed content
+		ctype := mime.TypeByExtension(path.Ext(name))
+		if ctype == "" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		hdr := w.Header()
+		hdr.Set("Content-Type", ctype)
+		hdr.Set("Content-Encoding", "gzip")
+		weakenETag(hdr)
+		hdr.Set("Content-Length", strconv.Itoa(len(gz)))
+		hdr.Add("Vary", "Accept-Encoding")
+		http.ServeContent(w, r, name, fi.ModTime(), bytes.NewReader(gz))
+	})
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"hash/fnv"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// CanaryOptions describes which requests are routed to a canary.
+type CanaryOptions struct {
+	Percent int    // share of clients routed to the canary, by client IP
+	Cookie  string // cookie choosing the canary ("1") or not ("0"), if set
+	Header  string // header choosing the canary ("1") or not ("0"), if set
+}
+
+// canaryChoice parses a cookie or header value choosing whether to use the
+// canary, returning false for ok if it doesn't make a choice.
+func canaryChoice(v string) (canary, ok bool) {
+	switch strings.ToLower(strings.TrimSpace(v)) {
+	case "1", "true", "yes", "on":
+		return true, true
+	case "0", "false", "no", "off":
+		return false, true
+	}
+	return false, false
+}
+
+// useCanary returns true if the request should be routed to the canary. The
+// header is consulted first, then the cookie; otherwise the client's IP
+// decides, so that each client consistently sees the same build.
+func (o CanaryOptions) useCanary(r *http.Request) bool {
+	if o.Header != "" {
+		if canary, ok := canaryChoice(r.Header.Get(o.Header)); ok {
+			return canary
+		}
+	}
+	if o.Cookie != "" {
+		if c, err := r.Cookie(o.Cookie); err == nil {
+			if canary, ok := canaryChoice(c.Value); ok {
+				return canary
+			}
+		}
+	}
+	if o.Percent <= 0 {
+		return false
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	h := fnv.New32a()
+	h.Write([]byte(host))
+	return int(h.Sum32()%100) < o.Percent
+}
+
+// CanaryHandler routes a share of requests to the canary handler, and the
+// rest to the stable handler.
+func CanaryHandler(stable, canary http.Handler, opts CanaryOptions) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if opts.useCanary(r) {
+			canary.ServeHTTP(w, r)
+		} else {
+			stable.ServeHTTP(w, r)
+		}
+	})
+}
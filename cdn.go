@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Headers CDN rules send surrogate keys in, by default.
+const defaultKeyHeader = "Surrogate-Key"
+
+// directives returns the caching directives of the rule, as they're written
+// in the header it's sent in: s-maxage in Cache-Control, where it's meant
+// for shared caches alone, and max-age in headers only CDNs read.
+func (c CDNRule) directives() []string {
+	var ds []string
+	add := func(name, value string) {
+		if d, _ := parseDuration(value); value != "" {
+			ds = append(ds, name+"="+strconv.Itoa(int(d/time.Second)))
+		}
+	}
+	if http.CanonicalHeaderKey(c.Header) == "Cache-Control" {
+		add("s-maxage", c.SMaxAge)
+	} else {
+		add("max-age", c.SMaxAge)
+	}
+	add("stale-while-revalidate", c.StaleWhileRevalidate)
+	add("stale-if-error", c.StaleIfError)
+	return ds
+}
+
+// keys returns the surrogate keys of a response for the path: the rule's own,
+// and with path_keys, the path and each directory above it, so that a file or
+// everything under a directory can be purged at once.
+func (c CDNRule) keys(p string) []string {
+	keys := append([]string(nil), c.Keys...)
+	if c.PathKeys {
+		// Separators of the key headers are escaped, as in URLs
+		p = strings.NewReplacer(" ", "%20", ",", "%2C").Replace(p)
+		keys = append(keys, p)
+		for dir := p; dir != "/"; {
+			dir = path.Dir(strings.TrimSuffix(dir, "/"))
+			if dir != "/" {
+				keys = append(keys, dir+"/")
+			} else {
+				keys = append(keys, dir)
+			}
+		}
+	}
+	return keys
+}
+
+// CDNHandler adds the caching directives and surrogate keys of the first rule
+// matching the request's path to its response, for CDNs and other shared
+// caches in front of the server. Directives are added to Cache-Control, or
+// sent in a header only CDNs read, such as CDN-Cache-Control or
+// Surrogate-Control, leaving browsers' caching alone. They're only added to
+// responses that aren't errors, and not to those marked private or no-store.
+// Keys let a CDN's cached responses be purged by key, rather than by URL.
+func CDNHandler(h http.Handler, rules []CDNRule) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var rule *CDNRule
+		for i := range rules {
+			if len(rules[i].Paths) == 0 || matchAny(rules[i].Paths, r.URL.Path) {
+				rule = &rules[i]
+				break
+			}
+		}
+		if rule == nil {
+			h.ServeHTTP(w, r)
+			return
+		}
+		h.ServeHTTP(&headerHookResponseWriter{
+			ResponseWriter: w,
+			hook: func(status int) {
+				hdr := w.Header()
+				if keys := rule.keys(r.URL.Path); len(keys) > 0 {
+					sep := ", "
+					if http.CanonicalHeaderKey(rule.KeyHeader) == defaultKeyHeader {
+						sep = " "
+					}
+					hdr.Set(rule.KeyHeader, strings.Join(keys, sep))
+				}
+				cc := strings.ToLower(hdr.Get("Cache-Control"))
+				if status >= 400 || strings.Contains(cc, "private") || strings.Contains(cc, "no-store") {
+					return
+				}
+				ds := rule.directives()
+				if len(ds) == 0 {
+					return
+				}
+				if http.CanonicalHeaderKey(rule.Header) == "Cache-Control" && cc != "" {
+					ds = append([]string{hdr.Get("Cache-Control")}, ds...)
+				}
+				hdr.Set(rule.Header, strings.Join(ds, ", "))
+			},
+		}, r)
+	})
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"text/tabwriter"
+)
+
+// command is a subcommand of the goserve binary.
+type command struct {
+	name    string
+	summary string
+	run     func(args []string) int // returns the exit status
+}
+
+// commands are the subcommands, in the order they're listed in the usage.
+var commands []command
+
+func init() {
+	commands = []command{
+		{"serve", "Serve files (the default)", runServe},
+		{"check", "Check a configuration", runCheck},
+		{"routes", "List the paths a configuration serves", runRoutes},
+		{"test", "Check the responses to a configuration's test requests", runTest},
+		{"config", "Import nginx and Caddy configurations", runConfig},
+		{"version", "Print the version", runVersion},
+		{"probe", "Check that a server is healthy, for container health checks", runProbe},
+		{"report", "Summarise recent traffic from the admin listener", runReport},
+		{"logs", "Print and follow the logs from the admin listener", runLogs},
+		{"compress", "Write gzipped copies of files for caches to use", runCompress},
+		{"upgrade", "Replace the binary with the latest release", runUpgrade},
+		{"help", "Describe the commands", runHelp},
+	}
+}
+
+// findCommand returns the subcommand with the name, or nil if there is none.
+func findCommand(name string) *command {
+	for i := range commands {
+		if commands[i].name == name {
+			return &commands[i]
+		}
+	}
+	return nil
+}
+
+// runHelp implements the `help` subcommand, which lists the subcommands, or
+// describes the flags of one of them.
+func runHelp(args []string) int {
+	if len(args) > 0 {
+		if c := findCommand(args[0]); c != nil && c.name != "help" {
+			return c.run([]string{"-help"})
+		}
+		fmt.Fprintf(os.Stderr, "Unknown command %s\n", args[0])
+		return 2
+	}
+	fmt.Fprintln(os.Stderr, "Usage: goserve [command] [flags] [args]")
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, "Commands:")
+	tw := tabwriter.NewWriter(os.Stderr, 0, 8, 2, ' ', 0)
+	for _, c := range commands {
+		fmt.Fprintf(tw, "  %s\t%s\n", c.name, c.summary)
+	}
+	tw.Flush()
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, "Without a command, goserve [flags] [dir] serves the directory.")
+	fmt.Fprintln(os.Stderr, "Run goserve help <command> to describe a command's flags.")
+	return 0
+}
+
+// runServe implements the `serve` subcommand, which starts the server. It
+// returns once the server is stopped by a signal.
+func runServe(args []string) int {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: goserve [serve] [flags] [dir]")
+		fs.PrintDefaults()
+	}
+	load := configFlags(fs)
+	// Superseded by the check subcommand, but kept for existing scripts
+	checkConfig := fs.Bool("config.check", false, "Check config then quit")
+	echo := fs.Bool("config.echo", false, "Echo config then quit")
+	fs.Parse(args)
+
+	var err error
+	cfg, err = load()
+	if err != nil {
+		log.Fatalln("Couldn't load config:", err)
+	}
+	if *echo {
+		echoConfig(cfg)
+	}
+	if !cfg.check() {
+		log.Fatalln("Invalid config. Exiting.")
+	}
+	if *checkConfig {
+		log.Println("Config check passed.")
+	}
+	if *echo || *checkConfig {
+		return 0
+	}
+
+	serve()
+	return 0
+}
+
+// runCheck implements the `check` subcommand, which checks a configuration
+// without starting the server.
+func runCheck(args []string) int {
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: goserve check [flags] [dir]")
+		fs.PrintDefaults()
+	}
+	load := configFlags(fs)
+	echo := fs.Bool("echo", false, "Print the configuration, with defaults applied")
+	fs.Parse(args)
+
+	c, err := load()
+	if err != nil {
+		log.Println("Couldn't load config:", err)
+		return 1
+	}
+	if *echo {
+		echoConfig(c)
+	}
+	if !c.check() {
+		log.Println("Invalid config.")
+		return 1
+	}
+	log.Println("Config check passed.")
+	return 0
+}
+
+// runRoutes implements the `routes` subcommand, which lists the listeners
+// and the paths a configuration serves, with what handles each of them.
+func runRoutes(args []string) int {
+	fs := flag.NewFlagSet("routes", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: goserve routes [flags] [dir]")
+		fs.PrintDefaults()
+	}
+	load := configFlags(fs)
+	fs.Parse(args)
+
+	c, err := load()
+	if err != nil {
+		log.Println("Couldn't load config:", err)
+		return 1
+	}
+	if !c.check() {
+		log.Println("Invalid config.")
+		return 1
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	for _, l := range c.Listeners {
+		fmt.Fprintf(tw, "listen\t%s\t%s\n", l.Addr, l.Protocol)
+	}
+	if c.Admin != nil {
+		fmt.Fprintf(tw, "listen\t%s\tadmin\n", c.Admin.Addr)
+	}
+	for _, s := range c.Serves {
+		fmt.Fprintf(tw, "route\t%s\t%s\n", s.Path, s.describe())
+		if s.Sitemap != nil {
+			fmt.Fprintf(tw, "route\t%s\tsitemap of %s\n", path.Join(s.Path, "sitemap.xml"), s.Target)
+		}
+		if s.Search != nil {
+			fmt.Fprintf(tw, "route\t%s\tsearch of %s\n", path.Join(s.Path, "_search"), s.Target)
+		}
+	}
+	for _, r := range c.Redirects {
+		fmt.Fprintf(tw, "route\t%s\tredirect %d to %s\n", r.From, r.With, r.To)
+	}
+	for _, w := range c.WellKnown {
+		what := "content"
+		if w.File != "" {
+			what = "file " + w.File
+		} else if w.Redirect != "" {
+			what = "redirect to " + w.Redirect
+		}
+		fmt.Fprintf(tw, "route\t%s\twell-known %s\n", WellKnownPrefix+w.Name, what)
+	}
+	if c.Downloads != nil && c.Downloads.Badges != "" {
+		fmt.Fprintf(tw, "route\t%s\tdownload badges\n", c.Downloads.Badges)
+	}
+	if c.Favicon {
+		fmt.Fprintf(tw, "route\t/favicon.ico\tempty (fallback)\n")
+	}
+	if c.Robots != "" {
+		fmt.Fprintf(tw, "route\t/robots.txt\trobots.txt (fallback)\n")
+	}
+	for _, e := range c.Errors {
+		target := e.Target
+		if target == "" {
+			target = "default page"
+		}
+		fmt.Fprintf(tw, "error\t%s\t%d from %s\n", e.Path, e.Status, target)
+	}
+	tw.Flush()
+	return 0
+}
+
+// describe returns a short description of what handles the serve's requests.
+func (s Serve) describe() string {
+	var d []string
+	switch {
+	case s.Error > 0:
+		d = append(d, fmt.Sprintf("error %d", s.Error))
+	case s.Alias != "":
+		d = append(d, "alias of "+s.Alias)
+	case s.Proxy != nil:
+		d = append(d, "proxy to "+strings.Join(s.Proxy.targets(), ", "))
+	case s.Type == ServeTemplate:
+		d = append(d, "templates in "+s.Target)
+	default:
+		d = append(d, "files in "+s.Target)
+	}
+	if s.Canary != nil {
+		d = append(d, fmt.Sprintf("canary %s (%d%%)", s.Canary.Target, s.Canary.Percent))
+	}
+	if s.Mirror != nil {
+		d = append(d, fmt.Sprintf("mirrored to %s (%d%%)", s.Mirror.URL, s.Mirror.Percent))
+	}
+	if s.Auth != "" {
+		d = append(d, "auth "+s.Auth)
+	}
+	if s.Indexes && s.Proxy == nil && s.Alias == "" && s.Error == 0 {
+		d = append(d, "indexes")
+	}
+	return strings.Join(d, ", ")
+}
+
+// runVersion implements the `version` subcommand, which prints the details
+// of the binary's build.
+func runVersion(args []string) int {
+	fs := flag.NewFlagSet("version", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "Print the details as JSON")
+	fs.Parse(args)
+
+	b := buildInfo()
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(b)
+		return 0
+	}
+	fmt.Printf("goserve %s\n", b.Version)
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	if b.Commit != "" {
+		fmt.Fprintf(tw, "  commit:\t%s\n", b.Commit)
+	}
+	if b.Date != "" {
+		fmt.Fprintf(tw, "  built:\t%s\n", b.Date)
+	}
+	fmt.Fprintf(tw, "  go:\t%s %s\n", b.GoVersion, b.Platform)
+	fmt.Fprintf(tw, "  features:\t%s\n", strings.Join(b.Features, " "))
+	tw.Flush()
+	return 0
+}
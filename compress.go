@@ -0,0 +1,141 @@
+package main
+
+import (
+	"compress/gzip"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// compressibleTypes are the prefixes of content types worth compressing.
+var compressibleTypes = []string{
+	"text/",
+	"application/javascript",
+	"application/json",
+	"application/manifest+json",
+	"application/wasm",
+	"application/xml",
+	"application/xhtml+xml",
+	"image/svg+xml",
+	"image/x-icon",
+	"font/ttf",
+	"font/otf",
+}
+
+// compressible returns true if the file's type, judged by its extension, is
+// worth compressing.
+func compressible(name string) bool {
+	ct := mime.TypeByExtension(filepath.Ext(name))
+	for _, t := range compressibleTypes {
+		if strings.HasPrefix(ct, t) {
+			return true
+		}
+	}
+	return false
+}
+
+// compressFile writes a gzipped copy of the file alongside it, with the same
+// modification time so that it's known to be up to date. It returns the size
+// of the copy, or 0 if compressing didn't make it smaller, in which case
+// any existing copy is removed.
+func compressFile(name string, fi os.FileInfo) (int64, error) {
+	in, err := os.Open(name)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+	tmp, err := ioutil.TempFile(filepath.Dir(name), ".tmp-")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name()) // if not renamed
+	gz, _ := gzip.NewWriterLevel(tmp, gzip.BestCompression)
+	_, err = io.Copy(gz, in)
+	if err == nil {
+		err = gz.Close()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return 0, err
+	}
+	out, err := os.Stat(tmp.Name())
+	if err != nil {
+		return 0, err
+	}
+	if out.Size() >= fi.Size() {
+		os.Remove(name + ".gz")
+		return 0, nil
+	}
+	if err := os.Chmod(tmp.Name(), fi.Mode().Perm()); err != nil {
+		return 0, err
+	}
+	if err := os.Chtimes(tmp.Name(), fi.ModTime(), fi.ModTime()); err != nil {
+		return 0, err
+	}
+	return out.Size(), os.Rename(tmp.Name(), name+".gz")
+}
+
+// runCompress implements the `compress` subcommand, which writes gzipped
+// copies of the compressible files in directories, at maximum compression,
+// for serves with a precompressing cache to use instead of compressing the
+// files themselves. It returns the exit status.
+func runCompress(args []string) int {
+	fs := flag.NewFlagSet("compress", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: goserve compress [flags] dir...")
+		fs.PrintDefaults()
+	}
+	minSize := fs.Int64("min-size", 256, "Smallest file to compress, in bytes")
+	force := fs.Bool("force", false, "Rewrite copies that are already up to date")
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+
+	var files, skipped int
+	var before, after int64
+	status := 0
+	for _, dir := range fs.Args() {
+		err := filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if !fi.Mode().IsRegular() || strings.HasSuffix(p, ".gz") ||
+				fi.Size() < *minSize || !compressible(p) {
+				return nil
+			}
+			if gz, err := os.Stat(p + ".gz"); err == nil && !*force &&
+				gz.ModTime().Equal(fi.ModTime()) {
+				skipped++
+				return nil
+			}
+			n, err := compressFile(p, fi)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Couldn't compress %s: %s\n", p, err)
+				status = 1
+				return nil
+			}
+			if n > 0 {
+				files++
+				before += fi.Size()
+				after += n
+			}
+			return nil
+		})
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			status = 1
+		}
+	}
+	fmt.Printf("Compressed %d files from %d to %d bytes; %d already up to date\n",
+		files, before, after, skipped)
+	return status
+}
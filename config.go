@@ -1,24 +1,141 @@
 package main
 
 import (
+	"github.com/johnsto/goserve/backend"
+
+	"compress/gzip"
+	"crypto/tls"
+	"crypto/x509"
+	"expvar"
 	"fmt"
 	"log"
+	"mime"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
 )
 
+// problems collects the problems found when checking a configuration. Its
+// methods mirror those of log, which the problems are logged with unless
+// they're returned through the admin API instead.
+type problems []string
+
+func (p *problems) Printf(format string, v ...interface{}) {
+	*p = append(*p, fmt.Sprintf(format, v...))
+}
+
+func (p *problems) Println(v ...interface{}) {
+	*p = append(*p, strings.TrimSuffix(fmt.Sprintln(v...), "\n"))
+}
+
 // Headers represents a simplified HTTP header dict
 type Headers map[string]string
 
+// HeaderRule describes headers to apply only to responses with a matching
+// content type and status.
+type HeaderRule struct {
+	ContentType string  `yaml:"content_type,omitempty"` // glob of media types, e.g. "font/*"
+	Status      string  `yaml:"status,omitempty"`       // status or class, e.g. "404", "2xx"
+	Headers     Headers `yaml:"headers"`                // headers to apply, as for Headers
+}
+
+func (r HeaderRule) check(label string, report *problems) (ok bool) {
+	ok = true
+	if _, err := path.Match(r.ContentType, ""); err != nil {
+		report.Printf(label+": invalid content_type `%s`", r.ContentType)
+		ok = false
+	}
+	if r.Status != "" && !validStatusPattern(r.Status) {
+		report.Printf(label+": invalid status `%s`; expected e.g. 404 or 4xx", r.Status)
+		ok = false
+	}
+	if len(r.Headers) == 0 {
+		report.Println(label + ": no headers specified")
+		ok = false
+	}
+	return r.Headers.check(label, report) && ok
+}
+
 // ServerConfig represents a server configuration.
 type ServerConfig struct {
 	Listeners []Listener `yaml:"listeners"`
 	Serves    []Serve    `yaml:"serves"`
 	Errors    []Error    `yaml:"errors,omitempty"`
 	Redirects []Redirect `yaml:"redirects,omitempty"`
+
+	Favicon bool   `yaml:"favicon,omitempty"` // 204 for missing /favicon.ico
+	Robots  string `yaml:"robots,omitempty"`  // content for missing /robots.txt
+
+	DenyLog  string `yaml:"deny_log,omitempty"`  // file or "syslog" to log denied requests to
+	AuditLog string `yaml:"audit_log,omitempty"` // file or "syslog" to log access decisions to
+
+	Methods []string `yaml:"methods,omitempty"` // allowed request methods (empty=all but TRACE)
+
+	ErrorTheme     string `yaml:"error_theme,omitempty"`      // built-in error pages (plain, light, dark, auto)
+	ErrorPagesFrom int    `yaml:"error_pages_from,omitempty"` // lowest status given a built-in page
+
+	APIPaths []string `yaml:"api_paths,omitempty"` // paths whose errors are always JSON
+
+	Alerts *Alerts `yaml:"alerts,omitempty"` // webhook alerts when things go wrong
+	Admin  *Admin  `yaml:"admin,omitempty"`  // listener for the status dashboard
+
+	DebugHeaders *DebugHeaders `yaml:"debug_headers,omitempty"` // X-Cache, X-Serve and X-Served-By
+
+	Realms    []Realm `yaml:"realms,omitempty"`     // users who may authenticate
+	QuotaFile string  `yaml:"quota_file,omitempty"` // where token quota usage is kept
+
+	Downloads *Downloads       `yaml:"downloads,omitempty"` // per-file download counts
+	Analytics *AnalyticsConfig `yaml:"analytics,omitempty"` // page views per path and day
+
+	LoadShedding *LoadShedding `yaml:"load_shedding,omitempty"` // 503 for requests while overloaded
+
+	Faults []Fault `yaml:"faults,omitempty"` // slow and failing responses, for development
+
+	Watch string `yaml:"watch,omitempty"` // how often certs and htpasswd files are checked for changes
+
+	WellKnown []WellKnown `yaml:"well_known,omitempty"` // files published under /.well-known/
+
+	Defaults *Defaults `yaml:"defaults,omitempty"` // values inherited by every serve and listener
+
+	Tests []Test `yaml:"tests,omitempty"` // requests `goserve test` checks the responses to
 }
 
-func (c ServerConfig) sanitise() {
+// Defaults gives values that every serve or listener inherits unless it gives
+// its own, such as headers, caching, compression and authentication. They're
+// applied as the configuration is read, by applyDefaults.
+type Defaults struct {
+	Serves    map[string]interface{} `yaml:"serves,omitempty"`
+	Listeners map[string]interface{} `yaml:"listeners,omitempty"`
+}
+
+func (d Defaults) check(report *problems) (ok bool) {
+	ok = true
+	for list, values := range map[string]map[string]interface{}{"serves": d.Serves, "listeners": d.Listeners} {
+		for _, f := range mergeKeys[list] {
+			if _, ok2 := values[f]; ok2 {
+				report.Printf("Defaults for %s: %s can't be defaulted", list, f)
+				ok = false
+			}
+		}
+	}
+	return
+}
+
+func (c *ServerConfig) sanitise() {
+	if c.ErrorTheme == "" {
+		c.ErrorTheme = ThemePlain
+	}
+	if c.ErrorPagesFrom == 0 {
+		c.ErrorPagesFrom = 400
+	}
 	for i := range c.Listeners {
 		c.Listeners[i].sanitise()
 	}
@@ -31,26 +148,151 @@ func (c ServerConfig) sanitise() {
 	for i := range c.Errors {
 		c.Errors[i].sanitise()
 	}
+	for i := range c.Tests {
+		c.Tests[i].sanitise()
+	}
+	for i := range c.Faults {
+		c.Faults[i].sanitise()
+	}
+	if c.Alerts != nil {
+		c.Alerts.sanitise()
+	}
+	if c.Admin != nil {
+		c.Admin.sanitise()
+	}
+	if c.Downloads != nil {
+		c.Downloads.sanitise()
+	}
+	if c.Analytics != nil {
+		c.Analytics.sanitise()
+	}
+	if c.LoadShedding != nil {
+		c.LoadShedding.sanitise()
+	}
+}
+
+// problems returns the problems found with the configuration, if any.
+func (c ServerConfig) problems() []string {
+	var report problems
+	c.validate(&report)
+	return report
 }
 
+// check logs the problems found with the configuration, returning true if
+// there are none.
 func (c ServerConfig) check() (ok bool) {
+	problems := c.problems()
+	for _, p := range problems {
+		log.Println(p)
+	}
+	return len(problems) == 0
+}
+
+// validate reports the problems found with the configuration.
+func (c ServerConfig) validate(report *problems) (ok bool) {
 	ok = true
 	if len(c.Listeners) == 0 {
-		log.Printf("No listeners defined!")
+		report.Printf("No listeners defined!")
 		ok = false
 	}
 	for i, l := range c.Listeners {
-		ok = l.check(fmt.Sprintf("Listener #%d", i)) && ok
+		ok = l.check(fmt.Sprintf("Listener #%d", i), report) && ok
+	}
+	if c.Defaults != nil {
+		ok = c.Defaults.check(report) && ok
 	}
 	if len(c.Serves) == 0 {
-		log.Printf("No serves defined!")
+		report.Printf("No serves defined!")
 		ok = false
 	}
 	for i, s := range c.Serves {
-		ok = s.check(fmt.Sprintf("Serve #%d", i)) && ok
+		ok = s.check(fmt.Sprintf("Serve #%d", i), report) && ok
 	}
+	ok = c.checkAliases(report) && ok
 	for i, r := range c.Redirects {
-		ok = r.check(fmt.Sprintf("Redirect #%d", i)) && ok
+		ok = r.check(fmt.Sprintf("Redirect #%d", i), report) && ok
+	}
+	for i, e := range c.Errors {
+		ok = e.check(fmt.Sprintf("Error #%d", i), report) && ok
+	}
+	for i, t := range c.Tests {
+		ok = t.check(fmt.Sprintf("Test #%d", i), report) && ok
+	}
+	if c.ErrorPagesFrom < 100 || c.ErrorPagesFrom > 600 {
+		report.Printf("Invalid error_pages_from %d", c.ErrorPagesFrom)
+		ok = false
+	}
+	if !validErrorTheme(c.ErrorTheme) {
+		report.Printf("Invalid error theme `%s`", c.ErrorTheme)
+		ok = false
+	}
+	for _, p := range c.APIPaths {
+		if _, err := path.Match(p, ""); err != nil || !strings.HasPrefix(p, "/") {
+			report.Printf("Invalid API path `%s`", p)
+			ok = false
+		}
+	}
+	for _, m := range c.Methods {
+		if m == "" || strings.ToUpper(m) != m {
+			report.Printf("Invalid method `%s`; methods must be upper case", m)
+			ok = false
+		}
+	}
+	if c.Alerts != nil {
+		ok = c.Alerts.check("Alerts", report) && ok
+	}
+	if c.Admin != nil {
+		ok = c.Admin.check("Admin", report) && ok
+	}
+	if c.Downloads != nil {
+		ok = c.Downloads.check("Downloads", report) && ok
+	}
+	if c.Analytics != nil {
+		ok = c.Analytics.check("Analytics", report) && ok
+	}
+	if c.LoadShedding != nil {
+		ok = c.LoadShedding.check("Load shedding", report) && ok
+	}
+	for i, f := range c.Faults {
+		ok = f.check(fmt.Sprintf("Fault #%d", i), report) && ok
+	}
+	wellKnown := make(map[string]bool)
+	for i, w := range c.WellKnown {
+		ok = w.check(fmt.Sprintf("Well-known #%d", i), report) && ok
+		if wellKnown[w.Name] {
+			report.Printf("Well-known #%d: duplicate name `%s`", i, w.Name)
+			ok = false
+		}
+		wellKnown[w.Name] = true
+	}
+	for i, s := range c.Serves {
+		if strings.HasPrefix(s.Path, WellKnownPrefix) && wellKnown[strings.TrimPrefix(s.Path, WellKnownPrefix)] {
+			report.Printf("Serve #%d: path `%s` is also a well-known file", i, s.Path)
+			ok = false
+		}
+	}
+	if d, err := parseDuration(c.Watch); err != nil || (c.Watch != "" && d < time.Second) {
+		report.Printf("Invalid watch interval `%s`", c.Watch)
+		ok = false
+	}
+	if c.DebugHeaders != nil && !c.DebugHeaders.Always && c.DebugHeaders.Secret == "" {
+		report.Printf("Debug headers: either always or a secret must be given")
+		ok = false
+	}
+	realms := make(map[string]bool)
+	for i, r := range c.Realms {
+		ok = r.check(fmt.Sprintf("Realm #%d", i), report) && ok
+		if realms[r.Name] {
+			report.Printf("Realm #%d: duplicate name `%s`", i, r.Name)
+			ok = false
+		}
+		realms[r.Name] = true
+	}
+	for i, s := range c.Serves {
+		if s.Auth != "" && !realms[s.Auth] {
+			report.Printf("Serve #%d: unknown auth realm `%s`", i, s.Auth)
+			ok = false
+		}
 	}
 	return
 }
@@ -59,10 +301,62 @@ func (c ServerConfig) check() (ok bool) {
 type Listener struct {
 	Protocol string  `yaml:"protocol"`
 	Addr     string  `yaml:"addr"`
-	CertFile string  `yaml:"cert,omitempty"`
-	KeyFile  string  `yaml:"key,omitempty"`
-	Headers  Headers `yaml:"headers,omitempty"` // custom headers
+	CertFile string  `yaml:"cert,omitempty"`           // path, inline PEM, env:NAME, fd:N or vault:PATH#FIELD
+	KeyFile  string  `yaml:"key,omitempty"`            // as cert
+	KeyPass  string  `yaml:"key_passphrase,omitempty"` // env:NAME, file:PATH or prompt
+	Headers  Headers `yaml:"headers,omitempty"`        // custom headers
 	Gzip     bool    `yaml:"gzip"`
+
+	HeaderRules []HeaderRule `yaml:"header_rules,omitempty"` // headers for matching responses
+
+	GzipLevel  int      `yaml:"gzip_level,omitempty"`  // 1-9 (0=default)
+	GzipTypes  []string `yaml:"gzip_types,omitempty"`  // content types to compress (empty=all)
+	GzipBuffer int      `yaml:"gzip_buffer,omitempty"` // compressed bytes buffered for Content-Length (0=4096, -1=none)
+
+	DisableKeepAlive bool   `yaml:"disable_keepalive,omitempty"` // close after each request
+	MaxRequests      int    `yaml:"max_requests,omitempty"`      // requests per connection (0=unlimited)
+	MaxIdle          int    `yaml:"max_idle,omitempty"`          // idle connections kept open (0=unlimited)
+	IdleTimeout      string `yaml:"idle_timeout,omitempty"`      // e.g. "30s"
+
+	Log          string `yaml:"log,omitempty"`           // access log format (off, common, verbose, errors)
+	LogAnonymize string `yaml:"log_anonymize,omitempty"` // anonymize client IPs (mask, hash)
+	LogSample    int    `yaml:"log_sample,omitempty"`    // log 1 in N successful requests
+	LogSlow      string `yaml:"log_slow,omitempty"`      // in errors format, also log requests slower than this
+
+	AccessLogs []AccessLog `yaml:"access_logs,omitempty"` // where accesses are logged (default stdout and stderr)
+
+	ServerTiming bool `yaml:"server_timing,omitempty"` // add a Server-Timing header
+
+	StripValidators bool `yaml:"strip_validators,omitempty"` // remove ETag and Last-Modified
+	StripIdentity   bool `yaml:"strip_identity,omitempty"`   // remove Server, X-Powered-By, etc.
+
+	// TLS and security policy, which may be overridden per host
+	ClientAuth string `yaml:"client_auth,omitempty"` // client certificates (none, request, require)
+	ClientCA   string `yaml:"client_ca,omitempty"`   // PEM bundle of CAs client certificates must chain to
+	HSTS       string `yaml:"hsts,omitempty"`        // Strict-Transport-Security value
+	Hosts      []Host `yaml:"hosts,omitempty"`       // per-host overrides
+
+	ClientCertHeaders bool `yaml:"client_cert_headers,omitempty"` // pass client cert identity upstream
+
+	TrustedProxies []string `yaml:"trusted_proxies,omitempty"` // IPs/CIDRs whose Forwarded headers are believed
+
+	TicketRotate string `yaml:"ticket_rotate,omitempty"` // how often session ticket keys change
+	TicketFile   string `yaml:"ticket_file,omitempty"`   // 32-byte keys shared with other instances
+
+	// TCP socket options
+	Network      string `yaml:"network,omitempty"`       // tcp (default), tcp4 or tcp6
+	TCPKeepAlive string `yaml:"tcp_keepalive,omitempty"` // probe period (negative=disabled)
+	TCPDelay     bool   `yaml:"tcp_delay,omitempty"`     // enable Nagle's algorithm
+	ReadBuffer   string `yaml:"read_buffer,omitempty"`   // socket receive buffer size
+	WriteBuffer  string `yaml:"write_buffer,omitempty"`  // socket send buffer size
+
+	RedirectHTTP bool `yaml:"redirect_http,omitempty"` // redirect plain HTTP to HTTPS on an auto listener
+}
+
+// secure returns true if the listener accepts TLS connections: those with the
+// https protocol, and auto, which accepts both TLS and plain HTTP.
+func (l Listener) secure() bool {
+	return l.Protocol == "https" || l.Protocol == "auto"
 }
 
 func (l *Listener) sanitise() {
@@ -72,134 +366,2385 @@ func (l *Listener) sanitise() {
 	if l.Addr == "" {
 		l.Addr = ":http"
 	}
+	if l.Log == "" {
+		l.Log = LogCommon
+	}
+	if l.Network == "" {
+		l.Network = "tcp"
+	}
 }
 
-func (l *Listener) check(label string) (ok bool) {
+func (l *Listener) check(label string, report *problems) (ok bool) {
 	ok = true
+	ok = l.Headers.check(label, report) && ok
+	for i, rule := range l.HeaderRules {
+		ok = rule.check(fmt.Sprintf("%s: header rule #%d", label, i), report) && ok
+	}
 	if l.Protocol == "http" {
 		if l.CertFile != "" || l.KeyFile != "" {
-			log.Printf(label + ": certificate supplied for non-HTTPS listener")
+			report.Println(label + ": certificate supplied for non-HTTPS listener")
+			ok = false
+		}
+	} else if l.secure() {
+		if err := checkPEMSpec(l.CertFile); os.IsNotExist(err) {
+			report.Printf(label+": cert file `%s` does not exist", l.CertFile)
+			ok = false
+		} else if err != nil && !isPEMFile(l.CertFile) {
+			report.Printf(label+": cert `%s`: %s", pemLabel(l.CertFile), err)
 			ok = false
 		}
-	} else if l.Protocol == "https" {
-		if _, err := os.Stat(l.CertFile); os.IsNotExist(err) {
-			log.Printf(label+": cert file `%s` does not exist", l.CertFile)
+		if err := checkPEMSpec(l.KeyFile); os.IsNotExist(err) {
+			report.Printf(label+": key file `%s` does not exist", l.KeyFile)
+			ok = false
+		} else if err != nil && !isPEMFile(l.KeyFile) {
+			report.Printf(label+": key `%s`: %s", pemLabel(l.KeyFile), err)
 			ok = false
 		}
-		if _, err := os.Stat(l.KeyFile); os.IsNotExist(err) {
-			log.Printf(label+": key file `%s` does not exist", l.KeyFile)
+		if !validPassphraseSpec(l.KeyPass) {
+			report.Printf(label+": invalid key_passphrase `%s`", l.KeyPass)
 			ok = false
 		}
 	} else {
-		log.Printf(label+": invalid protocol `%s`", l.Protocol)
+		report.Printf(label+": invalid protocol `%s`", l.Protocol)
 		ok = false
 	}
-	return
-}
-
-// Serve represents a path that will be served.
-type Serve struct {
-	Target  string  `yaml:"target"`            // where files are stored on the file system
-	Path    string  `yaml:"path"`              // HTTP path to serve files under
-	Error   int     `yaml:"error,omitempty"`   // HTTP error to return (0=disabled)
-	Indexes bool    `yaml:"indexes,omitempty"` // list directory contents
-	Headers Headers `yaml:"headers,omitempty"` // custom headers
-}
-
-func (s *Serve) sanitise() {
-	if s.Path == "" {
-		s.Path = "/"
+	if !validGzipLevel(l.GzipLevel) {
+		report.Printf(label+": invalid gzip_level %d", l.GzipLevel)
+		ok = false
+	}
+	if !validLogFormat(l.Log) {
+		report.Printf(label+": invalid log format `%s`", l.Log)
+		ok = false
+	}
+	if !validAnonymize(l.LogAnonymize) {
+		report.Printf(label+": invalid log_anonymize `%s`", l.LogAnonymize)
+		ok = false
+	}
+	if _, err := parseDuration(l.LogSlow); err != nil {
+		report.Printf(label+": invalid log_slow `%s`", l.LogSlow)
+		ok = false
+	}
+	if l.LogSample < 0 {
+		report.Println(label + ": log_sample must not be negative")
+		ok = false
+	}
+	for i, a := range l.AccessLogs {
+		ok = a.check(fmt.Sprintf("%s: access log #%d", label, i), report) && ok
+	}
+	if l.MaxRequests < 0 {
+		report.Println(label + ": max_requests must not be negative")
+		ok = false
+	}
+	if l.MaxIdle < 0 {
+		report.Println(label + ": max_idle must not be negative")
+		ok = false
+	}
+	if _, err := parseDuration(l.IdleTimeout); err != nil {
+		report.Printf(label+": invalid idle_timeout `%s`", l.IdleTimeout)
+		ok = false
+	}
+	if l.Network != "tcp" && l.Network != "tcp4" && l.Network != "tcp6" {
+		report.Printf(label+": invalid network `%s`", l.Network)
+		ok = false
+	}
+	if _, err := parseDuration(l.TCPKeepAlive); err != nil {
+		report.Printf(label+": invalid tcp_keepalive `%s`", l.TCPKeepAlive)
+		ok = false
+	}
+	for _, size := range []string{l.ReadBuffer, l.WriteBuffer} {
+		if size == "" {
+			continue
+		}
+		if n, err := parseSize(size); err != nil || n <= 0 {
+			report.Printf(label+": invalid buffer size `%s`", size)
+			ok = false
+		}
+	}
+	if !l.secure() && (l.ClientAuth != "" || l.HSTS != "") {
+		report.Println(label + ": client_auth and hsts require an HTTPS listener")
+		ok = false
+	}
+	ok = checkClientAuth(label, l.ClientAuth, l.ClientCA, report) && ok
+	if _, err := ParseTrustedProxies(l.TrustedProxies); err != nil {
+		report.Printf(label+": invalid trusted_proxies: %s", err)
+		ok = false
+	}
+	if !l.secure() && (l.TicketRotate != "" || l.TicketFile != "") {
+		report.Println(label + ": ticket_rotate and ticket_file require an HTTPS listener")
+		ok = false
+	}
+	if d, err := parseDuration(l.TicketRotate); err != nil || d < 0 {
+		report.Printf(label+": invalid ticket_rotate `%s`", l.TicketRotate)
+		ok = false
 	}
+	if l.TicketFile != "" {
+		if _, err := readTicketKeys(l.TicketFile); err != nil {
+			report.Printf(label+": invalid ticket_file: %s", err)
+			ok = false
+		}
+	}
+	if l.RedirectHTTP && l.Protocol != "auto" {
+		report.Println(label + ": redirect_http requires an auto listener")
+		ok = false
+	}
+	for i, h := range l.Hosts {
+		hlabel := fmt.Sprintf("%s host #%d", label, i)
+		if !l.secure() && (h.ClientAuth != "" || h.HSTS != "") {
+			report.Println(hlabel + ": client_auth and hsts require an HTTPS listener")
+			ok = false
+		}
+		ok = h.check(hlabel, l.ClientCA, report) && ok
+	}
+	return
 }
 
-func (s Serve) check(label string) (ok bool) {
+// checkClientAuth checks a client_auth mode and the CA bundle it needs.
+func checkClientAuth(label, mode, ca string, report *problems) (ok bool) {
 	ok = true
-	if s.Path == "" {
-		log.Println(label + ": no path specified")
+	if !validClientAuth(mode) {
+		report.Printf(label+": invalid client_auth `%s`", mode)
 		ok = false
 	}
-	if s.Error == 0 && s.Target == "" {
-		log.Println(label + ": no target path specified")
+	if (mode == ClientAuthRequest || mode == ClientAuthRequire) && ca == "" {
+		report.Println(label + ": client_auth needs a client_ca")
 		ok = false
 	}
-	if s.Error != 0 && s.Target != "" {
-		log.Println(label + ": error specified with target path")
-		ok = false
+	if ca != "" {
+		if _, err := os.Stat(ca); err != nil {
+			report.Printf(label+": client_ca `%s` does not exist", ca)
+			ok = false
+		}
 	}
 	return
 }
 
-func (s Serve) handler() http.Handler {
-	var h http.Handler
-	if s.Error > 0 {
-		errStatus := s.Error
-		h = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			http.Error(w, http.StatusText(errStatus), errStatus)
-		})
-	} else if s.Indexes {
-		h = http.FileServer(http.Dir(s.Target))
-	} else {
-		// Prevent listing of directories lacking an index.html file
-		h = SuppressListingHandler(http.Dir(s.Target))
+// hostPolicies returns the security policies of the listener and its hosts,
+// or nil if none are configured.
+func (l Listener) hostPolicies() (*HostPolicies, error) {
+	if l.ClientAuth == "" && l.HSTS == "" && len(l.Hosts) == 0 {
+		return nil, nil
 	}
-
-	if len(s.Headers) > 0 {
-		h = CustomHeadersHandler(h, s.Headers)
+	p := &HostPolicies{
+		Default: HostPolicy{
+			Pattern:    l.Addr,
+			ClientAuth: l.ClientAuth,
+			HSTS:       l.HSTS,
+		},
 	}
-
-	return http.StripPrefix(s.Path, h)
+	pools := map[string]*x509.CertPool{}
+	loadPool := func(file string) (*x509.CertPool, error) {
+		if file == "" || pools[file] != nil {
+			return pools[file], nil
+		}
+		pool, err := loadCertPool(file)
+		pools[file] = pool
+		return pool, err
+	}
+	var err error
+	if p.Default.ClientCAs, err = loadPool(l.ClientCA); err != nil {
+		return nil, err
+	}
+	for _, h := range l.Hosts {
+		hp := HostPolicy{
+			Pattern:    h.Host,
+			ClientAuth: h.ClientAuth,
+			HSTS:       h.HSTS,
+			Headers:    h.Headers,
+		}
+		if hp.ClientAuth == "" {
+			hp.ClientAuth = l.ClientAuth
+		}
+		if hp.HSTS == "" {
+			hp.HSTS = l.HSTS
+		} else if hp.HSTS == "off" {
+			hp.HSTS = ""
+		}
+		ca := h.ClientCA
+		if ca == "" {
+			ca = l.ClientCA
+		}
+		if hp.ClientCAs, err = loadPool(ca); err != nil {
+			return nil, err
+		}
+		p.Hosts = append(p.Hosts, hp)
+	}
+	return p, nil
 }
 
-// Redirect represents a redirect from one path to another.
-type Redirect struct {
-	From string `yaml:"from"`
-	To   string `yaml:"to"`
-	With int    `yaml:"status,omitempty"`
+// tlsConfig returns the TLS config for an HTTPS listener, applying the
+// client certificate requirements of the policies, if any. The function
+// returned stops watching the certificate and rotating session tickets.
+func (l Listener) tlsConfig(p *HostPolicies) (*tls.Config, func(), error) {
+	cert, err := loadKeyPair(l.CertFile, l.KeyFile, l.KeyPass)
+	if err != nil {
+		return nil, nil, err
+	}
+	if p == nil {
+		p = &HostPolicies{}
+	}
+	config := p.TLSConfig(cert)
+	stop := func() {}
+	if watchInterval > 0 && isPEMFile(l.CertFile) && isPEMFile(l.KeyFile) {
+		if l.KeyPass == "prompt" {
+			log.Printf("Not watching %s, as its passphrase is prompted for", l.KeyFile)
+		} else {
+			var current atomic.Value
+			current.Store(&cert)
+			config.Certificates = nil
+			config.GetCertificate = func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+				return current.Load().(*tls.Certificate), nil
+			}
+			stop = WatchFiles([]string{l.CertFile, l.KeyFile}, func() error {
+				cert, err := loadKeyPair(l.CertFile, l.KeyFile, l.KeyPass)
+				if err == nil {
+					current.Store(&cert)
+				}
+				return err
+			})
+		}
+	}
+	if l.TicketRotate != "" || l.TicketFile != "" {
+		interval, _ := parseDuration(l.TicketRotate)
+		if interval == 0 {
+			interval = 12 * time.Hour
+		}
+		rotator, err := NewTicketKeyRotator(config, l.TicketFile, interval)
+		if err != nil {
+			stop()
+			return nil, nil, err
+		}
+		stopCert := stop
+		stop = func() {
+			stopCert()
+			rotator.Stop()
+		}
+		if config.GetConfigForClient == nil {
+			// http.Server copies its config, so hand out copies of this
+			// one for each handshake to pick up rotated keys
+			config.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+				c := config.Clone()
+				c.GetConfigForClient = nil
+				return c, nil
+			}
+		}
+	}
+	return config, stop, nil
 }
 
-func (r *Redirect) sanitise() {
-	if r.With == 0 {
-		r.With = 301
-	}
+// Host overrides the security policy of a listener for matching hosts.
+// Unset values inherit from the listener.
+type Host struct {
+	Host       string  `yaml:"host"`                  // e.g. admin.example.com or *.example.com
+	ClientAuth string  `yaml:"client_auth,omitempty"` // none, request or require
+	ClientCA   string  `yaml:"client_ca,omitempty"`   // PEM bundle of client CAs
+	HSTS       string  `yaml:"hsts,omitempty"`        // Strict-Transport-Security value (off=none)
+	Headers    Headers `yaml:"headers,omitempty"`     // security and other headers
 }
 
-func (r Redirect) check(label string) (ok bool) {
-	if r.From == "" {
-		log.Printf(label + ": no `from` path")
+func (h Host) check(label, listenerCA string, report *problems) (ok bool) {
+	ok = true
+	if h.Host == "" {
+		report.Println(label + ": no host given")
 		ok = false
 	}
-
-	if r.To == "" {
-		log.Printf(label + ": no `to` path")
-		ok = false
+	ok = h.Headers.check(label, report) && ok
+	ca := h.ClientCA
+	if ca == "" {
+		ca = listenerCA
 	}
+	return checkClientAuth(label, h.ClientAuth, ca, report) && ok
+}
 
-	return true
+// listen creates the network listener for this listener.
+func (l Listener) listen() (net.Listener, error) {
+	opts := TCPOptions{
+		Network: l.Network,
+		NoDelay: !l.TCPDelay,
+	}
+	opts.KeepAlive, _ = parseDuration(l.TCPKeepAlive)
+	if l.ReadBuffer != "" {
+		n, _ := parseSize(l.ReadBuffer)
+		opts.ReadBuffer = int(n)
+	}
+	if l.WriteBuffer != "" {
+		n, _ := parseSize(l.WriteBuffer)
+		opts.WriteBuffer = int(n)
+	}
+	return ListenTCP(l.Addr, opts)
 }
 
-func (r Redirect) handler() http.Handler {
-	return http.RedirectHandler(r.To, r.With)
+func (l Listener) gzipOptions() GzipOptions {
+	return GzipOptions{
+		Enabled: l.Gzip,
+		Level:   l.GzipLevel,
+		Types:   l.GzipTypes,
+		Buffer:  l.GzipBuffer,
+	}
 }
 
-// Error represents what to do when a particular HTTP status is encountered.
-type Error struct {
-	Status int    `yaml:"status"`
-	Target string `yaml:"target"`
+// logOptions returns how the listener logs accesses, opening its access
+// logs.
+func (l Listener) logOptions() (LogOptions, error) {
+	slow, _ := parseDuration(l.LogSlow)
+	opts := LogOptions{
+		Format:    l.Log,
+		Anonymize: l.LogAnonymize,
+		Sample:    l.LogSample,
+		Slow:      slow,
+	}
+	for _, a := range l.AccessLogs {
+		w, err := openLogDestination(a.To, "goserve-access")
+		if err != nil {
+			return opts, err
+		}
+		opts.Sinks = append(opts.Sinks, LogSink{Writer: w, Format: a.Format, Status: a.Status, Paths: a.Paths})
+	}
+	return opts, nil
 }
 
-func (e *Error) sanitise() {
+// AccessLog describes a destination of a listener's access logs, and which
+// requests are logged to it.
+type AccessLog struct {
+	To     string   `yaml:"to"`               // file, "stdout", "stderr" or "syslog"
+	Format string   `yaml:"format,omitempty"` // common, verbose or errors (default: the listener's or serve's)
+	Status []string `yaml:"status,omitempty"` // statuses or classes logged, e.g. 4xx (default all)
+	Paths  []string `yaml:"paths,omitempty"`  // glob patterns of paths or file names logged (default all)
 }
 
-func (e Error) check() (ok bool) {
-	return true
+func (a AccessLog) check(label string, report *problems) (ok bool) {
+	ok = true
+	if a.To == "" {
+		report.Println(label + ": no destination (to) specified")
+		ok = false
+	}
+	if a.Format != "" && (a.Format == LogOff || !validLogFormat(a.Format)) {
+		report.Printf(label+": invalid format `%s`", a.Format)
+		ok = false
+	}
+	for _, pattern := range a.Status {
+		if !validStatusPattern(pattern) {
+			report.Printf(label+": invalid status `%s`; expected e.g. 404 or 4xx", pattern)
+			ok = false
+		}
+	}
+	for _, p := range a.Paths {
+		if _, err := path.Match(p, ""); err != nil {
+			report.Printf(label+": invalid path pattern `%s`", p)
+			ok = false
+		}
+	}
+	return
 }
 
-func (e Error) handler() http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Clear content-type as set by `http.Error` to force re-detection
-		w.Header().Del("Content-Type")
+// server creates an http.Server for this listener that serves using the
+// given handler.
+func (l Listener) server(h http.Handler) *http.Server {
+	if l.MaxRequests > 0 {
+		h = MaxRequestsHandler(h, l.MaxRequests)
+	}
+	srv := &http.Server{
+		Addr:    l.Addr,
+		Handler: h,
+	}
+	srv.IdleTimeout, _ = parseDuration(l.IdleTimeout)
+	if l.MaxRequests > 0 {
+		srv.ConnContext = countRequestsContext
+	}
+	if l.MaxIdle > 0 {
+		srv.ConnState = newIdleLimiter(l.MaxIdle).track
+	}
+	srv.SetKeepAlivesEnabled(!l.DisableKeepAlive)
+	return srv
+}
 
-		// Serve error page with a specific status code
-		http.ServeFile(w, r, e.Target)
-	})
+// Serve represents a path that will be served.
+type Serve struct {
+	Target  string  `yaml:"target"`            // where files are stored on the file system
+	Path    string  `yaml:"path"`              // HTTP path to serve files under
+	Error   int     `yaml:"error,omitempty"`   // HTTP error to return (0=disabled)
+	Indexes bool    `yaml:"indexes,omitempty"` // list directory contents
+	Headers Headers `yaml:"headers,omitempty"` // custom headers
+
+	HeaderRules []HeaderRule `yaml:"header_rules,omitempty"` // headers for matching responses
+
+	Type string   `yaml:"type,omitempty"` // how files are served (template; default as they are)
+	Data []string `yaml:"data,omitempty"` // YAML or JSON files templates are rendered with
+
+	Gallery      bool    `yaml:"gallery,omitempty"`       // list directories as image thumbnails
+	GalleryCache string  `yaml:"gallery_cache,omitempty"` // directory thumbnails are stored in
+	Resize       *Resize `yaml:"resize,omitempty"`        // scale images with ?w=&h=&format=
+	Highlight    bool    `yaml:"highlight,omitempty"`     // show source files as highlighted HTML
+	Archives     bool    `yaml:"archives,omitempty"`      // browse inside zip and tar archives
+	Digests      bool    `yaml:"digests,omitempty"`       // send file digests and checksums on request
+	Stat         bool    `yaml:"stat,omitempty"`          // describe files as JSON with ?stat
+
+	PageSize       int  `yaml:"page_size,omitempty"`       // entries per page of listings (0=all)
+	StreamListings bool `yaml:"stream_listings,omitempty"` // write listings unsorted as they're read
+
+	MaxDepth int `yaml:"max_depth,omitempty"` // levels of directories listed and indexed (0=unlimited)
+
+	Auth      string `yaml:"auth,omitempty"`      // name of realm required to access the serve
+	Overrides bool   `yaml:"overrides,omitempty"` // apply .goserve files in served directories
+
+	AllowSensitive bool `yaml:"allow_sensitive,omitempty"` // serve .git, .env*, *.pem, *.key, backups etc.
+
+	Untrusted     bool     `yaml:"untrusted,omitempty"`      // files may come from users, e.g. uploads
+	ForceDownload *bool    `yaml:"force_download,omitempty"` // serve dangerous types as attachments (default: untrusted)
+	DownloadTypes []string `yaml:"download_types,omitempty"` // glob patterns of those types
+
+	ContentTypes map[string]string `yaml:"content_types,omitempty"` // glob pattern to type, e.g. Dockerfile: text/plain
+
+	// Compression overrides; unset values inherit from the listener
+	Gzip      *bool    `yaml:"gzip,omitempty"`
+	GzipLevel int      `yaml:"gzip_level,omitempty"`
+	GzipTypes []string `yaml:"gzip_types,omitempty"`
+
+	Log string `yaml:"log,omitempty"` // access log format override
+
+	Sitemap *Sitemap `yaml:"sitemap,omitempty"` // generate a sitemap.xml
+	Search  *Search  `yaml:"search,omitempty"`  // serve a /_search endpoint for file names
+	Batch   *Batch   `yaml:"batch,omitempty"`   // download selected files as one archive
+
+	Manifest         string `yaml:"manifest,omitempty"`          // asset manifest (e.g. manifest.json)
+	ManifestRedirect bool   `yaml:"manifest_redirect,omitempty"` // 301 to fingerprinted names
+	ManifestReverse  bool   `yaml:"manifest_reverse,omitempty"`  // serve fingerprinted names from logical files
+
+	Immutable string `yaml:"immutable,omitempty"` // regexp of content-hashed file names
+	Expires   string `yaml:"expires,omitempty"`   // how long responses may be cached, e.g. "7d"
+	ETag      string `yaml:"etag,omitempty"`      // ETags sent with files (content; default none)
+
+	CDN []CDNRule `yaml:"cdn,omitempty"` // caching by CDNs, and surrogate keys, by path
+
+	LastModified     string `yaml:"last_modified,omitempty"`      // fixed modification time of files
+	LastModifiedMode string `yaml:"last_modified_mode,omitempty"` // override (default) or clamp
+
+	Cache *Cache `yaml:"cache,omitempty"` // hold file contents in memory
+	Mmap  string `yaml:"mmap,omitempty"`  // memory map files at least this large, e.g. "16M"
+
+	FSTimeout string `yaml:"fs_timeout,omitempty"` // fail file system operations taking longer, e.g. "5s"
+
+	Release string `yaml:"release,omitempty"` // when to resolve a symlinked target (request, signal)
+
+	Canary *Canary `yaml:"canary,omitempty"` // route a share of clients to another target
+
+	Alias string `yaml:"alias,omitempty"` // URL path to serve requests from instead
+
+	Proxy  *Proxy  `yaml:"proxy,omitempty"`  // forward requests to an upstream server
+	Mirror *Mirror `yaml:"mirror,omitempty"` // copy a share of requests to another upstream
+}
+
+func (s *Serve) sanitise() {
+	if s.Path == "" {
+		s.Path = "/"
+	}
+	s.Target = expandEnv(s.Target)
+	if s.Canary != nil {
+		s.Canary.Target = expandEnv(s.Canary.Target)
+	}
+	if s.Sitemap != nil {
+		s.Sitemap.sanitise()
+	}
+	if s.Search != nil {
+		s.Search.sanitise()
+	}
+	if s.Batch != nil {
+		s.Batch.sanitise()
+	}
+	for i := range s.CDN {
+		s.CDN[i].sanitise()
+	}
+	if s.Cache != nil {
+		s.Cache.sanitise()
+	}
+	if s.Proxy != nil {
+		s.Proxy.sanitise()
+	}
+	if s.Mirror != nil {
+		s.Mirror.sanitise()
+	}
+	if s.Gallery && s.GalleryCache == "" {
+		s.GalleryCache = filepath.Join(os.TempDir(), "goserve-thumbnails")
+	}
+	if s.Resize != nil {
+		s.Resize.sanitise()
+	}
+	if s.ForceDownload == nil {
+		force := s.Untrusted
+		s.ForceDownload = &force
+	}
+	if len(s.DownloadTypes) == 0 {
+		s.DownloadTypes = dangerousPatterns
+	}
+}
+
+func (s Serve) check(label string, report *problems) (ok bool) {
+	ok = true
+	ok = s.Headers.check(label, report) && ok
+	for i, rule := range s.HeaderRules {
+		ok = rule.check(fmt.Sprintf("%s: header rule #%d", label, i), report) && ok
+	}
+	if s.Path == "" {
+		report.Println(label + ": no path specified")
+		ok = false
+	}
+	if s.Error == 0 && s.Target == "" && s.Alias == "" && s.Proxy == nil {
+		report.Println(label + ": no target path specified")
+		ok = false
+	}
+	if s.Error != 0 && s.Target != "" {
+		report.Println(label + ": error specified with target path")
+		ok = false
+	}
+	if strings.Contains(s.Target, "${") {
+		report.Printf(label+": target `%s` refers to an undefined environment variable", s.Target)
+		ok = false
+	}
+	if s.hostTarget() && (s.Release != "" || s.Canary != nil || s.Sitemap != nil || s.Search != nil) {
+		report.Println(label + ": a target containing " + hostPlaceholder +
+			" can't be used with release, canary, sitemap or search")
+		ok = false
+	}
+	if b, location := backend.Lookup(s.Target); b != nil {
+		// Backends are only opened once the configuration is put into
+		// effect
+		if location == "" {
+			report.Printf(label+": target `%s` has no location", s.Target)
+			ok = false
+		}
+		if s.hostTarget() || s.Release != "" || s.Canary != nil || s.Sitemap != nil || s.Search != nil ||
+			(s.Cache != nil && len(s.Cache.Preload) > 0) {
+			report.Println(label + ": a target in a backend can't be used with release, canary, sitemap, search or preload")
+			ok = false
+		}
+	}
+	if s.Alias != "" {
+		if s.Target != "" || s.Error != 0 {
+			report.Println(label + ": alias specified with target path or error")
+			ok = false
+		}
+		if !strings.HasPrefix(s.Alias, "/") {
+			report.Printf(label+": alias `%s` must be an absolute URL path", s.Alias)
+			ok = false
+		}
+	}
+	if s.Proxy != nil {
+		if s.Target != "" || s.Error != 0 || s.Alias != "" {
+			report.Println(label + ": proxy specified with target path, error or alias")
+			ok = false
+		}
+		ok = s.Proxy.check(label, report) && ok
+	}
+	if s.Mirror != nil {
+		ok = s.Mirror.check(label, report) && ok
+	}
+	if !validGzipLevel(s.GzipLevel) {
+		report.Printf(label+": invalid gzip_level %d", s.GzipLevel)
+		ok = false
+	}
+	if s.Log != "" && !validLogFormat(s.Log) {
+		report.Printf(label+": invalid log format `%s`", s.Log)
+		ok = false
+	}
+	for _, p := range s.DownloadTypes {
+		if _, err := path.Match(p, ""); err != nil {
+			report.Printf(label+": invalid download type `%s`", p)
+			ok = false
+		}
+	}
+	for p, t := range s.ContentTypes {
+		if _, err := path.Match(p, ""); err != nil {
+			report.Printf(label+": invalid content type pattern `%s`", p)
+			ok = false
+		}
+		if _, _, err := mime.ParseMediaType(t); err != nil {
+			report.Printf(label+": invalid content type `%s` for `%s`", t, p)
+			ok = false
+		}
+	}
+	if s.Sitemap != nil {
+		if s.Target == "" {
+			report.Println(label + ": sitemap requires a target path")
+			ok = false
+		}
+		ok = s.Sitemap.check(label, report) && ok
+	}
+	if s.Search != nil {
+		if s.Target == "" {
+			report.Println(label + ": search requires a target path")
+			ok = false
+		}
+		ok = s.Search.check(label, report) && ok
+	}
+	if s.Overrides && (s.Sitemap != nil || s.Search != nil) {
+		// Indexes can't honour the rules of each directory's override file
+		report.Println(label + ": sitemap and search can't be used with overrides")
+		ok = false
+	}
+	if s.Batch != nil {
+		if s.Target == "" || s.Type == ServeTemplate {
+			report.Println(label + ": batch downloads require a target path of files served as they are")
+			ok = false
+		}
+		ok = s.Batch.check(label, report) && ok
+	}
+	if s.Manifest != "" {
+		if _, err := NewManifest(s.Manifest); err != nil {
+			report.Printf(label+": couldn't load manifest `%s`: %s", s.Manifest, err)
+			ok = false
+		}
+	} else if s.ManifestReverse {
+		report.Println(label + ": manifest_reverse given without a manifest")
+		ok = false
+	}
+	if s.Release != "" && s.Release != ReleasePerRequest && s.Release != ReleaseOnSignal {
+		report.Printf(label+": invalid release mode `%s`", s.Release)
+		ok = false
+	}
+	switch s.Type {
+	case ServeFiles:
+		if len(s.Data) > 0 {
+			report.Println(label + ": data given for a serve that isn't a template")
+			ok = false
+		}
+	case ServeTemplate:
+		if s.Target == "" || s.singleFile() {
+			report.Println(label + ": template requires a target directory")
+			ok = false
+		}
+		for _, file := range s.Data {
+			if _, err := os.Stat(file); err != nil {
+				report.Printf(label+": data file `%s` does not exist", file)
+				ok = false
+			}
+		}
+	default:
+		report.Printf(label+": invalid type `%s`", s.Type)
+		ok = false
+	}
+	if s.Canary != nil {
+		if s.Target == "" || s.singleFile() || s.Release != "" {
+			report.Println(label + ": canary requires a target directory, without release")
+			ok = false
+		}
+		ok = s.Canary.check(label, report) && ok
+	}
+	if d, err := parseDuration(s.Expires); err != nil || d < 0 {
+		report.Printf(label+": invalid expires `%s`", s.Expires)
+		ok = false
+	}
+	if s.LastModified != "" {
+		if _, err := parseTime(s.LastModified); err != nil {
+			report.Printf(label+": invalid last_modified `%s`: %s", s.LastModified, err)
+			ok = false
+		}
+	}
+	if s.LastModifiedMode != "" && s.LastModifiedMode != ModTimeOverride &&
+		s.LastModifiedMode != ModTimeClamp {
+		report.Printf(label+": invalid last_modified_mode `%s`", s.LastModifiedMode)
+		ok = false
+	}
+	if s.Cache != nil {
+		ok = s.Cache.check(label, report) && ok
+	}
+	if s.Resize != nil {
+		ok = s.Resize.check(label, report) && ok
+	}
+	if s.PageSize < 0 {
+		report.Println(label + ": page_size must not be negative")
+		ok = false
+	}
+	if s.Overrides && s.Target == "" {
+		report.Println(label + ": overrides requires a target path")
+		ok = false
+	}
+	if s.MaxDepth < 0 {
+		report.Printf(label+": invalid max_depth %d", s.MaxDepth)
+		ok = false
+	}
+	if s.StreamListings && (s.PageSize > 0 || s.Gallery) {
+		report.Println(label + ": stream_listings can't be used with page_size or gallery")
+		ok = false
+	}
+	if s.Mmap != "" {
+		if n, err := parseSize(s.Mmap); err != nil || n <= 0 {
+			report.Printf(label+": invalid mmap threshold `%s`", s.Mmap)
+			ok = false
+		}
+	}
+	if s.FSTimeout != "" {
+		if d, err := parseDuration(s.FSTimeout); err != nil || d <= 0 {
+			report.Printf(label+": invalid fs_timeout `%s`", s.FSTimeout)
+			ok = false
+		}
+		if s.Mmap != "" {
+			// reading mapped memory can't be timed out
+			report.Println(label + ": fs_timeout can't be used with mmap")
+			ok = false
+		}
+	}
+	if s.ETag != ETagNone && s.ETag != ETagContent {
+		report.Printf(label+": invalid etag mode `%s`", s.ETag)
+		ok = false
+	}
+	if _, err := regexp.Compile(s.Immutable); err != nil {
+		report.Printf(label+": invalid immutable pattern `%s`: %s", s.Immutable, err)
+		ok = false
+	}
+	for i, rule := range s.CDN {
+		ok = rule.check(fmt.Sprintf("%s: CDN rule #%d", label, i), report) && ok
+	}
+	return
+}
+
+// checkAliases reports serves whose aliases resolve back to the serve itself,
+// directly or through the aliases of other serves, which would loop until
+// maxAliasDepth. Aliases are resolved as the router resolves them, so an
+// alias within its own serve's path is fine if another serve handles it.
+func (c ServerConfig) checkAliases(report *problems) (ok bool) {
+	mux := http.NewServeMux()
+	patterns := map[string]int{} // serve index, by path
+	for i, s := range c.Serves {
+		if _, dup := patterns[s.Path]; dup {
+			continue
+		}
+		func() {
+			// Invalid paths are reported when the mux is built
+			defer func() { recover() }()
+			mux.Handle(s.Path, http.NotFoundHandler())
+			patterns[s.Path] = i
+		}()
+	}
+
+	ok = true
+	for i, s := range c.Serves {
+		seen := map[int]bool{i: true}
+		for next := s; strings.HasPrefix(next.Alias, "/"); {
+			_, pattern := mux.Handler(&http.Request{Method: http.MethodGet, URL: &url.URL{Path: next.Alias}})
+			j, found := patterns[pattern]
+			if found && j == i {
+				report.Printf("Serve #%d: alias `%s` resolves back to itself", i, s.Alias)
+				ok = false
+			}
+			if !found || seen[j] {
+				break
+			}
+			seen[j] = true
+			next = c.Serves[j]
+		}
+	}
+	return
+}
+
+// hostTarget returns true if the target depends on the request's host.
+func (s Serve) hostTarget() bool {
+	return strings.Contains(s.Target, hostPlaceholder)
+}
+
+// singleFile returns true if the target is a file rather than a directory.
+func (s Serve) singleFile() bool {
+	if s.Target == "" {
+		return false
+	}
+	fi, err := os.Stat(s.Target)
+	return err == nil && !fi.IsDir()
+}
+
+// methods returns the HTTP methods supported by the serve at the path,
+// relative to the serve's. Selections for batch downloads are POSTed to
+// directories.
+func (s Serve) methods(p string) []string {
+	if s.Batch != nil && batchPath(p) {
+		return []string{http.MethodGet, http.MethodHead, http.MethodPost, http.MethodOptions}
+	}
+	return []string{http.MethodGet, http.MethodHead, http.MethodOptions}
+}
+
+// fileSystem returns the file system files are served from, given the one
+// they're stored in and a key identifying it, such as its directory.
+func (s Serve) fileSystem(base http.FileSystem, key string) http.FileSystem {
+	fs := base
+	if s.FSTimeout != "" {
+		timeout, _ := parseDuration(s.FSTimeout)
+		fs = TimeoutFileSystem(fs, timeout)
+	}
+	if s.Mmap != "" {
+		threshold, _ := parseSize(s.Mmap)
+		fs = MmapFileSystem(fs, threshold)
+	}
+	if s.LastModified != "" {
+		t, _ := parseTime(s.LastModified)
+		fs = ModTimeFileSystem(fs, t, s.LastModifiedMode == ModTimeClamp)
+	}
+	if s.Cache != nil {
+		fs = s.fileCache(key, fs)
+	}
+	return fs
+}
+
+// fileCache returns the cache of files in the file system with the given key,
+// creating it around the given file system if necessary.
+func (s Serve) fileCache(key string, fs http.FileSystem) *FileCache {
+	return sharedFileCache(s.Path+"="+key, func() *FileCache {
+		maxSize, _ := parseSize(s.Cache.MaxSize)
+		maxFile, _ := parseSize(s.Cache.MaxFile)
+		return NewFileCache(fs, maxSize, maxFile, s.Cache.Precompress)
+	})
+}
+
+// dropReleaseCaches drops the serve's caches of releases other than the one
+// its target currently points at.
+func (s Serve) dropReleaseCaches() {
+	current, _ := filepath.EvalSymlinks(s.Target)
+	dropFileCaches(func(key string) bool {
+		return strings.HasPrefix(key, s.Path+"=") && key != s.Path+"="+current
+	})
+}
+
+// fileHandler returns a handler serving files from the given directory.
+func (s Serve) fileHandler(dir http.Dir) http.Handler {
+	return s.fsHandler(dir, string(dir))
+}
+
+// fsHandler returns a handler serving files from the file system with the
+// given key.
+func (s Serve) fsHandler(base http.FileSystem, key string) http.Handler {
+	fs := s.fileSystem(base, key)
+	var h http.Handler
+	if s.Indexes || s.Gallery {
+		lh := NewListingHandler(fs)
+		if s.LastModified != "" {
+			lh.SetSource(base)
+		}
+		if s.Gallery {
+			lh.SetGallery(NewImageCache(s.GalleryCache))
+		}
+		if s.Archives {
+			lh.SetArchives()
+		}
+		if s.Overrides {
+			lh.Hide(overrideFile)
+		}
+		if !s.AllowSensitive {
+			for _, pattern := range sensitivePatterns {
+				lh.Hide(pattern)
+			}
+		}
+		lh.SetPageSize(s.PageSize)
+		lh.SetMaxDepth(s.MaxDepth)
+		if s.StreamListings {
+			lh.SetStreaming()
+		}
+		h = lh
+	} else {
+		// Prevent listing of directories lacking an index.html file
+		h = SuppressListingHandler(fs)
+	}
+	var digests *DigestCache
+	if s.Digests || s.ETag == ETagContent {
+		digests = NewDigestCache(fs)
+	}
+	if s.Digests {
+		h = DigestHandler(h, digests)
+	}
+	if s.Cache != nil && s.Cache.Precompress {
+		cache := fs.(*FileCache)
+		h = PrecompressedHandler(h, func() *FileCache { return cache })
+	}
+	if s.ETag == ETagContent {
+		h = ETagHandler(h, digests)
+	}
+	if s.Resize != nil {
+		h = ResizeHandler(h, fs, NewImageCache(s.Resize.Cache), s.Resize.sizes())
+	}
+	if s.Highlight {
+		h = HighlightHandler(h, fs)
+	}
+	if s.Type == ServeTemplate {
+		h = TemplateHandler(h, fs, s.Data)
+	}
+	if s.Archives {
+		h = ArchiveHandler(h, fs, s.MaxDepth)
+	}
+	if s.Digests {
+		h = ChecksumHandler(h, digests)
+	}
+	if s.Stat {
+		h = StatHandler(h, fs, digests)
+	}
+	if s.Overrides {
+		h = OverrideHandler(h, fs)
+	}
+	if !s.AllowSensitive {
+		h = SensitiveFileHandler(h)
+	}
+	if s.Batch != nil {
+		h = BatchHandler(h, fs, s.batchOptions())
+	}
+	if s.FSTimeout != "" {
+		h = FSTimeoutHandler(h)
+	}
+	return h
+}
+
+// preload reads files into the serve's cache ahead of time.
+func (s Serve) preload() {
+	if s.Cache == nil || len(s.Cache.Preload) == 0 || s.singleFile() || s.hostTarget() {
+		return
+	}
+	dir := s.Target
+	if s.Release != "" {
+		resolved, err := filepath.EvalSymlinks(dir)
+		if err != nil {
+			return
+		}
+		dir = resolved
+	}
+	s.fileSystem(http.Dir(dir), dir).(*FileCache).Preload(dir, s.Cache.Preload)
+}
+
+// handler returns the handler of the serve's requests, and a function
+// stopping the work it does in the background, called once it's no longer
+// needed. An error is returned if the handler can't be created.
+func (s Serve) handler(mux handlerFinder) (http.Handler, func(), error) {
+	var h http.Handler
+	stop := func() {}
+	if s.Alias != "" {
+		h = AliasHandler(mux, s.Alias)
+	} else if s.Error > 0 {
+		errStatus := s.Error
+		rule := "serve " + s.Path
+		h = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			setDenyRule(r, rule)
+			audit(r, "acl", AuditDeny, rule, "")
+			http.Error(w, http.StatusText(errStatus), errStatus)
+		})
+	} else if s.Proxy != nil {
+		h, stop = s.Proxy.handler()
+	} else if b, _ := backend.Lookup(s.Target); b != nil {
+		fs, release, err := backend.Open(s.Target)
+		if err != nil {
+			return nil, nil, fmt.Errorf("couldn't open %s: %s", s.Target, err)
+		}
+		h, stop = s.fsHandler(fs, s.Target), release
+	} else if s.hostTarget() {
+		h = HostTargetHandler(s.Target, s.fileHandler)
+	} else if s.singleFile() {
+		h = SingleFileHandler(s.Path, s.Target)
+	} else if s.Release != "" {
+		h, stop = ReleaseHandler(s.Target, s.Release == ReleaseOnSignal, s.fileHandler)
+		if s.Cache != nil {
+			// Caches for previous releases are no longer needed
+			unhook := onRelease(s.dropReleaseCaches)
+			stopRelease := stop
+			stop = func() {
+				stopRelease()
+				unhook()
+			}
+		}
+	} else {
+		// Plain directories are a backend too
+		fs, release, err := backend.Open("dir:" + s.Target)
+		if err != nil {
+			return nil, nil, fmt.Errorf("couldn't open %s: %s", s.Target, err)
+		}
+		h, stop = s.fsHandler(fs, s.Target), release
+		if s.Canary != nil {
+			canary := s.fileHandler(http.Dir(s.Canary.Target))
+			h = CanaryHandler(h, canary, s.Canary.options())
+		}
+	}
+
+	if s.Manifest != "" {
+		m, err := NewManifest(s.Manifest)
+		if err != nil {
+			stop()
+			return nil, nil, fmt.Errorf("couldn't load manifest %s: %s", s.Manifest, err)
+		}
+		h = ManifestHandler(h, m, s.Path, s.ManifestRedirect, s.ManifestReverse)
+		stopWatch, stopHandler := m.watch(manifestInterval), stop
+		stop = func() {
+			stopWatch()
+			stopHandler()
+		}
+	}
+
+	if len(s.Headers) > 0 {
+		h = CustomHeadersHandler(h, s.Headers)
+	}
+	if len(s.HeaderRules) > 0 {
+		h = HeaderRulesHandler(h, s.HeaderRules)
+	}
+
+	if s.Expires != "" {
+		d, _ := parseDuration(s.Expires)
+		h = ExpiresHandler(h, d)
+	}
+
+	if s.Immutable != "" {
+		h = ImmutableHandler(h, regexp.MustCompile(s.Immutable))
+	}
+
+	if s.ForceDownload != nil && *s.ForceDownload {
+		h = ForceDownloadHandler(h, s.DownloadTypes)
+	}
+	if s.Untrusted {
+		h = NoSniffHandler(h)
+	}
+
+	if s.Gzip != nil || s.GzipLevel != 0 || len(s.GzipTypes) > 0 {
+		h = GzipOverrideHandler(h, s.Gzip, s.GzipLevel, s.GzipTypes)
+	}
+
+	if s.Log != "" {
+		h = LogFormatHandler(h, s.Log)
+	}
+
+	if s.Mirror != nil {
+		h = s.Mirror.handler(h)
+	}
+
+	h = s.guard(h)
+
+	if s.Proxy == nil {
+		// upstream servers answer OPTIONS themselves
+		h = OptionsHandler(h, s.methods)
+	}
+	h = ServeStatsHandler(h, s.Path)
+
+	if !s.singleFile() {
+		h = http.StripPrefix(s.Path, h)
+	}
+
+	if len(s.CDN) > 0 {
+		// Outside StripPrefix, so that patterns match, and keys are, whole
+		// URL paths
+		h = CDNHandler(h, s.CDN)
+	}
+
+	if len(s.ContentTypes) > 0 {
+		// Outside StripPrefix, so that patterns match whole URL paths
+		h = ContentTypeHandler(h, s.ContentTypes)
+	}
+	return h, stop, nil
+}
+
+// CDNRule describes how CDNs and other shared caches may cache responses
+// for matching paths, separately from browsers, and the surrogate keys they
+// may be purged by.
+type CDNRule struct {
+	Paths                []string `yaml:"paths,omitempty"`                  // glob patterns of paths or file names (empty=all)
+	SMaxAge              string   `yaml:"s_maxage,omitempty"`               // how long shared caches may keep responses
+	StaleWhileRevalidate string   `yaml:"stale_while_revalidate,omitempty"` // how long stale responses may be served while refreshing
+	StaleIfError         string   `yaml:"stale_if_error,omitempty"`         // how long stale responses may be served on errors
+	Header               string   `yaml:"header,omitempty"`                 // sent in: Cache-Control (default), CDN-Cache-Control, Surrogate-Control etc.
+	Keys                 []string `yaml:"keys,omitempty"`                   // surrogate keys of responses
+	PathKeys             bool     `yaml:"path_keys,omitempty"`              // add the path and its directories as keys
+	KeyHeader            string   `yaml:"key_header,omitempty"`             // keys sent in: Surrogate-Key (default), Cache-Tag etc.
+}
+
+func (c *CDNRule) sanitise() {
+	if c.Header == "" {
+		c.Header = "Cache-Control"
+	}
+	if c.KeyHeader == "" {
+		c.KeyHeader = defaultKeyHeader
+	}
+}
+
+func (c CDNRule) check(label string, report *problems) (ok bool) {
+	ok = true
+	for _, p := range c.Paths {
+		if _, err := path.Match(p, ""); err != nil {
+			report.Printf(label+": invalid path pattern `%s`", p)
+			ok = false
+		}
+	}
+	for name, value := range map[string]string{
+		"s_maxage":               c.SMaxAge,
+		"stale_while_revalidate": c.StaleWhileRevalidate,
+		"stale_if_error":         c.StaleIfError,
+	} {
+		if d, err := parseDuration(value); err != nil || d < 0 {
+			report.Printf(label+": invalid %s `%s`", name, value)
+			ok = false
+		}
+	}
+	for _, name := range []string{c.Header, c.KeyHeader} {
+		if strings.ContainsAny(name, " :") {
+			report.Printf(label+": invalid header name `%s`", name)
+			ok = false
+		}
+	}
+	for _, key := range c.Keys {
+		if key == "" || strings.ContainsAny(key, " ,") {
+			report.Printf(label+": invalid key `%s`; keys can't contain spaces or commas", key)
+			ok = false
+		}
+	}
+	if len(c.directives()) == 0 && len(c.Keys) == 0 && !c.PathKeys {
+		report.Println(label + ": no directives or keys specified")
+		ok = false
+	}
+	return
+}
+
+// Resize describes how images may be scaled on request.
+type Resize struct {
+	Sizes []string `yaml:"sizes"`           // allowed sizes, e.g. "640x480", "1280x" or "x200"
+	Cache string   `yaml:"cache,omitempty"` // directory scaled images are stored in
+}
+
+func (z *Resize) sanitise() {
+	if z.Cache == "" {
+		z.Cache = filepath.Join(os.TempDir(), "goserve-resized")
+	}
+}
+
+func (z Resize) check(label string, report *problems) (ok bool) {
+	ok = true
+	if len(z.Sizes) == 0 {
+		report.Println(label + ": resize needs at least one size")
+		ok = false
+	}
+	for _, size := range z.Sizes {
+		if _, err := parseImageSize(size); err != nil {
+			report.Printf(label+": %s", err)
+			ok = false
+		}
+	}
+	return
+}
+
+// sizes returns the allowed sizes.
+func (z Resize) sizes() []ImageSize {
+	var sizes []ImageSize
+	for _, s := range z.Sizes {
+		size, _ := parseImageSize(s)
+		sizes = append(sizes, size)
+	}
+	return sizes
+}
+
+// Canary describes a target serving a new build to a share of clients.
+type Canary struct {
+	Target  string `yaml:"target"`           // directory of the new build
+	Percent int    `yaml:"percent"`          // share of clients routed to it
+	Cookie  string `yaml:"cookie,omitempty"` // cookie that opts in (1) or out (0)
+	Header  string `yaml:"header,omitempty"` // header that opts in (1) or out (0)
+}
+
+func (c Canary) check(label string, report *problems) (ok bool) {
+	ok = true
+	if fi, err := os.Stat(c.Target); err != nil || !fi.IsDir() {
+		report.Printf(label+": canary target `%s` is not a directory", c.Target)
+		ok = false
+	}
+	if c.Percent < 0 || c.Percent > 100 {
+		report.Println(label + ": canary percent must be between 0 and 100")
+		ok = false
+	}
+	return
+}
+
+// options returns the CanaryOptions for the canary.
+func (c Canary) options() CanaryOptions {
+	return CanaryOptions{Percent: c.Percent, Cookie: c.Cookie, Header: c.Header}
+}
+
+// Proxy describes the upstream server requests are forwarded to.
+type Proxy struct {
+	URL            string `yaml:"url,omitempty"`             // e.g. http://127.0.0.1:3000/api
+	DialTimeout    string `yaml:"dial_timeout,omitempty"`    // connecting to the upstream
+	HeaderTimeout  string `yaml:"header_timeout,omitempty"`  // waiting for the response header (default: none)
+	IdleTimeout    string `yaml:"idle_timeout,omitempty"`    // closing idle upstream connections
+	MaxIdle        int    `yaml:"max_idle,omitempty"`        // idle connections kept to the upstream
+	Stream         bool   `yaml:"stream,omitempty"`          // flush responses immediately (e.g. for SSE)
+	BufferRequest  string `yaml:"buffer_request,omitempty"`  // read request bodies up to this size first
+	BufferResponse string `yaml:"buffer_response,omitempty"` // read responses up to this size first
+
+	RequestHeaders Headers `yaml:"request_headers,omitempty"` // headers to set, add or remove upstream
+
+	CircuitBreaker *Breaker `yaml:"circuit_breaker,omitempty"` // fail fast while the upstream is failing
+
+	URLs  []string `yaml:"urls,omitempty"`  // several upstreams taking turns, instead of url
+	Retry *Retry   `yaml:"retry,omitempty"` // send failed GET and HEAD requests again
+
+	Discovery *Discovery `yaml:"discovery,omitempty"` // find upstreams by resolving the urls' hosts
+}
+
+func (p *Proxy) sanitise() {
+	if p.DialTimeout == "" {
+		p.DialTimeout = "10s"
+	}
+	if p.IdleTimeout == "" {
+		p.IdleTimeout = "90s"
+	}
+	if p.MaxIdle == 0 {
+		p.MaxIdle = 16
+	}
+	if p.CircuitBreaker != nil {
+		p.CircuitBreaker.sanitise()
+	}
+	if p.Retry != nil {
+		p.Retry.sanitise(len(p.URLs))
+	}
+	if p.Discovery != nil {
+		p.Discovery.sanitise()
+	}
+}
+
+func (p Proxy) check(label string, report *problems) (ok bool) {
+	ok = true
+	if (p.URL == "") == (len(p.URLs) == 0) {
+		report.Println(label + ": proxy needs either a url or urls")
+		ok = false
+	}
+	for _, target := range p.targets() {
+		if u, err := url.Parse(target); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			report.Printf(label+": invalid proxy url `%s`", target)
+			ok = false
+		}
+	}
+	for name, v := range map[string]string{
+		"dial_timeout":   p.DialTimeout,
+		"header_timeout": p.HeaderTimeout,
+		"idle_timeout":   p.IdleTimeout,
+	} {
+		if d, err := parseDuration(v); err != nil || d < 0 {
+			report.Printf(label+": invalid proxy %s `%s`", name, v)
+			ok = false
+		}
+	}
+	if p.MaxIdle < 0 {
+		report.Println(label + ": proxy max_idle must not be negative")
+		ok = false
+	}
+	for _, size := range []string{p.BufferRequest, p.BufferResponse} {
+		if size == "" {
+			continue
+		}
+		if n, err := parseSize(size); err != nil || n <= 0 {
+			report.Printf(label+": invalid proxy buffer size `%s`", size)
+			ok = false
+		}
+	}
+	if p.Stream && p.BufferResponse != "" {
+		report.Println(label + ": proxy can't both stream and buffer responses")
+		ok = false
+	}
+	if p.CircuitBreaker != nil {
+		ok = p.CircuitBreaker.check(label, report) && ok
+	}
+	if p.Retry != nil {
+		ok = p.Retry.check(label, report) && ok
+	}
+	if p.Discovery != nil {
+		ok = p.Discovery.check(label, report) && ok
+	}
+	return p.RequestHeaders.check(label, report) && ok
+}
+
+// targets returns the URLs of the upstreams.
+func (p Proxy) targets() []string {
+	if p.URL != "" {
+		return []string{p.URL}
+	}
+	return p.URLs
+}
+
+// handler returns a handler forwarding requests to the upstreams, and a
+// function stopping its discovery of them.
+func (p Proxy) handler() (http.Handler, func()) {
+	var targets []*url.URL
+	for _, target := range p.targets() {
+		u, _ := url.Parse(target)
+		targets = append(targets, u)
+	}
+	opts := ProxyOptions{
+		MaxIdle: p.MaxIdle,
+		Stream:  p.Stream,
+		Headers: p.RequestHeaders,
+	}
+	opts.DialTimeout, _ = parseDuration(p.DialTimeout)
+	opts.HeaderTimeout, _ = parseDuration(p.HeaderTimeout)
+	opts.IdleTimeout, _ = parseDuration(p.IdleTimeout)
+	if p.BufferRequest != "" {
+		opts.BufferRequest, _ = parseSize(p.BufferRequest)
+	}
+	if p.BufferResponse != "" {
+		opts.BufferResponse, _ = parseSize(p.BufferResponse)
+	}
+	if p.CircuitBreaker != nil {
+		opts.Breaker = p.CircuitBreaker.options()
+	}
+	if p.Retry != nil {
+		opts.Retry = p.Retry.options()
+	}
+	if p.Discovery != nil {
+		opts.Discovery = p.Discovery.options()
+	}
+	return ProxyHandler(targets, opts)
+}
+
+// Discovery describes how a proxy finds its upstreams by resolving the
+// hosts of its URLs, so that backends behind service discovery are followed
+// as they come and go.
+type Discovery struct {
+	SRV      bool   `yaml:"srv,omitempty"`      // hosts are SRV record names giving hosts and ports
+	Interval string `yaml:"interval,omitempty"` // least time before names are resolved again
+}
+
+func (d *Discovery) sanitise() {
+	if d.Interval == "" {
+		d.Interval = "30s"
+	}
+}
+
+func (d Discovery) check(label string, report *problems) (ok bool) {
+	ok = true
+	if i, err := parseDuration(d.Interval); err != nil || i < time.Second {
+		report.Printf(label+": invalid discovery interval `%s`", d.Interval)
+		ok = false
+	}
+	return
+}
+
+// options returns the DiscoveryOptions for the configuration.
+func (d Discovery) options() *DiscoveryOptions {
+	interval, _ := parseDuration(d.Interval)
+	return &DiscoveryOptions{SRV: d.SRV, Interval: interval}
+}
+
+// Retry describes when a proxy sends a GET or HEAD request again, to the
+// next upstream, after a connection error or an unsuccessful response.
+type Retry struct {
+	Attempts int   `yaml:"attempts,omitempty"` // further attempts after the first
+	Statuses []int `yaml:"statuses,omitempty"` // upstream response statuses retried
+	Budget   int   `yaml:"budget,omitempty"`   // retries allowed as a percentage of requests
+}
+
+func (r *Retry) sanitise(upstreams int) {
+	if r.Attempts == 0 {
+		r.Attempts = upstreams - 1
+		if r.Attempts < 1 {
+			r.Attempts = 1
+		}
+	}
+	if r.Statuses == nil {
+		r.Statuses = []int{502, 503, 504}
+	}
+	if r.Budget == 0 {
+		r.Budget = 20
+	}
+}
+
+func (r Retry) check(label string, report *problems) (ok bool) {
+	ok = true
+	if r.Attempts < 0 {
+		report.Println(label + ": retry attempts must not be negative")
+		ok = false
+	}
+	for _, status := range r.Statuses {
+		if status < 400 || status > 599 {
+			report.Printf(label+": invalid retry status %d", status)
+			ok = false
+		}
+	}
+	if r.Budget < 0 || r.Budget > 100 {
+		report.Println(label + ": retry budget must be between 0 and 100")
+		ok = false
+	}
+	return
+}
+
+// options returns the RetryOptions for the configuration.
+func (r Retry) options() *RetryOptions {
+	opts := &RetryOptions{
+		Attempts: r.Attempts,
+		Statuses: make(map[int]bool),
+		Budget:   float64(r.Budget),
+	}
+	for _, status := range r.Statuses {
+		opts.Statuses[status] = true
+	}
+	return opts
+}
+
+// Breaker describes when a proxy stops forwarding requests to a failing
+// upstream, and for how long.
+type Breaker struct {
+	ErrorRate   float64 `yaml:"error_rate,omitempty"`   // percentage of failed requests that opens the circuit
+	Window      string  `yaml:"window,omitempty"`       // period the error rate is measured over
+	MinRequests int     `yaml:"min_requests,omitempty"` // requests needed in a window to open
+	OpenFor     string  `yaml:"open_for,omitempty"`     // time before the upstream is probed
+}
+
+func (b *Breaker) sanitise() {
+	if b.ErrorRate == 0 {
+		b.ErrorRate = 50
+	}
+	if b.Window == "" {
+		b.Window = "10s"
+	}
+	if b.MinRequests == 0 {
+		b.MinRequests = 5
+	}
+	if b.OpenFor == "" {
+		b.OpenFor = "30s"
+	}
+}
+
+func (b Breaker) check(label string, report *problems) (ok bool) {
+	ok = true
+	if b.ErrorRate <= 0 || b.ErrorRate > 100 {
+		report.Println(label + ": circuit_breaker error_rate must be between 0 and 100")
+		ok = false
+	}
+	for name, v := range map[string]string{
+		"window":   b.Window,
+		"open_for": b.OpenFor,
+	} {
+		if d, err := parseDuration(v); err != nil || d <= 0 {
+			report.Printf(label+": invalid circuit_breaker %s `%s`", name, v)
+			ok = false
+		}
+	}
+	if b.MinRequests < 0 {
+		report.Println(label + ": circuit_breaker min_requests must not be negative")
+		ok = false
+	}
+	return
+}
+
+// options returns the BreakerOptions for the configuration.
+func (b Breaker) options() *BreakerOptions {
+	opts := &BreakerOptions{ErrorRate: b.ErrorRate, MinRequests: b.MinRequests}
+	opts.Window, _ = parseDuration(b.Window)
+	opts.OpenFor, _ = parseDuration(b.OpenFor)
+	return opts
+}
+
+// Mirror describes an upstream server that receives copies of requests,
+// whose responses are discarded.
+type Mirror struct {
+	URL     string `yaml:"url"`               // e.g. http://127.0.0.1:3001/
+	Percent int    `yaml:"percent,omitempty"` // share of requests copied
+	Timeout string `yaml:"timeout,omitempty"` // for each copied request
+}
+
+func (m *Mirror) sanitise() {
+	if m.Percent == 0 {
+		m.Percent = 100
+	}
+	if m.Timeout == "" {
+		m.Timeout = "10s"
+	}
+}
+
+func (m Mirror) check(label string, report *problems) (ok bool) {
+	ok = true
+	if u, err := url.Parse(m.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		report.Printf(label+": invalid mirror url `%s`", m.URL)
+		ok = false
+	}
+	if m.Percent < 1 || m.Percent > 100 {
+		report.Println(label + ": mirror percent must be between 1 and 100")
+		ok = false
+	}
+	if d, err := parseDuration(m.Timeout); err != nil || d <= 0 {
+		report.Printf(label+": invalid mirror timeout `%s`", m.Timeout)
+		ok = false
+	}
+	return
+}
+
+// handler returns a handler copying requests to the mirror before passing
+// them to h.
+func (m Mirror) handler(h http.Handler) http.Handler {
+	target, _ := url.Parse(m.URL)
+	timeout, _ := parseDuration(m.Timeout)
+	return MirrorHandler(h, target, MirrorOptions{Percent: m.Percent, Timeout: timeout})
+}
+
+// Sitemap describes how a sitemap.xml is generated for a serve.
+type Sitemap struct {
+	BaseURL  string   `yaml:"base_url,omitempty"` // e.g. https://example.com (default: from request)
+	Exclude  []string `yaml:"exclude,omitempty"`  // glob patterns of files to omit
+	Interval string   `yaml:"interval,omitempty"` // how often to regenerate
+}
+
+func (m *Sitemap) sanitise() {
+	if m.Interval == "" {
+		m.Interval = "1h"
+	}
+}
+
+func (m Sitemap) check(label string, report *problems) (ok bool) {
+	ok = true
+	if d, err := parseDuration(m.Interval); err != nil || d <= 0 {
+		report.Printf(label+": invalid sitemap interval `%s`", m.Interval)
+		ok = false
+	}
+	for _, pattern := range m.Exclude {
+		if _, err := path.Match(pattern, ""); err != nil {
+			report.Printf(label+": invalid sitemap exclude pattern `%s`", pattern)
+			ok = false
+		}
+	}
+	return
+}
+
+// exclude returns the patterns of files to leave out of the serve's sitemap
+// or search index: the given ones, and sensitive files unless they're allowed.
+func (s Serve) exclude(patterns []string) []string {
+	if s.AllowSensitive {
+		return patterns
+	}
+	return append(append([]string(nil), patterns...), sensitivePatterns...)
+}
+
+// guard wraps the handler with the serve's access control, for each of the
+// serve's routes.
+func (s Serve) guard(h http.Handler) http.Handler {
+	if s.Auth != "" {
+		h = AuthHandler(h, authRealms[s.Auth])
+	}
+	return h
+}
+
+// sitemapHandler returns a handler serving the sitemap for the serve, and
+// the path it should be served at.
+func (s Serve) sitemapHandler() (string, *SitemapGenerator) {
+	interval, _ := parseDuration(s.Sitemap.Interval)
+	g := NewSitemapGenerator(s.Target, s.Path, s.Sitemap.BaseURL,
+		s.exclude(s.Sitemap.Exclude), s.MaxDepth, interval)
+	return path.Join(s.Path, "sitemap.xml"), g
+}
+
+// Batch describes how selected files of a serve may be downloaded together
+// as one archive.
+type Batch struct {
+	Exclude  []string `yaml:"exclude,omitempty"`   // glob patterns of files to omit
+	MaxFiles int      `yaml:"max_files,omitempty"` // most files in one download
+	MaxSize  string   `yaml:"max_size,omitempty"`  // most bytes in one download, e.g. "1G"
+}
+
+func (b *Batch) sanitise() {
+	if b.MaxFiles == 0 {
+		b.MaxFiles = 1000
+	}
+	if b.MaxSize == "" {
+		b.MaxSize = "1G"
+	}
+}
+
+func (b Batch) check(label string, report *problems) (ok bool) {
+	ok = true
+	for _, pattern := range b.Exclude {
+		if _, err := path.Match(pattern, ""); err != nil {
+			report.Printf(label+": invalid batch exclude pattern `%s`", pattern)
+			ok = false
+		}
+	}
+	if b.MaxFiles < 0 {
+		report.Println(label + ": batch max_files must not be negative")
+		ok = false
+	}
+	if n, err := parseSize(b.MaxSize); err != nil || n < 0 {
+		report.Printf(label+": invalid batch max_size `%s`", b.MaxSize)
+		ok = false
+	}
+	return
+}
+
+// batchOptions returns the limits of the serve's batch downloads.
+func (s Serve) batchOptions() BatchOptions {
+	maxSize, _ := parseSize(s.Batch.MaxSize)
+	return BatchOptions{
+		Exclude:  s.exclude(s.Batch.Exclude),
+		MaxFiles: s.Batch.MaxFiles,
+		MaxSize:  maxSize,
+		MaxDepth: s.MaxDepth,
+	}
+}
+
+// Search describes how a serve's file names are indexed for searching.
+type Search struct {
+	Exclude  []string `yaml:"exclude,omitempty"`  // glob patterns of files to omit
+	Interval string   `yaml:"interval,omitempty"` // how often to re-index
+	Limit    int      `yaml:"limit,omitempty"`    // maximum number of results
+
+	Content   []string `yaml:"content,omitempty"`    // glob patterns of files whose text is indexed
+	IndexFile string   `yaml:"index_file,omitempty"` // where the text index is kept (default: memory only)
+}
+
+func (x *Search) sanitise() {
+	if x.Interval == "" {
+		x.Interval = "5m"
+	}
+	if x.Limit == 0 {
+		x.Limit = 100
+	}
+}
+
+func (x Search) check(label string, report *problems) (ok bool) {
+	ok = true
+	if d, err := parseDuration(x.Interval); err != nil || d <= 0 {
+		report.Printf(label+": invalid search interval `%s`", x.Interval)
+		ok = false
+	}
+	for _, pattern := range x.Exclude {
+		if _, err := path.Match(pattern, ""); err != nil {
+			report.Printf(label+": invalid search exclude pattern `%s`", pattern)
+			ok = false
+		}
+	}
+	if x.Limit < 0 {
+		report.Println(label + ": search limit must not be negative")
+		ok = false
+	}
+	for _, pattern := range x.Content {
+		if _, err := path.Match(pattern, ""); err != nil {
+			report.Printf(label+": invalid search content pattern `%s`", pattern)
+			ok = false
+		}
+	}
+	if x.IndexFile != "" && len(x.Content) == 0 {
+		report.Println(label + ": search index_file requires content patterns")
+		ok = false
+	}
+	return
+}
+
+// searchHandler returns a handler serving searches of the serve's files, and
+// the path it should be served at.
+func (s Serve) searchHandler() (string, *SearchIndex) {
+	interval, _ := parseDuration(s.Search.Interval)
+	var text *TextIndex
+	if len(s.Search.Content) > 0 {
+		text = NewTextIndex(s.Search.Content, s.Search.IndexFile)
+	}
+	x := NewSearchIndex(s.Target, s.Path, s.exclude(s.Search.Exclude), s.MaxDepth, s.Search.Limit, interval, text)
+	return path.Join(s.Path, "_search"), x
+}
+
+// Alerts describes when and where alerts are sent.
+type Alerts struct {
+	Webhook     string  `yaml:"webhook"`                // URL to POST JSON alerts to
+	ErrorRate   float64 `yaml:"error_rate,omitempty"`   // percentage of 5xx responses to alert at
+	Window      string  `yaml:"window,omitempty"`       // period the error rate is measured over
+	MinRequests int     `yaml:"min_requests,omitempty"` // requests needed in a window to alert
+	CertExpiry  string  `yaml:"cert_expiry,omitempty"`  // alert when certs expire within this, e.g. "14d"
+}
+
+func (a *Alerts) sanitise() {
+	if a.Window == "" {
+		a.Window = "1m"
+	}
+	if a.MinRequests == 0 {
+		a.MinRequests = 10
+	}
+}
+
+func (a Alerts) check(label string, report *problems) (ok bool) {
+	ok = true
+	if u, err := url.Parse(a.Webhook); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		report.Printf(label+": invalid webhook `%s`", a.Webhook)
+		ok = false
+	}
+	if a.ErrorRate < 0 || a.ErrorRate > 100 {
+		report.Println(label + ": error_rate must be between 0 and 100")
+		ok = false
+	}
+	if d, err := parseDuration(a.Window); err != nil || d <= 0 {
+		report.Printf(label+": invalid window `%s`", a.Window)
+		ok = false
+	}
+	if a.MinRequests < 0 {
+		report.Println(label + ": min_requests must not be negative")
+		ok = false
+	}
+	if _, err := parseDuration(a.CertExpiry); err != nil {
+		report.Printf(label+": invalid cert_expiry `%s`", a.CertExpiry)
+		ok = false
+	}
+	return
+}
+
+// alerter returns an Alerter for the alert configuration.
+func (a Alerts) alerter() *Alerter {
+	window, _ := parseDuration(a.Window)
+	expiry, _ := parseDuration(a.CertExpiry)
+	return NewAlerter(a.Webhook, a.ErrorRate, window, a.MinRequests, expiry)
+}
+
+// Realm describes a set of users who may authenticate with HTTP Basic auth.
+// Passwords are given as hashes: "{SHA}" followed by the base64 SHA-1
+// digest, as written by `htpasswd -s`, or "sha256:" followed by the hex
+// SHA-256 digest.
+type Realm struct {
+	Name     string            `yaml:"name"`
+	Users    map[string]string `yaml:"users,omitempty"`    // user -> password hash
+	Htpasswd string            `yaml:"htpasswd,omitempty"` // file of user:hash lines
+	Tokens   []Token           `yaml:"tokens,omitempty"`   // tokens accepted instead of users
+}
+
+func (r Realm) check(label string, report *problems) (ok bool) {
+	ok = true
+	if r.Name == "" {
+		report.Println(label + ": no name specified")
+		ok = false
+	}
+	if len(r.Users) == 0 && r.Htpasswd == "" && len(r.Tokens) == 0 {
+		report.Println(label + ": no users, htpasswd file or tokens specified")
+		ok = false
+	}
+	for user, hash := range r.Users {
+		if !validPasswordHash(hash) {
+			report.Printf(label+": invalid password hash for `%s`", user)
+			ok = false
+		}
+	}
+	if r.Htpasswd != "" {
+		if _, err := readHtpasswd(r.Htpasswd); err != nil {
+			report.Printf(label+": couldn't read htpasswd: %s", err)
+			ok = false
+		}
+	}
+	names := make(map[string]bool)
+	for i, t := range r.Tokens {
+		ok = t.check(fmt.Sprintf("%s token #%d", label, i), report) && ok
+		if names[t.Name] {
+			report.Printf(label+": duplicate token name `%s`", t.Name)
+			ok = false
+		}
+		names[t.Name] = true
+	}
+	return
+}
+
+// realm returns the AuthRealm described by the configuration.
+func (r Realm) realm() (*AuthRealm, error) {
+	a, err := NewAuthRealm(r.Name, r.Users, r.Htpasswd)
+	if err != nil {
+		return nil, err
+	}
+	if r.Htpasswd != "" {
+		WatchFiles([]string{r.Htpasswd}, func() error {
+			return a.reload(r.Users, r.Htpasswd)
+		})
+	}
+	for _, t := range r.Tokens {
+		a.AddToken(t.Token, t.Name, t.quota())
+	}
+	return a, nil
+}
+
+// Token describes a token that may be used to authenticate with a realm,
+// by sending it as a bearer token or in the `token` query parameter. It is
+// given as "sha256:" followed by the hex SHA-256 digest of the token.
+type Token struct {
+	Name  string      `yaml:"name"`  // identifies the token in logs and quota usage
+	Token string      `yaml:"token"` // hash of the token
+	Quota *TokenQuota `yaml:"quota,omitempty"`
+}
+
+// TokenQuota limits the bytes and requests a token may be used for.
+type TokenQuota struct {
+	Bytes    string `yaml:"bytes,omitempty"`    // e.g. "10G" (empty=unlimited)
+	Requests int64  `yaml:"requests,omitempty"` // 0=unlimited
+	Window   string `yaml:"window,omitempty"`   // period usage is counted over (empty=forever)
+}
+
+func (t Token) check(label string, report *problems) (ok bool) {
+	ok = true
+	if t.Name == "" {
+		report.Println(label + ": no name specified")
+		ok = false
+	}
+	if !strings.HasPrefix(t.Token, "sha256:") || !validPasswordHash(t.Token) {
+		report.Println(label + ": token must be given as sha256:<hex digest>")
+		ok = false
+	}
+	if q := t.Quota; q != nil {
+		if n, err := parseSize(q.Bytes); q.Bytes != "" && (err != nil || n <= 0) {
+			report.Printf(label+": invalid quota bytes `%s`", q.Bytes)
+			ok = false
+		}
+		if q.Requests < 0 {
+			report.Println(label + ": quota requests must not be negative")
+			ok = false
+		}
+		if d, err := parseDuration(q.Window); err != nil || d < 0 {
+			report.Printf(label+": invalid quota window `%s`", q.Window)
+			ok = false
+		}
+	}
+	return
+}
+
+// quota returns the token's quota, or nil if it's unlimited.
+func (t Token) quota() *Quota {
+	if t.Quota == nil {
+		return nil
+	}
+	q := &Quota{Requests: t.Quota.Requests}
+	if t.Quota.Bytes != "" {
+		q.Bytes, _ = parseSize(t.Quota.Bytes)
+	}
+	q.Window, _ = parseDuration(t.Quota.Window)
+	return q
+}
+
+// DebugHeaders describes when debugging headers are added to responses.
+type DebugHeaders struct {
+	Always bool   `yaml:"always,omitempty"` // add to every response
+	Secret string `yaml:"secret,omitempty"` // add when the X-Goserve-Debug request header matches
+}
+
+// Admin describes the listener serving the status dashboard. It should not
+// be exposed publicly.
+type Admin struct {
+	Addr    string `yaml:"addr"`              // e.g. 127.0.0.1:9090
+	Refresh string `yaml:"refresh,omitempty"` // how often the dashboard reloads
+	Recent  int    `yaml:"recent,omitempty"`  // requests remembered for traffic reports
+
+	Token string `yaml:"token,omitempty"` // required to follow logs and change config and settings, e.g. ${ADMIN_TOKEN}
+}
+
+func (a *Admin) sanitise() {
+	a.Token = expandEnv(a.Token)
+	if a.Refresh == "" {
+		a.Refresh = "5s"
+	}
+	if a.Recent == 0 {
+		a.Recent = 10000
+	}
+}
+
+func (a Admin) check(label string, report *problems) (ok bool) {
+	ok = true
+	if a.Addr == "" {
+		report.Println(label + ": no addr given")
+		ok = false
+	}
+	if d, err := parseDuration(a.Refresh); err != nil || d < time.Second {
+		report.Printf(label+": invalid refresh `%s`", a.Refresh)
+		ok = false
+	}
+	if a.Recent < 0 {
+		report.Println(label + ": recent must not be negative")
+		ok = false
+	}
+	if strings.Contains(a.Token, "${") {
+		report.Println(label + ": token refers to an undefined environment variable")
+		ok = false
+	}
+	return
+}
+
+// handler returns the handler for the admin listener.
+func (a Admin) handler() http.Handler {
+	refresh, _ := parseDuration(a.Refresh)
+	mux := http.NewServeMux()
+	mux.Handle("/", DashboardHandler(stats, refresh))
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.Handle("/report", traffic)
+	mux.Handle("/version", VersionHandler())
+	if downloads != nil {
+		mux.Handle("/downloads", downloads)
+	}
+	if analytics != nil {
+		mux.Handle("/analytics", analytics)
+	}
+	if tail != nil && a.Token != "" {
+		mux.Handle("/logs", AdminTokenHandler(tail, a.Token))
+	}
+	if configAPI != nil && a.Token != "" {
+		mux.Handle("/config", AdminTokenHandler(configAPI, a.Token))
+		mux.Handle("/config/", AdminTokenHandler(configAPI, a.Token))
+	}
+	if a.Token != "" {
+		mux.Handle("/settings", AdminTokenHandler(SettingsHandler(), a.Token))
+	}
+	return mux
+}
+
+// LoadShedding describes when requests are refused to protect the server
+// from being overloaded.
+type LoadShedding struct {
+	MaxInFlight int      `yaml:"max_in_flight,omitempty"` // requests served at once (0=unlimited)
+	MaxMemory   string   `yaml:"max_memory,omitempty"`    // heap in use, e.g. 512M (empty=unlimited)
+	RetryAfter  string   `yaml:"retry_after,omitempty"`   // sent in Retry-After
+	Priority    []string `yaml:"priority,omitempty"`      // path prefixes never refused
+}
+
+func (l *LoadShedding) sanitise() {
+	if l.RetryAfter == "" {
+		l.RetryAfter = "5s"
+	}
+}
+
+func (l LoadShedding) check(label string, report *problems) (ok bool) {
+	ok = true
+	if l.MaxInFlight < 0 {
+		report.Println(label + ": max_in_flight must not be negative")
+		ok = false
+	}
+	if n, err := parseSize(l.MaxMemory); l.MaxMemory != "" && (err != nil || n <= 0) {
+		report.Printf(label+": invalid max_memory `%s`", l.MaxMemory)
+		ok = false
+	}
+	if l.MaxInFlight == 0 && l.MaxMemory == "" {
+		report.Println(label + ": either max_in_flight or max_memory must be given")
+		ok = false
+	}
+	if d, err := parseDuration(l.RetryAfter); err != nil || d < time.Second {
+		report.Printf(label+": invalid retry_after `%s`", l.RetryAfter)
+		ok = false
+	}
+	for _, p := range l.Priority {
+		if !strings.HasPrefix(p, "/") {
+			report.Printf(label+": priority path `%s` must be absolute", p)
+			ok = false
+		}
+	}
+	return
+}
+
+// shedder returns a LoadShedder for the configuration.
+func (l LoadShedding) shedder() *LoadShedder {
+	maxMemory, _ := parseSize(l.MaxMemory)
+	retryAfter, _ := parseDuration(l.RetryAfter)
+	return NewLoadShedder(int64(l.MaxInFlight), uint64(maxMemory), retryAfter, l.Priority)
+}
+
+// Fault describes how responses to matching requests are slowed down or
+// made to fail, to test clients against a poor network or flaky server.
+type Fault struct {
+	Paths        []string `yaml:"paths,omitempty"`        // glob patterns of paths or file names (empty=all)
+	Latency      string   `yaml:"latency,omitempty"`      // delay before responding, e.g. 200ms
+	Jitter       string   `yaml:"jitter,omitempty"`       // spread of the delay
+	Distribution string   `yaml:"distribution,omitempty"` // of the delay: fixed, uniform, normal or exponential
+	Bandwidth    string   `yaml:"bandwidth,omitempty"`    // bytes per second bodies are sent at, e.g. 64K
+	ErrorRate    float64  `yaml:"error_rate,omitempty"`   // fraction of requests failed, from 0 to 1
+	Statuses     []int    `yaml:"statuses,omitempty"`     // statuses failed requests are given at random
+}
+
+func (f *Fault) sanitise() {
+	if f.Distribution == "" {
+		if f.Jitter == "" {
+			f.Distribution = DistributionFixed
+		} else {
+			f.Distribution = DistributionUniform
+		}
+	}
+	if f.ErrorRate > 0 && len(f.Statuses) == 0 {
+		f.Statuses = []int{http.StatusServiceUnavailable}
+	}
+}
+
+func (f Fault) check(label string, report *problems) (ok bool) {
+	ok = true
+	for _, p := range f.Paths {
+		if _, err := path.Match(p, ""); err != nil {
+			report.Printf(label+": invalid path pattern `%s`", p)
+			ok = false
+		}
+	}
+	if d, err := parseDuration(f.Latency); err != nil || d < 0 {
+		report.Printf(label+": invalid latency `%s`", f.Latency)
+		ok = false
+	}
+	if d, err := parseDuration(f.Jitter); err != nil || d < 0 {
+		report.Printf(label+": invalid jitter `%s`", f.Jitter)
+		ok = false
+	}
+	switch f.Distribution {
+	case DistributionFixed, DistributionUniform, DistributionNormal, DistributionExponential:
+	default:
+		report.Printf(label+": unknown distribution `%s`", f.Distribution)
+		ok = false
+	}
+	if n, err := parseSize(f.Bandwidth); f.Bandwidth != "" && (err != nil || n <= 0) {
+		report.Printf(label+": invalid bandwidth `%s`", f.Bandwidth)
+		ok = false
+	}
+	if f.ErrorRate < 0 || f.ErrorRate > 1 {
+		report.Println(label + ": error_rate must be between 0 and 1")
+		ok = false
+	}
+	for _, status := range f.Statuses {
+		if status < 400 || status > 599 {
+			report.Printf(label+": invalid error status %d", status)
+			ok = false
+		}
+	}
+	if f.Latency == "" && f.Jitter == "" && f.Bandwidth == "" && f.ErrorRate == 0 {
+		report.Println(label + ": one of latency, jitter, bandwidth or error_rate must be given")
+		ok = false
+	}
+	return
+}
+
+// faultRules returns the rules FaultHandler applies for the faults.
+func faultRules(faults []Fault) []faultRule {
+	rules := make([]faultRule, len(faults))
+	for i, f := range faults {
+		latency, _ := parseDuration(f.Latency)
+		jitter, _ := parseDuration(f.Jitter)
+		bandwidth, _ := parseSize(f.Bandwidth)
+		rules[i] = faultRule{
+			paths:        f.Paths,
+			latency:      latency,
+			jitter:       jitter,
+			distribution: f.Distribution,
+			bandwidth:    bandwidth,
+			errorRate:    f.ErrorRate,
+			statuses:     f.Statuses,
+		}
+	}
+	return rules
+}
+
+// Downloads describes how downloads of files are counted. Counts are served
+// as JSON at /downloads on the admin listener.
+type Downloads struct {
+	File     string   `yaml:"file,omitempty"`     // where counts are kept
+	Interval string   `yaml:"interval,omitempty"` // how often counts are saved
+	Include  []string `yaml:"include,omitempty"`  // glob patterns of paths to count (empty=all)
+	Badges   string   `yaml:"badges,omitempty"`   // path to serve SVG badges under, e.g. /badges/
+}
+
+func (d *Downloads) sanitise() {
+	if d.Interval == "" {
+		d.Interval = "1m"
+	}
+	if d.Badges != "" && !strings.HasSuffix(d.Badges, "/") {
+		d.Badges += "/"
+	}
+}
+
+func (d Downloads) check(label string, report *problems) (ok bool) {
+	ok = true
+	if i, err := parseDuration(d.Interval); err != nil || i < time.Second {
+		report.Printf(label+": invalid interval `%s`", d.Interval)
+		ok = false
+	}
+	for _, p := range d.Include {
+		if _, err := path.Match(p, ""); err != nil {
+			report.Printf(label+": invalid include pattern `%s`", p)
+			ok = false
+		}
+	}
+	if d.Badges != "" && !strings.HasPrefix(d.Badges, "/") {
+		report.Printf(label+": badges `%s` must be an absolute path", d.Badges)
+		ok = false
+	}
+	return
+}
+
+// counter returns a DownloadCounter for the configuration.
+func (d Downloads) counter() (*DownloadCounter, error) {
+	return NewDownloadCounter(d.File, d.Include)
+}
+
+// badgeHandler returns a handler serving download badges, and the path it
+// should be served at.
+func (d Downloads) badgeHandler() (string, http.Handler) {
+	return d.Badges, http.StripPrefix(strings.TrimSuffix(d.Badges, "/"),
+		BadgeHandler(downloads, d.Badges))
+}
+
+// AnalyticsConfig describes how page views are aggregated. Views are exported
+// at /analytics on the admin listener.
+type AnalyticsConfig struct {
+	File     string   `yaml:"file,omitempty"`     // where views are kept
+	Interval string   `yaml:"interval,omitempty"` // how often views are saved and pushed
+	Include  []string `yaml:"include,omitempty"`  // glob patterns of paths to count (empty=HTML pages)
+	Webhook  string   `yaml:"webhook,omitempty"`  // URL to POST each finished day's views to
+	Retain   string   `yaml:"retain,omitempty"`   // how long views are kept, e.g. "365d" (empty=forever)
+}
+
+func (a *AnalyticsConfig) sanitise() {
+	if a.Interval == "" {
+		a.Interval = "1m"
+	}
+}
+
+func (a AnalyticsConfig) check(label string, report *problems) (ok bool) {
+	ok = true
+	if i, err := parseDuration(a.Interval); err != nil || i < time.Second {
+		report.Printf(label+": invalid interval `%s`", a.Interval)
+		ok = false
+	}
+	for _, p := range a.Include {
+		if _, err := path.Match(p, ""); err != nil {
+			report.Printf(label+": invalid include pattern `%s`", p)
+			ok = false
+		}
+	}
+	if u, err := url.Parse(a.Webhook); a.Webhook != "" &&
+		(err != nil || (u.Scheme != "http" && u.Scheme != "https")) {
+		report.Printf(label+": invalid webhook `%s`", a.Webhook)
+		ok = false
+	}
+	if d, err := parseDuration(a.Retain); err != nil || d < 0 {
+		report.Printf(label+": invalid retain `%s`", a.Retain)
+		ok = false
+	}
+	return
+}
+
+// analytics returns an Analytics for the configuration.
+func (a AnalyticsConfig) analytics() (*Analytics, error) {
+	retain, _ := parseDuration(a.Retain)
+	return NewAnalytics(a.File, a.Include, a.Webhook, retain)
+}
+
+// Cache describes how files are cached in memory.
+type Cache struct {
+	MaxSize     string   `yaml:"max_size,omitempty"`    // total size of cached files, e.g. "64M"
+	MaxFile     string   `yaml:"max_file,omitempty"`    // largest file to cache, e.g. "1M"
+	Preload     []string `yaml:"preload,omitempty"`     // globs of files to load at startup
+	Precompress bool     `yaml:"precompress,omitempty"` // also cache a gzipped copy
+}
+
+func (c *Cache) sanitise() {
+	if c.MaxSize == "" {
+		c.MaxSize = "64M"
+	}
+	if c.MaxFile == "" {
+		c.MaxFile = "1M"
+	}
+}
+
+func (c Cache) check(label string, report *problems) (ok bool) {
+	ok = true
+	if n, err := parseSize(c.MaxSize); err != nil || n <= 0 {
+		report.Printf(label+": invalid cache max_size `%s`", c.MaxSize)
+		ok = false
+	}
+	if n, err := parseSize(c.MaxFile); err != nil || n <= 0 {
+		report.Printf(label+": invalid cache max_file `%s`", c.MaxFile)
+		ok = false
+	}
+	for _, pattern := range c.Preload {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			report.Printf(label+": invalid preload pattern `%s`", pattern)
+			ok = false
+		}
+	}
+	return
+}
+
+// Redirect represents a redirect from one path to another.
+type Redirect struct {
+	From string `yaml:"from"`
+	To   string `yaml:"to"`
+	With int    `yaml:"status,omitempty"`
+}
+
+func (r *Redirect) sanitise() {
+	if r.With == 0 {
+		r.With = 301
+	}
+}
+
+func (r Redirect) check(label string, report *problems) (ok bool) {
+	if r.From == "" {
+		report.Println(label + ": no `from` path")
+		ok = false
+	}
+
+	if r.To == "" {
+		report.Println(label + ": no `to` path")
+		ok = false
+	}
+
+	return true
+}
+
+func (r Redirect) handler() http.Handler {
+	return http.RedirectHandler(r.To, r.With)
+}
+
+// WellKnownPrefix is the path well-known files are published under.
+const WellKnownPrefix = "/.well-known/"
+
+// WellKnown describes a file published under /.well-known/ for every host,
+// whatever the serves, such as security.txt, change-password or a challenge
+// file proving control of a domain.
+type WellKnown struct {
+	Name        string `yaml:"name"`                   // path under /.well-known/, e.g. security.txt
+	Content     string `yaml:"content,omitempty"`      // the file's content
+	File        string `yaml:"file,omitempty"`         // or a file to serve
+	Redirect    string `yaml:"redirect,omitempty"`     // or a URL to redirect to
+	ContentType string `yaml:"content_type,omitempty"` // default: by extension, or text/plain
+}
+
+func (w WellKnown) check(label string, report *problems) (ok bool) {
+	ok = true
+	if w.Name == "" || strings.HasPrefix(w.Name, "/") || strings.HasSuffix(w.Name, "/") ||
+		path.Clean(w.Name) != w.Name || strings.HasPrefix(w.Name, "..") {
+		report.Printf(label+": invalid name `%s`", w.Name)
+		ok = false
+	}
+	n := 0
+	for _, v := range []string{w.Content, w.File, w.Redirect} {
+		if v != "" {
+			n++
+		}
+	}
+	if n != 1 {
+		report.Println(label + ": exactly one of content, file or redirect must be given")
+		ok = false
+	}
+	if w.File != "" {
+		if fi, err := os.Stat(w.File); err != nil || fi.IsDir() {
+			report.Printf(label+": file `%s` does not exist", w.File)
+			ok = false
+		}
+	}
+	if w.Redirect != "" && w.ContentType != "" {
+		report.Println(label + ": content_type can't be given for a redirect")
+		ok = false
+	}
+	return
+}
+
+// handler returns the path of the well-known file, and a handler serving it.
+func (w WellKnown) handler() (string, http.Handler) {
+	p := WellKnownPrefix + w.Name
+	if w.Redirect != "" {
+		return p, http.RedirectHandler(w.Redirect, http.StatusFound)
+	}
+	contentType := w.ContentType
+	if contentType == "" {
+		contentType = mime.TypeByExtension(path.Ext(w.Name))
+	}
+	if contentType == "" {
+		contentType = "text/plain; charset=utf-8"
+	}
+	if w.Content != "" {
+		return p, ContentHandler(contentType, w.Content)
+	}
+	file := w.File
+	return p, http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Content-Type", contentType)
+		http.ServeFile(rw, r, file)
+	})
+}
+
+// Error represents what to do when a particular HTTP status is encountered.
+// Despite the name, any status may be handled, e.g. to replace the body of
+// redirects or add headers to 204 responses.
+type Error struct {
+	Status  int     `yaml:"status"`
+	Target  string  `yaml:"target,omitempty"`  // file to serve (empty=pass through)
+	Path    string  `yaml:"path,omitempty"`    // only handle requests under this path
+	Headers Headers `yaml:"headers,omitempty"` // headers to set on the response
+
+	Language string `yaml:"language,omitempty"` // default variant when target is a directory
+}
+
+func (e *Error) sanitise() {
+	if e.Path == "" {
+		e.Path = "/"
+	}
+	if e.Language == "" {
+		e.Language = "en"
+	}
+	e.Language = strings.ToLower(e.Language)
+}
+
+func (e Error) check(label string, report *problems) (ok bool) {
+	ok = true
+	ok = e.Headers.check(label, report) && ok
+	if e.Status < 200 || e.Status > 599 {
+		report.Printf(label+": invalid status %d", e.Status)
+		ok = false
+	}
+	if e.Target == "" && len(e.Headers) == 0 {
+		report.Println(label + ": no target or headers specified")
+		ok = false
+	}
+	if !validLanguageTag(e.Language) {
+		report.Printf(label+": invalid language `%s`", e.Language)
+		ok = false
+	}
+	return
+}
+
+func (e Error) handler() http.Handler {
+	if e.Target == "" {
+		return nil
+	}
+	if fi, err := os.Stat(e.Target); err == nil && fi.IsDir() {
+		return LocalizedErrorHandler(e.Target, e.Status, e.Language)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Clear content-type as set by `http.Error` to force re-detection
+		w.Header().Del("Content-Type")
+
+		// Serve error page with a specific status code
+		http.ServeFile(w, r, e.Target)
+	})
+}
+
+// validGzipLevel returns true if the level is zero (default) or a level
+// accepted by compress/gzip.
+func validGzipLevel(level int) bool {
+	return level >= gzip.HuffmanOnly && level <= gzip.BestCompression
+}
+
+// parseDuration parses a duration string as accepted by time.ParseDuration,
+// additionally accepting a "d" suffix for whole days. An empty string is
+// treated as zero.
+func parseDuration(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(s)
+}
+
+// parseTime parses a time given as "epoch" (the Unix epoch, which net/http
+// treats as unknown and so omits from Last-Modified), a number of seconds
+// since the epoch, or an RFC 3339 timestamp. Environment variables
+// (e.g. "$SOURCE_DATE_EPOCH") are expanded first.
+func parseTime(s string) (time.Time, error) {
+	s = os.ExpandEnv(s)
+	if s == "epoch" {
+		return time.Unix(0, 0), nil
+	}
+	if secs, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(secs, 0), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// parseSize parses a size in bytes, optionally suffixed with K, M or G
+// (powers of 1024).
+func parseSize(s string) (int64, error) {
+	mult := int64(1)
+	switch {
+	case strings.HasSuffix(s, "K"):
+		mult = 1 << 10
+	case strings.HasSuffix(s, "M"):
+		mult = 1 << 20
+	case strings.HasSuffix(s, "G"):
+		mult = 1 << 30
+	}
+	if mult > 1 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	return n * mult, err
 }
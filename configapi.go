@@ -0,0 +1,244 @@
+package main
+
+import (
+	"gopkg.in/v1/yaml"
+
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// configAPI, if set, allows the configuration to be changed at runtime.
+var configAPI *ConfigAPI
+
+// runtimeKeys are the top-level configuration keys that may be changed while
+// the server is running. Changing the others requires a restart.
+var runtimeKeys = map[string]bool{
+	"serves":     true,
+	"redirects":  true,
+	"errors":     true,
+	"well_known": true,
+}
+
+// maxConfigChange limits the size of configuration changes.
+const maxConfigChange = 1 << 20
+
+// ConfigAPI serves the configuration on the admin listener, and applies
+// changes to its serves, redirects, errors and well-known files while the
+// server is running. Changes are checked as the whole configuration is at
+// startup, and are persisted to the configuration file if requested.
+type ConfigAPI struct {
+	mu    sync.Mutex
+	raw   interface{}              // the configuration, as parsed from YAML
+	file  string                   // where changes are persisted ("" if they can't be)
+	apply func(ServerConfig) error // puts a checked configuration into effect
+}
+
+// NewConfigAPI creates a ConfigAPI for the configuration as parsed from the
+// file, which changes are persisted to, or from several overlaid files, in
+// which case they can't be.
+func NewConfigAPI(raw interface{}, file string, apply func(ServerConfig) error) *ConfigAPI {
+	return &ConfigAPI{raw: raw, file: file, apply: apply}
+}
+
+// configAPI returns a ConfigAPI for the configuration, which applies changes
+// with the function. Changes are persisted if the configuration was read from
+// a single file.
+func (c ServerConfig) configAPI(apply func(ServerConfig) error) *ConfigAPI {
+	var raw interface{}
+	var err error
+	if len(configSources) > 0 {
+		raw, err = readRawConfig(configSources...)
+	} else {
+		// Configured on the command line
+		var data []byte
+		if data, err = yaml.Marshal(c); err == nil {
+			err = yaml.Unmarshal(data, &raw)
+		}
+	}
+	if err != nil {
+		log.Fatalln("Couldn't read config:", err)
+	}
+	file := ""
+	if len(configSources) == 1 {
+		file = configSources[0]
+	}
+	return NewConfigAPI(raw, file, apply)
+}
+
+// ServeHTTP serves the configuration as YAML at /config, which may be
+// PATCHed with a YAML overlay, merged as overlay files are. Entries of the
+// top-level lists are removed with DELETE /config/{list}, with the fields
+// identifying the entry as query parameters, e.g. /config/serves?path=/old.
+// Changes are written to the configuration file with `persist=1`.
+func (api *ConfigAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	persist := r.URL.Query().Get("persist") == "1"
+	list := strings.Trim(strings.TrimPrefix(r.URL.Path, "/config"), "/")
+	switch {
+	case list == "" && r.Method == http.MethodGet:
+		api.mu.Lock()
+		data, err := yaml.Marshal(api.raw)
+		api.mu.Unlock()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/yaml")
+		w.Write(data)
+	case list == "" && r.Method == http.MethodPatch:
+		data, err := ioutil.ReadAll(io.LimitReader(r.Body, maxConfigChange))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var overlay interface{}
+		if err := yaml.Unmarshal(data, &overlay); err != nil {
+			http.Error(w, "Invalid YAML: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		m, ok := overlay.(map[interface{}]interface{})
+		if !ok {
+			http.Error(w, "Expected a mapping of configuration keys", http.StatusBadRequest)
+			return
+		}
+		for k := range m {
+			if !runtimeKeys[fmt.Sprint(k)] {
+				http.Error(w, fmt.Sprintf("%s can't be changed while running", k),
+					http.StatusBadRequest)
+				return
+			}
+		}
+		api.change(w, persist, func(raw interface{}) (interface{}, error) {
+			return mergeConfig(raw, overlay, true), nil
+		})
+	case list != "" && r.Method == http.MethodDelete:
+		fields, keyed := mergeKeys[list]
+		if !runtimeKeys[list] || !keyed {
+			http.Error(w, fmt.Sprintf("%s can't be changed while running", list),
+				http.StatusBadRequest)
+			return
+		}
+		key := make(map[interface{}]interface{})
+		for _, f := range fields {
+			if v := r.URL.Query().Get(f); v != "" {
+				key[f] = v
+			}
+		}
+		api.change(w, persist, func(raw interface{}) (interface{}, error) {
+			return removeEntry(raw, list, mergeKey(key, fields))
+		})
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// change applies a change to a copy of the configuration, and if the result
+// passes the configuration check, puts it into effect, responding with the
+// new configuration.
+func (api *ConfigAPI) change(w http.ResponseWriter, persist bool, f func(raw interface{}) (interface{}, error)) {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	if persist && api.file == "" {
+		http.Error(w, "Changes can only be persisted to a single configuration file",
+			http.StatusConflict)
+		return
+	}
+
+	// Copy the configuration, as merging modifies it
+	data, err := yaml.Marshal(api.raw)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var raw interface{}
+	yaml.Unmarshal(data, &raw)
+	if raw, err = f(raw); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	c, err := decodeConfig(raw)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	c.sanitise()
+	if problems := checkConfig(c); len(problems) > 0 {
+		http.Error(w, strings.Join(problems, "\n"), http.StatusUnprocessableEntity)
+		return
+	}
+	if err := api.apply(c); err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	api.raw = raw
+	log.Println("Configuration changed")
+
+	data, _ = yaml.Marshal(raw)
+	if persist {
+		if err := api.persist(data); err != nil {
+			log.Printf("Couldn't persist configuration to %s: %s", api.file, err)
+			http.Error(w, "Changed, but couldn't persist: "+err.Error(),
+				http.StatusInternalServerError)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/yaml")
+	w.Write(data)
+}
+
+// persist replaces the configuration file's contents. Comments in the file
+// are lost.
+func (api *ConfigAPI) persist(data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(api.file), ".tmp-")
+	if err == nil {
+		_, err = tmp.Write(data)
+		tmp.Close()
+		if fi, serr := os.Stat(api.file); err == nil && serr == nil {
+			err = os.Chmod(tmp.Name(), fi.Mode())
+		}
+		if err == nil {
+			err = os.Rename(tmp.Name(), api.file)
+		}
+		if err != nil {
+			os.Remove(tmp.Name())
+		}
+	}
+	return err
+}
+
+// removeEntry removes the entries with the key from the top-level list.
+func removeEntry(raw interface{}, list, key string) (interface{}, error) {
+	m, _ := raw.(map[interface{}]interface{})
+	entries, _ := m[list].([]interface{})
+	var kept []interface{}
+	for _, e := range entries {
+		if mergeKey(e, mergeKeys[list]) != key {
+			kept = append(kept, e)
+		}
+	}
+	if len(kept) == len(entries) {
+		return nil, fmt.Errorf("no entry of %s matches `%s`", list, key)
+	}
+	if len(kept) == 0 {
+		delete(m, list)
+	} else {
+		m[list] = kept
+	}
+	return m, nil
+}
+
+// checkConfig checks the configuration, returning the problems found, which
+// are also logged.
+func checkConfig(c ServerConfig) []string {
+	problems := c.problems()
+	for _, p := range problems {
+		log.Println(p)
+	}
+	return problems
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"gopkg.in/v1/yaml"
+
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestConfigAPIChanges(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goserve-configapi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var raw interface{}
+	if err := yaml.Unmarshal([]byte("listeners:\n- addr: :8080\nserves:\n- path: /\n  target: "+dir+"\n"), &raw); err != nil {
+		t.Fatal(err)
+	}
+	var applied []ServerConfig
+	api := NewConfigAPI(raw, "", func(c ServerConfig) error {
+		applied = append(applied, c)
+		return nil
+	})
+	request := func(method, target, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, httptest.NewRequest(method, target, strings.NewReader(body)))
+		return w
+	}
+
+	// Problems are returned, and nothing is applied
+	w := request(http.MethodPatch, "/config", "serves:\n- path: /docs/\n")
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("invalid change: status %d, want %d", w.Code, http.StatusUnprocessableEntity)
+	}
+	if !strings.Contains(w.Body.String(), "no target path specified") {
+		t.Errorf("invalid change: problems %q don't mention the missing target", w.Body.String())
+	}
+	if len(applied) != 0 {
+		t.Errorf("invalid change was applied")
+	}
+
+	// Settings that need a restart can't be changed
+	if w := request(http.MethodPatch, "/config", "listeners:\n- addr: :9090\n"); w.Code != http.StatusBadRequest {
+		t.Errorf("listener change: status %d, want %d", w.Code, http.StatusBadRequest)
+	}
+
+	w = request(http.MethodPatch, "/config", "serves:\n- path: /docs/\n  target: "+dir+"\n")
+	if w.Code != http.StatusOK {
+		t.Fatalf("valid change: status %d: %s", w.Code, w.Body.String())
+	}
+	if len(applied) != 1 || len(applied[0].Serves) != 2 || applied[0].Serves[1].Path != "/docs/" {
+		t.Fatalf("valid change: applied %+v", applied)
+	}
+
+	if w := request(http.MethodDelete, "/config/serves?path=/old/", ""); w.Code != http.StatusNotFound {
+		t.Errorf("removing a missing serve: status %d, want %d", w.Code, http.StatusNotFound)
+	}
+	if w := request(http.MethodDelete, "/config/serves?path=/docs/", ""); w.Code != http.StatusOK {
+		t.Fatalf("removing a serve: status %d: %s", w.Code, w.Body.String())
+	}
+	if len(applied) != 2 || len(applied[1].Serves) != 1 {
+		t.Errorf("removing a serve: applied %+v", applied[len(applied)-1])
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"gopkg.in/v1/yaml"
+
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// configFiles is a flag naming configuration files, which may be repeated to
+// overlay one file on another.
+type configFiles []string
+
+func (c *configFiles) String() string {
+	return strings.Join(*c, ",")
+}
+
+func (c *configFiles) Set(v string) error {
+	*c = append(*c, v)
+	return nil
+}
+
+// mergeKeys are the fields identifying entries of the top-level lists, so
+// that an overlay's entries replace or extend the base's entries with the
+// same key. Entries of other lists aren't merged; an overlay replaces them.
+var mergeKeys = map[string][]string{
+	"listeners":  {"addr"},
+	"serves":     {"path"},
+	"redirects":  {"from"},
+	"errors":     {"status", "path"},
+	"realms":     {"name"},
+	"well_known": {"name"},
+}
+
+// mergeKey returns the key of a list entry. A missing path is "/", as it is
+// once sanitised.
+func mergeKey(entry interface{}, fields []string) string {
+	m, _ := entry.(map[interface{}]interface{})
+	var key []string
+	for _, f := range fields {
+		v, ok := m[f]
+		if !ok && f == "path" {
+			v = "/"
+		}
+		key = append(key, fmt.Sprint(v))
+	}
+	return strings.Join(key, " ")
+}
+
+// mergeConfig overlays one parsed configuration on another. Mappings are
+// merged recursively, so that an overlay need only give the values it
+// changes; the overlay's scalars and lists replace the base's, except that
+// entries of the top-level lists are merged by key.
+func mergeConfig(base, overlay interface{}, top bool) interface{} {
+	bm, ok1 := base.(map[interface{}]interface{})
+	om, ok2 := overlay.(map[interface{}]interface{})
+	if !ok1 || !ok2 {
+		return overlay
+	}
+	for k, ov := range om {
+		fields, keyed := mergeKeys[fmt.Sprint(k)]
+		bl, ok1 := bm[k].([]interface{})
+		ol, ok2 := ov.([]interface{})
+		if !top || !keyed || !ok1 || !ok2 {
+			if bv, ok := bm[k]; ok {
+				bm[k] = mergeConfig(bv, ov, false)
+			} else {
+				bm[k] = ov
+			}
+			continue
+		}
+		merged := append([]interface{}{}, bl...)
+		for _, oe := range ol {
+			key := mergeKey(oe, fields)
+			found := false
+			for i, be := range merged {
+				if mergeKey(be, fields) == key {
+					merged[i] = mergeConfig(be, oe, false)
+					found = true
+					break
+				}
+			}
+			if !found {
+				merged = append(merged, oe)
+			}
+		}
+		bm[k] = merged
+	}
+	return bm
+}
+
+// readRawConfig reads the configuration files, overlaying each on those
+// before it, without decoding the result.
+func readRawConfig(filenames ...string) (interface{}, error) {
+	var merged interface{}
+	for _, filename := range filenames {
+		data, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return nil, err
+		}
+		var v interface{}
+		if err := yaml.Unmarshal(data, &v); err != nil {
+			return nil, fmt.Errorf("%s: %s", filename, err)
+		}
+		if merged == nil {
+			merged = v
+		} else if v != nil {
+			merged = mergeConfig(merged, v, true)
+		}
+	}
+	return merged, nil
+}
+
+// configProfile is the name of the profile applied to configurations as
+// they're decoded, if any.
+var configProfile string
+
+// applyProfile returns a copy of the parsed configuration with the named
+// section of its `profiles` overlaid on it, as an overlay file would be, and
+// the profiles themselves removed. No profile leaves it as it is.
+func applyProfile(raw interface{}, name string) (interface{}, error) {
+	if name == "" {
+		return raw, nil
+	}
+	m, _ := raw.(map[interface{}]interface{})
+	profiles, _ := m["profiles"].(map[interface{}]interface{})
+	profile, ok := profiles[name]
+	if !ok {
+		return nil, fmt.Errorf("no profile `%s` in the configuration", name)
+	}
+	m = copyRaw(m).(map[interface{}]interface{})
+	delete(m, "profiles")
+	if profile == nil {
+		return m, nil
+	}
+	return mergeConfig(m, copyRaw(profile), true), nil
+}
+
+// defaultedLists are the top-level lists whose entries inherit the values
+// given for them in the `defaults` section.
+var defaultedLists = []string{"serves", "listeners"}
+
+// applyDefaults returns a copy of the parsed configuration with the values in
+// its `defaults` section merged into the entries of the lists they're given
+// for. Entries' own values take precedence, merging with mappings such as
+// headers, and a null value removes an inherited one. The fields identifying
+// entries can't be defaulted.
+func applyDefaults(raw interface{}) interface{} {
+	m, _ := raw.(map[interface{}]interface{})
+	defaults, _ := m["defaults"].(map[interface{}]interface{})
+	if len(defaults) == 0 {
+		return raw
+	}
+	m = copyRaw(m).(map[interface{}]interface{})
+	for _, list := range defaultedLists {
+		d, _ := defaults[list].(map[interface{}]interface{})
+		entries, _ := m[list].([]interface{})
+		if len(d) == 0 {
+			continue
+		}
+		for i, e := range entries {
+			base := copyRaw(d).(map[interface{}]interface{})
+			for _, f := range mergeKeys[list] {
+				delete(base, f)
+			}
+			entries[i] = dropNulls(mergeConfig(base, e, false))
+		}
+	}
+	return m
+}
+
+// copyRaw returns a deep copy of a parsed configuration, so that it can be
+// merged without changing the original.
+func copyRaw(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		c := make(map[interface{}]interface{}, len(v))
+		for k, e := range v {
+			c[k] = copyRaw(e)
+		}
+		return c
+	case []interface{}:
+		c := make([]interface{}, len(v))
+		for i, e := range v {
+			c[i] = copyRaw(e)
+		}
+		return c
+	}
+	return v
+}
+
+// dropNulls removes null values from mappings, recursively.
+func dropNulls(v interface{}) interface{} {
+	if m, ok := v.(map[interface{}]interface{}); ok {
+		for k, e := range m {
+			if e == nil {
+				delete(m, k)
+			} else {
+				m[k] = dropNulls(e)
+			}
+		}
+	}
+	return v
+}
+
+// decodeConfig decodes a configuration read by readRawConfig, applying the
+// selected profile and then its defaults.
+func decodeConfig(raw interface{}) (cfg ServerConfig, err error) {
+	if raw, err = applyProfile(raw, configProfile); err != nil {
+		return
+	}
+	data, err := yaml.Marshal(applyDefaults(raw))
+	if err != nil {
+		return
+	}
+	err = yaml.Unmarshal(data, &cfg)
+	return
+}
+
+// readServerConfig reads the configuration files, overlaying each on those
+// before it.
+func readServerConfig(filenames ...string) (cfg ServerConfig, err error) {
+	raw, err := readRawConfig(filenames...)
+	if err != nil {
+		return
+	}
+	return decodeConfig(raw)
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type connRequestsKey struct{}
+
+// countRequestsContext attaches a per-connection request counter to the
+// connection's base context, for use by MaxRequestsHandler.
+func countRequestsContext(ctx context.Context, c net.Conn) context.Context {
+	return context.WithValue(ctx, connRequestsKey{}, new(int64))
+}
+
+// MaxRequestsHandler asks the server to close the connection once it has
+// served the given number of requests, by setting `Connection: close` on
+// the final response. The server must be configured with
+// countRequestsContext as its ConnContext.
+func MaxRequestsHandler(h http.Handler, max int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if n, ok := r.Context().Value(connRequestsKey{}).(*int64); ok {
+			if atomic.AddInt64(n, 1) >= int64(max) {
+				w.Header().Set("Connection", "close")
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// idleLimiter closes idle connections once more than a fixed number of
+// them are being held open.
+type idleLimiter struct {
+	max  int
+	mu   sync.Mutex
+	idle map[net.Conn]struct{}
+}
+
+func newIdleLimiter(max int) *idleLimiter {
+	return &idleLimiter{
+		max:  max,
+		idle: make(map[net.Conn]struct{}),
+	}
+}
+
+// track is suitable for use as an http.Server ConnState hook.
+func (l *idleLimiter) track(c net.Conn, state http.ConnState) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if state != http.StateIdle {
+		delete(l.idle, c)
+		return
+	}
+	if len(l.idle) >= l.max {
+		// Already holding as many idle connections as allowed
+		c.Close()
+		return
+	}
+	l.idle[c] = struct{}{}
+}
+
+// TCPOptions describes socket options applied to accepted TCP connections.
+type TCPOptions struct {
+	Network     string        // tcp, tcp4 or tcp6
+	KeepAlive   time.Duration // keep-alive probe period (0=default, <0=disabled)
+	NoDelay     bool          // disable Nagle's algorithm
+	ReadBuffer  int           // socket receive buffer size (0=system default)
+	WriteBuffer int           // socket send buffer size (0=system default)
+}
+
+// ListenTCP listens on the address, applying the options to each accepted
+// connection.
+func ListenTCP(addr string, opts TCPOptions) (net.Listener, error) {
+	lc := net.ListenConfig{KeepAlive: opts.KeepAlive}
+	ln, err := lc.Listen(context.Background(), opts.Network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return tunedListener{ln, opts}, nil
+}
+
+// tunedListener applies socket options to accepted connections.
+type tunedListener struct {
+	net.Listener
+	opts TCPOptions
+}
+
+func (l tunedListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if tc, ok := c.(*net.TCPConn); ok {
+		tc.SetNoDelay(l.opts.NoDelay)
+		if l.opts.ReadBuffer > 0 {
+			tc.SetReadBuffer(l.opts.ReadBuffer)
+		}
+		if l.opts.WriteBuffer > 0 {
+			tc.SetWriteBuffer(l.opts.WriteBuffer)
+		}
+	}
+	return c, nil
+}
+
+// sniffTimeout limits the wait for a connection's first byte, so that idle
+// connections can't pile up before they're handed to the server.
+const sniffTimeout = 10 * time.Second
+
+// SniffTLSListener wraps a listener so that both TLS and plain HTTP can be
+// served on its port. The first byte of each connection tells them apart, as
+// TLS connections start with a handshake record (0x16), which is never the
+// start of an HTTP request; TLS connections are returned as *tls.Conns for
+// the server to handshake.
+func SniffTLSListener(ln net.Listener, config *tls.Config) net.Listener {
+	l := &sniffListener{
+		Listener: ln,
+		config:   config,
+		conns:    make(chan net.Conn),
+		errs:     make(chan error),
+		done:     make(chan struct{}),
+	}
+	go l.run()
+	return l
+}
+
+type sniffListener struct {
+	net.Listener
+	config *tls.Config
+	conns  chan net.Conn
+	errs   chan error
+	done   chan struct{}
+	once   sync.Once
+}
+
+// run accepts connections, sniffing each without holding up the next.
+func (l *sniffListener) run() {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			select {
+			case l.errs <- err:
+			case <-l.done:
+				return
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		go l.sniff(c)
+	}
+}
+
+// sniff reads the first byte of the connection, and passes it to Accept.
+func (l *sniffListener) sniff(c net.Conn) {
+	b := make([]byte, 1)
+	c.SetReadDeadline(time.Now().Add(sniffTimeout))
+	if _, err := io.ReadFull(c, b); err != nil {
+		c.Close()
+		return
+	}
+	c.SetReadDeadline(time.Time{})
+	var conn net.Conn = &peekedConn{c, b}
+	if b[0] == 0x16 {
+		conn = tls.Server(conn, l.config)
+	}
+	select {
+	case l.conns <- conn:
+	case <-l.done:
+		conn.Close()
+	}
+}
+
+func (l *sniffListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case err := <-l.errs:
+		return nil, err
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *sniffListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return l.Listener.Close()
+}
+
+// peekedConn is a connection whose first bytes have already been read.
+type peekedConn struct {
+	net.Conn
+	peeked []byte
+}
+
+func (c *peekedConn) Read(p []byte) (int, error) {
+	if len(c.peeked) > 0 {
+		n := copy(p, c.peeked)
+		c.peeked = c.peeked[n:]
+		return n, nil
+	}
+	return c.Conn.Read(p)
+}
+
+// HTTPSRedirectHandler redirects requests made without TLS to the same URL
+// with https, on the same host and port.
+func HTTPSRedirectHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS != nil {
+			h.ServeHTTP(w, r)
+			return
+		}
+		status := http.StatusMovedPermanently
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			status = http.StatusPermanentRedirect // keep the method and body
+		}
+		http.Redirect(w, r, "https://"+r.Host+r.URL.RequestURI(), status)
+	})
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"html/template"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const dashboardTopPaths = 10
+
+var dashboardTemplate = template.Must(template.New("dashboard").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<meta http-equiv="refresh" content="{{.Refresh}}">
+<title>goserve status</title>
+<style>
+body { font-family: -apple-system, "Segoe UI", Helvetica, Arial, sans-serif; margin: 2em; background: #fafafa; color: #333; }
+h1 { font-weight: 300; }
+h2 { font-size: 1.1em; margin-top: 2em; }
+table { border-collapse: collapse; }
+td, th { padding: .2em 1em .2em 0; text-align: left; }
+td.n { text-align: right; font-family: monospace; }
+.summary span { display: inline-block; margin-right: 2em; }
+.summary b { display: block; font-size: 1.75em; font-weight: 400; }
+@media (prefers-color-scheme: dark) { body { background: #1e1e1e; color: #ddd; } }
+</style>
+</head>
+<body>
+<h1>goserve</h1>
+<div class="summary">
+<span><b>{{printf "%.1f" .Rate}}</b>requests/s</span>
+<span><b>{{.Total}}</b>requests</span>
+<span><b>{{.CacheRatio}}</b>cache hits</span>
+<span><b>{{.Uptime}}</b>uptime</span>
+</div>
+<h2>Status codes</h2>
+<table>
+{{range .Statuses}}<tr><td>{{.Key}}</td><td class="n">{{.Count}}</td></tr>
+{{else}}<tr><td>No requests yet</td></tr>
+{{end}}</table>
+<h2>Top paths</h2>
+<table>
+{{range .TopPaths}}<tr><td>{{.Key}}</td><td class="n">{{.Count}}</td></tr>
+{{else}}<tr><td>No requests yet</td></tr>
+{{end}}</table>
+<h2>Recent errors</h2>
+<table>
+{{range .Errors}}<tr><td>{{.Time.Format "2006-01-02 15:04:05"}}</td><td>{{.Status}}</td><td>{{.Method}}</td><td>{{.Path}}</td></tr>
+{{else}}<tr><td>No errors</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// DashboardHandler serves a page summarising the stats, which the browser
+// reloads at the given interval.
+func DashboardHandler(s *Stats, refresh time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+
+		snap := s.snapshot(dashboardTopPaths)
+		ratio := "-"
+		if hits, misses, _ := fileCacheStats(); hits+misses > 0 {
+			ratio = strconv.FormatFloat(
+				float64(hits)*100/float64(hits+misses), 'f', 1, 64) + "%"
+		}
+
+		var buf bytes.Buffer
+		err := dashboardTemplate.Execute(&buf, struct {
+			StatsSnapshot
+			Refresh    int
+			CacheRatio string
+		}{snap, int(refresh.Seconds()), ratio})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		h := w.Header()
+		h.Set("Content-Type", "text/html; charset=utf-8")
+		h.Set("Content-Length", strconv.Itoa(buf.Len()))
+		h.Set("Cache-Control", "no-store")
+		w.Write(buf.Bytes())
+	})
+}
+
+// AdminTokenHandler only passes requests to h that give the token in their
+// Authorization header or `token` query parameter, refusing others with
+// "401 Unauthorized".
+func AdminTokenHandler(h http.Handler, token string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(requestToken(r)), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="goserve admin"`)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// digestAlgorithms are the hash algorithms digests may be requested with, by
+// their names in the HTTP digest fields registry.
+var digestAlgorithms = map[string]func() hash.Hash{
+	"sha-256": sha256.New,
+	"sha-512": sha512.New,
+}
+
+// ETag modes.
+const (
+	ETagNone    = ""        // no ETags
+	ETagContent = "content" // strong ETags from the SHA-256 digest of files' content
+)
+
+// maxDigests limits the number of files whose digests are remembered.
+const maxDigests = 10000
+
+// DigestCache computes the digests of files on demand, and remembers them
+// until the files are modified.
+type DigestCache struct {
+	fs      http.FileSystem
+	mu      sync.Mutex
+	entries map[string]*digestEntry
+}
+
+type digestEntry struct {
+	modTime time.Time
+	size    int64
+	sums    map[string][]byte // by algorithm
+}
+
+// NewDigestCache creates a DigestCache for files in the file system.
+func NewDigestCache(fs http.FileSystem) *DigestCache {
+	return &DigestCache{fs: fs, entries: make(map[string]*digestEntry)}
+}
+
+// cached returns the digest of the file, if it's been computed since the
+// file was last modified.
+func (c *DigestCache) cached(name string, fi os.FileInfo, alg string) []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e := c.entries[name]
+	if e == nil || !e.modTime.Equal(fi.ModTime()) || e.size != fi.Size() {
+		return nil
+	}
+	return e.sums[alg]
+}
+
+// sum returns the digest of the named file, computing it if necessary, along
+// with the file's info.
+func (c *DigestCache) sum(r *http.Request, name, alg string) ([]byte, os.FileInfo, error) {
+	f, err := requestFileSystem(c.fs, r).Open(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+	if fi.IsDir() {
+		return nil, fi, os.ErrNotExist
+	}
+	if sum := c.cached(name, fi, alg); sum != nil {
+		return sum, fi, nil
+	}
+
+	hash := digestAlgorithms[alg]()
+	if _, err := io.Copy(hash, contextReader{r.Context(), f}); err != nil {
+		return nil, fi, err
+	}
+	sum := hash.Sum(nil)
+
+	c.mu.Lock()
+	e := c.entries[name]
+	if e == nil || !e.modTime.Equal(fi.ModTime()) || e.size != fi.Size() {
+		if e == nil && len(c.entries) >= maxDigests {
+			for k := range c.entries {
+				delete(c.entries, k)
+				break
+			}
+		}
+		e = &digestEntry{modTime: fi.ModTime(), size: fi.Size(), sums: make(map[string][]byte)}
+		c.entries[name] = e
+	}
+	e.sums[alg] = sum
+	c.mu.Unlock()
+	return sum, fi, nil
+}
+
+// wantedDigest returns the most preferred supported algorithm of those
+// requested, or "" if none are. The RFC 9530 Want-Repr-Digest field gives
+// preferences as weights from 1 to 10, e.g. `sha-512=3, sha-256=10`; the
+// older RFC 3230 Want-Digest field gives them as q-values, e.g.
+// `SHA-256;q=0.5, SHA-512`. A preference of 0 rules an algorithm out.
+func wantedDigest(want string, legacy bool) string {
+	best, bestPref := "", 0.0
+	for _, item := range strings.Split(want, ",") {
+		item = strings.TrimSpace(item)
+		sep := "="
+		if legacy {
+			sep = ";"
+		}
+		pref := 1.0
+		if i := strings.Index(item, sep); i >= 0 {
+			param := strings.TrimSpace(item[i+1:])
+			item = strings.TrimSpace(item[:i])
+			if legacy {
+				param = strings.TrimPrefix(strings.TrimSpace(param), "q=")
+			}
+			var err error
+			if pref, err = strconv.ParseFloat(param, 64); err != nil {
+				continue
+			}
+		}
+		alg := strings.ToLower(item)
+		if _, ok := digestAlgorithms[alg]; ok && pref > bestPref {
+			best, bestPref = alg, pref
+		}
+	}
+	return best
+}
+
+// checksumAlgorithm returns the algorithm named in a `checksum` query, which
+// may leave out the hyphen, as in `sha256`.
+func checksumAlgorithm(name string) string {
+	alg := strings.ToLower(name)
+	if strings.HasPrefix(alg, "sha") && !strings.HasPrefix(alg, "sha-") {
+		alg = "sha-" + alg[3:]
+	}
+	if _, ok := digestAlgorithms[alg]; !ok {
+		return ""
+	}
+	return alg
+}
+
+// DigestHandler adds the digest of files to successful responses for
+// requests asking for it with Want-Repr-Digest, as Repr-Digest, or with
+// Want-Digest, as Digest. Responses with digests aren't compressed on the
+// fly, so that the digest is of the content as sent.
+func DigestHandler(h http.Handler, c *DigestCache) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		field, alg := "Repr-Digest", wantedDigest(r.Header.Get("Want-Repr-Digest"), false)
+		if alg == "" {
+			field, alg = "Digest", wantedDigest(r.Header.Get("Want-Digest"), true)
+		}
+		if alg == "" || (r.Method != http.MethodGet && r.Method != http.MethodHead) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		sum, _, err := c.sum(r, path.Clean("/"+r.URL.Path), alg)
+		if err != nil {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if o, ok := r.Context().Value(gzipOptionsKey{}).(*GzipOptions); ok {
+			o.Enabled = false
+		}
+		value := base64.StdEncoding.EncodeToString(sum)
+		if field == "Repr-Digest" {
+			value = alg + "=:" + value + ":"
+		} else {
+			value = strings.ToUpper(alg) + "=" + value
+		}
+		h.ServeHTTP(&headerHookResponseWriter{
+			ResponseWriter: w,
+			hook: func(status int) {
+				if status == http.StatusOK || status == http.StatusPartialContent {
+					w.Header().Set(field, value)
+				}
+			},
+		}, r)
+	})
+}
+
+// ChecksumHandler responds to requests for files with a `checksum` query,
+// e.g. `?checksum=sha256`, with the file's checksum in the format of
+// sha256sum's output, so downloads can be checked with `sha256sum -c`.
+func ChecksumHandler(h http.Handler, c *DigestCache) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if !q.Has("checksum") || (r.Method != http.MethodGet && r.Method != http.MethodHead) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		alg := checksumAlgorithm(q.Get("checksum"))
+		if alg == "" {
+			http.Error(w, "Unsupported checksum algorithm", http.StatusBadRequest)
+			return
+		}
+		name := path.Clean("/" + r.URL.Path)
+		sum, fi, err := c.sum(r, name, alg)
+		if err != nil {
+			// Directories and missing files are left to the handler
+			h.ServeHTTP(w, r)
+			return
+		}
+		var buf bytes.Buffer
+		fmt.Fprintf(&buf, "%s  %s\n", hex.EncodeToString(sum), path.Base(name))
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		http.ServeContent(w, r, "", fi.ModTime(), bytes.NewReader(buf.Bytes()))
+	})
+}
+
+// ETagHandler sends a strong ETag computed from the SHA-256 digest of files'
+// content with successful responses for them, so that servers with the same
+// files agree on ETags however the files were copied to them. net/http then
+// answers conditional requests against it. Digests are computed when files
+// are first requested, and again once they're modified.
+func ETagHandler(h http.Handler, c *DigestCache) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			h.ServeHTTP(w, r)
+			return
+		}
+		name := path.Clean("/" + r.URL.Path)
+		if strings.HasSuffix(r.URL.Path, "/") || name == "/" {
+			// Served by the directory's index, if it has one
+			name = path.Join(name, "index.html")
+		}
+		sum, _, err := c.sum(r, name, "sha-256")
+		if err != nil {
+			h.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("ETag", `"`+base64.RawURLEncoding.EncodeToString(sum)+`"`)
+		h.ServeHTTP(&headerHookResponseWriter{
+			ResponseWriter: w,
+			hook: func(status int) {
+				// Not for redirects to the canonical path, or errors
+				if status != http.StatusOK && status != http.StatusPartialContent &&
+					status != http.StatusNotModified {
+					w.Header().Del("ETag")
+				}
+			},
+		}, r)
+	})
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DiscoveryOptions describes how upstreams are found from the hosts of the
+// configured URLs.
+type DiscoveryOptions struct {
+	SRV      bool          // hosts are the names of SRV records, rather than A or AAAA records
+	Interval time.Duration // least time before the names are resolved again
+}
+
+// discoveryTimeout limits the time taken to resolve the names of upstreams.
+const discoveryTimeout = 10 * time.Second
+
+// ttlTimeout limits the time taken to ask a nameserver for the TTL of a
+// name's records.
+const ttlTimeout = 2 * time.Second
+
+// DNS record types whose TTLs are looked up.
+const (
+	dnsTypeA    = 1
+	dnsTypeAAAA = 28
+	dnsTypeSRV  = 33
+)
+
+// resolveTargets returns an upstream for each address the host of each
+// origin URL resolves to. With srv, hosts are the names of SRV records, and
+// an upstream is returned for each host and port of the records with the
+// highest priority.
+func resolveTargets(ctx context.Context, origins []*url.URL, srv bool) ([]upstreamTarget, error) {
+	var targets []upstreamTarget
+	for _, origin := range origins {
+		var hosts []string
+		if srv {
+			_, records, err := net.DefaultResolver.LookupSRV(ctx, "", "", origin.Hostname())
+			if err != nil {
+				return nil, err
+			}
+			for _, rec := range records {
+				if rec.Priority != records[0].Priority {
+					break // sorted by priority
+				}
+				hosts = append(hosts, net.JoinHostPort(
+					strings.TrimSuffix(rec.Target, "."), strconv.Itoa(int(rec.Port))))
+			}
+		} else {
+			addrs, err := net.DefaultResolver.LookupHost(ctx, origin.Hostname())
+			if err != nil {
+				return nil, err
+			}
+			port := origin.Port()
+			if port == "" {
+				port = "80"
+				if origin.Scheme == "https" {
+					port = "443"
+				}
+			}
+			for _, addr := range addrs {
+				hosts = append(hosts, net.JoinHostPort(addr, port))
+			}
+		}
+		if len(hosts) == 0 {
+			return nil, fmt.Errorf("%s has no addresses", origin.Hostname())
+		}
+		for _, host := range hosts {
+			u := *origin
+			u.Host = host
+			targets = append(targets, upstreamTarget{&u, origin})
+		}
+	}
+	return targets, nil
+}
+
+// discover resolves the origins' hosts to find the pool's upstreams, and
+// resolves them again in the background as their records expire, but no
+// more often than every interval, until the pool's done channel is closed.
+// While names can't be resolved, the upstreams last found are kept.
+func (p *upstreamPool) discover(origins []*url.URL, opts DiscoveryOptions) {
+	var names []string
+	for _, origin := range origins {
+		names = append(names, origin.Hostname())
+	}
+	label := strings.Join(names, ", ")
+	resolve := func() (next time.Duration) {
+		ctx, cancel := context.WithTimeout(context.Background(), discoveryTimeout)
+		defer cancel()
+		targets, err := resolveTargets(ctx, origins, opts.SRV)
+		if err != nil {
+			log.Printf("Couldn't discover upstreams of %s: %s", label, err)
+			return opts.Interval
+		}
+		if p.set(targets) {
+			var hosts []string
+			for _, t := range targets {
+				hosts = append(hosts, t.url.Host)
+			}
+			log.Printf("Upstreams of %s: %s", label, strings.Join(hosts, ", "))
+		}
+		if ttl := originsTTL(origins, opts.SRV); ttl > opts.Interval {
+			return ttl
+		}
+		return opts.Interval
+	}
+	next := resolve()
+	go func() {
+		t := time.NewTimer(next)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				t.Reset(resolve())
+			case <-p.done:
+				return
+			}
+		}
+	}()
+}
+
+// originsTTL returns the lowest TTL of the records the origins' hosts were
+// resolved with, or 0 if it isn't known.
+func originsTTL(origins []*url.URL, srv bool) time.Duration {
+	types := []uint16{dnsTypeA, dnsTypeAAAA}
+	if srv {
+		types = []uint16{dnsTypeSRV}
+	}
+	var min time.Duration
+	for _, origin := range origins {
+		if net.ParseIP(origin.Hostname()) != nil {
+			continue
+		}
+		for _, qtype := range types {
+			ttl, err := lookupTTL(origin.Hostname(), qtype)
+			if err == nil && (min == 0 || ttl < min) {
+				min = ttl
+			}
+		}
+	}
+	return min
+}
+
+// lookupTTL returns the lowest TTL of the answers to a query for the name's
+// records of the type. Go's resolver doesn't expose TTLs, so the first
+// nameserver in /etc/resolv.conf is asked directly.
+func lookupTTL(name string, qtype uint16) (time.Duration, error) {
+	server, err := nameserver("/etc/resolv.conf")
+	if err != nil {
+		return 0, err
+	}
+	conn, err := net.DialTimeout("udp", server, ttlTimeout)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(ttlTimeout))
+
+	id := uint16(time.Now().UnixNano())
+	query, err := dnsQuery(id, name, qtype)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := conn.Write(query); err != nil {
+		return 0, err
+	}
+	resp := make([]byte, 4096)
+	n, err := conn.Read(resp)
+	if err != nil {
+		return 0, err
+	}
+	return dnsAnswerTTL(resp[:n], id)
+}
+
+// nameserver returns the address of the first nameserver in the resolv.conf
+// file.
+func nameserver(file string) (string, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			return net.JoinHostPort(fields[1], "53"), nil
+		}
+	}
+	return "", errors.New("no nameserver")
+}
+
+// dnsQuery returns a recursive DNS query for the name's records of the type.
+func dnsQuery(id uint16, name string, qtype uint16) ([]byte, error) {
+	b := []byte{byte(id >> 8), byte(id), 1, 0, 0, 1, 0, 0, 0, 0, 0, 0}
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return nil, fmt.Errorf("invalid name %s", name)
+		}
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0, byte(qtype>>8), byte(qtype), 0, 1), nil
+}
+
+// dnsAnswerTTL returns the lowest TTL of the answers in the DNS response to
+// the query with the ID, including those of any CNAME records followed.
+func dnsAnswerTTL(b []byte, id uint16) (time.Duration, error) {
+	if len(b) < 12 || binary.BigEndian.Uint16(b) != id {
+		return 0, errors.New("invalid DNS response")
+	}
+	if rcode := b[3] & 0xf; rcode != 0 {
+		return 0, fmt.Errorf("DNS response code %d", rcode)
+	}
+	questions := int(binary.BigEndian.Uint16(b[4:]))
+	answers := int(binary.BigEndian.Uint16(b[6:]))
+	i := 12
+	for ; questions > 0; questions-- {
+		if i = skipDNSName(b, i); i < 0 || i+4 > len(b) {
+			return 0, errors.New("invalid DNS response")
+		}
+		i += 4 // type and class
+	}
+	var min uint32
+	found := false
+	for ; answers > 0; answers-- {
+		if i = skipDNSName(b, i); i < 0 || i+10 > len(b) {
+			return 0, errors.New("invalid DNS response")
+		}
+		ttl := binary.BigEndian.Uint32(b[i+4:])
+		if !found || ttl < min {
+			min, found = ttl, true
+		}
+		i += 10 + int(binary.BigEndian.Uint16(b[i+8:]))
+	}
+	if !found {
+		return 0, errors.New("no DNS answers")
+	}
+	return time.Duration(min) * time.Second, nil
+}
+
+// skipDNSName returns the offset following the (possibly compressed) name
+// starting at the offset in the DNS message, or -1 if it's invalid.
+func skipDNSName(b []byte, i int) int {
+	for i < len(b) {
+		l := int(b[i])
+		switch {
+		case l == 0:
+			return i + 1
+		case l&0xc0 == 0xc0:
+			if i+2 > len(b) {
+				return -1
+			}
+			return i + 2
+		case l&0xc0 != 0:
+			return -1
+		}
+		i += 1 + l
+	}
+	return -1
+}
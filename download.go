@@ -0,0 +1,75 @@
+package main
+
+import (
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// dangerousPatterns are glob patterns of the names of files that a browser
+// would render or run in the site's origin, or that are commonly used to
+// deliver malware, and so are served from untrusted serves as attachments.
+var dangerousPatterns = []string{
+	"*.html", "*.htm", "*.xhtml", "*.shtml", "*.xml",
+	"*.svg", "*.svgz",
+	"*.js", "*.mjs", "*.swf",
+	"*.exe", "*.msi", "*.com", "*.scr",
+	"*.bat", "*.cmd", "*.ps1", "*.vbs", "*.sh", "*.jar",
+}
+
+// dangerousTypes returns the media types of the extensions of the glob
+// patterns, such as "text/html" for "*.html".
+func dangerousTypes(patterns []string) map[string]bool {
+	types := make(map[string]bool)
+	for _, pattern := range patterns {
+		ext := path.Ext(pattern)
+		if !strings.HasPrefix(pattern, "*.") || strings.ContainsAny(ext, "*?[\\") {
+			continue
+		}
+		if mt, _, err := mime.ParseMediaType(mime.TypeByExtension(strings.ToLower(ext))); err == nil {
+			types[mt] = true
+		}
+	}
+	return types
+}
+
+// ForceDownloadHandler makes successful responses for files whose names match
+// any of the glob patterns, ignoring case, attachments, which browsers save
+// rather than display, and stops browsers sniffing their content type. So
+// that files are caught however they're requested, as a directory's index
+// or through an alias, responses with the media type of any of the
+// patterns' extensions are made attachments too. This keeps files uploaded
+// by users, such as HTML or SVG pages with scripts, from running in the
+// site's origin.
+func ForceDownloadHandler(h http.Handler, patterns []string) http.Handler {
+	lower := make([]string, len(patterns))
+	for i, pattern := range patterns {
+		lower[i] = strings.ToLower(pattern)
+	}
+	types := dangerousTypes(lower)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.ServeHTTP(&headerHookResponseWriter{
+			ResponseWriter: w,
+			hook: func(status int) {
+				if status != http.StatusOK && status != http.StatusPartialContent {
+					return
+				}
+				mt, _, _ := mime.ParseMediaType(w.Header().Get("Content-Type"))
+				if types[mt] || matchAny(lower, strings.ToLower(r.URL.Path)) {
+					w.Header().Set("Content-Disposition", "attachment")
+					w.Header().Set("X-Content-Type-Options", "nosniff")
+				}
+			},
+		}, r)
+	})
+}
+
+// NoSniffHandler stops browsers guessing the content type of responses,
+// which might otherwise treat a user's file as a page or script.
+func NoSniffHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// downloadTestHandler serves a body of the given type for every request, as
+// an untrusted serve would.
+func downloadTestHandler(contentType string) http.Handler {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", contentType)
+		w.Write([]byte("<script>alert(1)</script>"))
+	})
+	return NoSniffHandler(ForceDownloadHandler(h, dangerousPatterns))
+}
+
+func TestForceDownloadHandler(t *testing.T) {
+	for _, test := range []struct {
+		path, contentType string
+		attachment        bool
+	}{
+		{"/upload.html", "text/html; charset=utf-8", true},
+		{"/UPLOAD.HTML", "text/html; charset=utf-8", true},
+		{"/Image.SVG", "image/svg+xml", true},
+		{"/uploads/", "text/html; charset=utf-8", true}, // a directory's index.html
+		{"/upload.txt", "text/html; charset=utf-8", true},
+		{"/photo.jpg", "image/jpeg", false},
+		{"/notes.txt", "text/plain; charset=utf-8", false},
+	} {
+		w := httptest.NewRecorder()
+		downloadTestHandler(test.contentType).ServeHTTP(w,
+			httptest.NewRequest(http.MethodGet, test.path, nil))
+
+		if got := w.Header().Get("Content-Disposition") == "attachment"; got != test.attachment {
+			t.Errorf("%s: attachment %t, want %t", test.path, got, test.attachment)
+		}
+		if nosniff := w.Header().Get("X-Content-Type-Options"); nosniff != "nosniff" {
+			t.Errorf("%s: X-Content-Type-Options %q, want nosniff", test.path, nosniff)
+		}
+	}
+}
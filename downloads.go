@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxDownloadPaths limits the number of distinct paths counted.
+const maxDownloadPaths = 100000
+
+// downloads, if set, counts successful downloads of files.
+var downloads *DownloadCounter
+
+// DownloadCount is the number of times a file has been downloaded, and the
+// bytes sent for it, including partial downloads.
+type DownloadCount struct {
+	Hits  uint64 `json:"hits"`
+	Bytes uint64 `json:"bytes"`
+}
+
+// DownloadCounter counts downloads per path, optionally persisting the
+// counts to a file.
+type DownloadCounter struct {
+	file    string
+	include []string // glob patterns of paths to count (empty=all)
+	badges  string   // path badges are served under, which isn't counted
+
+	mu     sync.Mutex
+	counts map[string]*DownloadCount
+	dirty  bool
+}
+
+// NewDownloadCounter creates a counter for the paths matching the include
+// patterns, loading the counts already saved to the file, if given.
+func NewDownloadCounter(file string, include []string) (*DownloadCounter, error) {
+	c := &DownloadCounter{
+		file:    file,
+		include: include,
+		counts:  make(map[string]*DownloadCount),
+	}
+	if file == "" {
+		return c, nil
+	}
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return c, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &c.counts); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// record counts a response. Only complete responses to GET requests count as
+// downloads, though bytes sent in partial responses are counted too.
+func (c *DownloadCounter) record(r *http.Request, status, size int) {
+	if r.Method != http.MethodGet ||
+		(status != http.StatusOK && status != http.StatusPartialContent) {
+		return
+	}
+	p := r.URL.Path
+	if c.badges != "" && strings.HasPrefix(p, c.badges) {
+		return
+	}
+	if len(c.include) > 0 && !matchAny(c.include, p) {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := c.counts[p]
+	if n == nil {
+		if len(c.counts) >= maxDownloadPaths {
+			return
+		}
+		n = &DownloadCount{}
+		c.counts[p] = n
+	}
+	if status == http.StatusOK {
+		n.Hits++
+	}
+	n.Bytes += uint64(size)
+	c.dirty = true
+}
+
+// count returns the count for a path.
+func (c *DownloadCounter) count(p string) DownloadCount {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if n := c.counts[p]; n != nil {
+		return *n
+	}
+	return DownloadCount{}
+}
+
+// saveEvery writes the counts to the file at the given interval, if they've
+// changed, until the function returned is called.
+func (c *DownloadCounter) saveEvery(interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				c.save()
+			case <-done:
+				return
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(done) })
+	}
+}
+
+// save writes the counts to the file, atomically, if they've changed.
+func (c *DownloadCounter) save() {
+	if c == nil || c.file == "" {
+		return
+	}
+	c.mu.Lock()
+	if !c.dirty {
+		c.mu.Unlock()
+		return
+	}
+	data, err := json.Marshal(c.counts)
+	c.dirty = false
+	c.mu.Unlock()
+	if err != nil {
+		log.Println("Couldn't encode download counts:", err)
+		return
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(c.file), ".tmp-")
+	if err == nil {
+		_, err = tmp.Write(data)
+		tmp.Close()
+		if err == nil {
+			err = os.Rename(tmp.Name(), c.file)
+		}
+		if err != nil {
+			os.Remove(tmp.Name())
+		}
+	}
+	if err != nil {
+		log.Printf("Couldn't save download counts to %s: %s", c.file, err)
+	}
+}
+
+type downloadStat struct {
+	Path string `json:"path"`
+	DownloadCount
+}
+
+// ServeHTTP responds with the counts as JSON, most downloaded first. A
+// `path` query parameter limits them to that path, or those beneath it if
+// it ends with a slash.
+func (c *DownloadCounter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	prefix := r.URL.Query().Get("path")
+	list := []downloadStat{}
+	c.mu.Lock()
+	for p, n := range c.counts {
+		if prefix == "" || p == prefix ||
+			(strings.HasSuffix(prefix, "/") && strings.HasPrefix(p, prefix)) {
+			list = append(list, downloadStat{p, *n})
+		}
+	}
+	c.mu.Unlock()
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Hits != list[j].Hits {
+			return list[i].Hits > list[j].Hits
+		}
+		return list[i].Path < list[j].Path
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	json.NewEncoder(w).Encode(list)
+}
+
+// shortCount formats a count compactly, e.g. 1234 as "1.2k".
+func shortCount(n uint64) string {
+	switch {
+	case n >= 1e9:
+		return fmt.Sprintf("%.1fG", float64(n)/1e9)
+	case n >= 1e6:
+		return fmt.Sprintf("%.1fM", float64(n)/1e6)
+	case n >= 1e3:
+		return fmt.Sprintf("%.1fk", float64(n)/1e3)
+	}
+	return fmt.Sprint(n)
+}
+
+const badgeSVG = `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="20" role="img" aria-label="downloads: %s">
+<rect width="70" height="20" fill="#555"/><rect x="70" width="%d" height="20" fill="#4c1"/>
+<g fill="#fff" font-family="Verdana,DejaVu Sans,sans-serif" font-size="11" text-anchor="middle">
+<text x="35" y="14">downloads</text><text x="%d" y="14">%s</text>
+</g>
+</svg>
+`
+
+// BadgeHandler serves SVG badges showing the number of downloads of the
+// file at the requested path, for embedding in pages such as READMEs.
+// Requests to the prefix aren't themselves counted as downloads, and must
+// have had it stripped from their path.
+func BadgeHandler(c *DownloadCounter, prefix string) http.Handler {
+	c.badges = prefix
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		count := html.EscapeString(shortCount(c.count(path.Clean("/" + r.URL.Path)).Hits))
+		width := 10 + 7*len(count)
+		w.Header().Set("Content-Type", "image/svg+xml")
+		w.Header().Set("Cache-Control", "max-age=300")
+		fmt.Fprintf(w, badgeSVG, 70+width, count, width, 70+width/2, count)
+	})
+}
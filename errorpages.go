@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Built-in error page themes.
+const (
+	ThemePlain = "plain" // bare text, as produced by http.Error
+	ThemeLight = "light"
+	ThemeDark  = "dark"
+	ThemeAuto  = "auto" // light or dark according to the client's preference
+)
+
+// validErrorTheme returns true if the theme is one of the built-in themes.
+func validErrorTheme(theme string) bool {
+	switch theme {
+	case ThemePlain, ThemeLight, ThemeDark, ThemeAuto:
+		return true
+	}
+	return false
+}
+
+var errorPageTemplate = template.Must(template.New("error").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Status}} {{.Text}}</title>
+<style>
+body { font-family: -apple-system, "Segoe UI", Helvetica, Arial, sans-serif; margin: 0; display: flex; align-items: center; justify-content: center; min-height: 100vh; }
+main { text-align: center; padding: 2em; }
+h1 { font-size: 5em; margin: 0; font-weight: 300; }
+p { font-size: 1.25em; margin: .5em 0 2em; }
+small { font-family: monospace; opacity: .6; }
+{{if eq .Theme "dark"}}{{template "dark"}}{{else if eq .Theme "auto"}}{{template "light"}}
+@media (prefers-color-scheme: dark) { {{template "dark"}} }{{else}}{{template "light"}}{{end}}
+</style>
+</head>
+<body>
+<main>
+<h1>{{.Status}}</h1>
+<p>{{.Text}}</p>
+{{if .RequestID}}<small>Request ID: {{.RequestID}}</small>{{end}}
+</main>
+</body>
+</html>
+{{define "light"}}body { background: #fafafa; color: #333; }{{end}}
+{{define "dark"}}body { background: #1e1e1e; color: #ddd; }{{end}}
+`))
+
+// writeErrorPage writes a built-in error page for the status in the given
+// theme.
+func writeErrorPage(w http.ResponseWriter, r *http.Request, status int, theme string) {
+	if theme == ThemePlain || theme == "" {
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+
+	var buf bytes.Buffer
+	err := errorPageTemplate.Execute(&buf, struct {
+		Status    int
+		Text      string
+		RequestID string
+		Theme     string
+	}{status, http.StatusText(status), requestID(r), theme})
+	if err != nil {
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+
+	h := w.Header()
+	h.Set("Content-Type", "text/html; charset=utf-8")
+	h.Set("Content-Length", strconv.Itoa(buf.Len()))
+	h.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	w.Write(buf.Bytes())
+}
+
+// jsonError is the body of errors returned to API clients.
+type jsonError struct {
+	Status    int    `json:"status"`
+	Message   string `json:"message"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// writeJSONError writes an error for the status as a JSON object, for clients
+// that would choke on an HTML page.
+func writeJSONError(w http.ResponseWriter, r *http.Request, status int) {
+	b, _ := json.Marshal(jsonError{status, http.StatusText(status), requestID(r)})
+	b = append(b, '\n')
+
+	h := w.Header()
+	h.Set("Content-Type", "application/json; charset=utf-8")
+	h.Set("Content-Length", strconv.Itoa(len(b)))
+	h.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	w.Write(b)
+}
+
+// prefersJSON returns true if the Accept header ranks application/json above
+// HTML. Wildcards count towards both, so "*/*" prefers neither.
+func prefersJSON(accept string) bool {
+	var qJSON, qHTML float64
+	for _, part := range strings.Split(accept, ",") {
+		fields := strings.Split(part, ";")
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if f, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = f
+				}
+			}
+		}
+		mt := strings.ToLower(strings.TrimSpace(fields[0]))
+		if (mt == "application/json" || mt == "application/*" || mt == "*/*") && q > qJSON {
+			qJSON = q
+		}
+		if (mt == "text/html" || mt == "text/*" || mt == "*/*") && q > qHTML {
+			qHTML = q
+		}
+	}
+	return qJSON > qHTML
+}
+
+// matchPathPrefix returns true if any of the glob patterns matches the
+// slash-separated path or one of its parent directories, so that "/api"
+// covers everything below it.
+func matchPathPrefix(patterns []string, p string) bool {
+	for {
+		for _, pattern := range patterns {
+			if m, _ := path.Match(pattern, p); m {
+				return true
+			}
+		}
+		if p == "/" || p == "" {
+			return false
+		}
+		p = path.Dir(strings.TrimSuffix(p, "/"))
+	}
+}
+
+// LocalizedErrorHandler serves the variant of the page for the status in dir
+// in the language the client prefers, going by files named like
+// "404.de.html". If there's no variant in any of the client's languages, the
+// one in the default language is served, or failing that "404.html".
+func LocalizedErrorHandler(dir string, status int, def string) http.Handler {
+	base := filepath.Join(dir, strconv.Itoa(status))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Clear content-type as set by `http.Error` to force re-detection
+		w.Header().Del("Content-Type")
+		w.Header().Add("Vary", "Accept-Language")
+
+		langs := append(acceptedLanguages(r.Header.Get("Accept-Language")), def)
+		for _, lang := range langs {
+			name := base + "." + lang + ".html"
+			if fi, err := os.Stat(name); err == nil && !fi.IsDir() {
+				w.Header().Set("Content-Language", lang)
+				http.ServeFile(w, r, name)
+				return
+			}
+		}
+		http.ServeFile(w, r, base+".html")
+	})
+}
+
+// acceptedLanguages returns the lower-cased language tags of an
+// Accept-Language header, most preferred first. As in RFC 4647 lookup, each
+// regional tag is followed by its language, so "de-AT" falls back to "de".
+// Wildcards and malformed tags are ignored.
+func acceptedLanguages(header string) []string {
+	type lang struct {
+		tag string
+		q   float64
+	}
+	var langs []lang
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(part, ";")
+		tag := strings.ToLower(strings.TrimSpace(fields[0]))
+		if !validLanguageTag(tag) {
+			continue
+		}
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if f, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = f
+				}
+			}
+		}
+		if q > 0 {
+			langs = append(langs, lang{tag, q})
+		}
+	}
+	sort.SliceStable(langs, func(i, j int) bool { return langs[i].q > langs[j].q })
+
+	var tags []string
+	seen := make(map[string]bool)
+	for _, l := range langs {
+		for tag := l.tag; tag != ""; {
+			if !seen[tag] {
+				seen[tag] = true
+				tags = append(tags, tag)
+			}
+			i := strings.LastIndex(tag, "-")
+			if i < 0 {
+				break
+			}
+			tag = tag[:i]
+		}
+	}
+	return tags
+}
+
+// validLanguageTag returns true if the tag consists of letters, digits and
+// hyphens, like "en" or "pt-BR", so it's safe to use in file names.
+func validLanguageTag(tag string) bool {
+	if tag == "" || tag[0] == '-' {
+		return false
+	}
+	for _, c := range tag {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"expvar"
+	"net/http"
+	"runtime"
+	"strconv"
+)
+
+// Counters published via expvar, and served on the admin listener.
+var (
+	expRequests = expvar.NewInt("requests")
+	expBytes    = expvar.NewInt("bytes")
+	expStatuses = expvar.NewMap("statuses")
+	expServes   = expvar.NewMap("serves") // of *expvar.Map, by serve path
+)
+
+func init() {
+	expvar.Publish("goroutines", expvar.Func(func() interface{} {
+		return runtime.NumGoroutine()
+	}))
+	expvar.Publish("cache", expvar.Func(func() interface{} {
+		hits, misses, coalesced := fileCacheStats()
+		return map[string]int64{"hits": hits, "misses": misses, "coalesced": coalesced}
+	}))
+}
+
+// recordExpvar counts a response in the published counters.
+func recordExpvar(status, size int) {
+	expRequests.Add(1)
+	expBytes.Add(int64(size))
+	expStatuses.Add(strconv.Itoa(status), 1)
+}
+
+// ServeStatsHandler counts the requests handled and bytes written by a serve
+// in the published counters, under the given name.
+func ServeStatsHandler(h http.Handler, name string) http.Handler {
+	m := new(expvar.Map).Init()
+	expServes.Set(name, m)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceFrom(r).routed(name)
+		m.Add("requests", 1)
+		if lrw, ok := r.Context().Value(loggingWriterKey{}).(LoggingResponseWriter); ok {
+			before := *lrw.size
+			defer func() {
+				m.Add("bytes", int64(*lrw.size-before))
+			}()
+		}
+		h.ServeHTTP(w, r)
+	})
+}
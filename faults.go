@@ -0,0 +1,129 @@
+package main
+
+import (
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+// Latency distributions of faults.
+const (
+	DistributionFixed       = "fixed"       // always the latency
+	DistributionUniform     = "uniform"     // the latency, plus or minus up to the jitter
+	DistributionNormal      = "normal"      // a mean of the latency, with the jitter as standard deviation
+	DistributionExponential = "exponential" // the latency, plus a long tail averaging the jitter
+)
+
+// faultChunk is the most written at once to a response whose bandwidth is
+// limited, so that it trickles out rather than arriving in bursts.
+const faultChunk = 1024
+
+// faultRule is a Fault with its values parsed.
+type faultRule struct {
+	paths        []string
+	latency      time.Duration
+	jitter       time.Duration
+	distribution string
+	bandwidth    int64
+	errorRate    float64
+	statuses     []int
+}
+
+// delay returns how long to delay a response by.
+func (f faultRule) delay() time.Duration {
+	var d time.Duration
+	switch f.distribution {
+	case DistributionFixed:
+		d = f.latency
+	case DistributionUniform:
+		d = f.latency + time.Duration((rand.Float64()*2-1)*float64(f.jitter))
+	case DistributionNormal:
+		d = f.latency + time.Duration(rand.NormFloat64()*float64(f.jitter))
+	case DistributionExponential:
+		d = f.latency + time.Duration(rand.ExpFloat64()*float64(f.jitter))
+	}
+	if d < 0 {
+		return 0
+	}
+	return d
+}
+
+// FaultHandler makes responses to requests for paths matching a rule slow or
+// unreliable, as the first such rule describes: delaying them, limiting the
+// rate their bodies are sent at, and failing some at random. It's intended
+// for testing how clients cope with poor networks and flaky servers, and
+// shouldn't be used in production.
+func FaultHandler(h http.Handler, rules []faultRule) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var rule *faultRule
+		for i := range rules {
+			if len(rules[i].paths) == 0 || matchAny(rules[i].paths, r.URL.Path) {
+				rule = &rules[i]
+				break
+			}
+		}
+		if rule == nil {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		if d := rule.delay(); d > 0 {
+			t := time.NewTimer(d)
+			select {
+			case <-t.C:
+			case <-r.Context().Done():
+				t.Stop()
+				return
+			}
+		}
+		if rule.errorRate > 0 && rand.Float64() < rule.errorRate {
+			status := rule.statuses[rand.Intn(len(rule.statuses))]
+			w.Header().Set("Cache-Control", "no-store")
+			http.Error(w, http.StatusText(status), status)
+			return
+		}
+		if rule.bandwidth > 0 {
+			w = &throttledResponseWriter{ResponseWriter: w, r: r, rate: rule.bandwidth}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// throttledResponseWriter writes a response body no faster than a number of
+// bytes per second.
+type throttledResponseWriter struct {
+	http.ResponseWriter
+	r    *http.Request
+	rate int64 // bytes per second
+}
+
+func (w *throttledResponseWriter) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		n := len(b)
+		if n > faultChunk {
+			n = faultChunk
+		}
+		t := time.NewTimer(time.Duration(int64(n) * int64(time.Second) / w.rate))
+		select {
+		case <-t.C:
+		case <-w.r.Context().Done():
+			t.Stop()
+			return written, w.r.Context().Err()
+		}
+		m, err := w.ResponseWriter.Write(b[:n])
+		written += m
+		if err != nil {
+			return written, err
+		}
+		if f, ok := w.ResponseWriter.(http.Flusher); ok {
+			f.Flush()
+		}
+		b = b[n:]
+	}
+	return written, nil
+}
+
+func (w *throttledResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
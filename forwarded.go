@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// TrustedProxies is a set of networks whose forwarding headers are believed.
+type TrustedProxies []*net.IPNet
+
+// ParseTrustedProxies parses a list of IP addresses and CIDR networks.
+func ParseTrustedProxies(list []string) (TrustedProxies, error) {
+	var t TrustedProxies
+	for _, s := range list {
+		if !strings.Contains(s, "/") {
+			if strings.Contains(s, ":") {
+				s += "/128"
+			} else {
+				s += "/32"
+			}
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		t = append(t, n)
+	}
+	return t, nil
+}
+
+// trusts returns true if the address (with or without a port) is that of a
+// trusted proxy.
+func (t TrustedProxies) trusts(addr string) bool {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, n := range t {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedHop describes one hop of a forwarded request.
+type forwardedHop struct {
+	For   string // node identifier of the client, as host:port
+	Proto string // protocol the hop was received with
+}
+
+// parseForwarded parses the elements of RFC 7239 Forwarded headers, in the
+// order they were added.
+func parseForwarded(values []string) []forwardedHop {
+	var hops []forwardedHop
+	for _, v := range values {
+		for _, elem := range strings.Split(v, ",") {
+			var hop forwardedHop
+			for _, pair := range strings.Split(elem, ";") {
+				i := strings.Index(pair, "=")
+				if i < 0 {
+					continue
+				}
+				key := strings.ToLower(strings.TrimSpace(pair[:i]))
+				val := strings.Trim(strings.TrimSpace(pair[i+1:]), `"`)
+				switch key {
+				case "for":
+					hop.For = forwardedNode(val)
+				case "proto":
+					hop.Proto = strings.ToLower(val)
+				}
+			}
+			hops = append(hops, hop)
+		}
+	}
+	return hops
+}
+
+// forwardedNode converts a Forwarded node identifier, such as
+// "[2001:db8::1]:4711", "192.0.2.60" or "unknown", to host:port form.
+func forwardedNode(node string) string {
+	if _, _, err := net.SplitHostPort(node); err == nil {
+		return node
+	}
+	return net.JoinHostPort(strings.Trim(node, "[]"), "0")
+}
+
+// parseXForwarded converts legacy X-Forwarded-For and X-Forwarded-Proto
+// headers to hops. As the protocol isn't recorded per hop, it's only
+// applied to the most recent.
+func parseXForwarded(h http.Header) []forwardedHop {
+	var hops []forwardedHop
+	for _, v := range h["X-Forwarded-For"] {
+		for _, addr := range strings.Split(v, ",") {
+			if addr = strings.TrimSpace(addr); addr != "" {
+				hops = append(hops, forwardedHop{For: forwardedNode(addr)})
+			}
+		}
+	}
+	if len(hops) > 0 {
+		protos := strings.Split(h.Get("X-Forwarded-Proto"), ",")
+		hops[len(hops)-1].Proto = strings.ToLower(
+			strings.TrimSpace(protos[len(protos)-1]))
+	}
+	return hops
+}
+
+type forwardedProtoKey struct{}
+type forwardedPeerKey struct{}
+
+// ForwardedHandler replaces the remote address of requests from trusted
+// proxies with that of the original client, according to the Forwarded
+// header, or X-Forwarded-For if there is none. Hops are followed from the
+// most recent back to the first address that isn't a trusted proxy, so
+// clients can't forge their address by sending these headers themselves.
+func ForwardedHandler(h http.Handler, trusted TrustedProxies) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !trusted.trusts(r.RemoteAddr) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		// Keep the proxy's address, to record when forwarding upstream
+		r = r.WithContext(context.WithValue(r.Context(), forwardedPeerKey{}, r.RemoteAddr))
+		hops := parseForwarded(r.Header["Forwarded"])
+		if len(hops) == 0 {
+			hops = parseXForwarded(r.Header)
+		}
+		for i := len(hops) - 1; i >= 0; i-- {
+			if hops[i].For == "" {
+				break
+			}
+			r.RemoteAddr = hops[i].For
+			if hops[i].Proto != "" {
+				ctx := context.WithValue(r.Context(), forwardedProtoKey{}, hops[i].Proto)
+				r = r.WithContext(ctx)
+			}
+			if !trusted.trusts(hops[i].For) {
+				break
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// requestScheme returns the scheme the client used to make the request,
+// which may have been forwarded by a trusted proxy.
+func requestScheme(r *http.Request) string {
+	if proto, ok := r.Context().Value(forwardedProtoKey{}).(string); ok {
+		return proto
+	}
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// forwardedPeer returns the address of the peer that sent the request, and
+// whether it's a trusted proxy whose forwarding headers may be passed on.
+func forwardedPeer(r *http.Request) (addr string, trusted bool) {
+	if peer, ok := r.Context().Value(forwardedPeerKey{}).(string); ok {
+		return peer, true
+	}
+	return r.RemoteAddr, false
+}
+
+// forwardedFor formats an address as a Forwarded node identifier.
+func forwardedFor(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	if strings.Contains(addr, ":") {
+		return `"[` + addr + `]"`
+	}
+	return addr
+}
+
+// setForwardedHeaders sets the Forwarded and X-Forwarded-* headers of a
+// request being sent upstream. Headers received from a trusted proxy are
+// extended; any others are replaced.
+func setForwardedHeaders(in, out *http.Request) {
+	peer, trusted := forwardedPeer(in)
+	out.Header.Del("Forwarded")
+	out.Header.Del("X-Forwarded-For")
+	if trusted {
+		out.Header["Forwarded"] = in.Header["Forwarded"]
+		out.Header["X-Forwarded-For"] = in.Header["X-Forwarded-For"]
+	}
+
+	// The new element describes the connection from the peer to us
+	proto := "http"
+	if in.TLS != nil {
+		proto = "https"
+	}
+	elem := "for=" + forwardedFor(peer) + ";proto=" + proto
+	if in.Host != "" {
+		elem += ";host=" + strconv.Quote(in.Host)
+	}
+	if prior := out.Header["Forwarded"]; len(prior) > 0 {
+		elem = strings.Join(prior, ", ") + ", " + elem
+	}
+	out.Header.Set("Forwarded", elem)
+
+	ip := peer
+	if host, _, err := net.SplitHostPort(peer); err == nil {
+		ip = host
+	}
+	if prior := out.Header["X-Forwarded-For"]; len(prior) > 0 {
+		ip = strings.Join(prior, ", ") + ", " + ip
+	}
+	out.Header.Set("X-Forwarded-For", ip)
+	out.Header.Set("X-Forwarded-Host", in.Host)
+	out.Header.Set("X-Forwarded-Proto", requestScheme(in))
+}
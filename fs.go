@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"os"
+	"time"
+)
+
+// Modification time adjustment modes.
+const (
+	ModTimeOverride = "override" // report the given time for all files
+	ModTimeClamp    = "clamp"    // report the given time for files newer than it
+)
+
+// ModTimeFileSystem wraps a file system so that files report the given
+// modification time, or, if clamping, no later than the given time. This
+// makes Last-Modified deterministic for build artifacts whose mtimes vary
+// between machines.
+func ModTimeFileSystem(fs http.FileSystem, t time.Time, clamp bool) http.FileSystem {
+	return modTimeFileSystem{fs, t, clamp}
+}
+
+type modTimeFileSystem struct {
+	http.FileSystem
+	t     time.Time
+	clamp bool
+}
+
+func (fs modTimeFileSystem) Open(name string) (http.File, error) {
+	f, err := fs.FileSystem.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return modTimeFile{f, fs}, nil
+}
+
+func (fs modTimeFileSystem) adjust(fi os.FileInfo) os.FileInfo {
+	if fs.clamp && !fi.ModTime().After(fs.t) {
+		return fi
+	}
+	return modTimeFileInfo{fi, fs.t}
+}
+
+type modTimeFile struct {
+	http.File
+	fs modTimeFileSystem
+}
+
+func (f modTimeFile) Stat() (os.FileInfo, error) {
+	fi, err := f.File.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return f.fs.adjust(fi), nil
+}
+
+func (f modTimeFile) Readdir(count int) ([]os.FileInfo, error) {
+	fis, err := f.File.Readdir(count)
+	for i := range fis {
+		fis[i] = f.fs.adjust(fis[i])
+	}
+	return fis, err
+}
+
+type modTimeFileInfo struct {
+	os.FileInfo
+	t time.Time
+}
+
+func (fi modTimeFileInfo) ModTime() time.Time {
+	return fi.t
+}
+
+// MmapFileSystem wraps a file system so that regular files of at least the
+// given size are memory mapped rather than read, avoiding copying their
+// contents through intermediate buffers. Files that can't be mapped, or
+// platforms that don't support it, fall back to normal reads. Mapped files
+// must not be truncated while being served; replace them instead.
+func MmapFileSystem(fs http.FileSystem, threshold int64) http.FileSystem {
+	return mmapFileSystem{fs, threshold}
+}
+
+type mmapFileSystem struct {
+	http.FileSystem
+	threshold int64
+}
+
+func (fs mmapFileSystem) Open(name string) (http.File, error) {
+	f, err := fs.FileSystem.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	osf, ok := f.(*os.File)
+	if !ok {
+		return f, nil
+	}
+	fi, err := osf.Stat()
+	if err != nil || !fi.Mode().IsRegular() || fi.Size() < fs.threshold {
+		return f, nil
+	}
+	data, unmap, err := mmapFile(osf, fi.Size())
+	if err != nil {
+		return f, nil
+	}
+	return &mmappedFile{bytes.NewReader(data), osf, unmap}, nil
+}
+
+// mmappedFile reads from a memory mapped file.
+type mmappedFile struct {
+	*bytes.Reader
+	f     *os.File
+	unmap func() error
+}
+
+func (f *mmappedFile) Close() error {
+	err := f.unmap()
+	if cerr := f.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (f *mmappedFile) Readdir(count int) ([]os.FileInfo, error) {
+	return f.f.Readdir(count)
+}
+
+func (f *mmappedFile) Stat() (os.FileInfo, error) {
+	return f.f.Stat()
+}
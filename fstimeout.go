@@ -0,0 +1,302 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// ErrFSTimeout is returned by file systems wrapped by TimeoutFileSystem when
+// an operation doesn't complete in time.
+var ErrFSTimeout = errors.New("file system operation timed out")
+
+// maxBlockedFSOps limits the timed out operations left running on a file
+// system. Beyond it, the file system is presumed hung, and operations fail
+// immediately rather than piling up goroutines.
+const maxBlockedFSOps = 64
+
+// TimeoutFileSystem wraps a file system so that opening files, and reading,
+// seeking, listing and closing them, fails with ErrFSTimeout if it takes
+// longer than the timeout, as when a network or FUSE mount hangs.
+func TimeoutFileSystem(fs http.FileSystem, timeout time.Duration) http.FileSystem {
+	return timeoutFileSystem{fs, timeout, new(int32)}
+}
+
+type timeoutFileSystem struct {
+	fs      http.FileSystem
+	timeout time.Duration
+	blocked *int32 // timed out operations still running
+}
+
+// call runs the operation, giving up once the timeout expires. Operations
+// that time out are left to complete in the background, then cleaned up.
+func (fs timeoutFileSystem) call(op func(), cleanup func()) error {
+	if atomic.LoadInt32(fs.blocked) >= maxBlockedFSOps {
+		return ErrFSTimeout
+	}
+	done := make(chan struct{})
+	go func() {
+		op()
+		close(done)
+	}()
+	t := time.NewTimer(fs.timeout)
+	defer t.Stop()
+	select {
+	case <-done:
+		return nil
+	case <-t.C:
+		atomic.AddInt32(fs.blocked, 1)
+		go func() {
+			<-done
+			if cleanup != nil {
+				cleanup()
+			}
+			atomic.AddInt32(fs.blocked, -1)
+		}()
+		return ErrFSTimeout
+	}
+}
+
+func (fs timeoutFileSystem) Open(name string) (http.File, error) {
+	var f http.File
+	var err error
+	terr := fs.call(func() {
+		f, err = fs.fs.Open(name)
+	}, func() {
+		if err == nil {
+			f.Close()
+		}
+	})
+	if terr != nil {
+		return nil, terr
+	}
+	if err != nil {
+		return nil, err
+	}
+	tf := &timeoutFile{
+		f:     f,
+		fs:    fs,
+		ops:   make(chan func(), 1),
+		done:  make(chan struct{}, 1),
+		timer: time.NewTimer(fs.timeout),
+	}
+	tf.timer.Stop()
+	go tf.work()
+	return tf, nil
+}
+
+// timeoutFile passes the operations on a file to a goroutine of its own,
+// one at a time, so that they can be timed out without starting a goroutine
+// or timer for each. Once one times out, the file is presumed hung: later
+// operations fail immediately, and the file is closed once the one that
+// timed out completes.
+type timeoutFile struct {
+	f     http.File
+	fs    timeoutFileSystem
+	ops   chan func()   // run in order by work
+	done  chan struct{} // signalled as each operation completes
+	timer *time.Timer
+	buf   []byte // reused by reads, as a timed out read may complete late
+	hung  bool
+}
+
+// work runs the operations on the file until ops is closed.
+func (f *timeoutFile) work() {
+	for op := range f.ops {
+		op()
+		select {
+		case f.done <- struct{}{}:
+		default: // not waited for, as an operation timed out
+		}
+	}
+}
+
+// run runs the operation, giving up once the timeout expires.
+func (f *timeoutFile) run(op func()) error {
+	if f.hung || atomic.LoadInt32(f.fs.blocked) >= maxBlockedFSOps {
+		return ErrFSTimeout
+	}
+	f.ops <- op
+	f.timer.Reset(f.fs.timeout)
+	select {
+	case <-f.done:
+		if !f.timer.Stop() {
+			select {
+			case <-f.timer.C:
+			default:
+			}
+		}
+		return nil
+	case <-f.timer.C:
+		f.hung = true
+		atomic.AddInt32(f.fs.blocked, 1)
+		return ErrFSTimeout
+	}
+}
+
+func (f *timeoutFile) Read(p []byte) (int, error) {
+	if cap(f.buf) < len(p) {
+		f.buf = make([]byte, len(p))
+	}
+	buf := f.buf[:len(p)]
+	var n int
+	var err error
+	if terr := f.run(func() { n, err = f.f.Read(buf) }); terr != nil {
+		return 0, terr
+	}
+	copy(p, buf[:n])
+	return n, err
+}
+
+func (f *timeoutFile) Seek(offset int64, whence int) (int64, error) {
+	var n int64
+	var err error
+	if terr := f.run(func() { n, err = f.f.Seek(offset, whence) }); terr != nil {
+		return 0, terr
+	}
+	return n, err
+}
+
+func (f *timeoutFile) Stat() (os.FileInfo, error) {
+	var fi os.FileInfo
+	var err error
+	if terr := f.run(func() { fi, err = f.f.Stat() }); terr != nil {
+		return nil, terr
+	}
+	return fi, err
+}
+
+func (f *timeoutFile) Readdir(count int) ([]os.FileInfo, error) {
+	var fis []os.FileInfo
+	var err error
+	if terr := f.run(func() { fis, err = f.f.Readdir(count) }); terr != nil {
+		return nil, terr
+	}
+	return fis, err
+}
+
+func (f *timeoutFile) Close() error {
+	defer close(f.ops)
+	if f.hung {
+		// Closed once the operation that timed out completes
+		f.ops <- func() {
+			f.f.Close()
+			atomic.AddInt32(f.fs.blocked, -1)
+		}
+		return nil
+	}
+	var err error
+	terr := f.run(func() { err = f.f.Close() })
+	if terr == nil {
+		return err
+	}
+	if f.hung {
+		// No longer counted once the close completes
+		f.ops <- func() { atomic.AddInt32(f.fs.blocked, -1) }
+	} else {
+		// Refused, as the file system is presumed hung
+		f.ops <- func() { f.f.Close() }
+	}
+	return terr
+}
+
+// fsTimeoutKey is the context key of the flag recording that a request's
+// file system operation timed out.
+type fsTimeoutKey struct{}
+
+// fsTimeoutFileSystem records in a request's flag when an operation on the
+// file system times out.
+type fsTimeoutFileSystem struct {
+	fs       http.FileSystem
+	timedOut *int32
+}
+
+func (fs fsTimeoutFileSystem) flag(err error) error {
+	if err == ErrFSTimeout {
+		atomic.StoreInt32(fs.timedOut, 1)
+	}
+	return err
+}
+
+func (fs fsTimeoutFileSystem) Open(name string) (http.File, error) {
+	f, err := fs.fs.Open(name)
+	if err != nil {
+		return nil, fs.flag(err)
+	}
+	return fsTimeoutFile{f, fs}, nil
+}
+
+type fsTimeoutFile struct {
+	http.File
+	fs fsTimeoutFileSystem
+}
+
+func (f fsTimeoutFile) Read(p []byte) (int, error) {
+	n, err := f.File.Read(p)
+	return n, f.fs.flag(err)
+}
+
+func (f fsTimeoutFile) Seek(offset int64, whence int) (int64, error) {
+	n, err := f.File.Seek(offset, whence)
+	return n, f.fs.flag(err)
+}
+
+func (f fsTimeoutFile) Stat() (os.FileInfo, error) {
+	fi, err := f.File.Stat()
+	return fi, f.fs.flag(err)
+}
+
+func (f fsTimeoutFile) Readdir(count int) ([]os.FileInfo, error) {
+	fis, err := f.File.Readdir(count)
+	return fis, f.fs.flag(err)
+}
+
+// FSTimeoutHandler responds "504 Gateway Timeout" in place of the server
+// errors of requests whose file system operations timed out. Handlers must
+// open files with requestFileSystem for timeouts to be noticed.
+func FSTimeoutHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		timedOut := new(int32)
+		r = r.WithContext(context.WithValue(r.Context(), fsTimeoutKey{}, timedOut))
+		h.ServeHTTP(&fsTimeoutResponseWriter{ResponseWriter: w, timedOut: timedOut}, r)
+	})
+}
+
+type fsTimeoutResponseWriter struct {
+	http.ResponseWriter
+	timedOut *int32
+	written  bool
+	replaced bool
+}
+
+func (w *fsTimeoutResponseWriter) WriteHeader(status int) {
+	if w.written {
+		return
+	}
+	w.written = true
+	if status >= 500 && atomic.LoadInt32(w.timedOut) == 1 {
+		w.replaced = true
+		w.Header().Del("Content-Length")
+		http.Error(w.ResponseWriter, http.StatusText(http.StatusGatewayTimeout),
+			http.StatusGatewayTimeout)
+		return
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *fsTimeoutResponseWriter) Write(b []byte) (int, error) {
+	if !w.written {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.replaced {
+		return len(b), nil
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *fsTimeoutResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
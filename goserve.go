@@ -4,39 +4,63 @@ import (
 	"gopkg.in/v1/yaml"
 
 	"flag"
-	"io/ioutil"
+	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 )
 
 var verbose bool
 var cfg ServerConfig
 
-func init() {
-	flag.BoolVar(&verbose, "verbose", false, "Increase verbosity")
+// configSources are the configuration files the configuration was loaded
+// from, if any.
+var configSources []string
 
-	configPath := flag.String("config", "", "Path to configuration")
-	checkConfig := flag.Bool("config.check", false, "Check config then quit")
-	echoConfig := flag.Bool("config.echo", false, "Echo config then quit")
+// configFlags defines the flags describing a configuration on the flag set,
+// returning a function that loads the configuration once they're parsed. A
+// configuration file, if given, takes precedence over the other flags.
+func configFlags(fs *flag.FlagSet) func() (ServerConfig, error) {
+	fs.BoolVar(&verbose, "verbose", false, "Increase verbosity")
 
-	indexes := flag.Bool("indexes", true, "Allow directory listing")
+	var configPaths configFiles
+	fs.Var(&configPaths, "config", "Path to configuration (repeat to overlay files)")
+	fs.StringVar(&configProfile, "profile", os.Getenv("GOSERVE_PROFILE"),
+		"Profile of the configuration to apply (or set GOSERVE_PROFILE)")
 
-	httpEnabled := flag.Bool("http", true, "Enable HTTP listener")
-	httpAddr := flag.String("http.addr", ":8080", "HTTP address")
-	httpGzip := flag.Bool("http.gzip", true, "Enable HTTP gzip compression")
+	indexes := fs.Bool("indexes", true, "Allow directory listing")
 
-	httpsEnabled := flag.Bool("https", false, "Enable HTTPS listener")
-	httpsAddr := flag.String("https.addr", ":8443", "HTTPS address")
-	httpsGzip := flag.Bool("https.gzip", true, "Enable HTTPS gzip compression")
-	httpsKey := flag.String("https.key", "", "Path to HTTPS key")
-	httpsCert := flag.String("https.cert", "", "Path to HTTPS cert")
+	httpEnabled := fs.Bool("http", true, "Enable HTTP listener")
+	httpAddr := fs.String("http.addr", ":8080", "HTTP address")
+	httpGzip := fs.Bool("http.gzip", true, "Enable HTTP gzip compression")
 
-	flag.Parse()
+	httpsEnabled := fs.Bool("https", false, "Enable HTTPS listener")
+	httpsAddr := fs.String("https.addr", ":8443", "HTTPS address")
+	httpsGzip := fs.Bool("https.gzip", true, "Enable HTTPS gzip compression")
+	httpsKey := fs.String("https.key", "", "Path to HTTPS key")
+	httpsCert := fs.String("https.cert", "", "Path to HTTPS cert")
+
+	return func() (cfg ServerConfig, err error) {
+		if len(configPaths) > 0 {
+			if verbose {
+				log.Println("Config file specified; ignoring command line arguments")
+			}
+			cfg, err = readServerConfig(configPaths...)
+			if err != nil {
+				return
+			}
+			configSources = configPaths
+			if configProfile != "" {
+				log.Printf("Using configuration profile %s", configProfile)
+			}
+			cfg.sanitise()
+			return
+		}
 
-	if *configPath == "" {
 		if verbose {
 			log.Println("Config file not specified; using arguments")
 		}
@@ -61,7 +85,7 @@ func init() {
 		}
 
 		// Serve from first path given on cmdline
-		target := flag.Arg(0)
+		target := fs.Arg(0)
 		if target == "" {
 			target = "."
 		}
@@ -73,92 +97,204 @@ func init() {
 				Indexes: *indexes,
 			},
 		}
-	} else {
-		if verbose {
-			log.Println("Config file specified; ignoring command line arguments")
+		cfg.sanitise()
+		return
+	}
+}
+
+// echoConfig prints the configuration as YAML.
+func echoConfig(cfg ServerConfig) {
+	b, err := yaml.Marshal(cfg)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	fmt.Print(string(b))
+}
+
+func main() {
+	args := os.Args[1:]
+	if len(args) > 0 {
+		if args[0] == "-version" || args[0] == "--version" {
+			os.Exit(runVersion(args[1:]))
 		}
+		if c := findCommand(args[0]); c != nil {
+			os.Exit(c.run(args[1:]))
+		}
+	}
+	// goserve [flags] [dir] is short for goserve serve [flags] [dir]
+	os.Exit(runServe(args))
+}
 
-		var err error
-		cfg, err = readServerConfig(*configPath)
+// serve starts the servers described by the configuration, and waits for a
+// signal to stop them.
+func serve() {
+	watchInterval, _ = parseDuration(cfg.Watch)
+	if cfg.DenyLog != "" {
+		w, err := openLogDestination(cfg.DenyLog, "goserve")
 		if err != nil {
-			log.Fatalln("Couldn't load config:", err)
+			log.Fatalln("Couldn't open deny log:", err)
 		}
+		flags := log.LstdFlags
+		if cfg.DenyLog == "syslog" {
+			flags = 0 // syslog records its own timestamps
+		}
+		denyLog = log.New(w, "goserve: ", flags)
 	}
-
-	cfg.sanitise()
-
-	if *echoConfig {
-		b, err := yaml.Marshal(cfg)
+	if cfg.AuditLog != "" {
+		w, err := openLogDestination(cfg.AuditLog, "goserve-audit")
 		if err != nil {
-			log.Fatalln(err)
+			log.Fatalln("Couldn't open audit log:", err)
 		}
-		print(string(b))
+		auditLog = newAuditWriter(w)
 	}
 
-	if !cfg.check() {
-		log.Fatalln("Invalid config. Exiting.")
+	if cfg.Alerts != nil {
+		alerter = cfg.Alerts.alerter()
+		var certFiles []string
+		for _, l := range cfg.Listeners {
+			if l.secure() {
+				certFiles = append(certFiles, l.CertFile)
+			}
+		}
+		stopAlerts := alerter.watch(certFiles)
+		defer stopAlerts()
 	}
 
-	if *checkConfig {
-		log.Println("Config check passed.")
+	if cfg.Downloads != nil {
+		var err error
+		if downloads, err = cfg.Downloads.counter(); err != nil {
+			log.Fatalln("Couldn't load download counts:", err)
+		}
+		interval, _ := parseDuration(cfg.Downloads.Interval)
+		stopDownloads := downloads.saveEvery(interval)
+		defer stopDownloads()
+	}
+	if cfg.Analytics != nil {
+		var err error
+		if analytics, err = cfg.Analytics.analytics(); err != nil {
+			log.Fatalln("Couldn't load analytics:", err)
+		}
+		interval, _ := parseDuration(cfg.Analytics.Interval)
+		stopAnalytics := analytics.run(interval)
+		defer stopAnalytics()
 	}
 
-	if *echoConfig || *checkConfig {
-		os.Exit(0)
+	if cfg.Admin != nil {
+		stats = NewStats()
+		traffic = NewTrafficLog(cfg.Admin.Recent)
+		if cfg.Admin.Token != "" {
+			tail = NewLogTail(tailBacklog)
+			log.SetOutput(io.MultiWriter(os.Stderr, tail))
+		}
 	}
-}
 
-func readServerConfig(filename string) (cfg ServerConfig, err error) {
-	data, err := ioutil.ReadFile(filename)
-	if err != nil {
-		return
+	if cfg.QuotaFile != "" {
+		var err error
+		if quotas, err = NewQuotaStore(cfg.QuotaFile); err != nil {
+			log.Fatalln("Couldn't load quota usage:", err)
+		}
+		stopQuotas := quotas.saveEvery(10 * time.Second)
+		defer stopQuotas()
+	}
+	if err := cfg.loadRealms(); err != nil {
+		log.Fatalln(err)
 	}
-	err = yaml.Unmarshal(data, &cfg)
-	return
-}
 
-func main() {
 	// Setup handlers
-	mux := NewStaticServeMux()
-	for _, e := range cfg.Errors {
-		mux.HandleError(e.Status, e.handler())
+	router := NewRouter(nil)
+	builder := NewRouteBuilder(router)
+	mux, err := builder.build(cfg)
+	if err != nil {
+		log.Fatalln("Couldn't set up routes:", err)
 	}
-	for _, s := range cfg.Serves {
-		mux.Handle(s.Path, s.handler())
+	router.SetMux(mux)
+
+	if cfg.Admin != nil {
+		if cfg.Admin.Token != "" {
+			configAPI = cfg.configAPI(func(c ServerConfig) error {
+				mux, err := builder.build(c)
+				if err == nil {
+					router.SetMux(mux)
+				}
+				return err
+			})
+		}
+		go func() {
+			if verbose {
+				log.Printf("listening on admin %s\n", cfg.Admin.Addr)
+			}
+			err := http.ListenAndServe(cfg.Admin.Addr, cfg.Admin.handler())
+			if err != nil {
+				alert(AlertListenerFailed, fmt.Sprintf(
+					"admin listener %s failed: %s", cfg.Admin.Addr, err))
+				log.Fatalln(err)
+			}
+		}()
 	}
-	for _, r := range cfg.Redirects {
-		mux.Handle(r.From, r.handler())
+
+	if len(cfg.Faults) > 0 {
+		log.Println("Fault injection is enabled; responses will be slowed down and fail on purpose")
 	}
 
 	// Start listeners
+	var shedder *LoadShedder
+	if cfg.LoadShedding != nil {
+		shedder = cfg.LoadShedding.shedder()
+	}
 	for _, l := range cfg.Listeners {
-		var h http.Handler = mux
-		if len(l.Headers) > 0 {
-			h = CustomHeadersHandler(h, l.Headers)
+		policies, err := l.hostPolicies()
+		if err != nil {
+			log.Fatalln("Couldn't load client CAs:", err)
 		}
-		if l.Gzip {
-			h = GzipHandler(h)
+		h, err := l.handler(router, policies, shedder)
+		if err != nil {
+			log.Fatalln("Couldn't open access log:", err)
 		}
-		h = LogHandler(h)
 		if l.Protocol == "http" {
 			go func(l Listener) {
 				if verbose {
 					log.Printf("listening on HTTP %s\n", l.Addr)
 				}
-				err := http.ListenAndServe(l.Addr, h)
+				ln, err := l.listen()
+				if err == nil {
+					err = l.server(h).Serve(ln)
+				}
 				if err != nil {
+					alert(AlertListenerFailed, fmt.Sprintf(
+						"listener %s failed: %s", l.Addr, err))
 					log.Fatalln(err)
 				}
 			}(l)
-		} else if l.Protocol == "https" {
+		} else if l.secure() {
+			// Load keys before starting, as a passphrase may be prompted for
+			tlsConfig, stopTLS, err := l.tlsConfig(policies)
+			if err != nil {
+				alert(AlertListenerFailed, fmt.Sprintf(
+					"listener %s failed: %s", l.Addr, err))
+				log.Fatalln("Couldn't load TLS key pair:", err)
+			}
+			defer stopTLS()
 			go func(l Listener) {
 				if verbose {
+					kind := "HTTPS"
+					if l.Protocol == "auto" {
+						kind = "HTTP and HTTPS"
+					}
 					log.Printf(
-						"listening on HTTPS %s (cert: %s, key: %s)\n",
-						l.Addr, l.CertFile, l.KeyFile)
+						"listening on %s %s (cert: %s, key: %s)\n",
+						kind, l.Addr, pemLabel(l.CertFile), pemLabel(l.KeyFile))
+				}
+				srv := l.server(h)
+				srv.TLSConfig = tlsConfig
+				ln, err := l.listen()
+				if err == nil && l.Protocol == "auto" {
+					err = srv.Serve(SniffTLSListener(ln, tlsConfig))
+				} else if err == nil {
+					err = srv.ServeTLS(ln, "", "")
 				}
-				err := http.ListenAndServeTLS(l.Addr, l.CertFile, l.KeyFile, h)
 				if err != nil {
+					alert(AlertListenerFailed, fmt.Sprintf(
+						"listener %s failed: %s", l.Addr, err))
 					log.Fatalln(err)
 				}
 			}(l)
@@ -168,9 +304,102 @@ func main() {
 	}
 
 	// Since all the listeners are running in separate gorotines, we have to
-	// wait here for a termination signal.
-	exit := make(chan os.Signal, 1)
-	signal.Notify(exit, os.Interrupt, syscall.SIGTERM)
-	<-exit
-	os.Exit(0)
+	// wait here for a termination signal. SIGHUP signals a new release,
+	// SIGUSR1 reopens log files, and SIGUSR2 toggles debug mode.
+	var debugging debugMode
+	var reopened bool
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGUSR1, syscall.SIGUSR2)
+	for s := range sig {
+		if s == syscall.SIGHUP {
+			release()
+			continue
+		}
+		if s == syscall.SIGUSR1 {
+			if !reopened {
+				// For those whose scripts still send SIGUSR1 to toggle debug mode
+				log.Println("SIGUSR1 now reopens log files; debug mode is toggled by SIGUSR2")
+				reopened = true
+			}
+			reopenLogFiles()
+			continue
+		}
+		if s == syscall.SIGUSR2 {
+			debugging.toggle()
+			continue
+		}
+		break
+	}
+	quotas.save()
+	downloads.save()
+	analytics.save()
+}
+
+// loadRealms loads the users of the configuration's realms.
+func (c ServerConfig) loadRealms() error {
+	for _, r := range c.Realms {
+		realm, err := r.realm()
+		if err != nil {
+			return fmt.Errorf("Couldn't load realm %s: %s", r.Name, err)
+		}
+		authRealms[r.Name] = realm
+	}
+	return nil
+}
+
+// handler returns the handler of requests to the listener, which passes them
+// to the router's current mux, or an error if its access logs can't be
+// opened.
+func (l Listener) handler(router *Router, policies *HostPolicies, shedder *LoadShedder) (http.Handler, error) {
+	var h http.Handler = RecoverHandler(router, router)
+	if len(l.Headers) > 0 {
+		h = CustomHeadersHandler(h, l.Headers)
+	}
+	if len(l.HeaderRules) > 0 {
+		h = HeaderRulesHandler(h, l.HeaderRules)
+	}
+	if policies != nil {
+		h = HostPolicyHandler(h, policies)
+	}
+	if l.ClientCertHeaders {
+		h = ClientCertHeadersHandler(h)
+	}
+	h = GzipHandler(h, l.gzipOptions())
+	h = MethodFilterHandler(h, cfg.Methods)
+	if shedder != nil {
+		h = shedder.Handler(h)
+	}
+	if l.ServerTiming {
+		h = ServerTimingHandler(h)
+	}
+	// Always added, as debug headers may be turned on at runtime
+	debug := DebugHeaders{}
+	if cfg.DebugHeaders != nil {
+		debug = *cfg.DebugHeaders
+	}
+	h = DebugHeadersHandler(h, debug.Always, debug.Secret)
+	if l.RedirectHTTP {
+		h = HTTPSRedirectHandler(h)
+	}
+	if len(cfg.Faults) > 0 {
+		// Inside the access log, so injected failures and delays are logged
+		h = FaultHandler(h, faultRules(cfg.Faults))
+	}
+	logOpts, err := l.logOptions()
+	if err != nil {
+		return nil, err
+	}
+	h = LogHandler(h, logOpts)
+	if len(l.TrustedProxies) > 0 {
+		trusted, _ := ParseTrustedProxies(l.TrustedProxies)
+		h = ForwardedHandler(h, trusted)
+	}
+	h = RequestIDHandler(h)
+	if l.StripValidators {
+		h = StripValidatorsHandler(h)
+	}
+	if l.StripIdentity {
+		h = StripIdentityHandler(h)
+	}
+	return h, nil
 }
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultGzipBuffer is the default size up to which compressed responses are
+// buffered in order to send a Content-Length.
+const defaultGzipBuffer = 4096
+
+// GzipOptions describes how responses should be compressed.
+type GzipOptions struct {
+	Enabled bool
+	Level   int      // compression level (0=default)
+	Types   []string // content type prefixes to compress (empty=all)
+	Buffer  int      // compressed bytes to buffer (0=default, <0=none)
+}
+
+// compresses returns true if responses of the given content type should be
+// compressed.
+func (o GzipOptions) compresses(contentType string) bool {
+	if !o.Enabled {
+		return false
+	}
+	if len(o.Types) == 0 {
+		return true
+	}
+	for _, t := range o.Types {
+		if strings.HasPrefix(contentType, t) {
+			return true
+		}
+	}
+	return false
+}
+
+type gzipOptionsKey struct{}
+
+// GzipHandler gzips the HTTP response if supported by the client. Based on
+// the implementation of `go.httpgzip`. The options may be overridden for a
+// single request by GzipOverrideHandler further down the chain.
+func GzipHandler(h http.Handler, opts GzipOptions) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Serve normally to clients that don't express gzip support
+		if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		// Byte ranges refer to the uncompressed content, so partial
+		// requests (e.g. resumed downloads) must be served uncompressed.
+		if r.Header.Get("Range") != "" || r.Header.Get("If-Range") != "" {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		o := opts
+		r = r.WithContext(context.WithValue(r.Context(), gzipOptionsKey{}, &o))
+		gw := &GzipResponseWriter{ResponseWriter: w, opts: &o, trace: traceFrom(r), ctx: r.Context()}
+		defer gw.Close()
+		h.ServeHTTP(gw, r)
+	})
+}
+
+// GzipOverrideHandler replaces the compression options for requests that
+// pass through it, regardless of those given to the enclosing GzipHandler.
+// A nil `enabled` leaves the enclosing setting as-is, as does a zero level
+// or empty list of types.
+func GzipOverrideHandler(h http.Handler, enabled *bool, level int, types []string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if o, ok := r.Context().Value(gzipOptionsKey{}).(*GzipOptions); ok {
+			if enabled != nil {
+				o.Enabled = *enabled
+			}
+			if level != 0 {
+				o.Level = level
+			}
+			if len(types) > 0 {
+				o.Types = types
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// GzipResponseWriter gzips content written to it. Whether to compress is
+// decided when the response is first written to, once the content type is
+// known; until then the status is held back.
+//
+// Compressed output is buffered up to a threshold, so that small responses
+// can be sent with a Content-Length rather than chunked. Once the threshold
+// is exceeded, the response is streamed.
+type GzipResponseWriter struct {
+	http.ResponseWriter
+	opts    *GzipOptions
+	gz      *gzip.Writer
+	buf     *bytes.Buffer // compressed output not yet written
+	status  int
+	decided bool
+	trace   *requestTrace   // receives time spent compressing, if traced
+	ctx     context.Context // request context; compression stops once done
+}
+
+// WriteHeader records the status, which is written out along with the
+// first part of the body.
+func (w *GzipResponseWriter) WriteHeader(status int) {
+	if w.decided {
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *GzipResponseWriter) Write(b []byte) (int, error) {
+	if !w.decided {
+		if w.Header().Get("Content-Type") == "" {
+			w.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+		w.decide()
+	}
+	if w.gz != nil {
+		if err := w.ctx.Err(); err != nil {
+			// The client has gone, so don't compress any more
+			return 0, err
+		}
+		start := time.Now()
+		n, err := w.gz.Write(b)
+		w.trace.compressed(time.Since(start))
+		return n, err
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// decide determines whether the response will be compressed, and writes the
+// response header.
+func (w *GzipResponseWriter) decide() {
+	w.decided = true
+	status := w.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+
+	hdr := w.Header()
+	if status != http.StatusNoContent && status != http.StatusNotModified &&
+		status != http.StatusPartialContent && hdr.Get("Content-Range") == "" &&
+		hdr.Get("Content-Encoding") == "" &&
+		w.opts.compresses(hdr.Get("Content-Type")) {
+		level := w.opts.Level
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		gz, err := gzip.NewWriterLevel(gzipSink{w}, level)
+		if err == nil {
+			w.gz = gz
+			hdr.Set("Content-Encoding", "gzip")
+			weakenETag(hdr)
+			hdr.Del("Content-Length")
+			// Ranges of the compressed stream can't be served
+			hdr.Del("Accept-Ranges")
+			hdr.Add("Vary", "Accept-Encoding")
+			if w.opts.Buffer >= 0 {
+				// Hold back the header until the size is known
+				w.status = status
+				w.buf = new(bytes.Buffer)
+				return
+			}
+		}
+	}
+
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// weakenETag makes a strong ETag weak, for a compressed response, whose
+// bytes differ from those it was computed from. Weak ETags still match
+// If-None-Match, so compressed responses are revalidated as usual.
+func weakenETag(hdr http.Header) {
+	if etag := hdr.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		hdr.Set("ETag", "W/"+etag)
+	}
+}
+
+// bufferLimit returns the number of compressed bytes that may be buffered.
+func (w *GzipResponseWriter) bufferLimit() int {
+	if w.opts.Buffer == 0 {
+		return defaultGzipBuffer
+	}
+	return w.opts.Buffer
+}
+
+// flushBuffer writes the held back header and any buffered output, and
+// stops further buffering.
+func (w *GzipResponseWriter) flushBuffer() error {
+	w.ResponseWriter.WriteHeader(w.status)
+	_, err := w.ResponseWriter.Write(w.buf.Bytes())
+	w.buf = nil
+	return err
+}
+
+// gzipSink receives compressed output, buffering it while the response is
+// small enough.
+type gzipSink struct {
+	w *GzipResponseWriter
+}
+
+func (s gzipSink) Write(b []byte) (int, error) {
+	w := s.w
+	if w.buf == nil {
+		return w.ResponseWriter.Write(b)
+	}
+	w.buf.Write(b)
+	if w.buf.Len() > w.bufferLimit() {
+		if err := w.flushBuffer(); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// Flush writes out any compressed output held back so far, so that streamed
+// responses reach the client promptly.
+func (w *GzipResponseWriter) Flush() {
+	if !w.decided {
+		w.decide()
+	}
+	if w.gz != nil {
+		w.gz.Flush()
+		if w.buf != nil {
+			w.flushBuffer()
+		}
+	}
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+func (w *GzipResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Close flushes any compressed output, and writes the response header if
+// nothing has been written yet.
+func (w *GzipResponseWriter) Close() error {
+	if !w.decided {
+		w.decided = true
+		if w.status != 0 {
+			w.ResponseWriter.WriteHeader(w.status)
+		}
+	}
+	if w.gz == nil {
+		return nil
+	}
+	if err := w.ctx.Err(); err != nil {
+		return err
+	}
+	start := time.Now()
+	err := w.gz.Close()
+	w.trace.compressed(time.Since(start))
+	if err != nil {
+		return err
+	}
+	if w.buf != nil {
+		// Entire response fit in the buffer, so its length is known
+		w.Header().Set("Content-Length", strconv.Itoa(w.buf.Len()))
+		return w.flushBuffer()
+	}
+	return nil
+}
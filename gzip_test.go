@@ -0,0 +1,97 @@
+package main
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+var gzipTestBody = strings.Repeat("All work and no play makes Jack a dull boy. ", 100)
+
+// gzipTestHandler serves gzipTestBody as http.FileServer would a file,
+// honouring ranges and conditional requests.
+func gzipTestHandler() http.Handler {
+	modTime := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		http.ServeContent(w, r, "", modTime, strings.NewReader(gzipTestBody))
+	})
+	return GzipHandler(h, GzipOptions{Enabled: true})
+}
+
+func TestGzipHandlerRangeUncompressed(t *testing.T) {
+	for _, hdr := range []map[string]string{
+		{"Range": "bytes=0-9"},
+		{"Range": "bytes=0-9", "If-Range": "Wed, 01 Jan 2020 00:00:00 GMT"},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Accept-Encoding", "gzip")
+		for k, v := range hdr {
+			r.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		gzipTestHandler().ServeHTTP(w, r)
+
+		if w.Code != http.StatusPartialContent {
+			t.Errorf("%v: status %d, want %d", hdr, w.Code, http.StatusPartialContent)
+		}
+		if ce := w.Header().Get("Content-Encoding"); ce != "" {
+			t.Errorf("%v: Content-Encoding %q, want none", hdr, ce)
+		}
+		if body := w.Body.String(); body != gzipTestBody[:10] {
+			t.Errorf("%v: body %q, want %q", hdr, body, gzipTestBody[:10])
+		}
+	}
+}
+
+func TestGzipHandlerIfRangeUncompressed(t *testing.T) {
+	// If-Range without Range is ignored by ServeContent, but the response
+	// must still be uncompressed, as the client may be resuming a download
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	r.Header.Set("If-Range", "Wed, 01 Jan 2020 00:00:00 GMT")
+	w := httptest.NewRecorder()
+	gzipTestHandler().ServeHTTP(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("status %d, want %d", w.Code, http.StatusOK)
+	}
+	if ce := w.Header().Get("Content-Encoding"); ce != "" {
+		t.Errorf("Content-Encoding %q, want none", ce)
+	}
+	if w.Header().Get("Accept-Ranges") != "bytes" {
+		t.Errorf("Accept-Ranges %q, want bytes", w.Header().Get("Accept-Ranges"))
+	}
+}
+
+func TestGzipHandlerCompressedDropsAcceptRanges(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	gzipTestHandler().ServeHTTP(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("status %d, want %d", w.Code, http.StatusOK)
+	}
+	if ce := w.Header().Get("Content-Encoding"); ce != "gzip" {
+		t.Fatalf("Content-Encoding %q, want gzip", ce)
+	}
+	if ar, ok := w.Header()["Accept-Ranges"]; ok {
+		t.Errorf("Accept-Ranges %q, want none", ar)
+	}
+	gz, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != gzipTestBody {
+		t.Errorf("decompressed body differs from the original")
+	}
+}
@@ -1,12 +1,16 @@
 package main
 
 import (
-	"compress/gzip"
-	"fmt"
+	"context"
 	"io"
-	"net"
+	"log"
+	"mime"
 	"net/http"
 	"os"
+	"path"
+	"regexp"
+	"runtime/debug"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -15,39 +19,156 @@ import (
 // StaticServeMux wraps ServeMux but allows for the interception of errors.
 type StaticServeMux struct {
 	*http.ServeMux
-	errors map[int]http.Handler
+	errors     map[int][]statusHandler
+	fallbacks  map[string]http.Handler
+	theme      string
+	errorsFrom int
+	apiPaths   []string
+}
+
+// statusHandler handles responses of a particular status to requests under
+// a path prefix.
+type statusHandler struct {
+	prefix  string
+	handler http.Handler // nil to pass the response through
+	headers Headers      // headers to add to the response
 }
 
 // NewStaticServeMux allocates and returns a new StaticServeMux
 func NewStaticServeMux() *StaticServeMux {
 	return &StaticServeMux{
-		ServeMux: http.NewServeMux(),
-		errors:   make(map[int]http.Handler),
+		ServeMux:   http.NewServeMux(),
+		errors:     make(map[int][]statusHandler),
+		fallbacks:  make(map[string]http.Handler),
+		theme:      ThemePlain,
+		errorsFrom: 400,
 	}
 }
 
+// SetErrorPagesFrom sets the lowest status for which responses without a
+// registered handler are replaced with a built-in error page.
+func (s *StaticServeMux) SetErrorPagesFrom(status int) {
+	s.errorsFrom = status
+}
+
+// SetErrorTheme sets the theme of the built-in pages used for errors that
+// have no registered handler.
+func (s *StaticServeMux) SetErrorTheme(theme string) {
+	s.theme = theme
+}
+
+// SetAPIPaths sets glob patterns of paths whose errors are always returned as
+// JSON. Errors for other paths are JSON if the request's Accept header
+// prefers it to HTML.
+func (s *StaticServeMux) SetAPIPaths(patterns []string) {
+	s.apiPaths = patterns
+}
+
+// wantsJSONError returns true if errors for the request should be JSON
+// rather than an HTML page.
+func (s StaticServeMux) wantsJSONError(req *http.Request) bool {
+	return matchPathPrefix(s.apiPaths, req.URL.Path) || prefersJSON(req.Header.Get("Accept"))
+}
+
 // HandleError registers a handler for the given response code.
 func (s *StaticServeMux) HandleError(status int, handler http.Handler) {
-	if s.errors[status] != nil {
-		panic("Handler for error already registered")
+	s.HandleStatus(status, "/", handler, nil)
+}
+
+// HandleStatus registers a handler for responses with the given status to
+// requests under the path prefix, along with headers to add to the response.
+// Any status may be intercepted, not just errors. If the handler is nil, the
+// headers are added and the response passes through unchanged.
+func (s *StaticServeMux) HandleStatus(status int, prefix string, handler http.Handler, headers Headers) {
+	for _, sh := range s.errors[status] {
+		if sh.prefix == prefix {
+			panic("Handler for status already registered")
+		}
 	}
-	s.errors[status] = handler
+	s.errors[status] = append(s.errors[status], statusHandler{
+		prefix:  prefix,
+		handler: handler,
+		headers: headers,
+	})
+}
+
+// statusHandler returns the handler registered for the status with the
+// longest prefix matching the request path.
+func (s StaticServeMux) statusHandler(status int, req *http.Request) (statusHandler, bool) {
+	var best statusHandler
+	found := false
+	for _, sh := range s.errors[status] {
+		if strings.HasPrefix(req.URL.Path, sh.prefix) &&
+			(!found || len(sh.prefix) > len(best.prefix)) {
+			best = sh
+			found = true
+		}
+	}
+	return best, found
+}
+
+// HandleFallback registers a handler for the given path that is only used
+// when serving the path would otherwise result in a 404.
+func (s *StaticServeMux) HandleFallback(path string, handler http.Handler) {
+	if s.fallbacks[path] != nil {
+		panic("Fallback for path already registered")
+	}
+	s.fallbacks[path] = handler
 }
 
 func (s StaticServeMux) intercept(status int, w http.ResponseWriter, req *http.Request) bool {
+	// Serve fallback content in place of missing files
+	if h, f := s.fallbacks[req.URL.Path]; f && status == http.StatusNotFound {
+		w.Header().Del("Content-Type")
+		w.Header().Del("X-Content-Type-Options")
+		h.ServeHTTP(w, req)
+		return true
+	}
 	// Get error handler if there is one
-	if h, f := s.errors[status]; f {
-		h.ServeHTTP(statusResponseWriter{w, status}, req)
+	if sh, f := s.statusHandler(status, req); f {
+		for k, v := range sh.headers {
+			if p, _ := headerRule(k); p == "" {
+				w.Header().Set(k, v)
+			}
+		}
+		sh.headers.applyRules(w.Header())
+		if sh.handler == nil {
+			return false
+		}
+		// Only errors have a JSON form
+		if status >= 400 {
+			w.Header().Add("Vary", "Accept")
+			if s.wantsJSONError(req) {
+				writeJSONError(w, req, status)
+				return true
+			}
+		}
+		sh.handler.ServeHTTP(statusResponseWriter{w, status}, req)
 		return true
 	}
 	// Ignore non-error status codes
-	if status < 400 {
+	if status < s.errorsFrom {
 		return false
 	}
-	http.Error(w, http.StatusText(status), status)
+	if status >= 400 {
+		w.Header().Add("Vary", "Accept")
+		if s.wantsJSONError(req) {
+			writeJSONError(w, req, status)
+			return true
+		}
+	}
+	writeErrorPage(w, req, status, s.theme)
 	return true
 }
 
+// ServeError responds to the request with the handler registered for the
+// status, or a built-in error page.
+func (s *StaticServeMux) ServeError(w http.ResponseWriter, r *http.Request, status int) {
+	if !s.intercept(status, w, r) {
+		w.WriteHeader(status)
+	}
+}
+
 func (s *StaticServeMux) interceptHandler(handler http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		irw := &InterceptResponseWriter{
@@ -102,6 +223,12 @@ func (h *InterceptResponseWriter) WriteHeader(status int) {
 	}
 }
 
+// Unwrap returns the wrapped ResponseWriter, so that http.ResponseController
+// can flush streamed responses.
+func (h *InterceptResponseWriter) Unwrap() http.ResponseWriter {
+	return h.ResponseWriter
+}
+
 type statusResponseWriter struct {
 	http.ResponseWriter
 	Status int
@@ -118,15 +245,19 @@ func (h statusResponseWriter) WriteHeader(status int) {
 	h.ResponseWriter.WriteHeader(status)
 }
 
+func (h statusResponseWriter) Unwrap() http.ResponseWriter {
+	return h.ResponseWriter
+}
+
 // PreventListingDir panics whenever a file open fails, allowing index
 // requests to be intercepted.
 type PreventListingDir struct {
-	http.Dir
+	http.FileSystem
 }
 
 // Open panics whenever opening an index file fails.
 func (dir *PreventListingDir) Open(name string) (f http.File, err error) {
-	f, err = dir.Dir.Open(name)
+	f, err = dir.FileSystem.Open(name)
 	if f == nil && strings.HasSuffix(name, "/index.html") {
 		panic(dir)
 	}
@@ -135,13 +266,15 @@ func (dir *PreventListingDir) Open(name string) (f http.File, err error) {
 
 // SuppressListingHandler returns a FileServer handler that does not permit
 // the listing of files.
-func SuppressListingHandler(dir http.Dir) http.Handler {
+func SuppressListingHandler(dir http.FileSystem) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		d := &PreventListingDir{dir}
+		d := &PreventListingDir{requestFileSystem(dir, r)}
 		h := http.FileServer(d)
 		defer func() {
 			if p := recover(); p != nil {
 				if p == d {
+					setDenyRule(r, "listing")
+					audit(r, "acl", AuditDeny, "listing", "")
 					http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
 					return
 				}
@@ -152,109 +285,500 @@ func SuppressListingHandler(dir http.Dir) http.Handler {
 	})
 }
 
-// CustomHeadersHandler creates a new handler that includes the provided
-// headers in each response.
-func CustomHeadersHandler(h http.Handler, headers Headers) http.Handler {
+type aliasDepthKey struct{}
+
+// maxAliasDepth limits how many aliases a request may pass through, to
+// guard against aliases that refer to each other.
+const maxAliasDepth = 8
+
+// AliasHandler serves requests as if they had been made for the same path
+// under the alias instead, without redirecting the client. Requests must
+// have had the alias serve's own prefix stripped from their path.
+func AliasHandler(mux handlerFinder, alias string) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		wh := w.Header()
-		for k, v := range headers {
-			if wh.Get(k) == "" {
-				wh.Set(k, v)
+		depth, _ := r.Context().Value(aliasDepthKey{}).(int)
+		if depth >= maxAliasDepth {
+			http.Error(w, http.StatusText(http.StatusLoopDetected),
+				http.StatusLoopDetected)
+			return
+		}
+		ctx := context.WithValue(r.Context(), aliasDepthKey{}, depth+1)
+
+		r2 := r.WithContext(ctx)
+		u := *r.URL
+		u.Path = path.Join(alias, r.URL.Path)
+		if strings.HasSuffix(r.URL.Path, "/") || r.URL.Path == "" {
+			u.Path += "/"
+		}
+		u.RawPath = ""
+		r2.URL = &u
+
+		h, _ := mux.Handler(r2)
+		h.ServeHTTP(w, r2)
+	})
+}
+
+// SingleFileHandler serves the named file at exactly the given URL path, and
+// 404s for any other path that reaches it.
+func SingleFileHandler(urlPath, filename string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != urlPath {
+			http.NotFound(w, r)
+			return
+		}
+		f, err := os.Open(filename)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		defer f.Close()
+		fi, err := f.Stat()
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		// Content type is determined from the file's name, not the URL
+		http.ServeContent(w, r, filename, fi.ModTime(), f)
+	})
+}
+
+// Prefixes of header names in Headers that change how they're applied. A
+// header without a prefix is only set if the response doesn't have it.
+const (
+	HeaderRemove    = "-" // remove the header from the response
+	HeaderAppend    = "+" // add a value to any the response already has
+	HeaderOverwrite = "=" // replace any value the response already has
+)
+
+// headerRule splits a header name in Headers into its prefix, if any, and
+// the name of the header.
+func headerRule(key string) (prefix, name string) {
+	if key != "" && strings.Contains(HeaderRemove+HeaderAppend+HeaderOverwrite, key[:1]) {
+		return key[:1], key[1:]
+	}
+	return "", key
+}
+
+// hasRules returns true if any of the headers have a prefix.
+func (hs Headers) hasRules() bool {
+	for k := range hs {
+		if p, _ := headerRule(k); p != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// setDefaults sets the headers without a prefix that aren't already set.
+func (hs Headers) setDefaults(h http.Header) {
+	for k, v := range hs {
+		if p, _ := headerRule(k); p == "" && h.Get(k) == "" {
+			h.Set(k, v)
+		}
+	}
+}
+
+// applyRules removes, then overwrites, then appends to the headers with a
+// prefix, so that removing and appending to a header replaces it.
+func (hs Headers) applyRules(h http.Header) {
+	for _, prefix := range []string{HeaderRemove, HeaderOverwrite, HeaderAppend} {
+		for k, v := range hs {
+			p, name := headerRule(k)
+			if p != prefix {
+				continue
+			}
+			switch p {
+			case HeaderRemove:
+				h.Del(name)
+			case HeaderOverwrite:
+				h.Set(name, v)
+			case HeaderAppend:
+				h.Add(name, v)
 			}
 		}
+	}
+}
+
+// check returns true if every header has a name.
+func (hs Headers) check(label string, report *problems) (ok bool) {
+	ok = true
+	for k := range hs {
+		if _, name := headerRule(k); name == "" || strings.ContainsAny(name, " :") {
+			report.Printf(label+": invalid header name `%s`", k)
+			ok = false
+		}
+	}
+	return
+}
+
+// serve passes the request to the handler, having set the headers without
+// a prefix on its response if they're not already set. Headers with a
+// prefix are applied just before the response is written, so that they
+// also affect headers set by the handler.
+func (hs Headers) serve(w http.ResponseWriter, r *http.Request, h http.Handler) {
+	hs.setDefaults(w.Header())
+	if !hs.hasRules() {
 		h.ServeHTTP(w, r)
+		return
+	}
+	h.ServeHTTP(&headerHookResponseWriter{
+		ResponseWriter: w,
+		hook: func(status int) {
+			hs.applyRules(w.Header())
+		},
+	}, r)
+}
+
+// CustomHeadersHandler creates a new handler that includes the provided
+// headers in each response.
+func CustomHeadersHandler(h http.Handler, headers Headers) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers.serve(w, r, h)
 	})
 }
 
-// GzipResponseWriter gzips content written to it
-type GzipResponseWriter struct {
-	io.Writer
+// validStatusPattern returns true if the pattern is a status, or a status
+// with trailing digits replaced by "x", such as "404", "40x" or "4xx".
+func validStatusPattern(pattern string) bool {
+	if len(pattern) != 3 || pattern[0] < '1' || pattern[0] > '5' {
+		return false
+	}
+	wild := false
+	for _, c := range pattern[1:] {
+		switch {
+		case c == 'x' || c == 'X':
+			wild = true
+		case c >= '0' && c <= '9' && !wild:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// matchStatus returns true if the status matches a valid status pattern.
+func matchStatus(pattern string, status int) bool {
+	s := strconv.Itoa(status)
+	for i := range pattern {
+		if pattern[i] != 'x' && pattern[i] != 'X' && pattern[i] != s[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// matches returns true if a response with the status and content type
+// should have the rule's headers.
+func (rule HeaderRule) matches(status int, contentType string) bool {
+	if rule.Status != "" && !matchStatus(rule.Status, status) {
+		return false
+	}
+	if rule.ContentType != "" {
+		mt, _, _ := mime.ParseMediaType(contentType)
+		if m, _ := path.Match(rule.ContentType, mt); !m {
+			return false
+		}
+	}
+	return true
+}
+
+// headerRulesResponseWriter applies header rules once the status and content
+// type of the response are known.
+type headerRulesResponseWriter struct {
 	http.ResponseWriter
-	gotContentType bool
+	rules   []HeaderRule
+	written bool
 }
 
-func (w *GzipResponseWriter) Write(b []byte) (int, error) {
-	if !w.gotContentType {
-		if w.Header().Get("Content-Type") == "" {
+func (w *headerRulesResponseWriter) WriteHeader(status int) {
+	if !w.written {
+		w.written = true
+		h := w.Header()
+		for _, rule := range w.rules {
+			if rule.matches(status, h.Get("Content-Type")) {
+				rule.Headers.setDefaults(h)
+				rule.Headers.applyRules(h)
+			}
+		}
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *headerRulesResponseWriter) Write(b []byte) (int, error) {
+	if !w.written {
+		// Detect the content type now, as net/http would, so rules can match it
+		if _, ok := w.Header()["Content-Type"]; !ok && len(b) > 0 {
 			w.Header().Set("Content-Type", http.DetectContentType(b))
 		}
-		w.gotContentType = true
+		w.WriteHeader(http.StatusOK)
 	}
-	return w.Writer.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *headerRulesResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
 }
 
-// GzipHandler gzips the HTTP response if supported by the client. Based on
-// the implementation of `go.httpgzip`
-func GzipHandler(h http.Handler) http.Handler {
+// HeaderRulesHandler applies the headers of each rule matching a response
+// just before it's written, once its status and content type are known.
+func HeaderRulesHandler(h http.Handler, rules []HeaderRule) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Serve normally to clients that don't express gzip support
-		if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+		h.ServeHTTP(&headerRulesResponseWriter{ResponseWriter: w, rules: rules}, r)
+	})
+}
+
+// NoContentHandler responds to every request with 204 No Content.
+func NoContentHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// ContentHandler responds to every request with the given content.
+func ContentHandler(contentType, content string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", contentType)
+		io.WriteString(w, content)
+	})
+}
+
+// OptionsHandler responds to OPTIONS requests with the methods allowed on
+// the requested path, passing all other requests through.
+func OptionsHandler(h http.Handler, methods func(p string) []string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodOptions {
 			h.ServeHTTP(w, r)
 			return
 		}
+		w.Header().Set("Allow", strings.Join(methods(r.URL.Path), ", "))
+		w.Header().Set("Content-Length", "0")
+		w.WriteHeader(http.StatusOK)
+	})
+}
 
-		w.Header().Set("Content-Encoding", "gzip")
-		gz := gzip.NewWriter(w)
-		defer gz.Close()
-		h.ServeHTTP(&GzipResponseWriter{Writer: gz, ResponseWriter: w}, r)
+// MethodFilterHandler rejects requests using methods not in the allowed list
+// with 405 Method Not Allowed. TRACE and TRACK are always rejected. If no
+// methods are given, all others are allowed.
+func MethodFilterHandler(h http.Handler, methods []string) http.Handler {
+	allowed := make(map[string]bool, len(methods))
+	for _, m := range methods {
+		allowed[strings.ToUpper(m)] = true
+	}
+	allow := strings.Join(methods, ", ")
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rejected := r.Method == http.MethodTrace || r.Method == "TRACK" ||
+			(len(allowed) > 0 && !allowed[r.Method])
+		if !rejected {
+			h.ServeHTTP(w, r)
+			return
+		}
+		audit(r, "method", AuditDeny, "methods", "")
+		if allow != "" {
+			w.Header().Set("Allow", allow)
+		}
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed),
+			http.StatusMethodNotAllowed)
 	})
 }
 
-// LogHandler wraps with a LoggingResponseWriter for the purpose of logging
-// accesses and errors.
-func LogHandler(h http.Handler) http.Handler {
+// RecoverHandler recovers from panics in the wrapped handler, logging the
+// stack trace and responding with the mux's 500 error page, rather than
+// letting net/http abort the connection. If the response has already been
+// started, the connection is aborted as usual.
+func RecoverHandler(h http.Handler, mux errorServer) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		rw := NewLoggingResponseWriter(w)
-		h.ServeHTTP(rw, r)
-		rw.log(r)
+		hw := &headerHookResponseWriter{ResponseWriter: w, hook: func(int) {}}
+		defer func() {
+			p := recover()
+			if p == nil {
+				return
+			}
+			if p == http.ErrAbortHandler {
+				panic(p)
+			}
+			log.Printf("panic serving %s (request %s): %v\n%s",
+				r.URL.Path, requestID(r), p, debug.Stack())
+			if hw.written {
+				panic(http.ErrAbortHandler)
+			}
+			mux.ServeError(w, r, http.StatusInternalServerError)
+		}()
+		h.ServeHTTP(hw, r)
 	})
 }
 
-// LoggingResponseWriter intercepts the request and stores the status.
-type LoggingResponseWriter struct {
+// headerHookResponseWriter calls a function with the response status just
+// before the response header is written, allowing headers to be adjusted
+// according to the outcome of the request.
+type headerHookResponseWriter struct {
 	http.ResponseWriter
-	status *int
-	size   *int
+	hook    func(status int)
+	written bool
 }
 
-// NewLoggingResponseWriter creates a new LoggingResponseWriter that wraps
-// the given ResponseWriter. It will log 4xx/5xx responses to stderr, and
-// everything else to stdout.
-func NewLoggingResponseWriter(w http.ResponseWriter) LoggingResponseWriter {
-	lrw := LoggingResponseWriter{
-		ResponseWriter: w,
-		status:         new(int),
-		size:           new(int),
+func (w *headerHookResponseWriter) WriteHeader(status int) {
+	if !w.written {
+		w.written = true
+		w.hook(status)
 	}
-	*lrw.status = 200 // as WriteHeader normally isn't called
-	*lrw.size = 0
-	return lrw
+	w.ResponseWriter.WriteHeader(status)
 }
 
-// WriteHeader records the status written in the response.
-func (w LoggingResponseWriter) WriteHeader(status int) {
-	w.ResponseWriter.WriteHeader(status)
-	*w.status = status
+func (w *headerHookResponseWriter) Write(b []byte) (int, error) {
+	if !w.written {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
 }
 
-func (w LoggingResponseWriter) Write(b []byte) (c int, e error) {
-	c, e = w.ResponseWriter.Write(b)
-	*w.size += c
-	return
+func (w *headerHookResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
 }
 
-func (w LoggingResponseWriter) log(req *http.Request) {
-	out := os.Stdout
-	if *w.status >= 400 && *w.status < 600 {
-		// direct all errors to stderr
-		out = os.Stderr
+// Headers removed by StripValidatorsHandler and StripIdentityHandler.
+var (
+	validatorHeaders   = []string{"ETag", "Last-Modified"}
+	conditionalHeaders = []string{"If-Match", "If-None-Match",
+		"If-Modified-Since", "If-Unmodified-Since", "If-Range"}
+	identityHeaders = []string{"Server", "X-Powered-By", "Via"}
+)
+
+// StripHeadersHandler removes the named headers from requests before they
+// are handled, and from responses just before they are written, so that
+// no other handler can add them back.
+func StripHeadersHandler(h http.Handler, request, response []string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, k := range request {
+			r.Header.Del(k)
+		}
+		h.ServeHTTP(&headerHookResponseWriter{
+			ResponseWriter: w,
+			hook: func(status int) {
+				for _, k := range response {
+					w.Header().Del(k)
+				}
+			},
+		}, r)
+	})
+}
+
+// StripValidatorsHandler removes cache validators (ETag and Last-Modified)
+// from responses, and ignores conditional requests that would use them.
+func StripValidatorsHandler(h http.Handler) http.Handler {
+	return StripHeadersHandler(h, conditionalHeaders, validatorHeaders)
+}
+
+// StripIdentityHandler removes headers identifying server software from
+// responses.
+func StripIdentityHandler(h http.Handler) http.Handler {
+	return StripHeadersHandler(h, nil, identityHeaders)
+}
+
+// ExpiresHandler sets consistent Expires and Cache-Control max-age headers on
+// non-error responses so that they may be cached for the given duration.
+func ExpiresHandler(h http.Handler, d time.Duration) http.Handler {
+	maxAge := "max-age=" + strconv.Itoa(int(d.Seconds()))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.ServeHTTP(&headerHookResponseWriter{
+			ResponseWriter: w,
+			hook: func(status int) {
+				if status >= 400 {
+					return
+				}
+				expires := time.Now().Add(d).UTC().Format(http.TimeFormat)
+				w.Header().Set("Expires", expires)
+				w.Header().Set("Cache-Control", maxAge)
+			},
+		}, r)
+	})
+}
+
+// ImmutableHandler marks successful responses for files whose names match
+// the pattern as cacheable forever, replacing any other Cache-Control.
+func ImmutableHandler(h http.Handler, pattern *regexp.Regexp) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !pattern.MatchString(path.Base(r.URL.Path)) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		h.ServeHTTP(&headerHookResponseWriter{
+			ResponseWriter: w,
+			hook: func(status int) {
+				if status == http.StatusOK ||
+					status == http.StatusPartialContent ||
+					status == http.StatusNotModified {
+					w.Header().Set("Cache-Control",
+						"public, max-age=31536000, immutable")
+				}
+			},
+		}, r)
+	})
+}
+
+// ContentTypeHandler sets the content type of successful responses for paths
+// matching a glob pattern of the map to the type it gives, in place of the
+// type guessed from the file's extension or content. Patterns starting with
+// a slash match whole URL paths, and others the base name. If several
+// patterns match, the longest is used.
+func ContentTypeHandler(h http.Handler, types map[string]string) http.Handler {
+	patterns := make([]string, 0, len(types))
+	for p := range types {
+		patterns = append(patterns, p)
+	}
+	sort.Slice(patterns, func(i, j int) bool {
+		if len(patterns[i]) != len(patterns[j]) {
+			return len(patterns[i]) > len(patterns[j])
+		}
+		return patterns[i] < patterns[j]
+	})
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctype := ""
+		for _, p := range patterns {
+			if matchContentTypePattern(p, r.URL.Path) {
+				ctype = types[p]
+				break
+			}
+		}
+		if ctype == "" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if metadataQuery(r) {
+			// The response describes the file, so isn't of its type
+			h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), contentTypeKey{}, ctype)))
+			return
+		}
+		h.ServeHTTP(&headerHookResponseWriter{
+			ResponseWriter: w,
+			hook: func(status int) {
+				if status == http.StatusOK || status == http.StatusPartialContent {
+					w.Header().Set("Content-Type", ctype)
+				}
+			},
+		}, r)
+	})
+}
+
+// matchContentTypePattern returns true if the glob pattern matches the URL
+// path, if it starts with a slash, or otherwise its base name.
+func matchContentTypePattern(pattern, p string) bool {
+	if !strings.HasPrefix(pattern, "/") {
+		p = path.Base(p)
 	}
+	m, _ := path.Match(pattern, p)
+	return m
+}
 
-	t := time.Now().Format(time.RFC3339)
-	remoteAddr, _, _ := net.SplitHostPort(req.RemoteAddr)
-	localAddr, _, _ := net.SplitHostPort(req.Host)
-	requestLine := req.Method + " " + req.RequestURI
+// contextReader reads from a reader until the context is cancelled, so that
+// work on behalf of a request stops once its client has gone.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
 
-	fmt.Fprintf(out, "%s [%s] %s %s %d %d\n", remoteAddr, t, localAddr,
-		strconv.Quote(requestLine), *w.status, *w.size)
+func (r contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
 }
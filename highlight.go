@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// maxHighlightSize is the largest file that will be highlighted; larger
+// files are served as-is.
+const maxHighlightSize = 1 << 20
+
+// syntax describes enough of a language to highlight it.
+type syntax struct {
+	lineComments []string
+	blockComment [2]string
+	quotes       string // characters that delimit strings
+	keywords     map[string]bool
+}
+
+func keywords(s string) map[string]bool {
+	m := make(map[string]bool)
+	for _, k := range strings.Fields(s) {
+		m[k] = true
+	}
+	return m
+}
+
+var (
+	cKeywords = keywords(`auto break case char const continue default do double
+		else enum extern float for goto if inline int long register return short
+		signed sizeof static struct switch typedef union unsigned void volatile
+		while bool true false NULL class namespace template typename public
+		private protected virtual new delete this throw try catch using nullptr`)
+	jsKeywords = keywords(`async await break case catch class const continue
+		debugger default delete do else export extends false finally for
+		function if import in instanceof let new null return super switch this
+		throw true try typeof undefined var void while yield of interface type
+		enum implements readonly`)
+	shKeywords = keywords(`if then else elif fi case esac for while until do
+		done in function return local export readonly set unset shift exit`)
+
+	syntaxes = map[string]*syntax{
+		"go": {[]string{"//"}, [2]string{"/*", "*/"}, "\"'`", keywords(`break case
+			chan const continue default defer else fallthrough for func go goto
+			if import interface map package range return select struct switch
+			type var true false nil iota`)},
+		"c":    {[]string{"//"}, [2]string{"/*", "*/"}, "\"'", cKeywords},
+		"js":   {[]string{"//"}, [2]string{"/*", "*/"}, "\"'`", jsKeywords},
+		"java": {[]string{"//"}, [2]string{"/*", "*/"}, "\"'", cKeywords},
+		"rust": {[]string{"//"}, [2]string{"/*", "*/"}, "\"", keywords(`as async
+			await break const continue crate dyn else enum extern false fn for if
+			impl in let loop match mod move mut pub ref return self Self static
+			struct super trait true type unsafe use where while`)},
+		"python": {[]string{"#"}, [2]string{}, "\"'", keywords(`and as assert
+			async await break class continue def del elif else except False
+			finally for from global if import in is lambda None nonlocal not or
+			pass raise return True try while with yield`)},
+		"ruby": {[]string{"#"}, [2]string{}, "\"'", keywords(`alias and begin
+			break case class def defined do else elsif end ensure false for if
+			in module next nil not or redo rescue retry return self super then
+			true undef unless until when while yield`)},
+		"sh":   {[]string{"#"}, [2]string{}, "\"'", shKeywords},
+		"yaml": {[]string{"#"}, [2]string{}, "\"'", keywords(`true false null yes no on off`)},
+		"conf": {[]string{"#", ";"}, [2]string{}, "\"'", keywords(`true false`)},
+		"json": {nil, [2]string{}, "\"", keywords(`true false null`)},
+		"css":  {nil, [2]string{"/*", "*/"}, "\"'", nil},
+		"html": {nil, [2]string{"<!--", "-->"}, "\"'", nil},
+		"sql": {[]string{"--"}, [2]string{"/*", "*/"}, "'\"", keywords(`select
+			from where and or not insert into values update set delete create
+			table index drop alter join left right inner outer on group by
+			order having limit as null is in like between union distinct
+			primary key foreign references default SELECT FROM WHERE AND OR
+			NOT INSERT INTO VALUES UPDATE SET DELETE CREATE TABLE INDEX DROP
+			ALTER JOIN LEFT RIGHT INNER OUTER ON GROUP BY ORDER HAVING LIMIT AS
+			NULL IS IN LIKE BETWEEN UNION DISTINCT PRIMARY KEY FOREIGN
+			REFERENCES DEFAULT`)},
+		"text": {nil, [2]string{}, "", nil},
+	}
+
+	// syntaxByExt maps file extensions to the syntax they're highlighted with.
+	syntaxByExt = map[string]string{
+		".go": "go", ".c": "c", ".h": "c", ".cc": "c", ".cpp": "c", ".hpp": "c",
+		".cs": "java", ".java": "java", ".kt": "java", ".swift": "java",
+		".js": "js", ".mjs": "js", ".jsx": "js", ".ts": "js", ".tsx": "js",
+		".rs": "rust", ".py": "python", ".rb": "ruby",
+		".sh": "sh", ".bash": "sh", ".zsh": "sh",
+		".yml": "yaml", ".yaml": "yaml", ".toml": "conf", ".ini": "conf",
+		".conf": "conf", ".cfg": "conf", ".env": "conf", ".properties": "conf",
+		".json": "json", ".css": "css", ".scss": "css",
+		".html": "html", ".htm": "html", ".xml": "html", ".svg": "html",
+		".sql": "sql", ".txt": "text", ".md": "text", ".log": "text",
+		".csv": "text", ".diff": "text", ".patch": "text",
+	}
+)
+
+// syntaxFor returns the syntax for the named file, or nil if it isn't a
+// known kind of text file.
+func syntaxFor(name string) *syntax {
+	switch path.Base(name) {
+	case "Makefile", "Dockerfile", "Vagrantfile", ".gitignore", ".bashrc", ".profile":
+		return syntaxes["sh"]
+	}
+	return syntaxes[syntaxByExt[strings.ToLower(path.Ext(name))]]
+}
+
+// highlightWriter writes highlighted source as HTML, one numbered line at a
+// time.
+type highlightWriter struct {
+	buf  bytes.Buffer
+	line int
+}
+
+func (w *highlightWriter) startLine() {
+	w.line++
+	fmt.Fprintf(&w.buf, `<span class="ln" id="L%d"><a href="#L%d">%d</a></span>`,
+		w.line, w.line, w.line)
+}
+
+// emit writes text in the given class (empty=plain), splitting spans at
+// line breaks so each line stands alone.
+func (w *highlightWriter) emit(class, text string) {
+	for i, part := range strings.Split(text, "\n") {
+		if i > 0 {
+			w.buf.WriteString("\n")
+			w.startLine()
+		}
+		if part == "" {
+			continue
+		}
+		if class != "" {
+			fmt.Fprintf(&w.buf, `<span class="%s">%s</span>`, class, html.EscapeString(part))
+		} else {
+			w.buf.WriteString(html.EscapeString(part))
+		}
+	}
+}
+
+func isIdentRune(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// highlight returns the source as HTML, with comments, strings, numbers and
+// keywords wrapped in spans of class c, s, n and k respectively.
+func highlight(src string, syn *syntax) []byte {
+	src = strings.TrimSuffix(src, "\n") // don't number an empty last line
+	w := &highlightWriter{}
+	w.startLine()
+	plain := 0 // start of plain text not yet emitted
+	i := 0
+	token := func(class string, end int) {
+		w.emit("", src[plain:i])
+		w.emit(class, src[i:end])
+		i, plain = end, end
+	}
+	for i < len(src) {
+		rest := src[i:]
+		if open := syn.blockComment[0]; open != "" && strings.HasPrefix(rest, open) {
+			end := strings.Index(rest[len(open):], syn.blockComment[1])
+			if end < 0 {
+				token("c", len(src))
+			} else {
+				token("c", i+len(open)+end+len(syn.blockComment[1]))
+			}
+			continue
+		}
+		comment := false
+		for _, lc := range syn.lineComments {
+			if strings.HasPrefix(rest, lc) && (i == 0 || src[i-1] != '$') {
+				end := strings.IndexByte(rest, '\n')
+				if end < 0 {
+					end = len(rest)
+				}
+				token("c", i+end)
+				comment = true
+				break
+			}
+		}
+		if comment {
+			continue
+		}
+		c := src[i]
+		if strings.IndexByte(syn.quotes, c) >= 0 {
+			end := i + 1
+			for end < len(src) && src[end] != c {
+				if src[end] == '\\' && c != '`' {
+					end++
+				} else if src[end] == '\n' && c != '`' {
+					break // unterminated
+				}
+				end++
+			}
+			if end > len(src) {
+				end = len(src) // ended with an escape
+			} else if end < len(src) && src[end] == c {
+				end++
+			}
+			token("s", end)
+			continue
+		}
+		r, size := utf8.DecodeRuneInString(rest)
+		prevIdent := false
+		if i > 0 {
+			pr, _ := utf8.DecodeLastRuneInString(src[:i])
+			prevIdent = isIdentRune(pr)
+		}
+		if isIdentRune(r) && !prevIdent {
+			end := i + size
+			for end < len(src) {
+				r, size := utf8.DecodeRuneInString(src[end:])
+				if !isIdentRune(r) && r != '.' {
+					break
+				}
+				if r == '.' && !unicode.IsDigit(rune(src[i])) {
+					break
+				}
+				end += size
+			}
+			word := src[i:end]
+			if unicode.IsDigit(rune(word[0])) {
+				token("n", end)
+			} else if syn.keywords[word] {
+				token("k", end)
+			} else {
+				i = end
+			}
+			continue
+		}
+		i += size
+	}
+	w.emit("", src[plain:])
+	return w.buf.Bytes()
+}
+
+// HighlightHandler renders text files as syntax-highlighted HTML with line
+// numbers, for browsers that ask for HTML. Requests with a `raw` query
+// parameter, and files that aren't recognised or are too large, are served
+// as-is. Requests must have had the serve's prefix stripped from their path.
+func HighlightHandler(h http.Handler, fs http.FileSystem) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		syn := syntaxFor(r.URL.Path)
+		if syn == nil || r.URL.Query().Has("raw") ||
+			!strings.Contains(r.Header.Get("Accept"), "text/html") ||
+			(r.Method != http.MethodGet && r.Method != http.MethodHead) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		name := path.Clean("/" + r.URL.Path)
+		f, err := requestFileSystem(fs, r).Open(name)
+		if err != nil {
+			h.ServeHTTP(w, r)
+			return
+		}
+		defer f.Close()
+		fi, err := f.Stat()
+		if err != nil || fi.IsDir() || fi.Size() > maxHighlightSize {
+			h.ServeHTTP(w, r)
+			return
+		}
+		src, err := ioutil.ReadAll(f)
+		if err != nil || !utf8.Valid(src) {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		base := html.EscapeString(path.Base(name))
+		raw := html.EscapeString((&url.URL{Path: path.Base(name), RawQuery: "raw"}).String())
+		var buf bytes.Buffer
+		fmt.Fprintf(&buf, highlightPage, base, base, raw)
+		buf.Write(highlight(string(src), syn))
+		buf.WriteString("</pre>\n")
+
+		hdr := w.Header()
+		hdr.Set("Content-Type", "text/html; charset=utf-8")
+		hdr.Add("Vary", "Accept")
+		http.ServeContent(w, r, "", fi.ModTime(), bytes.NewReader(buf.Bytes()))
+	})
+}
+
+const highlightPage = `<!doctype html>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width">
+<title>%s</title>
+<style>
+body { margin: 0; font-family: -apple-system, "Segoe UI", Helvetica, Arial, sans-serif; background: #fafafa; color: #333; }
+header { padding: .5em 1em; border-bottom: 1px solid #ddd; }
+pre { margin: 0; padding: .5em 0; font-size: 13px; line-height: 1.45; }
+.ln { display: inline-block; width: 4em; padding-right: 1em; text-align: right; color: #aaa; user-select: none; }
+.ln a { color: inherit; text-decoration: none; }
+.ln:target { background: #ffe; }
+.c { color: #6a737d; font-style: italic; } .s { color: #032f62; } .n { color: #005cc5; } .k { color: #d73a49; }
+@media (prefers-color-scheme: dark) {
+  body { background: #1e1e1e; color: #ddd; } header { border-color: #333; }
+  .c { color: #8b949e; } .s { color: #a5d6ff; } .n { color: #79c0ff; } .k { color: #ff7b72; }
+}
+</style>
+<header><strong>%s</strong> &middot; <a href="%s">raw</a></header>
+<pre>`
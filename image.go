@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// maxImagePixels limits the size of images that will be decoded, to bound
+// the memory used when scaling.
+const maxImagePixels = 64 << 20
+
+// imageExts are the extensions of image files that can be decoded.
+var imageExts = map[string]bool{
+	".jpg": true, ".jpeg": true, ".png": true, ".gif": true,
+}
+
+// isImage returns true if the file name has the extension of an image that
+// can be decoded.
+func isImage(name string) bool {
+	return imageExts[strings.ToLower(path.Ext(name))]
+}
+
+// decodeImage decodes an image, refusing any that are unreasonably large.
+func decodeImage(r io.ReadSeeker) (image.Image, string, error) {
+	cfg, _, err := image.DecodeConfig(r)
+	if err != nil {
+		return nil, "", err
+	}
+	if cfg.Width*cfg.Height > maxImagePixels {
+		return nil, "", fmt.Errorf("image is too large (%dx%d)", cfg.Width, cfg.Height)
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, "", err
+	}
+	return image.Decode(r)
+}
+
+// fitSize returns the largest size with the aspect ratio of the source that
+// fits within the given width and height, without enlarging it. A zero
+// width or height leaves that dimension unconstrained.
+func fitSize(srcW, srcH, w, h int) (int, int) {
+	if w <= 0 || w > srcW {
+		w = srcW
+	}
+	if h <= 0 || h > srcH {
+		h = srcH
+	}
+	if srcW*h > srcH*w {
+		h = srcH * w / srcW
+	} else {
+		w = srcW * h / srcH
+	}
+	if w < 1 {
+		w = 1
+	}
+	if h < 1 {
+		h = 1
+	}
+	return w, h
+}
+
+// scaleImage scales the image to the given size, averaging the source
+// pixels covered by each destination pixel.
+func scaleImage(src image.Image, w, h int) image.Image {
+	b := src.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		y0 := b.Min.Y + y*b.Dy()/h
+		y1 := b.Min.Y + (y+1)*b.Dy()/h
+		if y1 == y0 {
+			y1++
+		}
+		for x := 0; x < w; x++ {
+			x0 := b.Min.X + x*b.Dx()/w
+			x1 := b.Min.X + (x+1)*b.Dx()/w
+			if x1 == x0 {
+				x1++
+			}
+			var r, g, bl, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := src.At(sx, sy).RGBA()
+					r, g, bl, a = r+uint64(cr), g+uint64(cg), bl+uint64(cb), a+uint64(ca)
+					n++
+				}
+			}
+			dst.SetRGBA(x, y, color.RGBA{
+				uint8(r / n >> 8), uint8(g / n >> 8), uint8(bl / n >> 8), uint8(a / n >> 8),
+			})
+		}
+	}
+	return dst
+}
+
+// encodeImage encodes the image in the named format (jpeg, png or gif).
+func encodeImage(w io.Writer, img image.Image, format string) error {
+	switch format {
+	case "jpeg":
+		return jpeg.Encode(w, img, &jpeg.Options{Quality: 85})
+	case "png":
+		return png.Encode(w, img)
+	case "gif":
+		return gif.Encode(w, img, nil)
+	}
+	return fmt.Errorf("unsupported image format %s", format)
+}
+
+// ImageCache stores scaled copies of images on disk, keyed by the original
+// file's name, size and modification time, and the scaling parameters.
+type ImageCache struct {
+	dir string
+}
+
+// NewImageCache creates a cache storing images in the given directory.
+func NewImageCache(dir string) *ImageCache {
+	return &ImageCache{dir: dir}
+}
+
+// Serve responds with a copy of the named image from the file system, scaled
+// to fit the given size and encoded in the given format (empty=that of the
+// original), generating and caching it if necessary.
+func (c *ImageCache) Serve(w http.ResponseWriter, r *http.Request, fs http.FileSystem, name string, width, height int, format string) {
+	f, err := fs.Open(name)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil || fi.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+
+	key := sha256.Sum256([]byte(fmt.Sprintf("%s\x00%d\x00%d\x00%dx%d\x00%s",
+		name, fi.Size(), fi.ModTime().UnixNano(), width, height, format)))
+	file := filepath.Join(c.dir, hex.EncodeToString(key[:]))
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		data, err = c.generate(f, file, width, height, format)
+		if err != nil {
+			http.Error(w, "Couldn't scale image", http.StatusUnsupportedMediaType)
+			return
+		}
+	}
+
+	if format == "" {
+		_, format, _ = image.DecodeConfig(bytes.NewReader(data))
+	}
+	w.Header().Set("Content-Type", "image/"+format)
+	http.ServeContent(w, r, "", fi.ModTime(), bytes.NewReader(data))
+}
+
+// generate scales the image, and writes it to the cache file.
+func (c *ImageCache) generate(f http.File, file string, width, height int, format string) ([]byte, error) {
+	src, srcFormat, err := decodeImage(f)
+	if err != nil {
+		return nil, err
+	}
+	if format == "" {
+		format = srcFormat
+	}
+	b := src.Bounds()
+	w, h := fitSize(b.Dx(), b.Dy(), width, height)
+	var buf bytes.Buffer
+	if err := encodeImage(&buf, scaleImage(src, w, h), format); err != nil {
+		return nil, err
+	}
+
+	// Write atomically, so concurrent requests never see a partial file
+	if err := os.MkdirAll(c.dir, 0755); err == nil {
+		tmp, err := ioutil.TempFile(c.dir, ".tmp-")
+		if err == nil {
+			_, err = tmp.Write(buf.Bytes())
+			tmp.Close()
+			if err == nil {
+				err = os.Rename(tmp.Name(), file)
+			}
+			if err != nil {
+				os.Remove(tmp.Name())
+			}
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// ImageSize is a size images may be scaled to fit. A zero width or height
+// leaves that dimension unconstrained.
+type ImageSize struct {
+	Width, Height int
+}
+
+// parseImageSize parses a size such as "640x480", "640x" or "x480".
+func parseImageSize(s string) (ImageSize, error) {
+	var size ImageSize
+	i := strings.Index(s, "x")
+	if i < 0 {
+		return size, fmt.Errorf("invalid size `%s`", s)
+	}
+	var err error
+	if w := s[:i]; w != "" {
+		if size.Width, err = strconv.Atoi(w); err != nil || size.Width <= 0 {
+			return size, fmt.Errorf("invalid width in `%s`", s)
+		}
+	}
+	if h := s[i+1:]; h != "" {
+		if size.Height, err = strconv.Atoi(h); err != nil || size.Height <= 0 {
+			return size, fmt.Errorf("invalid height in `%s`", s)
+		}
+	}
+	if size.Width == 0 && size.Height == 0 {
+		return size, fmt.Errorf("invalid size `%s`", s)
+	}
+	return size, nil
+}
+
+// imageFormats maps the formats that may be requested to those understood
+// by encodeImage.
+var imageFormats = map[string]string{
+	"jpeg": "jpeg", "jpg": "jpeg", "png": "png", "gif": "gif",
+}
+
+// ResizeHandler serves images scaled according to the `w` and `h` query
+// parameters, and converted to the `format` parameter, if given. Only the
+// allowed sizes may be requested, so that clients can't fill the cache with
+// arbitrary sizes. Requests must have had the serve's prefix stripped from
+// their path.
+func ResizeHandler(h http.Handler, fs http.FileSystem, cache *ImageCache, sizes []ImageSize) http.Handler {
+	allowed := make(map[ImageSize]bool, len(sizes))
+	for _, s := range sizes {
+		allowed[s] = true
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if !isImage(r.URL.Path) || (!q.Has("w") && !q.Has("h") && !q.Has("format")) {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		var size ImageSize
+		var err error
+		if v := q.Get("w"); v != "" {
+			size.Width, err = strconv.Atoi(v)
+		}
+		if v := q.Get("h"); v != "" && err == nil {
+			size.Height, err = strconv.Atoi(v)
+		}
+		if err != nil || (size != ImageSize{} && !allowed[size]) {
+			http.Error(w, "Size not allowed", http.StatusBadRequest)
+			return
+		}
+		format := ""
+		if v := q.Get("format"); v != "" {
+			if format = imageFormats[strings.ToLower(v)]; format == "" {
+				http.Error(w, "Unsupported image format", http.StatusUnsupportedMediaType)
+				return
+			}
+		}
+
+		name := path.Clean("/" + r.URL.Path)
+		cache.Serve(w, r, requestFileSystem(fs, r), name, size.Width, size.Height, format)
+	})
+}
@@ -0,0 +1,846 @@
+package main
+
+import (
+	"gopkg.in/v1/yaml"
+
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// directive is a directive of an nginx or Caddy configuration, with the
+// directives of any block it opens.
+type directive struct {
+	name  string
+	args  []string
+	block []directive
+	line  int
+}
+
+// token is a word or punctuation of a configuration being imported.
+type token struct {
+	text   string
+	line   int
+	quoted bool
+}
+
+// tokenize splits a configuration into words and the punctuation characters
+// given, skipping # comments. Quoted words may contain any character.
+func tokenize(src string, punct string) ([]token, error) {
+	var tokens []token
+	line := 1
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == '\n':
+			line++
+			if strings.Contains(punct, "\n") {
+				tokens = append(tokens, token{"\n", line - 1, false})
+			}
+			i++
+		case c == ' ' || c == '\t' || c == '\r':
+			i++
+		case c == '#':
+			for i < len(src) && src[i] != '\n' {
+				i++
+			}
+		case strings.IndexByte(punct, c) >= 0:
+			tokens = append(tokens, token{string(c), line, false})
+			i++
+		case c == '"' || c == '\'' || c == '`':
+			start := line
+			var b strings.Builder
+			for i++; i < len(src) && src[i] != c; i++ {
+				if src[i] == '\\' && c != '`' && i+1 < len(src) {
+					i++
+				}
+				if src[i] == '\n' {
+					line++
+				}
+				b.WriteByte(src[i])
+			}
+			if i >= len(src) {
+				return nil, fmt.Errorf("line %d: unterminated quote", start)
+			}
+			i++
+			tokens = append(tokens, token{b.String(), start, true})
+		default:
+			start := i
+			for i < len(src) && !strings.ContainsRune(" \t\r\n", rune(src[i])) &&
+				strings.IndexByte(punct, src[i]) < 0 {
+				i++
+			}
+			tokens = append(tokens, token{src[start:i], line, false})
+		}
+	}
+	return tokens, nil
+}
+
+// parseNginx parses an nginx configuration, in which directives end with
+// semicolons or blocks.
+func parseNginx(src string) ([]directive, error) {
+	tokens, err := tokenize(src, ";{}")
+	if err != nil {
+		return nil, err
+	}
+	ds, rest, err := parseNginxBlock(tokens, false)
+	if err == nil && len(rest) > 0 {
+		err = fmt.Errorf("line %d: unexpected }", rest[0].line)
+	}
+	return ds, err
+}
+
+func parseNginxBlock(tokens []token, nested bool) ([]directive, []token, error) {
+	var ds []directive
+	var d *directive
+	for len(tokens) > 0 {
+		t := tokens[0]
+		tokens = tokens[1:]
+		switch {
+		case t.text == "}" && !t.quoted:
+			if d != nil {
+				return nil, nil, fmt.Errorf("line %d: missing ;", d.line)
+			}
+			if !nested {
+				return ds, append([]token{t}, tokens...), nil
+			}
+			return ds, tokens, nil
+		case d == nil:
+			d = &directive{name: t.text, line: t.line}
+		case t.text == ";" && !t.quoted:
+			ds = append(ds, *d)
+			d = nil
+		case t.text == "{" && !t.quoted:
+			var err error
+			if d.block, tokens, err = parseNginxBlock(tokens, true); err != nil {
+				return nil, nil, err
+			}
+			ds = append(ds, *d)
+			d = nil
+		default:
+			d.args = append(d.args, t.text)
+		}
+	}
+	if d != nil {
+		return nil, nil, fmt.Errorf("line %d: missing ;", d.line)
+	}
+	if nested {
+		return nil, nil, errors.New("missing }")
+	}
+	return ds, nil, nil
+}
+
+// parseCaddyfile parses a Caddyfile, in which each line is a directive, and
+// a line ending with { opens a block.
+func parseCaddyfile(src string) ([]directive, error) {
+	tokens, err := tokenize(src, "{}\n")
+	if err != nil {
+		return nil, err
+	}
+	ds, rest, err := parseCaddyBlock(tokens, false)
+	if err == nil && len(rest) > 0 {
+		err = fmt.Errorf("line %d: unexpected }", rest[0].line)
+	}
+	return ds, err
+}
+
+func parseCaddyBlock(tokens []token, nested bool) ([]directive, []token, error) {
+	var ds []directive
+	var d *directive
+	for len(tokens) > 0 {
+		t := tokens[0]
+		tokens = tokens[1:]
+		switch {
+		case t.text == "\n" && !t.quoted:
+			if d != nil {
+				ds = append(ds, *d)
+				d = nil
+			}
+		case t.text == "}" && !t.quoted:
+			if d != nil {
+				ds = append(ds, *d)
+			}
+			if !nested {
+				return ds, append([]token{t}, tokens...), nil
+			}
+			return ds, tokens, nil
+		case t.text == "{" && !t.quoted:
+			if d == nil {
+				// a block without a name, e.g. global options
+				d = &directive{line: t.line}
+			}
+			var err error
+			if d.block, tokens, err = parseCaddyBlock(tokens, true); err != nil {
+				return nil, nil, err
+			}
+			ds = append(ds, *d)
+			d = nil
+		case d == nil:
+			d = &directive{name: t.text, line: t.line}
+		default:
+			d.args = append(d.args, t.text)
+		}
+	}
+	if d != nil {
+		ds = append(ds, *d)
+	}
+	if nested {
+		return nil, nil, errors.New("missing }")
+	}
+	return ds, nil, nil
+}
+
+// importer translates a configuration into a goserve configuration,
+// recording what couldn't be translated.
+type importer struct {
+	file     string
+	cfg      ServerConfig
+	warnings []string
+}
+
+func (im *importer) warn(d directive, format string, args ...interface{}) {
+	im.warnings = append(im.warnings,
+		fmt.Sprintf("%s:%d: ", im.file, d.line)+fmt.Sprintf(format, args...))
+}
+
+func (im *importer) unsupported(d directive) {
+	im.warn(d, "unsupported directive `%s`", strings.TrimSpace(d.name+" "+strings.Join(d.args, " ")))
+}
+
+// addListener adds a listener for the address, unless there already is one.
+func (im *importer) addListener(l Listener) {
+	for _, m := range im.cfg.Listeners {
+		if m.Addr == l.Addr {
+			return
+		}
+	}
+	im.cfg.Listeners = append(im.cfg.Listeners, l)
+}
+
+// addServe adds the serve, unless one already serves its path.
+func (im *importer) addServe(d directive, s Serve) {
+	for _, t := range im.cfg.Serves {
+		if t.Path == s.Path {
+			im.warn(d, "%s is already served; ignoring", s.Path)
+			return
+		}
+	}
+	im.cfg.Serves = append(im.cfg.Serves, s)
+}
+
+// redirectStatus returns the status of a redirect, or 0 if the code isn't
+// a redirect.
+func redirectStatus(code string) int {
+	switch code {
+	case "permanent", "301":
+		return 301
+	case "redirect", "temporary", "", "302":
+		return 302
+	case "303", "307", "308":
+		n, _ := strconv.Atoi(code)
+		return n
+	}
+	return 0
+}
+
+// nginxIgnored are nginx directives that don't affect what's served.
+var nginxIgnored = map[string]bool{
+	"user": true, "worker_processes": true, "worker_connections": true,
+	"pid": true, "events": true, "error_log": true, "access_log": true,
+	"sendfile": true, "tcp_nopush": true, "tcp_nodelay": true,
+	"keepalive_timeout": true, "types": true, "default_type": true,
+	"server_tokens": true, "charset": true, "server_name": true,
+	"ssl_protocols": true, "ssl_ciphers": true, "ssl_prefer_server_ciphers": true,
+	"ssl_session_cache": true, "ssl_session_timeout": true,
+	"gzip_vary": true, "gzip_proxied": true, "gzip_min_length": true,
+	"proxy_set_header": true, "proxy_http_version": true,
+}
+
+// nginxLiteralPath matches rewrite regexps that match a single path.
+var nginxLiteralPath = regexp.MustCompile(`^\^(/[A-Za-z0-9_./-]*)\$$`)
+
+// nginxServer holds the settings of an nginx server block that apply to the
+// listeners and serves it describes.
+type nginxServer struct {
+	root      string
+	indexes   bool
+	gzip      *bool
+	gzipTypes []string
+	gzipLevel int
+	cert, key string
+	headers   Headers
+	listeners []Listener
+}
+
+// set applies a directive of an http or server block that may be inherited
+// by servers, returning false if it isn't one.
+func (srv *nginxServer) set(d directive) bool {
+	switch d.name {
+	case "root":
+		if len(d.args) == 1 {
+			srv.root = d.args[0]
+		}
+	case "autoindex":
+		srv.indexes = len(d.args) == 1 && d.args[0] == "on"
+	case "gzip":
+		on := len(d.args) == 1 && d.args[0] == "on"
+		srv.gzip = &on
+	case "gzip_types":
+		srv.gzipTypes = append(srv.gzipTypes, d.args...)
+	case "gzip_comp_level":
+		if len(d.args) == 1 {
+			srv.gzipLevel, _ = strconv.Atoi(d.args[0])
+		}
+	case "ssl_certificate":
+		if len(d.args) == 1 {
+			srv.cert = d.args[0]
+		}
+	case "ssl_certificate_key":
+		if len(d.args) == 1 {
+			srv.key = d.args[0]
+		}
+	case "add_header":
+		if len(d.args) >= 2 {
+			srv.headers[d.args[0]] = d.args[1]
+		}
+	default:
+		return false
+	}
+	return true
+}
+
+func (im *importer) nginx(ds []directive) {
+	servers := 0
+	var walk func(ds []directive, http bool)
+	walk = func(ds []directive, http bool) {
+		defaults := nginxServer{headers: Headers{}}
+		for _, d := range ds {
+			switch {
+			case d.name == "http" && !http:
+				walk(d.block, true)
+			case d.name == "server":
+				if servers++; servers == 2 {
+					im.warn(d, "server blocks are merged, as goserve serves the same paths on every listener")
+				}
+				im.nginxServer(d.block, defaults)
+			case d.name == "include":
+				if len(d.args) != 1 || path.Base(d.args[0]) != "mime.types" {
+					im.warn(d, "included files aren't imported; import them separately")
+				}
+			case http && defaults.set(d):
+			case !nginxIgnored[d.name]:
+				im.unsupported(d)
+			}
+		}
+	}
+	walk(ds, false)
+	if servers == 0 {
+		// A file included into a server block
+		im.nginxServer(ds, nginxServer{headers: Headers{}})
+	}
+}
+
+// nginxServer translates a server block, which inherits the settings of the
+// http block.
+func (im *importer) nginxServer(ds []directive, srv nginxServer) {
+	headers := srv.headers
+	srv.headers = Headers{}
+	for k, v := range headers {
+		srv.headers[k] = v
+	}
+	var locations, routes []directive
+	for _, d := range ds {
+		switch d.name {
+		case "listen":
+			if len(d.args) == 0 {
+				im.unsupported(d)
+				continue
+			}
+			addr := d.args[0]
+			if _, err := strconv.Atoi(addr); err == nil {
+				addr = ":" + addr
+			} else if host, port, err := net.SplitHostPort(addr); err == nil && host == "::" {
+				addr = ":" + port // Go listens on IPv4 and IPv6 alike
+			}
+			l := Listener{Protocol: "http", Addr: addr}
+			for _, a := range d.args[1:] {
+				if a == "ssl" {
+					l.Protocol = "https"
+				}
+			}
+			srv.listeners = append(srv.listeners, l)
+		case "index":
+			if len(d.args) != 1 || d.args[0] != "index.html" {
+				im.warn(d, "only index.html is used as the index")
+			}
+		case "location":
+			locations = append(locations, d)
+		case "error_page", "return", "rewrite":
+			routes = append(routes, d)
+		case "include":
+			im.warn(d, "included files aren't imported; import them separately")
+		default:
+			if !srv.set(d) && !nginxIgnored[d.name] {
+				im.unsupported(d)
+			}
+		}
+	}
+	for _, d := range routes {
+		im.nginxRoute(d, srv.root, "")
+	}
+
+	if len(srv.listeners) == 0 {
+		srv.listeners = []Listener{{Protocol: "http", Addr: ":80"}}
+	}
+	for _, l := range srv.listeners {
+		if l.Protocol == "https" {
+			l.CertFile, l.KeyFile = srv.cert, srv.key
+		}
+		if srv.gzip != nil {
+			l.Gzip = *srv.gzip
+			l.GzipTypes = srv.gzipTypes
+			l.GzipLevel = srv.gzipLevel
+		}
+		if len(srv.headers) > 0 {
+			l.Headers = srv.headers
+		}
+		im.addListener(l)
+	}
+
+	root := false
+	for _, d := range locations {
+		if im.nginxLocation(d, srv) == "/" {
+			root = true
+		}
+	}
+	if !root && srv.root != "" {
+		im.addServe(directive{}, Serve{Path: "/", Target: srv.root, Indexes: srv.indexes})
+	}
+}
+
+// nginxRoute translates the error_page, return and rewrite directives of a
+// server, or of the location with the path.
+func (im *importer) nginxRoute(d directive, root, location string) {
+	switch d.name {
+	case "error_page":
+		if len(d.args) < 2 || !strings.HasPrefix(d.args[len(d.args)-1], "/") {
+			im.unsupported(d)
+			return
+		}
+		uri := d.args[len(d.args)-1]
+		for _, code := range d.args[:len(d.args)-1] {
+			status, err := strconv.Atoi(code)
+			if err != nil {
+				im.warn(d, "changing the status with %s isn't supported", code)
+				continue
+			}
+			e := Error{Status: status, Target: filepath.Join(root, uri)}
+			if location != "" {
+				e.Path = location
+			}
+			im.cfg.Errors = append(im.cfg.Errors, e)
+		}
+	case "return":
+		from := location
+		if from == "" {
+			from = "/"
+		}
+		if len(d.args) == 2 {
+			if status := redirectStatus(d.args[0]); status != 0 {
+				to := d.args[1]
+				if strings.Contains(to, "$") {
+					im.warn(d, "redirects with variables aren't supported")
+					return
+				}
+				im.cfg.Redirects = append(im.cfg.Redirects, Redirect{from, to, status})
+				return
+			}
+		}
+		if len(d.args) == 1 {
+			if status, err := strconv.Atoi(d.args[0]); err == nil && status >= 400 {
+				im.cfg.Serves = append(im.cfg.Serves, Serve{Path: from, Error: status})
+				return
+			}
+		}
+		im.unsupported(d)
+	case "rewrite":
+		if len(d.args) == 3 {
+			m := nginxLiteralPath.FindStringSubmatch(d.args[0])
+			status := redirectStatus(d.args[2])
+			if m != nil && status != 0 && d.args[2] != "" {
+				im.cfg.Redirects = append(im.cfg.Redirects, Redirect{m[1], d.args[1], status})
+				return
+			}
+		}
+		im.warn(d, "only rewrites of a single path to a redirect are supported")
+	}
+}
+
+// nginxLocation translates a location block, returning its path if it's
+// served.
+func (im *importer) nginxLocation(d directive, srv nginxServer) string {
+	if len(d.args) == 2 && (d.args[0] == "=" || d.args[0] == "^~") {
+		if d.args[0] == "=" {
+			im.warn(d, "exact location %s is imported as a prefix", d.args[1])
+		}
+		d.args = d.args[1:]
+	}
+	if len(d.args) != 1 || !strings.HasPrefix(d.args[0], "/") {
+		im.warn(d, "regular expression locations aren't supported")
+		return ""
+	}
+	loc := d.args[0]
+	s := Serve{Path: loc, Indexes: srv.indexes, Headers: Headers{}}
+	root := srv.root
+	alias := ""
+	returns := false
+	for _, c := range d.block {
+		switch c.name {
+		case "root":
+			if len(c.args) == 1 {
+				root = c.args[0]
+			}
+		case "alias":
+			if len(c.args) == 1 {
+				alias = c.args[0]
+			}
+		case "autoindex":
+			s.Indexes = len(c.args) == 1 && c.args[0] == "on"
+		case "add_header":
+			if len(c.args) >= 2 {
+				s.Headers[c.args[0]] = c.args[1]
+			}
+		case "expires":
+			if len(c.args) == 1 {
+				if c.args[0] == "max" {
+					s.Expires = "365d"
+				} else if _, err := parseDuration(c.args[0]); err == nil {
+					s.Expires = c.args[0]
+				} else if c.args[0] != "off" {
+					im.unsupported(c)
+				}
+			}
+		case "proxy_pass":
+			if len(c.args) == 1 {
+				u := c.args[0]
+				if i := strings.Index(strings.TrimPrefix(strings.TrimPrefix(u, "http://"), "https://"), "/"); i < 0 {
+					// Without a URI, nginx passes the full request path
+					u = strings.TrimSuffix(u, "/") + loc
+				}
+				s.Proxy = &Proxy{URL: u}
+			}
+		case "index":
+			if len(c.args) != 1 || c.args[0] != "index.html" {
+				im.warn(c, "only index.html is used as the index")
+			}
+		case "error_page", "return", "rewrite":
+			returns = returns || c.name != "error_page"
+			im.nginxRoute(c, root, loc)
+		default:
+			if !nginxIgnored[c.name] {
+				im.unsupported(c)
+			}
+		}
+	}
+	if len(s.Headers) == 0 {
+		s.Headers = nil
+	}
+	switch {
+	case returns:
+		return ""
+	case s.Proxy != nil:
+		s.Indexes = false
+	case alias != "":
+		s.Target = alias
+	case root != "":
+		s.Target = filepath.Join(root, loc)
+	default:
+		im.warn(d, "location %s has no root", loc)
+		return ""
+	}
+	im.addServe(d, s)
+	return loc
+}
+
+// caddyAddress returns the listener of a Caddy site address. Site names
+// without a scheme or port use HTTPS, which needs a certificate.
+func caddyAddress(addr string) Listener {
+	l := Listener{Protocol: "https", Addr: ":443"}
+	if strings.HasPrefix(addr, "http://") {
+		l = Listener{Protocol: "http", Addr: ":80"}
+		addr = strings.TrimPrefix(addr, "http://")
+	}
+	addr = strings.TrimPrefix(addr, "https://")
+	if i := strings.IndexByte(addr, '/'); i >= 0 {
+		addr = addr[:i]
+	}
+	if _, port, err := net.SplitHostPort(addr); err == nil {
+		l.Addr = ":" + port
+		if port == "80" || strings.HasPrefix(addr, ":") && port != "443" {
+			l.Protocol = "http"
+		}
+	}
+	return l
+}
+
+// caddyPath returns the path of a Caddy path matcher, e.g. /api/*, or "" if
+// the argument isn't one.
+func caddyPath(m string) string {
+	if !strings.HasPrefix(m, "/") {
+		return ""
+	}
+	return strings.TrimSuffix(m, "*")
+}
+
+func (im *importer) caddy(ds []directive) {
+	for i, d := range ds {
+		if d.name == "" {
+			// Global options
+			for _, o := range d.block {
+				im.unsupported(o)
+			}
+			continue
+		}
+		if d.block == nil {
+			// A single site without braces is all the rest of the file
+			im.caddySite(directive{name: d.name, args: d.args, line: d.line, block: ds[i+1:]})
+			return
+		}
+		im.caddySite(d)
+	}
+}
+
+func (im *importer) caddySite(site directive) {
+	var listeners []Listener
+	for _, a := range append([]string{site.name}, site.args...) {
+		listeners = append(listeners, caddyAddress(strings.TrimSuffix(a, ",")))
+	}
+	var root, cert, key string
+	var browse, files, gzip bool
+	headers := Headers{}
+	var serves []Serve
+	for _, d := range site.block {
+		args := d.args
+		switch d.name {
+		case "root":
+			if len(args) > 0 && args[0] == "*" {
+				args = args[1:]
+			}
+			if len(args) == 1 {
+				root = args[0]
+			} else {
+				im.unsupported(d)
+			}
+		case "file_server":
+			files = true
+			browse = len(args) > 0 && args[len(args)-1] == "browse"
+		case "encode":
+			for _, a := range args {
+				if a == "gzip" {
+					gzip = true
+				}
+			}
+		case "header":
+			p := ""
+			if len(args) > 0 && caddyPath(args[0]) != "" {
+				p, args = caddyPath(args[0]), args[1:]
+			}
+			if p != "" && p != "/" {
+				im.warn(d, "headers for %s are applied to the whole site", p)
+			}
+			if len(args) >= 2 {
+				headers[args[0]] = strings.Join(args[1:], " ")
+			} else if len(args) == 1 && strings.HasPrefix(args[0], "-") {
+				headers[args[0]] = ""
+			}
+			for _, h := range d.block {
+				if len(h.args) > 0 {
+					headers[h.name] = strings.Join(h.args, " ")
+				} else if strings.HasPrefix(h.name, "-") {
+					headers[h.name] = ""
+				}
+			}
+		case "redir":
+			from := "/"
+			if len(args) > 0 && caddyPath(args[0]) != "" && len(args) >= 2 {
+				from, args = args[0], args[1:]
+			}
+			code := ""
+			if len(args) > 1 {
+				code = args[1]
+			}
+			if status := redirectStatus(code); len(args) >= 1 && status != 0 {
+				if strings.Contains(args[0], "{") || strings.HasSuffix(from, "*") {
+					im.warn(d, "placeholders in redirects aren't supported; check %s", from)
+				}
+				im.cfg.Redirects = append(im.cfg.Redirects, Redirect{caddyPath(from), args[0], status})
+			} else {
+				im.unsupported(d)
+			}
+		case "reverse_proxy":
+			p := "/"
+			if len(args) > 0 && caddyPath(args[0]) != "" {
+				p, args = caddyPath(args[0]), args[1:]
+			}
+			if len(args) < 1 {
+				im.unsupported(d)
+				continue
+			}
+			var urls []string
+			for _, u := range args {
+				if !strings.Contains(u, "://") {
+					u = "http://" + u
+				}
+				if p != "/" {
+					u = strings.TrimSuffix(u, "/") + p // Caddy passes the full path
+				}
+				urls = append(urls, u)
+			}
+			proxy := &Proxy{URL: urls[0]}
+			if len(urls) > 1 {
+				proxy = &Proxy{URLs: urls}
+			}
+			serves = append(serves, Serve{Path: p, Proxy: proxy})
+		case "handle_path":
+			if len(args) != 1 || caddyPath(args[0]) == "" {
+				im.unsupported(d)
+				continue
+			}
+			s := Serve{Path: caddyPath(args[0])}
+			for _, c := range d.block {
+				switch {
+				case c.name == "root" && len(c.args) > 0:
+					s.Target = c.args[len(c.args)-1]
+				case c.name == "file_server":
+					s.Indexes = len(c.args) > 0 && c.args[len(c.args)-1] == "browse"
+				default:
+					im.unsupported(c)
+				}
+			}
+			if s.Target == "" {
+				im.warn(d, "handle_path %s has no root", s.Path)
+				continue
+			}
+			serves = append(serves, s)
+		case "tls":
+			if len(args) == 2 {
+				cert, key = args[0], args[1]
+			} else {
+				im.warn(d, "automatic certificates aren't supported; give cert and key files")
+			}
+		case "log":
+		default:
+			im.unsupported(d)
+		}
+	}
+
+	for _, l := range listeners {
+		if l.Protocol == "https" {
+			if cert == "" {
+				im.warn(site, "%s needs a certificate and key", site.name)
+			}
+			l.CertFile, l.KeyFile = cert, key
+		}
+		l.Gzip = gzip
+		if len(headers) > 0 {
+			l.Headers = headers
+		}
+		im.addListener(l)
+	}
+	if files && root != "" {
+		serves = append(serves, Serve{Path: "/", Target: root, Indexes: browse})
+	} else if root != "" {
+		im.warn(site, "root %s isn't served without file_server", root)
+	}
+	for _, s := range serves {
+		im.addServe(site, s)
+	}
+}
+
+// runConfig implements the `config` subcommand, which works with
+// configurations.
+func runConfig(args []string) int {
+	if len(args) == 0 || args[0] != "import" {
+		fmt.Fprintln(os.Stderr, "Usage: goserve config import [flags]")
+		return 2
+	}
+	return runConfigImport(args[1:])
+}
+
+// runConfigImport implements `config import`, which translates the common
+// parts of an nginx configuration or Caddyfile into a goserve configuration,
+// listing what couldn't be translated.
+func runConfigImport(args []string) int {
+	fs := flag.NewFlagSet("config import", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: goserve config import -from file [flags]")
+		fs.PrintDefaults()
+	}
+	from := fs.String("from", "", "nginx configuration or Caddyfile to import")
+	format := fs.String("format", "", "Format of the file: nginx or caddy (default: by file name)")
+	out := fs.String("o", "", "File to write the configuration to (default: standard output)")
+	fs.Parse(args)
+	if *from == "" {
+		fs.Usage()
+		return 2
+	}
+	if *format == "" {
+		*format = "nginx"
+		if strings.HasPrefix(strings.ToLower(filepath.Base(*from)), "caddyfile") {
+			*format = "caddy"
+		}
+	}
+
+	src, err := ioutil.ReadFile(*from)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	im := &importer{file: *from}
+	var ds []directive
+	switch *format {
+	case "nginx":
+		if ds, err = parseNginx(string(src)); err == nil {
+			im.nginx(ds)
+		}
+	case "caddy":
+		if ds, err = parseCaddyfile(string(src)); err == nil {
+			im.caddy(ds)
+		}
+	default:
+		err = fmt.Errorf("unknown format %s", *format)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Couldn't import %s: %s\n", *from, err)
+		return 1
+	}
+
+	b, err := yaml.Marshal(im.cfg)
+	if err == nil {
+		if *out == "" {
+			_, err = os.Stdout.Write(b)
+		} else {
+			err = ioutil.WriteFile(*out, b, 0644)
+		}
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	for _, w := range im.warnings {
+		fmt.Fprintln(os.Stderr, w)
+	}
+	if len(im.warnings) > 0 {
+		fmt.Fprintf(os.Stderr, "%d directives need attention; review the configuration before use\n",
+			len(im.warnings))
+	}
+	return 0
+}
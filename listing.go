@@ -0,0 +1,438 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxCachedListings limits the number of directory listings held in memory.
+const maxCachedListings = 1024
+
+// thumbnailSize is the width and height that gallery thumbnails fit within.
+const thumbnailSize = 240
+
+// ListingHandler serves files from a file system like http.FileServer, but
+// generates directory listings itself. Listings are cached, keyed by path
+// and the directory's modification time, so that large directories aren't
+// read and sorted for every request.
+type ListingHandler struct {
+	fs       http.FileSystem
+	source   http.FileSystem // fs without modification time adjustments, if any
+	gallery  *ImageCache     // thumbnails, if listing directories as galleries
+	archives bool            // link to listings of the contents of archives
+	pageSize int             // entries per page of a listing (0=unlimited)
+	stream   bool            // write unsorted listings as directories are read
+	hidden   []string        // glob patterns of names left out of listings
+	maxDepth int             // levels of directories listed (0=unlimited)
+
+	mu    sync.Mutex
+	cache map[string]cachedListing
+}
+
+type cachedListing struct {
+	modTime time.Time
+	entries []os.FileInfo // sorted by name
+}
+
+// NewListingHandler creates a handler serving files from the file system.
+func NewListingHandler(fs http.FileSystem) *ListingHandler {
+	return &ListingHandler{
+		fs:    fs,
+		cache: make(map[string]cachedListing),
+	}
+}
+
+func (h *ListingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fs := requestFileSystem(h.fs, r)
+	next := http.FileServer(fs)
+	name := r.URL.Path
+	if !strings.HasPrefix(name, "/") {
+		name = "/" + name
+	}
+	if h.gallery != nil && isImage(name) && r.URL.Query().Has("thumb") {
+		h.gallery.Serve(w, r, fs, path.Clean(name), thumbnailSize, thumbnailSize, "")
+		return
+	}
+	// Let FileServer deal with files, redirects and index.html
+	if !strings.HasSuffix(name, "/") {
+		next.ServeHTTP(w, r)
+		return
+	}
+	name = path.Clean(name)
+	d, err := fs.Open(name)
+	if err != nil {
+		next.ServeHTTP(w, r)
+		return
+	}
+	defer d.Close()
+	fi, err := d.Stat()
+	if err != nil || !fi.IsDir() {
+		next.ServeHTTP(w, r)
+		return
+	}
+	if index, err := fs.Open(path.Join(name, "index.html")); err == nil {
+		index.Close()
+		next.ServeHTTP(w, r)
+		return
+	}
+	if h.maxDepth > 0 && pathDepth(name) > h.maxDepth {
+		http.NotFound(w, r)
+		return
+	}
+
+	if h.stream {
+		h.streamListing(w, r, d)
+		return
+	}
+	asJSON := wantsJSON(r)
+	var fis []os.FileInfo
+	if asJSON {
+		// Sizes and times of files would go out of date in the cache, as
+		// changing a file doesn't change its directory's modification time
+		fis, err = h.readEntries(d)
+	} else {
+		fis, err = h.entries(name, d, h.modTime(name, fi))
+	}
+	if err != nil {
+		http.Error(w, "Error reading directory", http.StatusInternalServerError)
+		return
+	}
+	page, pages := 1, 1
+	if h.pageSize > 0 {
+		pages = (len(fis) + h.pageSize - 1) / h.pageSize
+		if pages == 0 {
+			pages = 1
+		}
+		if p := r.URL.Query().Get("page"); p != "" {
+			if page, err = strconv.Atoi(p); err != nil || page < 1 || page > pages {
+				http.NotFound(w, r)
+				return
+			}
+		}
+		start := (page - 1) * h.pageSize
+		end := start + h.pageSize
+		if end > len(fis) {
+			end = len(fis)
+		}
+		fis = fis[start:end]
+	}
+
+	var body []byte
+	modTime := fi.ModTime()
+	w.Header().Add("Vary", "Accept")
+	if asJSON {
+		for _, efi := range fis {
+			if efi.ModTime().After(modTime) {
+				modTime = efi.ModTime()
+			}
+		}
+		body = renderJSONListing(fis, page, pages)
+		w.Header().Set("Content-Type", "application/json")
+	} else {
+		if h.gallery != nil {
+			body = renderGallery(fis)
+		} else {
+			body = renderListing(fis, h.archives)
+		}
+		body = append(body, renderPager(page, pages)...)
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	}
+	http.ServeContent(w, r, "", modTime, bytes.NewReader(body))
+}
+
+// SetSource sets the file system whose directories' modification times key
+// cached listings, when the one files are served from reports adjusted
+// times, as ModTimeFileSystem does, that wouldn't change with the listing.
+func (h *ListingHandler) SetSource(fs http.FileSystem) {
+	h.source = fs
+}
+
+// modTime returns the modification time of the directory in the source file
+// system, or failing that, as served.
+func (h *ListingHandler) modTime(name string, fi os.FileInfo) time.Time {
+	if h.source == nil {
+		return fi.ModTime()
+	}
+	d, err := h.source.Open(name)
+	if err != nil {
+		return fi.ModTime()
+	}
+	defer d.Close()
+	sfi, err := d.Stat()
+	if err != nil {
+		return fi.ModTime()
+	}
+	return sfi.ModTime()
+}
+
+// SetGallery makes directories be listed as a grid of image thumbnails,
+// which are stored in the given cache.
+func (h *ListingHandler) SetGallery(c *ImageCache) {
+	h.gallery = c
+}
+
+// SetArchives makes listings link to the contents of zip and tar archives,
+// as served by ArchiveHandler.
+func (h *ListingHandler) SetArchives() {
+	h.archives = true
+}
+
+// SetPageSize splits listings into pages of the given number of entries,
+// selected with the `page` query parameter.
+func (h *ListingHandler) SetPageSize(n int) {
+	h.pageSize = n
+}
+
+// SetMaxDepth stops directories more than the given number of levels below
+// the root from being listed, guarding against pathological trees and
+// symlink cycles.
+func (h *ListingHandler) SetMaxDepth(n int) {
+	h.maxDepth = n
+}
+
+// Hide leaves files whose names match the glob pattern out of listings.
+func (h *ListingHandler) Hide(pattern string) {
+	h.hidden = append(h.hidden, pattern)
+}
+
+// visible returns the entries that aren't hidden.
+func (h *ListingHandler) visible(fis []os.FileInfo) []os.FileInfo {
+	if len(h.hidden) == 0 {
+		return fis
+	}
+	shown := fis[:0]
+	for _, fi := range fis {
+		if !matchAny(h.hidden, fi.Name()) {
+			shown = append(shown, fi)
+		}
+	}
+	return shown
+}
+
+// SetStreaming makes listings be written as directories are read, rather
+// than once they've been read and sorted, so the start of the listing of a
+// huge directory appears immediately. Listings are then neither cached,
+// sorted nor paged, though HTML listings may be sorted by the browser.
+func (h *ListingHandler) SetStreaming() {
+	h.stream = true
+}
+
+// streamBatch is how many entries are read from a directory before the
+// listing written so far is flushed to the client.
+const streamBatch = 256
+
+// streamListing writes the listing of the open directory in batches.
+func (h *ListingHandler) streamListing(w http.ResponseWriter, r *http.Request, d http.File) {
+	asJSON := wantsJSON(r)
+	w.Header().Add("Vary", "Accept")
+	if asJSON {
+		w.Header().Set("Content-Type", "application/json")
+	} else {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	}
+	if r.Method == http.MethodHead {
+		return
+	}
+	rc := http.NewResponseController(w)
+	if asJSON {
+		io.WriteString(w, `{"page":1,"pages":1,"entries":[`)
+	} else {
+		io.WriteString(w, streamListingHeader)
+	}
+	first := true
+	for {
+		fis, err := d.Readdir(streamBatch)
+		n := len(fis)
+		var buf bytes.Buffer
+		for _, fi := range h.visible(fis) {
+			if asJSON {
+				if !first {
+					buf.WriteByte(',')
+				}
+				e, _ := json.Marshal(jsonListingEntry{fi.Name(), fi.Size(), fi.ModTime().UTC(), fi.IsDir()})
+				buf.Write(e)
+			} else {
+				name := fi.Name()
+				if fi.IsDir() {
+					name += "/"
+				}
+				u := url.URL{Path: name}
+				fmt.Fprintf(&buf, "<a href=\"%s\">%s</a>\n", u.String(), html.EscapeString(name))
+			}
+			first = false
+		}
+		w.Write(buf.Bytes())
+		rc.Flush()
+		if err != nil || n == 0 {
+			break // io.EOF, or the listing is truncated by an error
+		}
+	}
+	if asJSON {
+		io.WriteString(w, "]}\n")
+	} else {
+		io.WriteString(w, "</pre>\n")
+	}
+}
+
+// streamListingHeader starts a streamed HTML listing, with a button that
+// sorts it once complete.
+const streamListingHeader = `<!doctype html>
+<meta name="viewport" content="width=device-width">
+<button onclick="var p=document.getElementById('l'),a=Array.from(p.children).sort(function(a,b){return a.textContent<b.textContent?-1:1});p.textContent='';a.forEach(function(e){p.append(e,'\n')})">Sort</button>
+<pre id="l">
+`
+
+// entries returns the sorted entries of the open directory, from the cache
+// if it's unchanged.
+func (h *ListingHandler) entries(name string, d http.File, modTime time.Time) ([]os.FileInfo, error) {
+	h.mu.Lock()
+	c, ok := h.cache[name]
+	h.mu.Unlock()
+	if ok && c.modTime.Equal(modTime) {
+		return c.entries, nil
+	}
+
+	fis, err := h.readEntries(d)
+	if err != nil {
+		return nil, err
+	}
+
+	h.mu.Lock()
+	if len(h.cache) >= maxCachedListings {
+		h.cache = make(map[string]cachedListing)
+	}
+	h.cache[name] = cachedListing{modTime, fis}
+	h.mu.Unlock()
+	return fis, nil
+}
+
+// readEntries reads the visible entries of the open directory, sorted by name.
+func (h *ListingHandler) readEntries(d http.File) ([]os.FileInfo, error) {
+	fis, err := d.Readdir(-1)
+	if err != nil {
+		return nil, err
+	}
+	fis = h.visible(fis)
+	sort.Slice(fis, func(i, j int) bool { return fis[i].Name() < fis[j].Name() })
+	return fis, nil
+}
+
+// renderPager renders links to the previous and next pages of a listing,
+// if there are any.
+func renderPager(page, pages int) []byte {
+	if pages <= 1 {
+		return nil
+	}
+	var buf bytes.Buffer
+	buf.WriteString("<p>")
+	if page > 1 {
+		fmt.Fprintf(&buf, "<a href=\"?page=%d\" rel=\"prev\">&larr; Previous</a> ", page-1)
+	}
+	fmt.Fprintf(&buf, "Page %d of %d", page, pages)
+	if page < pages {
+		fmt.Fprintf(&buf, " <a href=\"?page=%d\" rel=\"next\">Next &rarr;</a>", page+1)
+	}
+	buf.WriteString("</p>\n")
+	return buf.Bytes()
+}
+
+type jsonListing struct {
+	Page    int                `json:"page"`
+	Pages   int                `json:"pages"`
+	Entries []jsonListingEntry `json:"entries"`
+}
+
+type jsonListingEntry struct {
+	Name     string    `json:"name"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+	Dir      bool      `json:"dir,omitempty"`
+}
+
+// renderJSONListing renders a page of a listing as JSON.
+func renderJSONListing(fis []os.FileInfo, page, pages int) []byte {
+	l := jsonListing{page, pages, make([]jsonListingEntry, 0, len(fis))}
+	for _, fi := range fis {
+		l.Entries = append(l.Entries,
+			jsonListingEntry{fi.Name(), fi.Size(), fi.ModTime().UTC(), fi.IsDir()})
+	}
+	body, _ := json.Marshal(l)
+	return append(body, '\n')
+}
+
+// renderListing renders a listing of files in the same style as
+// http.FileServer, optionally with links to browse inside archives.
+func renderListing(fis []os.FileInfo, archives bool) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("<!doctype html>\n")
+	buf.WriteString("<meta name=\"viewport\" content=\"width=device-width\">\n")
+	buf.WriteString("<pre>\n")
+	for _, fi := range fis {
+		name := fi.Name()
+		if fi.IsDir() {
+			name += "/"
+		}
+		u := url.URL{Path: name}
+		fmt.Fprintf(&buf, "<a href=\"%s\">%s</a>", u.String(), html.EscapeString(name))
+		if archives && !fi.IsDir() && isArchive(name) {
+			u.Path += archiveSep
+			fmt.Fprintf(&buf, " <a href=\"%s\">[browse]</a>", u.String())
+		}
+		buf.WriteString("\n")
+	}
+	buf.WriteString("</pre>\n")
+	return buf.Bytes()
+}
+
+// renderGallery renders a listing with a grid of thumbnails for images,
+// after links to any subdirectories and other files.
+func renderGallery(fis []os.FileInfo) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(`<!doctype html>
+<meta name="viewport" content="width=device-width">
+<style>
+body { font-family: -apple-system, "Segoe UI", Helvetica, Arial, sans-serif; margin: 1em; }
+.grid { display: grid; grid-template-columns: repeat(auto-fill, minmax(` + fmt.Sprint(thumbnailSize) + `px, 1fr)); gap: 1em; }
+figure { margin: 0; text-align: center; }
+figure img { max-width: 100%; height: auto; }
+figcaption { font-size: .85em; overflow-wrap: anywhere; }
+</style>
+<pre>
+`)
+	var images []os.FileInfo
+	for _, fi := range fis {
+		name := fi.Name()
+		if !fi.IsDir() && isImage(name) {
+			images = append(images, fi)
+			continue
+		}
+		if fi.IsDir() {
+			name += "/"
+		}
+		u := url.URL{Path: name}
+		fmt.Fprintf(&buf, "<a href=\"%s\">%s</a>\n", u.String(), html.EscapeString(name))
+	}
+	buf.WriteString("</pre>\n<div class=\"grid\">\n")
+	for _, fi := range images {
+		u := url.URL{Path: fi.Name()}
+		href := u.String()
+		name := html.EscapeString(fi.Name())
+		fmt.Fprintf(&buf, "<figure><a href=\"%s\"><img src=\"%s?thumb\" alt=\"%s\" loading=\"lazy\"></a>"+
+			"<figcaption>%s <a href=\"%s\" download>&#x2b73;</a></figcaption></figure>\n",
+			href, href, name, name, href)
+	}
+	buf.WriteString("</div>\n")
+	return buf.Bytes()
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"expvar"
+	"net/http"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// expShed counts the requests refused by load shedding.
+var expShed = expvar.NewInt("shed")
+
+// memorySampleInterval is how often the heap size is read for load shedding,
+// as reading it briefly stops the world.
+const memorySampleInterval = time.Second
+
+// LoadShedder refuses requests with "503 Service Unavailable" while too many
+// are in flight or the heap is too large, so that a traffic spike slows
+// clients down rather than exhausting the process. Requests for priority
+// paths are always served.
+type LoadShedder struct {
+	maxInFlight int64
+	maxMemory   uint64
+	retryAfter  string
+	priority    []string
+
+	inFlight int64  // requests being served
+	memory   uint64 // heap in use when last sampled
+}
+
+// NewLoadShedder creates a LoadShedder refusing requests when more than
+// maxInFlight are being served or more than maxMemory bytes of heap are in
+// use (either 0 for no limit), and asking clients to retry after the given
+// time. Paths starting with any of the priority prefixes are never refused.
+func NewLoadShedder(maxInFlight int64, maxMemory uint64, retryAfter time.Duration, priority []string) *LoadShedder {
+	secs := int(retryAfter / time.Second)
+	if secs < 1 {
+		secs = 1
+	}
+	ls := &LoadShedder{
+		maxInFlight: maxInFlight,
+		maxMemory:   maxMemory,
+		retryAfter:  strconv.Itoa(secs),
+		priority:    priority,
+	}
+	if maxMemory > 0 {
+		go ls.sampleMemory(memorySampleInterval)
+	}
+	return ls
+}
+
+// sampleMemory records the size of the heap every interval.
+func (ls *LoadShedder) sampleMemory(interval time.Duration) {
+	var m runtime.MemStats
+	for {
+		runtime.ReadMemStats(&m)
+		atomic.StoreUint64(&ls.memory, m.HeapInuse)
+		time.Sleep(interval)
+	}
+}
+
+// isPriority returns true if the request must not be refused.
+func (ls *LoadShedder) isPriority(r *http.Request) bool {
+	for _, p := range ls.priority {
+		if strings.HasPrefix(r.URL.Path, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// overloaded returns true if the thresholds are exceeded with n requests in
+// flight.
+func (ls *LoadShedder) overloaded(n int64) bool {
+	if ls.maxInFlight > 0 && n > ls.maxInFlight {
+		return true
+	}
+	return ls.maxMemory > 0 && atomic.LoadUint64(&ls.memory) > ls.maxMemory
+}
+
+// Handler returns a handler refusing requests to h while overloaded. The
+// same LoadShedder should wrap every listener's handler, so that requests
+// are counted together.
+func (ls *LoadShedder) Handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt64(&ls.inFlight, 1)
+		defer atomic.AddInt64(&ls.inFlight, -1)
+		if ls.overloaded(n) && !ls.isPriority(r) {
+			expShed.Add(1)
+			w.Header().Set("Retry-After", ls.retryAfter)
+			http.Error(w, "Server overloaded", http.StatusServiceUnavailable)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Access log formats.
+const (
+	LogOff     = "off"     // don't log accesses
+	LogCommon  = "common"  // the default format
+	LogVerbose = "verbose" // common format plus referer, user agent and duration
+	LogErrors  = "errors"  // common format, but only errors and slow requests
+)
+
+// validLogFormat returns true if the format is one of the known formats.
+func validLogFormat(format string) bool {
+	switch format {
+	case LogOff, LogCommon, LogVerbose, LogErrors:
+		return true
+	}
+	return false
+}
+
+// LogOptions describes how accesses are logged.
+type LogOptions struct {
+	Format    string        // one of the Log* formats
+	Anonymize string        // how client IPs are anonymized (empty=not at all)
+	Sample    int           // log 1 in this many successful requests (0=all)
+	Slow      time.Duration // in errors format, also log requests this slow
+	Sinks     []LogSink     // where accesses are logged (empty=stdout, and stderr for errors)
+}
+
+// LogSink is a destination of access logs, which may have its own format
+// and log only some requests.
+type LogSink struct {
+	Writer io.Writer
+	Format string   // one of the Log* formats (empty=that of the request)
+	Status []string // status patterns of requests logged, e.g. 4xx (empty=all)
+	Paths  []string // glob patterns of paths or file names logged (empty=all)
+}
+
+// matches returns true if the request, with the response status, should be
+// logged to the sink.
+func (s LogSink) matches(req *http.Request, status int) bool {
+	if len(s.Paths) > 0 && !matchAny(s.Paths, req.URL.Path) {
+		return false
+	}
+	if len(s.Status) == 0 {
+		return true
+	}
+	for _, pattern := range s.Status {
+		if matchStatus(pattern, status) {
+			return true
+		}
+	}
+	return false
+}
+
+// denyLog, if set, receives a line for every request denied with a 401, 403
+// or 429 status, in a stable format suitable for tools such as fail2ban.
+var denyLog *log.Logger
+
+// openLogDestination opens a log destination, which is either "syslog",
+// "stdout", "stderr", or the path of a file to append to. Files are shared
+// by all the logs written to them, and reopened by reopenLogFiles.
+func openLogDestination(dest, tag string) (io.Writer, error) {
+	switch dest {
+	case "syslog":
+		return newSyslogWriter(tag)
+	case "stdout":
+		return os.Stdout, nil
+	case "stderr":
+		return os.Stderr, nil
+	}
+	logFilesMu.Lock()
+	defer logFilesMu.Unlock()
+	if lf, ok := logFiles[dest]; ok {
+		return lf, nil
+	}
+	f, err := os.OpenFile(dest, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	lf := &logFile{name: dest, f: f}
+	logFiles[dest] = lf
+	return lf, nil
+}
+
+var (
+	logFilesMu sync.Mutex
+	logFiles   = map[string]*logFile{} // by path
+)
+
+// logFile is a log file that may be reopened, once it's been moved aside by
+// a tool such as logrotate, to continue logging to a new file at its path.
+type logFile struct {
+	name string
+	mu   sync.Mutex
+	f    *os.File
+}
+
+func (lf *logFile) Write(b []byte) (int, error) {
+	lf.mu.Lock()
+	defer lf.mu.Unlock()
+	return lf.f.Write(b)
+}
+
+// reopen opens the file at the log's path again, closing the file it had
+// been writing to. If the file can't be opened, the old one is kept.
+func (lf *logFile) reopen() error {
+	f, err := os.OpenFile(lf.name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	lf.mu.Lock()
+	old := lf.f
+	lf.f = f
+	lf.mu.Unlock()
+	return old.Close()
+}
+
+// reopenLogFiles reopens every log file, as on SIGUSR1.
+func reopenLogFiles() {
+	logFilesMu.Lock()
+	defer logFilesMu.Unlock()
+	for _, lf := range logFiles {
+		if err := lf.reopen(); err != nil {
+			log.Printf("Couldn't reopen log %s: %s", lf.name, err)
+		}
+	}
+	if settings().Verbose {
+		log.Printf("Reopened %d log files", len(logFiles))
+	}
+}
+
+type loggingWriterKey struct{}
+
+// LogHandler wraps with a LoggingResponseWriter for the purpose of logging
+// accesses and errors with the given options.
+func LogHandler(h http.Handler, opts LogOptions) http.Handler {
+	counter := new(uint64)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rw := NewLoggingResponseWriter(w)
+		*rw.format = opts.Format
+		rw.anonymize = opts.Anonymize
+		rw.sample = opts.Sample
+		rw.slow = opts.Slow
+		rw.sinks = opts.Sinks
+		rw.counter = counter
+		start := time.Now()
+		ctx := context.WithValue(r.Context(), loggingWriterKey{}, rw)
+		h.ServeHTTP(rw, r.WithContext(ctx))
+		rw.log(r, time.Since(start))
+	})
+}
+
+// LogFormatHandler overrides the format used by the enclosing LogHandler for
+// requests that pass through it.
+func LogFormatHandler(h http.Handler, format string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if lrw, ok := r.Context().Value(loggingWriterKey{}).(LoggingResponseWriter); ok {
+			*lrw.format = format
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// setDenyRule records the rule responsible for denying a request, for
+// inclusion in the deny log.
+func setDenyRule(r *http.Request, rule string) {
+	if lrw, ok := r.Context().Value(loggingWriterKey{}).(LoggingResponseWriter); ok {
+		*lrw.rule = rule
+	}
+}
+
+// LoggingResponseWriter intercepts the request and stores the status.
+type LoggingResponseWriter struct {
+	http.ResponseWriter
+	status *int
+	size   *int
+	format *string
+	rule   *string
+
+	anonymize string
+	sample    int
+	counter   *uint64 // successful requests seen, for sampling
+	slow      time.Duration
+	sinks     []LogSink
+}
+
+// NewLoggingResponseWriter creates a new LoggingResponseWriter that wraps
+// the given ResponseWriter. It will log 4xx/5xx responses to stderr, and
+// everything else to stdout.
+func NewLoggingResponseWriter(w http.ResponseWriter) LoggingResponseWriter {
+	lrw := LoggingResponseWriter{
+		ResponseWriter: w,
+		status:         new(int),
+		size:           new(int),
+		format:         new(string),
+		rule:           new(string),
+	}
+	*lrw.status = 200 // as WriteHeader normally isn't called
+	*lrw.size = 0
+	*lrw.format = LogCommon
+	return lrw
+}
+
+// WriteHeader records the status written in the response.
+func (w LoggingResponseWriter) WriteHeader(status int) {
+	w.ResponseWriter.WriteHeader(status)
+	*w.status = status
+}
+
+func (w LoggingResponseWriter) Write(b []byte) (c int, e error) {
+	c, e = w.ResponseWriter.Write(b)
+	*w.size += c
+	return
+}
+
+func (w LoggingResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w LoggingResponseWriter) log(req *http.Request, d time.Duration) {
+	w.logDenied(req)
+	if alerter != nil {
+		alerter.record(*w.status)
+	}
+	if stats != nil {
+		stats.record(req, *w.status)
+	}
+	if traffic != nil {
+		traffic.record(req, *w.status, *w.size, w.anonymize)
+	}
+	if tail != nil {
+		tail.record(req, *w.status, *w.size, d, w.anonymize)
+	}
+	if downloads != nil {
+		downloads.record(req, *w.status, *w.size)
+	}
+	if analytics != nil {
+		analytics.record(req, *w.status, w.Header().Get("Content-Type"))
+	}
+	recordExpvar(*w.status, *w.size)
+
+	if *w.format == LogOff {
+		return
+	}
+
+	slow := w.slow > 0 && d >= w.slow
+	if len(w.sinks) > 0 {
+		w.logSinks(req, d, slow)
+		return
+	}
+	if *w.format == LogErrors && *w.status < 400 && !slow {
+		return
+	}
+
+	// Only log a sample of successful requests; errors are always logged
+	sampled := w.sample > 1 && *w.status < 400 && settings().LogSampling
+	if sampled && atomic.AddUint64(w.counter, 1)%uint64(w.sample) != 0 {
+		return
+	}
+
+	out := os.Stdout
+	if *w.status >= 400 && *w.status < 600 {
+		// direct all errors to stderr
+		out = os.Stderr
+	}
+	fmt.Fprintln(out, w.line(req, d, *w.format, slow, sampled))
+}
+
+// logSinks writes the access to each of the sinks it matches, in the sink's
+// format.
+func (w LoggingResponseWriter) logSinks(req *http.Request, d time.Duration, slow bool) {
+	sampled := w.sample > 1 && *w.status < 400 && settings().LogSampling
+	if sampled && atomic.AddUint64(w.counter, 1)%uint64(w.sample) != 0 {
+		return
+	}
+	lines := make(map[string]string) // by format
+	for _, s := range w.sinks {
+		format := s.Format
+		if format == "" {
+			format = *w.format
+		}
+		if (format == LogErrors && *w.status < 400 && !slow) || !s.matches(req, *w.status) {
+			continue
+		}
+		line, ok := lines[format]
+		if !ok {
+			line = w.line(req, d, format, slow, sampled)
+			lines[format] = line
+		}
+		fmt.Fprintln(s.Writer, line)
+	}
+}
+
+// line returns the line an access is logged with in the format.
+func (w LoggingResponseWriter) line(req *http.Request, d time.Duration, format string, slow, sampled bool) string {
+	t := time.Now().Format(time.RFC3339)
+	remoteAddr, _, _ := net.SplitHostPort(req.RemoteAddr)
+	if w.anonymize != "" {
+		remoteAddr = anonymizeIP(remoteAddr, w.anonymize)
+	}
+	localAddr, _, _ := net.SplitHostPort(req.Host)
+	requestLine := req.Method + " " + redactToken(req.RequestURI)
+
+	line := fmt.Sprintf("%s [%s] %s %s %d %d", remoteAddr, t, localAddr,
+		strconv.Quote(requestLine), *w.status, *w.size)
+	if format == LogVerbose {
+		line += fmt.Sprintf(" %s %s %s", strconv.Quote(req.Referer()),
+			strconv.Quote(req.UserAgent()), d)
+	}
+	if subject, fp, ok := clientCert(req); ok {
+		line += fmt.Sprintf(" client_cert=%s client_fp=%s",
+			strconv.Quote(subject), fp)
+	}
+	if format == LogErrors && slow {
+		line += fmt.Sprintf(" slow=%s", d)
+	}
+	if sampled {
+		line += fmt.Sprintf(" sample=%d", w.sample)
+	}
+	return line
+}
+
+// logDenied writes a line to the deny log if the request was denied.
+func (w LoggingResponseWriter) logDenied(req *http.Request) {
+	if denyLog == nil {
+		return
+	}
+	switch *w.status {
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusTooManyRequests:
+	default:
+		return
+	}
+	remoteAddr, _, _ := net.SplitHostPort(req.RemoteAddr)
+	rule := *w.rule
+	if rule == "" {
+		rule = "-"
+	}
+	denyLog.Printf("denied client=%s status=%d rule=%s method=%s path=%s",
+		remoteAddr, *w.status, strconv.Quote(rule), req.Method,
+		strconv.Quote(req.URL.Path))
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Manifest maps logical asset names to their fingerprinted filenames, as
+// described by a build tool's manifest file. Both webpack-style manifests
+// (`{"main.js": "main.1a2b3c.js"}`) and Vite-style manifests
+// (`{"src/main.js": {"file": "assets/main.1a2b3c.js"}}`) are understood.
+// The manifest is reloaded when the file changes while it's watched.
+type Manifest struct {
+	filename string
+
+	mu      sync.RWMutex
+	modTime time.Time
+	assets  map[string]string // fingerprinted filenames, by logical name
+	logical map[string]string // logical names, by fingerprinted filename
+}
+
+// NewManifest loads the manifest from the given file.
+func NewManifest(filename string) (*Manifest, error) {
+	m := &Manifest{filename: filename}
+	fi, err := os.Stat(filename)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.load(fi.ModTime()); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *Manifest) load(modTime time.Time) error {
+	data, err := ioutil.ReadFile(m.filename)
+	if err != nil {
+		return err
+	}
+	raw := map[string]json.RawMessage{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	assets := make(map[string]string, len(raw))
+	logical := make(map[string]string, len(raw))
+	for name, v := range raw {
+		var file string
+		if json.Unmarshal(v, &file) != nil {
+			var entry struct {
+				File string `json:"file"`
+			}
+			if json.Unmarshal(v, &entry) != nil || entry.File == "" {
+				continue
+			}
+			file = entry.File
+		}
+		name, file = strings.TrimPrefix(name, "/"), strings.TrimPrefix(file, "/")
+		assets[name] = file
+		logical[file] = name
+	}
+
+	m.mu.Lock()
+	m.assets = assets
+	m.logical = logical
+	m.modTime = modTime
+	m.mu.Unlock()
+	return nil
+}
+
+// manifestInterval is how often manifests are checked for changes.
+const manifestInterval = 2 * time.Second
+
+// Lookup returns the fingerprinted filename for the given logical name.
+func (m *Manifest) Lookup(name string) (string, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	file, ok := m.assets[strings.TrimPrefix(name, "/")]
+	return file, ok
+}
+
+// Logical returns the logical name for the given fingerprinted filename.
+func (m *Manifest) Logical(file string) (string, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	name, ok := m.logical[strings.TrimPrefix(file, "/")]
+	return name, ok
+}
+
+// watch reloads the manifest whenever the file changes, checking at the
+// given interval until stopped.
+func (m *Manifest) watch(interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				m.refresh()
+			case <-done:
+				return
+			}
+		}
+	}()
+	var once sync.Once
+	return func() { once.Do(func() { close(done) }) }
+}
+
+// refresh reloads the manifest if the file has changed.
+func (m *Manifest) refresh() {
+	if fi, err := os.Stat(m.filename); err == nil {
+		m.mu.RLock()
+		stale := !fi.ModTime().Equal(m.modTime)
+		m.mu.RUnlock()
+		if stale {
+			if err := m.load(fi.ModTime()); err != nil {
+				log.Printf("Couldn't reload manifest %s: %s", m.filename, err)
+			}
+		}
+	}
+}
+
+// ManifestHandler resolves requests for logical asset names to their
+// fingerprinted filenames. If redirect is true, clients are sent a 301 to the
+// fingerprinted file under prefix, otherwise the request is rewritten
+// internally. If reverse is true, files are stored under their logical names,
+// and only their URLs are fingerprinted: requests for fingerprinted names are
+// rewritten to the logical names instead, and requests for logical names are
+// served as they are unless redirected. Requests must have had prefix
+// stripped from their path.
+func ManifestHandler(h http.Handler, m *Manifest, prefix string, redirect, reverse bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if reverse {
+			if name, ok := m.Logical(r.URL.Path); ok {
+				r.URL.Path = "/" + name
+				h.ServeHTTP(w, r)
+				return
+			}
+		}
+		file, ok := m.Lookup(r.URL.Path)
+		if !ok || reverse && !redirect {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if redirect {
+			target := path.Join(prefix, file)
+			if r.URL.RawQuery != "" {
+				target += "?" + r.URL.RawQuery
+			}
+			http.Redirect(w, r, target, http.StatusMovedPermanently)
+			return
+		}
+		r.URL.Path = "/" + file
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// maxMirrorsInFlight limits the mirrored requests awaiting a response, so a
+// slow mirror can't exhaust resources; requests beyond it aren't mirrored.
+const maxMirrorsInFlight = 64
+
+// MirrorOptions describes which requests are copied to a mirror.
+type MirrorOptions struct {
+	Percent int           // share of requests mirrored
+	Timeout time.Duration // for each mirrored request
+}
+
+// MirrorHandler copies a share of GET and HEAD requests to the upstream at
+// the target URL in the background, discarding the responses, before
+// passing them to the handler. The request path is appended to the target's
+// path. Mirrored requests carry an X-Goserve-Mirror header.
+func MirrorHandler(h http.Handler, target *url.URL, opts MirrorOptions) http.Handler {
+	client := &http.Client{
+		Timeout: opts.Timeout,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	inFlight := make(chan struct{}, maxMirrorsInFlight)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if (r.Method == http.MethodGet || r.Method == http.MethodHead) &&
+			rand.Intn(100) < opts.Percent {
+			select {
+			case inFlight <- struct{}{}:
+				out := mirrorRequest(r, target)
+				go func() {
+					defer func() { <-inFlight }()
+					resp, err := client.Do(out)
+					if err != nil {
+						if settings().Verbose {
+							log.Printf("Mirror error for %s: %s", out.URL, err)
+						}
+						return
+					}
+					io.Copy(ioutil.Discard, resp.Body)
+					resp.Body.Close()
+				}()
+			default:
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// mirrorRequest returns a copy of the request to send to the mirror. It
+// isn't tied to the original's context, so it isn't cancelled when the
+// original request completes.
+func mirrorRequest(r *http.Request, target *url.URL) *http.Request {
+	u := *target
+	u.Path = strings.TrimSuffix(target.Path, "/") + "/" + strings.TrimPrefix(r.URL.Path, "/")
+	u.RawPath = ""
+	u.RawQuery = r.URL.RawQuery
+	out, _ := http.NewRequestWithContext(context.Background(), r.Method, u.String(), nil)
+	out.Header = r.Header.Clone()
+	out.Header.Del("Connection")
+	out.Host = r.Host
+	setForwardedHeaders(r, out)
+	out.Header.Set("X-Goserve-Mirror", "1")
+	return out
+}
@@ -0,0 +1,17 @@
+//go:build !unix
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// mmapSupported is true if files may be memory mapped on this platform.
+const mmapSupported = false
+
+// mmapFile returns an error, as memory mapping is unsupported on this
+// platform; callers fall back to reading the file normally.
+func mmapFile(f *os.File, size int64) ([]byte, func() error, error) {
+	return nil, nil, errors.New("mmap is not supported on this platform")
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"gopkg.in/v1/yaml"
+
+	"io/ioutil"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// overrideFile is the name of the files in served directories that override
+// the configuration for them and their subdirectories.
+const overrideFile = ".goserve"
+
+// Listing overrides.
+const (
+	ListingAllow = "allow"
+	ListingDeny  = "deny"
+)
+
+// DirOverride is the restricted set of directives that may be given in an
+// override file.
+type DirOverride struct {
+	Listing string  `yaml:"listing,omitempty"` // allow or deny listing the directory
+	Auth    string  `yaml:"auth,omitempty"`    // name of realm to require
+	Headers Headers `yaml:"headers,omitempty"` // extra response headers
+}
+
+// merge applies the overrides of a subdirectory to those of its parent.
+func (o DirOverride) merge(sub *DirOverride) DirOverride {
+	if sub.Listing != "" {
+		o.Listing = sub.Listing
+	}
+	if sub.Auth != "" {
+		o.Auth = sub.Auth
+	}
+	if len(sub.Headers) > 0 {
+		headers := make(Headers, len(o.Headers)+len(sub.Headers))
+		for k, v := range o.Headers {
+			headers[k] = v
+		}
+		for k, v := range sub.Headers {
+			headers[k] = v
+		}
+		o.Headers = headers
+	}
+	return o
+}
+
+// check returns an error message if the override is invalid.
+func (o DirOverride) check() string {
+	if o.Listing != "" && o.Listing != ListingAllow && o.Listing != ListingDeny {
+		return "invalid listing `" + o.Listing + "`"
+	}
+	if o.Auth != "" && authRealms[o.Auth] == nil {
+		return "unknown auth realm `" + o.Auth + "`"
+	}
+	return ""
+}
+
+type cachedOverride struct {
+	modTime  time.Time
+	override *DirOverride
+	err      string
+}
+
+// overrides reads and caches override files.
+type overrides struct {
+	fs http.FileSystem
+
+	mu    sync.Mutex
+	cache map[string]cachedOverride
+}
+
+// read returns the override for a directory, or nil if it has none, and an
+// error message if its override file is invalid.
+func (o *overrides) read(fs http.FileSystem, dir string) (*DirOverride, string) {
+	name := path.Join(dir, overrideFile)
+	f, err := fs.Open(name)
+	if err != nil {
+		return nil, ""
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil || fi.IsDir() {
+		return nil, ""
+	}
+	o.mu.Lock()
+	c, ok := o.cache[name]
+	o.mu.Unlock()
+	if ok && c.modTime.Equal(fi.ModTime()) {
+		return c.override, c.err
+	}
+
+	c = cachedOverride{modTime: fi.ModTime(), override: &DirOverride{}}
+	data, err := ioutil.ReadAll(f)
+	if err == nil {
+		err = yaml.Unmarshal(data, c.override)
+	}
+	if err != nil {
+		c.err = err.Error()
+	} else {
+		c.err = c.override.check()
+	}
+	if c.err != "" {
+		log.Printf("Invalid %s: %s", name, c.err)
+	}
+	o.mu.Lock()
+	if len(o.cache) >= maxCachedListings {
+		o.cache = make(map[string]cachedOverride)
+	}
+	o.cache[name] = c
+	o.mu.Unlock()
+	return c.override, c.err
+}
+
+// OverrideHandler applies the directives of `.goserve` files in the
+// requested directory and its parents, with those deeper in the tree taking
+// precedence. The files themselves are never served. Requests must have had
+// the serve's prefix stripped from their path.
+func OverrideHandler(h http.Handler, fs http.FileSystem) http.Handler {
+	o := &overrides{fs: fs, cache: make(map[string]cachedOverride)}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := path.Clean("/" + r.URL.Path)
+		isDir := strings.HasSuffix(r.URL.Path, "/") || name == "/"
+		for _, part := range strings.Split(name, "/") {
+			if part == overrideFile {
+				http.NotFound(w, r)
+				return
+			}
+		}
+
+		dir := name
+		if !isDir {
+			dir = path.Dir(name)
+		}
+		rfs := requestFileSystem(o.fs, r)
+		dirs := []string{"/"}
+		if dir != "/" {
+			for i := 1; i < len(dir); i++ {
+				if dir[i] == '/' {
+					dirs = append(dirs, dir[:i])
+				}
+			}
+			dirs = append(dirs, dir)
+		}
+		var merged DirOverride
+		for _, d := range dirs {
+			sub, errMsg := o.read(rfs, d)
+			if errMsg != "" {
+				// The file might have been meant to restrict access
+				http.Error(w, http.StatusText(http.StatusInternalServerError),
+					http.StatusInternalServerError)
+				return
+			}
+			if sub != nil {
+				merged = merged.merge(sub)
+			}
+		}
+
+		next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if merged.Listing == ListingDeny && isDir {
+				if index, err := rfs.Open(path.Join(dir, "index.html")); err == nil {
+					index.Close()
+				} else {
+					setDenyRule(r, "listing")
+					audit(r, "acl", AuditDeny, "listing", authUser(r))
+					http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+					return
+				}
+			}
+			for k, v := range merged.Headers {
+				w.Header().Set(k, v)
+			}
+			h.ServeHTTP(w, r)
+		})
+		if merged.Auth != "" {
+			authRealms[merged.Auth].serve(w, r, next)
+		} else {
+			next.ServeHTTP(w, r)
+		}
+	})
+}
@@ -0,0 +1,21 @@
+//go:build windows || plan9
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// promptPassphrase asks for a passphrase on standard input. The passphrase
+// is echoed, as there's no portable way to disable echo on this platform.
+func promptPassphrase(prompt string) (string, error) {
+	fmt.Fprint(os.Stderr, prompt)
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
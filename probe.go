@@ -0,0 +1,96 @@
+package main
+
+import (
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+// probeURL returns the URL of the local server described by the
+// configuration's first listener.
+func probeURL(cfg ServerConfig) string {
+	if len(cfg.Listeners) == 0 {
+		return "http://127.0.0.1:8080/"
+	}
+	l := cfg.Listeners[0]
+	host, port, err := net.SplitHostPort(l.Addr)
+	if err != nil {
+		host, port = "", l.Addr
+	}
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host = "127.0.0.1"
+	}
+	scheme := l.Protocol
+	if l.secure() {
+		scheme = "https"
+	}
+	return scheme + "://" + net.JoinHostPort(host, port) + "/"
+}
+
+// runProbe implements the `probe` subcommand, which requests a URL of the
+// local server and exits with 0 if it's healthy, or 1 otherwise, so that
+// container images without other tools can check the server's health.
+func runProbe(args []string) int {
+	fs := flag.NewFlagSet("probe", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: goserve probe [flags] [url]")
+		fs.PrintDefaults()
+	}
+	var configPaths configFiles
+	fs.Var(&configPaths, "config", "Configuration whose first listener is probed, if no URL is given")
+	fs.StringVar(&configProfile, "profile", os.Getenv("GOSERVE_PROFILE"),
+		"Profile of the configuration to apply (or set GOSERVE_PROFILE)")
+	timeout := fs.Duration("timeout", 5*time.Second, "Timeout for the request")
+	insecure := fs.Bool("insecure", true, "Don't verify the server's certificate")
+	status := fs.Int("status", 0, "Status the response must have (default: any below 400)")
+	fs.Parse(args)
+
+	url := fs.Arg(0)
+	if url == "" {
+		var cfg ServerConfig
+		if len(configPaths) > 0 {
+			var err error
+			if cfg, err = readServerConfig(configPaths...); err != nil {
+				fmt.Fprintln(os.Stderr, "Couldn't load config:", err)
+				return 1
+			}
+			cfg.sanitise()
+		}
+		url = probeURL(cfg)
+	}
+
+	client := &http.Client{
+		Timeout: *timeout,
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: *insecure},
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	req.Header.Set("User-Agent", "goserve-probe")
+	resp, err := client.Do(req)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 1<<20))
+	resp.Body.Close()
+	if *status != 0 && resp.StatusCode != *status ||
+		*status == 0 && resp.StatusCode >= 400 {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", url, resp.Status)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,463 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ProxyOptions describes how requests are forwarded to upstream servers.
+type ProxyOptions struct {
+	DialTimeout    time.Duration // connecting to the upstream (0=none)
+	HeaderTimeout  time.Duration // waiting for the response header (0=none)
+	IdleTimeout    time.Duration // idle upstream connections are closed after this
+	MaxIdle        int           // idle connections kept per upstream
+	Stream         bool          // flush response data to the client immediately
+	BufferRequest  int64         // read request bodies up to this size before forwarding (0=stream)
+	BufferResponse int64         // read responses up to this size before replying (0=stream)
+	Headers        Headers       // request headers to set, add or remove, as for responses
+
+	Breaker *BreakerOptions // stop forwarding to a failing upstream (nil=never)
+	Retry   *RetryOptions   // send failed GET and HEAD requests again (nil=never)
+
+	Discovery *DiscoveryOptions // find upstreams by resolving the targets' hosts (nil=don't)
+}
+
+// RetryOptions describes when GET and HEAD requests are sent again, to the
+// next upstream, after a connection error or an unsuccessful response.
+type RetryOptions struct {
+	Attempts int          // further attempts after the first
+	Statuses map[int]bool // upstream response statuses that are retried
+	Budget   float64      // retries allowed as a percentage of requests
+}
+
+// upstream is a server requests are forwarded to.
+type upstream struct {
+	rp      *httputil.ReverseProxy
+	breaker *CircuitBreaker // nil if circuits aren't broken
+}
+
+// upstreamTarget is the URL of an upstream, and the configured URL it was
+// found from.
+type upstreamTarget struct {
+	url    *url.URL
+	origin *url.URL
+}
+
+// newUpstream returns an upstream forwarding requests to the target with the
+// transport.
+func newUpstream(target upstreamTarget, transport *http.Transport, opts ProxyOptions) upstream {
+	rp := &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetURL(target.url)
+			pr.Out.Host = pr.In.Host
+			setForwardedHeaders(pr.In, pr.Out)
+			if len(opts.Headers) > 0 {
+				setUpstreamHeaders(pr.Out, target.origin, opts.Headers)
+			}
+		},
+		ErrorHandler: retryProxyError,
+	}
+	var rt http.RoundTripper = transport
+	if host := target.url.Hostname(); target.url.Scheme == "https" &&
+		net.ParseIP(host) != nil && host != target.origin.Hostname() {
+		// Verify the certificates of resolved addresses against the name
+		t := transport.Clone()
+		t.TLSClientConfig = &tls.Config{ServerName: target.origin.Hostname()}
+		rt = t
+	}
+	var breaker *CircuitBreaker
+	if opts.Breaker != nil {
+		breaker = NewCircuitBreaker(target.url.Host, *opts.Breaker)
+		rt = breakerTransport{rt, breaker}
+	}
+	rp.Transport = rt
+	if opts.Stream {
+		rp.FlushInterval = -1
+	}
+	if opts.BufferResponse > 0 {
+		rp.ModifyResponse = func(resp *http.Response) error {
+			return bufferResponse(resp, opts.BufferResponse)
+		}
+	}
+	return upstream{rp, breaker}
+}
+
+// upstreamPool holds the upstreams of a proxy, which change as the names of
+// discovered upstreams are resolved again.
+type upstreamPool struct {
+	transport *http.Transport
+	opts      ProxyOptions
+	upstreams atomic.Value        // []upstream
+	byURL     map[string]upstream // the current upstreams, by URL
+	done      chan struct{}       // closed to stop discovering upstreams
+}
+
+// get returns the current upstreams.
+func (p *upstreamPool) get() []upstream {
+	upstreams, _ := p.upstreams.Load().([]upstream)
+	return upstreams
+}
+
+// set replaces the upstreams with those for the targets, keeping the circuit
+// state and connections of upstreams that remain. It returns true if the
+// upstreams changed.
+func (p *upstreamPool) set(targets []upstreamTarget) bool {
+	byURL := make(map[string]upstream, len(targets))
+	upstreams := make([]upstream, 0, len(targets))
+	changed := false
+	for _, target := range targets {
+		key := target.url.String()
+		if _, dup := byURL[key]; dup {
+			continue
+		}
+		u, ok := p.byURL[key]
+		if !ok {
+			u = newUpstream(target, p.transport, p.opts)
+			changed = true
+		}
+		byURL[key] = u
+		upstreams = append(upstreams, u)
+	}
+	changed = changed || len(byURL) != len(p.byURL)
+	p.byURL = byURL
+	p.upstreams.Store(upstreams)
+	return changed
+}
+
+// ProxyHandler forwards requests to the upstream servers at the target URLs,
+// taking turns between them. The request path is appended to the target's
+// path. With discovery, upstreams are found by resolving the targets' hosts.
+// The function returned stops discovery and closes idle connections.
+func ProxyHandler(targets []*url.URL, opts ProxyOptions) (http.Handler, func()) {
+	dialer := &net.Dialer{
+		Timeout:   opts.DialTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+	transport := &http.Transport{
+		DialContext:           dialer.DialContext,
+		ForceAttemptHTTP2:     true,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: opts.HeaderTimeout,
+		IdleConnTimeout:       opts.IdleTimeout,
+		MaxIdleConnsPerHost:   opts.MaxIdle,
+	}
+	pool := &upstreamPool{transport: transport, opts: opts, done: make(chan struct{})}
+	if opts.Discovery != nil {
+		pool.discover(targets, *opts.Discovery)
+	} else {
+		var static []upstreamTarget
+		for _, target := range targets {
+			static = append(static, upstreamTarget{target, target})
+		}
+		pool.set(static)
+	}
+	var budget *retryBudget
+	if opts.Retry != nil {
+		budget = &retryBudget{percent: opts.Retry.Budget}
+	}
+	var turn uint32
+
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if opts.BufferRequest > 0 && r.Body != nil && r.Body != http.NoBody {
+			body, err := ioutil.ReadAll(io.LimitReader(r.Body, opts.BufferRequest+1))
+			r.Body.Close()
+			if err != nil {
+				http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+				return
+			}
+			if int64(len(body)) > opts.BufferRequest {
+				http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge),
+					http.StatusRequestEntityTooLarge)
+				return
+			}
+			r.Body = ioutil.NopCloser(bytes.NewReader(body))
+			r.ContentLength = int64(len(body))
+			r.TransferEncoding = nil
+		}
+		upstreams := pool.get()
+		first := int(atomic.AddUint32(&turn, 1) - 1)
+		if opts.Retry == nil || !retryable(r) {
+			u := pickUpstream(upstreams, first)
+			if u == nil {
+				failFast(w, upstreams)
+				return
+			}
+			u.rp.ServeHTTP(w, r)
+			return
+		}
+		proxyWithRetries(w, r, upstreams, first, opts.Retry, budget)
+	})
+	return h, func() {
+		close(pool.done)
+		transport.CloseIdleConnections()
+	}
+}
+
+// pickUpstream returns the first upstream from the start, in turn, that
+// requests may be forwarded to, or nil if all their circuits are open.
+func pickUpstream(upstreams []upstream, start int) *upstream {
+	for i := range upstreams {
+		u := &upstreams[(start+i)%len(upstreams)]
+		if u.breaker == nil || u.breaker.allow() {
+			return u
+		}
+	}
+	return nil
+}
+
+// failFast responds "503 Service Unavailable" while the circuits to all the
+// upstreams are open, with the time until one will next be tried, or while
+// none have been discovered.
+func failFast(w http.ResponseWriter, upstreams []upstream) {
+	retryAfter := time.Duration(-1)
+	for _, u := range upstreams {
+		if d := u.breaker.retryAfter(); retryAfter < 0 || d < retryAfter {
+			retryAfter = d
+		}
+	}
+	if retryAfter >= 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter/time.Second)+1))
+	}
+	http.Error(w, http.StatusText(http.StatusServiceUnavailable),
+		http.StatusServiceUnavailable)
+}
+
+// retryable returns true if the request may be sent upstream again: it must
+// be a GET or HEAD request without a body.
+func retryable(r *http.Request) bool {
+	return (r.Method == http.MethodGet || r.Method == http.MethodHead) &&
+		(r.Body == nil || r.Body == http.NoBody)
+}
+
+// proxyAttemptKey is the context key of the *proxyAttempt of a request
+// forwarded upstream.
+type proxyAttemptKey struct{}
+
+// proxyAttempt records why an attempt to forward a request failed, if it's
+// to be retried.
+type proxyAttempt struct {
+	retry    bool         // whether a failure may be retried
+	statuses map[int]bool // response statuses that are retried
+	err      error        // the connection error
+	status   int          // or the response status
+}
+
+// failed returns true if the attempt is to be retried.
+func (a *proxyAttempt) failed() bool {
+	return a.err != nil || a.status != 0
+}
+
+// proxyWithRetries forwards a request to the upstreams in turn, until one
+// responds with a status that isn't retried, or the attempts or retry budget
+// are exhausted.
+func proxyWithRetries(w http.ResponseWriter, r *http.Request, upstreams []upstream, first int, opts *RetryOptions, budget *retryBudget) {
+	budget.request()
+	var last *proxyAttempt
+	for i := 0; ; i++ {
+		u := pickUpstream(upstreams, first+i)
+		if u == nil && last == nil {
+			failFast(w, upstreams)
+			return
+		}
+		if u == nil {
+			// The previous response was discarded
+			if last.err != nil {
+				proxyError(w, r, last.err)
+			} else {
+				http.Error(w, http.StatusText(last.status), last.status)
+			}
+			return
+		}
+		a := &proxyAttempt{
+			retry:    i < opts.Attempts && budget.available(),
+			statuses: opts.Statuses,
+		}
+		rw := &retryResponseWriter{ResponseWriter: w, header: w.Header().Clone(), attempt: a}
+		u.rp.ServeHTTP(rw, r.WithContext(context.WithValue(r.Context(), proxyAttemptKey{}, a)))
+		if !a.failed() {
+			return
+		}
+		budget.take()
+		if a.err != nil {
+			log.Printf("Retrying %s after proxy error: %s", r.URL, a.err)
+		}
+		last = a
+	}
+}
+
+// retryProxyError records the error of a request that's to be retried, or
+// responds with an error as proxyError otherwise.
+func retryProxyError(w http.ResponseWriter, r *http.Request, err error) {
+	a, ok := r.Context().Value(proxyAttemptKey{}).(*proxyAttempt)
+	if ok && a.retry && r.Context().Err() == nil {
+		a.err = err
+		return
+	}
+	proxyError(w, r, err)
+}
+
+// retryResponseWriter discards a response with a status that's to be
+// retried. Headers are held back until the status is known, so that those of
+// a discarded response don't reach the client.
+type retryResponseWriter struct {
+	http.ResponseWriter
+	header  http.Header
+	attempt *proxyAttempt
+	written bool
+}
+
+func (w *retryResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *retryResponseWriter) WriteHeader(status int) {
+	if w.written {
+		return
+	}
+	if status >= http.StatusOK {
+		w.written = true
+		if w.attempt.retry && w.attempt.statuses[status] {
+			w.attempt.status = status
+			return
+		}
+	}
+	h := w.ResponseWriter.Header()
+	for k, v := range w.header {
+		h[k] = v
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *retryResponseWriter) Write(b []byte) (int, error) {
+	if !w.written {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.attempt.status != 0 {
+		return len(b), nil
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *retryResponseWriter) Flush() {
+	if w.written && w.attempt.status == 0 {
+		http.NewResponseController(w.ResponseWriter).Flush()
+	}
+}
+
+func (w *retryResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// retryBudgetWindow is the period retries are counted over for a budget.
+const retryBudgetWindow = 10 * time.Second
+
+// minRetries are allowed in each window regardless of the budget, so that
+// quiet servers can retry.
+const minRetries = 3
+
+// retryBudget limits retries to a percentage of requests, so that retrying
+// can't multiply the load on struggling upstreams.
+type retryBudget struct {
+	percent float64
+
+	mu       sync.Mutex
+	start    time.Time // of the current window
+	requests int
+	retries  int
+}
+
+// reset starts a new window if the current one is over. b.mu must be held.
+func (b *retryBudget) reset() {
+	if now := time.Now(); now.Sub(b.start) >= retryBudgetWindow {
+		b.start, b.requests, b.retries = now, 0, 0
+	}
+}
+
+// request counts a request that may be retried.
+func (b *retryBudget) request() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.reset()
+	b.requests++
+}
+
+// available returns true if a request may be retried.
+func (b *retryBudget) available() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.reset()
+	return b.retries < minRetries || float64(b.retries) < float64(b.requests)*b.percent/100
+}
+
+// take counts a retry against the budget.
+func (b *retryBudget) take() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.retries++
+}
+
+// setUpstreamHeaders applies configured headers to a request sent upstream,
+// after any it already has. A Host header replaces the host requested by the
+// client, and removing it sends the upstream's own host name instead.
+func setUpstreamHeaders(out *http.Request, target *url.URL, headers Headers) {
+	headers.setDefaults(out.Header)
+	headers.applyRules(out.Header)
+	if host := out.Header.Get("Host"); host != "" {
+		out.Host = host
+		out.Header.Del("Host")
+	}
+	if _, ok := headers[HeaderRemove+"Host"]; ok {
+		out.Host = target.Host
+	}
+}
+
+// bufferResponse reads the response body into memory, up to the limit, so
+// the upstream connection is released without waiting for a slow client.
+// Larger responses stream the remainder once the limit is reached.
+func bufferResponse(resp *http.Response, limit int64) error {
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		return err
+	}
+	if int64(len(body)) <= limit {
+		resp.Body.Close()
+		resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+		resp.ContentLength = int64(len(body))
+		resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+		resp.Header.Del("Transfer-Encoding")
+		return nil
+	}
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+	return nil
+}
+
+// proxyError responds with 504 Gateway Timeout if the upstream timed out,
+// or 502 Bad Gateway otherwise.
+func proxyError(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, context.Canceled) {
+		return // client went away
+	}
+	log.Printf("Proxy error for %s: %s", r.URL, err)
+	status := http.StatusBadGateway
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() || errors.Is(err, context.DeadlineExceeded) {
+		status = http.StatusGatewayTimeout
+	}
+	http.Error(w, http.StatusText(status), status)
+}
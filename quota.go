@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Quota limits the bytes and requests a token may use within a window.
+type Quota struct {
+	Bytes    int64         // 0=unlimited
+	Requests int64         // 0=unlimited
+	Window   time.Duration // period after the first request before usage resets
+}
+
+// quotaUsage is how much of its quota a token has used in the current
+// window.
+type quotaUsage struct {
+	Start    time.Time `json:"start"`
+	Bytes    int64     `json:"bytes"`
+	Requests int64     `json:"requests"`
+}
+
+// QuotaStore records the usage of quotas, optionally persisting it to a file
+// so that restarting doesn't reset quotas.
+type QuotaStore struct {
+	file string
+
+	mu    sync.Mutex
+	usage map[string]*quotaUsage // by realm and token name
+	dirty bool
+}
+
+// quotas records the usage of token quotas.
+var quotas = &QuotaStore{usage: map[string]*quotaUsage{}}
+
+// NewQuotaStore creates a store persisted to the given file, loading any
+// usage already recorded there.
+func NewQuotaStore(file string) (*QuotaStore, error) {
+	q := &QuotaStore{file: file, usage: map[string]*quotaUsage{}}
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return q, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &q.usage); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+// saveEvery writes usage to the file at the given interval, if it has
+// changed, until the function returned is called.
+func (q *QuotaStore) saveEvery(interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				q.save()
+			case <-done:
+				return
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(done) })
+	}
+}
+
+// save writes usage to the file, atomically, if it has changed.
+func (q *QuotaStore) save() {
+	if q.file == "" {
+		return
+	}
+	q.mu.Lock()
+	if !q.dirty {
+		q.mu.Unlock()
+		return
+	}
+	data, err := json.Marshal(q.usage)
+	q.dirty = false
+	q.mu.Unlock()
+	if err != nil {
+		log.Println("Couldn't encode quota usage:", err)
+		return
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(q.file), ".tmp-")
+	if err == nil {
+		_, err = tmp.Write(data)
+		tmp.Close()
+		if err == nil {
+			err = os.Rename(tmp.Name(), q.file)
+		}
+		if err != nil {
+			os.Remove(tmp.Name())
+		}
+	}
+	if err != nil {
+		log.Printf("Couldn't save quota usage to %s: %s", q.file, err)
+	}
+}
+
+// take records a request against the quota, unless it's exhausted, in which
+// case it returns the status to respond with and when the window resets.
+func (q *QuotaStore) take(key string, quota Quota) (status int, reset time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	now := time.Now()
+	u := q.usage[key]
+	if u == nil || (quota.Window > 0 && now.Sub(u.Start) >= quota.Window) {
+		u = &quotaUsage{Start: now}
+		q.usage[key] = u
+	}
+	reset = u.Start.Add(quota.Window)
+	if quota.Bytes > 0 && u.Bytes >= quota.Bytes {
+		return http.StatusForbidden, reset
+	}
+	if quota.Requests > 0 && u.Requests >= quota.Requests {
+		return http.StatusTooManyRequests, reset
+	}
+	u.Requests++
+	q.dirty = true
+	return 0, reset
+}
+
+// add records bytes sent against a quota.
+func (q *QuotaStore) add(key string, n int64) {
+	q.mu.Lock()
+	if u := q.usage[key]; u != nil {
+		u.Bytes += n
+		q.dirty = true
+	}
+	q.mu.Unlock()
+}
+
+// quotaResponseWriter counts the bytes of a response against a quota.
+type quotaResponseWriter struct {
+	http.ResponseWriter
+	store *QuotaStore
+	key   string
+}
+
+func (w *quotaResponseWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	w.store.add(w.key, int64(n))
+	return n, err
+}
+
+func (w *quotaResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// limit checks the quota before a request is served, and counts the bytes of
+// its response. It returns false if the quota is exhausted, having
+// responded with "429 Too Many Requests" if the request limit was reached,
+// or "403 Forbidden" if the byte limit was.
+func (q *QuotaStore) limit(w http.ResponseWriter, r *http.Request, key string, quota Quota) (http.ResponseWriter, bool) {
+	status, reset := q.take(key, quota)
+	if status == 0 {
+		return &quotaResponseWriter{w, q, key}, true
+	}
+	rule := "quota " + key
+	setDenyRule(r, rule)
+	audit(r, "quota", AuditDeny, rule, authUser(r))
+	if quota.Window > 0 {
+		secs := int(time.Until(reset).Seconds()) + 1
+		w.Header().Set("Retry-After", strconv.Itoa(secs))
+	}
+	http.Error(w, "Quota exhausted", status)
+	return w, false
+}
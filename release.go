@@ -0,0 +1,114 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"path/filepath"
+	"sync"
+)
+
+// Release modes for serves whose target is a symlink to the current release.
+const (
+	ReleasePerRequest = "request" // re-resolve the target for every request
+	ReleaseOnSignal   = "signal"  // re-resolve the target on SIGHUP only
+)
+
+var (
+	releaseMu    sync.Mutex
+	releaseHooks []*releaseHook
+)
+
+type releaseHook struct {
+	f func()
+}
+
+// onRelease registers a function to be called when a release is signalled,
+// e.g. to re-resolve targets and flush caches, returning a function that
+// unregisters it.
+func onRelease(f func()) (remove func()) {
+	hook := &releaseHook{f}
+	releaseMu.Lock()
+	releaseHooks = append(releaseHooks, hook)
+	releaseMu.Unlock()
+	return func() {
+		releaseMu.Lock()
+		defer releaseMu.Unlock()
+		for i, h := range releaseHooks {
+			if h == hook {
+				releaseHooks = append(releaseHooks[:i:i], releaseHooks[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// release calls all registered release hooks.
+func release() {
+	releaseMu.Lock()
+	defer releaseMu.Unlock()
+	for _, h := range releaseHooks {
+		h.f()
+	}
+}
+
+// ReleaseHandler serves from the directory a symlink currently points at.
+// The link is resolved once per request, or, if pinned, once up front and
+// again whenever a release is signalled, so that clients never see a mix of
+// files from different releases within a request (or between releases).
+// Per request, the handler of the directory last resolved is kept, and only
+// replaced once the link points elsewhere.
+// The function returned stops following releases.
+func ReleaseHandler(link string, pinned bool, serve func(dir http.Dir) http.Handler) (http.Handler, func()) {
+	if !pinned {
+		var mu sync.Mutex
+		var lastDir string
+		var last http.Handler
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			dir, err := filepath.EvalSymlinks(link)
+			if err != nil {
+				log.Printf("Couldn't resolve %s: %s", link, err)
+				http.Error(w, http.StatusText(http.StatusServiceUnavailable),
+					http.StatusServiceUnavailable)
+				return
+			}
+			mu.Lock()
+			if last == nil || dir != lastDir {
+				lastDir, last = dir, serve(http.Dir(dir))
+			}
+			h := last
+			mu.Unlock()
+			h.ServeHTTP(w, r)
+		}), func() {}
+	}
+
+	var mu sync.RWMutex
+	var current http.Handler
+	resolve := func() {
+		dir, err := filepath.EvalSymlinks(link)
+		if err != nil {
+			log.Printf("Couldn't resolve %s: %s", link, err)
+			return
+		}
+		if settings().Verbose {
+			log.Printf("Serving release %s for %s", dir, link)
+		}
+		h := serve(http.Dir(dir))
+		mu.Lock()
+		current = h
+		mu.Unlock()
+	}
+	resolve()
+	stop := onRelease(resolve)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.RLock()
+		h := current
+		mu.RUnlock()
+		if h == nil {
+			http.Error(w, http.StatusText(http.StatusServiceUnavailable),
+				http.StatusServiceUnavailable)
+			return
+		}
+		h.ServeHTTP(w, r)
+	}), stop
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const reportTop = 10 // default number of entries in each top list
+
+// traffic, if set, remembers recent requests for traffic reports.
+var traffic *TrafficLog
+
+type trafficEntry struct {
+	time    time.Time
+	path    string
+	client  string
+	referer string
+	status  int
+	size    int
+}
+
+// TrafficLog is a ring buffer of the most recent requests.
+type TrafficLog struct {
+	mu      sync.Mutex
+	entries []trafficEntry
+	next    int  // index the next entry is written to
+	full    bool // whether entries has wrapped
+}
+
+// NewTrafficLog creates a TrafficLog remembering up to size requests.
+func NewTrafficLog(size int) *TrafficLog {
+	return &TrafficLog{entries: make([]trafficEntry, size)}
+}
+
+// record remembers a response to the request, with the client's IP
+// anonymized in the given way, if any.
+func (t *TrafficLog) record(r *http.Request, status, size int, anonymize string) {
+	client, _, _ := net.SplitHostPort(r.RemoteAddr)
+	if anonymize != "" {
+		client = anonymizeIP(client, anonymize)
+	}
+	e := trafficEntry{time.Now(), r.URL.Path, client, r.Referer(), status, size}
+
+	t.mu.Lock()
+	t.entries[t.next] = e
+	t.next++
+	if t.next == len(t.entries) {
+		t.next = 0
+		t.full = true
+	}
+	t.mu.Unlock()
+}
+
+// TrafficReport summarises the requests remembered by a TrafficLog.
+type TrafficReport struct {
+	Since    time.Time    `json:"since"` // time of the oldest request included
+	Requests uint64       `json:"requests"`
+	Bytes    uint64       `json:"bytes"`
+	Statuses []StatsCount `json:"statuses"`
+	Paths    []StatsCount `json:"paths"`
+	Clients  []StatsCount `json:"clients"`
+	Referers []StatsCount `json:"referers"`
+}
+
+// topCounts returns at most top of the counts, largest first.
+func topCounts(m map[string]uint64, top int) []StatsCount {
+	counts := []StatsCount{}
+	for k, n := range m {
+		counts = append(counts, StatsCount{k, n})
+	}
+	sort.Slice(counts, func(i, j int) bool {
+		a, b := counts[i], counts[j]
+		return a.Count > b.Count || (a.Count == b.Count && a.Key < b.Key)
+	})
+	if len(counts) > top {
+		counts = counts[:top]
+	}
+	return counts
+}
+
+// report summarises the remembered requests made within the given period
+// (0=all), with at most top entries in each list.
+func (t *TrafficLog) report(top int, period time.Duration) TrafficReport {
+	var rep TrafficReport
+	statuses := make(map[string]uint64)
+	paths := make(map[string]uint64)
+	clients := make(map[string]uint64)
+	referers := make(map[string]uint64)
+	var cutoff time.Time
+	if period > 0 {
+		cutoff = time.Now().Add(-period)
+	}
+
+	t.mu.Lock()
+	n := t.next
+	if t.full {
+		n = len(t.entries)
+	}
+	for i := 0; i < n; i++ {
+		e := t.entries[i]
+		if e.time.Before(cutoff) {
+			continue
+		}
+		if rep.Since.IsZero() || e.time.Before(rep.Since) {
+			rep.Since = e.time
+		}
+		rep.Requests++
+		rep.Bytes += uint64(e.size)
+		statuses[strconv.Itoa(e.status)+" "+http.StatusText(e.status)]++
+		paths[e.path]++
+		clients[e.client]++
+		if e.referer != "" {
+			referers[e.referer]++
+		}
+	}
+	t.mu.Unlock()
+
+	rep.Statuses = topCounts(statuses, len(statuses))
+	sort.Slice(rep.Statuses, func(i, j int) bool {
+		return rep.Statuses[i].Key < rep.Statuses[j].Key
+	})
+	rep.Paths = topCounts(paths, top)
+	rep.Clients = topCounts(clients, top)
+	rep.Referers = topCounts(referers, top)
+	return rep
+}
+
+// ServeHTTP responds with a JSON report of recent traffic. The `top` query
+// parameter sets the length of each list, and `since` limits the report to
+// requests made within a period, e.g. "15m".
+func (t *TrafficLog) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	top := reportTop
+	if s := r.URL.Query().Get("top"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			http.Error(w, "Invalid top", http.StatusBadRequest)
+			return
+		}
+		top = n
+	}
+	period, err := parseDuration(r.URL.Query().Get("since"))
+	if err != nil || period < 0 {
+		http.Error(w, "Invalid since", http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(t.report(top, period))
+}
+
+// runReport implements the `report` subcommand, which prints a report of
+// recent traffic fetched from a running server's admin listener. It returns
+// the exit status.
+func runReport(args []string) int {
+	fs := flag.NewFlagSet("report", flag.ExitOnError)
+	admin := fs.String("admin", "127.0.0.1:9090", "Address of the admin listener")
+	top := fs.Int("top", reportTop, "Number of entries in each list")
+	since := fs.String("since", "", "Only include requests made within this period, e.g. 15m")
+	asJSON := fs.Bool("json", false, "Print the report as JSON")
+	fs.Parse(args)
+
+	u := fmt.Sprintf("http://%s/report?top=%d&since=%s", *admin, *top, *since)
+	client := http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(u)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Couldn't fetch report:", err)
+		return 1
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		fmt.Fprintln(os.Stderr, "Couldn't fetch report:", resp.Status)
+		return 1
+	}
+	var rep TrafficReport
+	if err := json.NewDecoder(resp.Body).Decode(&rep); err != nil {
+		fmt.Fprintln(os.Stderr, "Couldn't read report:", err)
+		return 1
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(rep)
+		return 0
+	}
+	fmt.Printf("%d requests, %d bytes", rep.Requests, rep.Bytes)
+	if rep.Requests > 0 {
+		fmt.Printf(" since %s", rep.Since.Local().Format(time.RFC3339))
+	}
+	fmt.Println()
+	for _, list := range []struct {
+		title  string
+		counts []StatsCount
+	}{
+		{"Statuses", rep.Statuses},
+		{"Top paths", rep.Paths},
+		{"Top clients", rep.Clients},
+		{"Top referers", rep.Referers},
+	} {
+		fmt.Printf("\n%s:\n", list.title)
+		for _, c := range list.counts {
+			fmt.Printf("%10d  %s\n", c.Count, c.Key)
+		}
+	}
+	return 0
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"gopkg.in/v1/yaml"
+
+	"fmt"
+	"net/http"
+	"sync/atomic"
+)
+
+// handlerFinder finds the handler for a request, as http.ServeMux does.
+type handlerFinder interface {
+	Handler(r *http.Request) (h http.Handler, pattern string)
+}
+
+// errorServer responds to requests with error pages.
+type errorServer interface {
+	ServeError(w http.ResponseWriter, r *http.Request, status int)
+}
+
+// Router passes requests to the current StaticServeMux, which may be replaced
+// while requests are being served when the configuration changes.
+type Router struct {
+	mux atomic.Value // *StaticServeMux
+}
+
+// NewRouter creates a Router passing requests to the mux.
+func NewRouter(mux *StaticServeMux) *Router {
+	rt := &Router{}
+	rt.mux.Store(mux)
+	return rt
+}
+
+// Mux returns the current mux.
+func (rt *Router) Mux() *StaticServeMux {
+	return rt.mux.Load().(*StaticServeMux)
+}
+
+// SetMux replaces the mux. Requests already being served finish with the old
+// one.
+func (rt *Router) SetMux(mux *StaticServeMux) {
+	rt.mux.Store(mux)
+}
+
+func (rt *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rt.Mux().ServeHTTP(w, r)
+}
+
+// ServeError responds with the current mux's page for the status.
+func (rt *Router) ServeError(w http.ResponseWriter, r *http.Request, status int) {
+	rt.Mux().ServeError(w, r, status)
+}
+
+// Handler returns the current mux's handler for the request.
+func (rt *Router) Handler(r *http.Request) (http.Handler, string) {
+	return rt.Mux().Handler(r)
+}
+
+// route is a handler and the path it's registered at.
+type route struct {
+	path    string
+	handler http.Handler
+	stop    func() // stops the handler's background work
+}
+
+// stopRoutes stops the handlers of the routes.
+func stopRoutes(routes []route) {
+	for _, r := range routes {
+		if r.stop != nil {
+			r.stop()
+		}
+	}
+}
+
+// RouteBuilder builds the StaticServeMux for a configuration. The handlers of
+// serves that haven't changed since the previous build are reused, so that
+// their caches and indexes survive configuration changes, and those of serves
+// that have changed or been removed are stopped.
+type RouteBuilder struct {
+	router *Router
+	serves map[string][]route // by the serve's YAML
+}
+
+// NewRouteBuilder creates a RouteBuilder for muxes used by the router, which
+// aliases are resolved through.
+func NewRouteBuilder(router *Router) *RouteBuilder {
+	return &RouteBuilder{router: router, serves: make(map[string][]route)}
+}
+
+// build returns the mux for the configuration, which must have been checked.
+func (b *RouteBuilder) build(c ServerConfig) (mux *StaticServeMux, err error) {
+	serves := make(map[string][]route)
+	defer func() {
+		// ServeMux panics on conflicting patterns
+		if p := recover(); p != nil {
+			mux, err = nil, fmt.Errorf("%v", p)
+		}
+		if err != nil {
+			// The previous routes remain in use
+			for key, routes := range serves {
+				if _, ok := b.serves[key]; !ok {
+					stopRoutes(routes)
+				}
+			}
+		}
+	}()
+
+	mux = NewStaticServeMux()
+	mux.SetErrorTheme(c.ErrorTheme)
+	mux.SetAPIPaths(c.APIPaths)
+	mux.SetErrorPagesFrom(c.ErrorPagesFrom)
+	for _, e := range c.Errors {
+		mux.HandleStatus(e.Status, e.Path, e.handler(), e.Headers)
+	}
+	var added []Serve
+	for _, s := range c.Serves {
+		data, _ := yaml.Marshal(s)
+		key := string(data)
+		routes, ok := b.serves[key]
+		if !ok {
+			routes, ok = serves[key] // the same serve given twice
+		}
+		if !ok {
+			h, stop, err := s.handler(b.router)
+			if err != nil {
+				return nil, fmt.Errorf("serve %s: %s", s.Path, err)
+			}
+			routes = []route{{s.Path, h, stop}}
+			if s.Sitemap != nil {
+				p, g := s.sitemapHandler()
+				routes = append(routes, route{p, s.guard(g), g.Stop})
+			}
+			if s.Search != nil {
+				p, x := s.searchHandler()
+				routes = append(routes, route{p, s.guard(x), x.Stop})
+			}
+			added = append(added, s)
+		}
+		serves[key] = routes
+		for _, r := range routes {
+			mux.Handle(r.path, r.handler)
+		}
+	}
+	for _, r := range c.Redirects {
+		mux.Handle(r.From, r.handler())
+	}
+	if c.Downloads != nil && c.Downloads.Badges != "" {
+		mux.Handle(c.Downloads.badgeHandler())
+	}
+	for _, w := range c.WellKnown {
+		mux.Handle(w.handler())
+	}
+	if c.Favicon {
+		mux.HandleFallback("/favicon.ico", NoContentHandler())
+	}
+	if c.Robots != "" {
+		mux.HandleFallback("/robots.txt",
+			ContentHandler("text/plain; charset=utf-8", c.Robots))
+	}
+
+	// Warm up caches before accepting requests
+	for _, s := range added {
+		s.preload()
+	}
+	for key, routes := range b.serves {
+		if _, ok := serves[key]; !ok {
+			stopRoutes(routes)
+		}
+	}
+	b.serves = serves
+	return mux, nil
+}
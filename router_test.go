@@ -0,0 +1,60 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRouteBuilderAuthenticatesIndexes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goserve-router")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "secret.txt"), []byte("secret"), 0644)
+
+	realm, err := NewAuthRealm("staff", map[string]string{
+		// "password"
+		"alice": "sha256:5e884898da28047151d0e56f8dc6292773603d0d6aabbdd62a11ef721d1542d8",
+	}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	authRealms["staff"] = realm
+	defer delete(authRealms, "staff")
+
+	c := ServerConfig{Serves: []Serve{{
+		Path:    "/docs/",
+		Target:  dir,
+		Auth:    "staff",
+		Sitemap: &Sitemap{},
+		Search:  &Search{},
+	}}}
+	c.sanitise()
+	b := NewRouteBuilder(NewRouter(nil))
+	mux, err := b.build(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.build(ServerConfig{}) // stops the indexes
+
+	for _, p := range []string{"/docs/_search?q=secret", "/docs/sitemap.xml", "/docs/secret.txt"} {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, p, nil))
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("%s: status %d, want %d", p, w.Code, http.StatusUnauthorized)
+		}
+
+		r := httptest.NewRequest(http.MethodGet, p, nil)
+		r.SetBasicAuth("alice", "password")
+		w = httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Errorf("%s: authenticated status %d, want %d", p, w.Code, http.StatusOK)
+		}
+	}
+}
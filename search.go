@@ -0,0 +1,297 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SearchIndex periodically walks a directory, and serves searches of the
+// names of the files within it, and optionally of their text.
+type SearchIndex struct {
+	root    string     // directory to walk
+	prefix  string     // URL path the directory is served under
+	exclude []string   // glob patterns of paths to leave out
+	limit   int        // maximum number of results
+	text    *TextIndex // full-text index (nil=names only)
+
+	maxDepth int // levels of directories indexed (0=unlimited)
+
+	mu      sync.RWMutex
+	entries []searchEntry
+
+	done chan struct{} // closed to stop rebuilding
+}
+
+type searchEntry struct {
+	rel     string // slash-separated path relative to the root
+	size    int64
+	modTime time.Time
+	dir     bool
+}
+
+// NewSearchIndex creates an index of the files within root, served under the
+// URL prefix, updating the full-text index if given. Directories more than
+// maxDepth levels below root aren't indexed, unless it's 0. The index is
+// built immediately and then rebuilt at the given interval, until the index
+// is stopped.
+func NewSearchIndex(root, prefix string, exclude []string, maxDepth, limit int, interval time.Duration, text *TextIndex) *SearchIndex {
+	x := &SearchIndex{
+		root:     root,
+		prefix:   prefix,
+		exclude:  exclude,
+		limit:    limit,
+		text:     text,
+		maxDepth: maxDepth,
+		done:     make(chan struct{}),
+	}
+	x.build()
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				x.build()
+			case <-x.done:
+				return
+			}
+		}
+	}()
+	return x
+}
+
+// Stop stops rebuilding the index.
+func (x *SearchIndex) Stop() {
+	close(x.done)
+}
+
+// matchAny returns true if the slash-separated path, or its base name,
+// matches any of the glob patterns.
+func matchAny(patterns []string, rel string) bool {
+	for _, pattern := range patterns {
+		if m, _ := path.Match(pattern, rel); m {
+			return true
+		}
+		if m, _ := path.Match(pattern, path.Base(rel)); m {
+			return true
+		}
+	}
+	return false
+}
+
+// pathDepth returns the number of directories a slash-separated path is
+// below the root, counting the path itself, so "a/b" and "/a/b/" are 2.
+func pathDepth(p string) int {
+	p = strings.Trim(p, "/")
+	if p == "" || p == "." {
+		return 0
+	}
+	return strings.Count(p, "/") + 1
+}
+
+func (x *SearchIndex) build() {
+	entries := []searchEntry{}
+	err := filepath.Walk(x.root, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		rel, err := filepath.Rel(x.root, p)
+		if err != nil || rel == "." {
+			return nil
+		}
+		rel = filepath.ToSlash(rel)
+		if matchAny(x.exclude, rel) || fi.IsDir() && x.maxDepth > 0 && pathDepth(rel) > x.maxDepth {
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		entries = append(entries, searchEntry{rel, fi.Size(), fi.ModTime(), fi.IsDir()})
+		return nil
+	})
+	if err != nil {
+		log.Printf("Couldn't index %s for search: %s", x.root, err)
+		return
+	}
+
+	x.mu.Lock()
+	x.entries = entries
+	x.mu.Unlock()
+	if x.text != nil {
+		x.text.update(x.root, entries)
+	}
+}
+
+// search returns the entries whose names contain the query, or match it if
+// it's a glob pattern, ignoring case. Patterns containing a slash are
+// matched against the whole path instead. The result is truncated if it
+// has more than the limit.
+func (x *SearchIndex) search(q string) (results []searchEntry, truncated bool) {
+	q = strings.ToLower(q)
+	glob := strings.ContainsAny(q, "*?[")
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	for _, e := range x.entries {
+		name := strings.ToLower(path.Base(e.rel))
+		var match bool
+		switch {
+		case glob && strings.Contains(q, "/"):
+			match, _ = path.Match(q, strings.ToLower(e.rel))
+		case glob:
+			match, _ = path.Match(q, name)
+		default:
+			match = strings.Contains(name, q)
+		}
+		if !match {
+			continue
+		}
+		if len(results) >= x.limit {
+			return results, true
+		}
+		results = append(results, e)
+	}
+	return results, false
+}
+
+// url returns the URL path of an entry.
+func (x *SearchIndex) url(e searchEntry) string {
+	p := path.Join(x.prefix, e.rel)
+	if e.dir {
+		p += "/"
+	}
+	return (&url.URL{Path: p}).String()
+}
+
+type searchResponse struct {
+	Query     string         `json:"query"`
+	Results   []searchResult `json:"results"`
+	Truncated bool           `json:"truncated"`
+}
+
+type searchResult struct {
+	Path     string    `json:"path"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+	Dir      bool      `json:"dir,omitempty"`
+
+	// Only for searches of text
+	Title   string  `json:"title,omitempty"`
+	Score   float64 `json:"score,omitempty"`
+	Snippet string  `json:"snippet,omitempty"`
+}
+
+// wantsJSON returns true if the request asks for a JSON response, with a
+// `format=json` query parameter or an Accept header preferring it to HTML.
+func wantsJSON(r *http.Request) bool {
+	if f := r.URL.Query().Get("format"); f != "" {
+		return f == "json"
+	}
+	accept := r.Header.Get("Accept")
+	return strings.Contains(accept, "application/json") &&
+		!strings.Contains(accept, "text/html")
+}
+
+// Search modes, chosen with the `in` query parameter.
+const (
+	SearchNames   = "names"
+	SearchContent = "content"
+)
+
+// ServeHTTP responds to a search for `q`, with HTML or JSON results. Text is
+// searched if there's a full-text index, unless `in=names` is given.
+func (x *SearchIndex) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	q := strings.TrimSpace(r.URL.Query().Get("q"))
+	mode := SearchNames
+	if x.text != nil && r.URL.Query().Get("in") != SearchNames {
+		mode = SearchContent
+	}
+	var results []searchResult
+	var truncated bool
+	if q != "" && mode == SearchContent {
+		var found []textResult
+		found, truncated = x.text.search(q, x.limit)
+		for _, t := range found {
+			e := searchEntry{t.doc.Rel, t.doc.Size, t.doc.ModTime, false}
+			results = append(results, searchResult{x.url(e), e.size, e.modTime.UTC(), false,
+				t.doc.Title, t.score, t.snippet})
+		}
+	} else if q != "" {
+		var found []searchEntry
+		found, truncated = x.search(q)
+		for _, e := range found {
+			results = append(results, searchResult{Path: x.url(e), Size: e.size,
+				Modified: e.modTime.UTC(), Dir: e.dir})
+		}
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Add("Vary", "Accept")
+
+	if wantsJSON(r) {
+		if results == nil {
+			results = []searchResult{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(searchResponse{q, results, truncated})
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintf(w, `<!doctype html>
+<meta name="viewport" content="width=device-width">
+<title>Search</title>
+<form><input type="search" name="q" value="%s" autofocus> <button>Search</button>`,
+		html.EscapeString(q))
+	if x.text != nil {
+		checked := ""
+		if mode == SearchNames {
+			checked = " checked"
+		}
+		fmt.Fprintf(w, ` <label><input type="checkbox" name="in" value="%s"%s> names only</label>`,
+			SearchNames, checked)
+	}
+	w.Write([]byte("</form>\n"))
+	if mode == SearchContent {
+		re := wordsPattern(terms(q))
+		for _, res := range results {
+			fmt.Fprintf(w, "<p><a href=\"%s\">%s</a><br>%s</p>\n",
+				res.Path, html.EscapeString(res.Title), markMatches(res.Snippet, re))
+		}
+	} else {
+		w.Write([]byte("<pre>\n"))
+		for _, res := range results {
+			fmt.Fprintf(w, "<a href=\"%s\">%s</a>\n",
+				res.Path, html.EscapeString(strings.TrimPrefix(res.Path, x.prefix)))
+		}
+		w.Write([]byte("</pre>\n"))
+	}
+	if q != "" && len(results) == 0 {
+		w.Write([]byte("<p>No matching files.</p>\n"))
+	} else if truncated {
+		fmt.Fprintf(w, "<p>Only the first %d matches are shown.</p>\n", x.limit)
+	}
+}
+
+// markMatches escapes text as HTML, with matches of the pattern wrapped in
+// mark elements.
+func markMatches(text string, re *regexp.Regexp) string {
+	var b strings.Builder
+	last := 0
+	for _, m := range re.FindAllStringIndex(text, -1) {
+		b.WriteString(html.EscapeString(text[last:m[0]]))
+		b.WriteString("<mark>" + html.EscapeString(text[m[0]:m[1]]) + "</mark>")
+		last = m[1]
+	}
+	b.WriteString(html.EscapeString(text[last:]))
+	return b.String()
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Sources of PEM data other than files, given in place of a cert or key path.
+const (
+	PEMInlinePrefix = "-----BEGIN" // the PEM data itself
+	PEMEnvPrefix    = "env:"       // env:NAME, PEM or base64 PEM in a variable
+	PEMFDPrefix     = "fd:"        // fd:N, read from an inherited file descriptor
+	PEMVaultPrefix  = "vault:"     // vault:PATH#FIELD, from a Vault-compatible store
+)
+
+// fdContents holds what was read from file descriptors, as they can only be
+// read once.
+var fdContents = struct {
+	sync.Mutex
+	m map[int][]byte
+}{m: make(map[int][]byte)}
+
+// isPEMFile returns true if the spec is the path of a file, rather than
+// another source of PEM data.
+func isPEMFile(spec string) bool {
+	return !strings.HasPrefix(spec, PEMInlinePrefix) &&
+		!strings.HasPrefix(spec, PEMEnvPrefix) &&
+		!strings.HasPrefix(spec, PEMFDPrefix) &&
+		!strings.HasPrefix(spec, PEMVaultPrefix)
+}
+
+// pemLabel returns a name for the source of PEM data for messages, without
+// revealing inline data.
+func pemLabel(spec string) string {
+	if strings.HasPrefix(spec, PEMInlinePrefix) {
+		return "inline PEM"
+	}
+	return spec
+}
+
+// checkPEMSpec returns an error if the source of PEM data is unusable,
+// without reading from it unless it's a file or variable.
+func checkPEMSpec(spec string) error {
+	switch {
+	case strings.HasPrefix(spec, PEMInlinePrefix):
+		return nil
+	case strings.HasPrefix(spec, PEMEnvPrefix):
+		if os.Getenv(strings.TrimPrefix(spec, PEMEnvPrefix)) == "" {
+			return fmt.Errorf("environment variable %s is empty",
+				strings.TrimPrefix(spec, PEMEnvPrefix))
+		}
+		return nil
+	case strings.HasPrefix(spec, PEMFDPrefix):
+		if _, err := strconv.Atoi(strings.TrimPrefix(spec, PEMFDPrefix)); err != nil {
+			return fmt.Errorf("invalid file descriptor")
+		}
+		return nil
+	case strings.HasPrefix(spec, PEMVaultPrefix):
+		if !strings.Contains(spec, "#") {
+			return fmt.Errorf("missing #field")
+		}
+		if os.Getenv("VAULT_TOKEN") == "" {
+			return fmt.Errorf("VAULT_TOKEN is not set")
+		}
+		return nil
+	}
+	_, err := os.Stat(spec)
+	return err
+}
+
+// readPEM returns the PEM data from the source described by the spec: a
+// file path, the PEM data itself, "env:NAME" for an environment variable
+// holding PEM or base64 encoded PEM, "fd:N" for an inherited file descriptor,
+// or "vault:PATH#FIELD" for a field of a secret in a Vault-compatible store.
+func readPEM(spec string) ([]byte, error) {
+	switch {
+	case strings.HasPrefix(spec, PEMInlinePrefix):
+		return []byte(spec), nil
+	case strings.HasPrefix(spec, PEMEnvPrefix):
+		name := strings.TrimPrefix(spec, PEMEnvPrefix)
+		v := strings.TrimSpace(os.Getenv(name))
+		if v == "" {
+			return nil, fmt.Errorf("environment variable %s is empty", name)
+		}
+		if strings.HasPrefix(v, PEMInlinePrefix) {
+			return []byte(v), nil
+		}
+		b, err := base64.StdEncoding.DecodeString(v)
+		if err != nil {
+			return nil, fmt.Errorf("environment variable %s is neither PEM nor base64", name)
+		}
+		return b, nil
+	case strings.HasPrefix(spec, PEMFDPrefix):
+		fd, err := strconv.Atoi(strings.TrimPrefix(spec, PEMFDPrefix))
+		if err != nil {
+			return nil, fmt.Errorf("invalid file descriptor in `%s`", spec)
+		}
+		fdContents.Lock()
+		defer fdContents.Unlock()
+		if b, ok := fdContents.m[fd]; ok {
+			return b, nil
+		}
+		f := os.NewFile(uintptr(fd), spec)
+		if f == nil {
+			return nil, fmt.Errorf("invalid file descriptor in `%s`", spec)
+		}
+		defer f.Close()
+		b, err := ioutil.ReadAll(f)
+		if err != nil {
+			return nil, err
+		}
+		fdContents.m[fd] = b
+		return b, nil
+	case strings.HasPrefix(spec, PEMVaultPrefix):
+		return readVaultPEM(strings.TrimPrefix(spec, PEMVaultPrefix))
+	}
+	return ioutil.ReadFile(spec)
+}
+
+// readVaultPEM returns a field of a secret read from a Vault-compatible HTTP
+// API, authenticating with the token in VAULT_TOKEN. The path is a URL, or
+// is relative to VAULT_ADDR; fields of both version 1 and version 2
+// key/value secrets are found.
+func readVaultPEM(ref string) ([]byte, error) {
+	i := strings.LastIndexByte(ref, '#')
+	if i < 0 {
+		return nil, fmt.Errorf("missing #field in `vault:%s`", ref)
+	}
+	path, field := ref[:i], ref[i+1:]
+	url := path
+	if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+		addr := os.Getenv("VAULT_ADDR")
+		if addr == "" {
+			addr = "http://127.0.0.1:8200"
+		}
+		url = strings.TrimSuffix(addr, "/") + "/v1/" + strings.TrimPrefix(path, "/")
+	}
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Vault-Token", os.Getenv("VAULT_TOKEN"))
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("reading %s: %s", path, resp.Status)
+	}
+	var secret struct {
+		Data map[string]json.RawMessage `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&secret); err != nil {
+		return nil, fmt.Errorf("reading %s: %s", path, err)
+	}
+	data := secret.Data
+	if raw, ok := data["data"]; ok {
+		// Version 2 secrets nest their fields
+		var nested map[string]json.RawMessage
+		if json.Unmarshal(raw, &nested) == nil {
+			data = nested
+		}
+	}
+	var v string
+	if err := json.Unmarshal(data[field], &v); err != nil || v == "" {
+		return nil, fmt.Errorf("secret %s has no field %s", path, field)
+	}
+	if !strings.HasPrefix(strings.TrimSpace(v), PEMInlinePrefix) {
+		if b, err := base64.StdEncoding.DecodeString(v); err == nil {
+			return b, nil
+		}
+	}
+	return []byte(v), nil
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"gopkg.in/v1/yaml"
+
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+)
+
+// Test is a request made by `goserve test`, and what its response is
+// expected to be.
+type Test struct {
+	Name     string            `yaml:"name,omitempty"`
+	Method   string            `yaml:"method,omitempty"`   // default GET
+	Path     string            `yaml:"path"`               // path and query requested
+	Host     string            `yaml:"host,omitempty"`     // Host header (default: localhost)
+	Listener string            `yaml:"listener,omitempty"` // address of the listener requested (default: the first)
+	Headers  map[string]string `yaml:"headers,omitempty"`  // request headers
+	Body     string            `yaml:"body,omitempty"`     // request body
+
+	Expect TestExpect `yaml:"expect"`
+}
+
+// TestExpect is what a test's response is expected to be. Unset fields
+// aren't checked.
+type TestExpect struct {
+	Status  int               `yaml:"status,omitempty"`
+	Headers map[string]string `yaml:"headers,omitempty"` // values contained in headers ("" for absent)
+	Body    string            `yaml:"body,omitempty"`    // text the body contains
+}
+
+func (t *Test) sanitise() {
+	if t.Method == "" {
+		t.Method = http.MethodGet
+	}
+	if t.Host == "" {
+		t.Host = "localhost"
+	}
+	if t.Name == "" {
+		t.Name = t.Method + " " + t.Path
+	}
+}
+
+func (t Test) check(label string, report *problems) (ok bool) {
+	ok = true
+	if !strings.HasPrefix(t.Path, "/") {
+		report.Printf(label+": path `%s` must start with /", t.Path)
+		ok = false
+	}
+	if t.Expect.Status != 0 && (t.Expect.Status < 100 || t.Expect.Status > 599) {
+		report.Printf(label+": invalid expected status %d", t.Expect.Status)
+		ok = false
+	}
+	return
+}
+
+// run makes the test's request of the handler, returning what was wrong with
+// the response, if anything.
+func (t Test) run(h http.Handler, secure bool) []string {
+	r := httptest.NewRequest(t.Method, t.Path, strings.NewReader(t.Body))
+	r.Host = t.Host
+	if secure {
+		r.TLS = &tls.ConnectionState{ServerName: t.Host}
+	}
+	for k, v := range t.Headers {
+		r.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+
+	var problems []string
+	if t.Expect.Status != 0 && w.Code != t.Expect.Status {
+		problems = append(problems, fmt.Sprintf("status %d, expected %d", w.Code, t.Expect.Status))
+	}
+	for k, want := range t.Expect.Headers {
+		got, present := w.Header().Get(k), len(w.Header().Values(k)) > 0
+		switch {
+		case want == "" && present:
+			problems = append(problems, fmt.Sprintf("%s is `%s`, expected it to be absent", k, got))
+		case want != "" && !strings.Contains(got, want):
+			problems = append(problems, fmt.Sprintf("%s is `%s`, expected `%s`", k, got, want))
+		}
+	}
+	if t.Expect.Body != "" && !strings.Contains(w.Body.String(), t.Expect.Body) {
+		problems = append(problems, fmt.Sprintf("body doesn't contain `%s`", t.Expect.Body))
+	}
+	return problems
+}
+
+// runTest implements the `test` subcommand, which makes the requests of the
+// configuration's tests, and those in any test files, of a server set up
+// in-process, and checks their responses.
+func runTest(args []string) int {
+	fs := flag.NewFlagSet("test", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: goserve test [flags] [dir]")
+		fs.PrintDefaults()
+	}
+	load := configFlags(fs)
+	var testFiles configFiles
+	fs.Var(&testFiles, "tests", "YAML file of tests to run as well as the configuration's (repeatable)")
+	fs.Parse(args)
+
+	var err error
+	if cfg, err = load(); err != nil {
+		log.Println("Couldn't load config:", err)
+		return 1
+	}
+	tests := cfg.Tests
+	for _, file := range testFiles {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			log.Println("Couldn't read tests:", err)
+			return 1
+		}
+		var f struct {
+			Tests []Test `yaml:"tests"`
+		}
+		if err := yaml.Unmarshal(data, &f); err != nil {
+			log.Printf("Couldn't read tests: %s: %s", file, err)
+			return 1
+		}
+		var report problems
+		for i := range f.Tests {
+			f.Tests[i].sanitise()
+			f.Tests[i].check(fmt.Sprintf("%s: test #%d", file, i), &report)
+		}
+		if len(report) > 0 {
+			for _, p := range report {
+				log.Println(p)
+			}
+			return 1
+		}
+		tests = append(tests, f.Tests...)
+	}
+	if !cfg.check() {
+		log.Println("Invalid config.")
+		return 1
+	}
+	if len(tests) == 0 {
+		log.Println("No tests defined!")
+		return 1
+	}
+
+	if err := cfg.loadRealms(); err != nil {
+		log.Println(err)
+		return 1
+	}
+	router := NewRouter(nil)
+	mux, err := NewRouteBuilder(router).build(cfg)
+	if err != nil {
+		log.Println("Couldn't set up routes:", err)
+		return 1
+	}
+	router.SetMux(mux)
+	handlers := make(map[string]http.Handler)
+	for _, l := range cfg.Listeners {
+		policies, err := l.hostPolicies()
+		if err != nil {
+			log.Println("Couldn't load client CAs:", err)
+			return 1
+		}
+		if !verbose {
+			// Access logs would be mixed up with the results
+			l.Log = LogOff
+		}
+		// Tests aren't logged to the server's access logs
+		l.AccessLogs = nil
+		if handlers[l.Addr], err = l.handler(router, policies, nil); err != nil {
+			log.Println("Couldn't open access log:", err)
+			return 1
+		}
+	}
+	failed := 0
+	for _, t := range tests {
+		l := cfg.Listeners[0]
+		for _, other := range cfg.Listeners {
+			if t.Listener == other.Addr {
+				l = other
+			}
+		}
+		problems := []string{fmt.Sprintf("no listener %s", t.Listener)}
+		if t.Listener == "" || t.Listener == l.Addr {
+			problems = t.run(handlers[l.Addr], l.secure())
+		}
+		if len(problems) == 0 {
+			fmt.Printf("ok    %s\n", t.Name)
+			continue
+		}
+		failed++
+		fmt.Printf("FAIL  %s: %s\n", t.Name, strings.Join(problems, "; "))
+	}
+	fmt.Printf("%d passed, %d failed\n", len(tests)-failed, failed)
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/http"
+	"path"
+	"strings"
+)
+
+// sensitivePatterns are glob patterns of the names of files and directories
+// that aren't served unless a serve allows them, as they regularly leak from
+// document roots: version control metadata, environment files, keys and
+// certificates, and editor backups.
+var sensitivePatterns = []string{
+	".git", ".svn", ".hg",
+	".env*",
+	"*.pem", "*.key",
+	".htpasswd",
+	"*~", "*.swp", "*.swo",
+}
+
+// isSensitive returns true if any part of the slash-separated path matches
+// one of the sensitive patterns.
+func isSensitive(name string) bool {
+	for _, part := range strings.Split(path.Clean("/"+name), "/") {
+		if part != "" && matchAny(sensitivePatterns, part) {
+			return true
+		}
+	}
+	return false
+}
+
+// SensitiveFileHandler responds "404 Not Found" to requests for sensitive
+// files, or for anything inside sensitive directories, as if they didn't
+// exist.
+func SensitiveFileHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isSensitive(r.URL.Path) {
+			setDenyRule(r, "sensitive file")
+			audit(r, "acl", AuditDeny, "sensitive file", "")
+			http.NotFound(w, r)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// RuntimeSettings are settings that can be changed while the server is
+// running, from the admin listener or with a signal, to debug problems in
+// production without restarting.
+type RuntimeSettings struct {
+	Verbose      bool `json:"verbose"`       // log details such as cache evictions
+	DebugHeaders bool `json:"debug_headers"` // add debug headers to every response
+	LogSampling  bool `json:"log_sampling"`  // sample access logs as listeners are configured to
+}
+
+var runtimeSettings atomic.Value // RuntimeSettings
+
+// settings returns the current runtime settings.
+func settings() RuntimeSettings {
+	if s, ok := runtimeSettings.Load().(RuntimeSettings); ok {
+		return s
+	}
+	return RuntimeSettings{Verbose: verbose, LogSampling: true}
+}
+
+// setSettings replaces the runtime settings, logging those that changed.
+func setSettings(s RuntimeSettings) {
+	prev := settings()
+	runtimeSettings.Store(s)
+	if s != prev {
+		log.Printf("Settings changed: verbose=%t debug_headers=%t log_sampling=%t",
+			s.Verbose, s.DebugHeaders, s.LogSampling)
+	}
+}
+
+// debugMode turns on verbose logging and debug headers, and turns off log
+// sampling, or, if it's already on, restores the settings from before.
+type debugMode struct {
+	mu    sync.Mutex
+	saved *RuntimeSettings
+}
+
+func (d *debugMode) toggle() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.saved != nil {
+		log.Println("Debug mode off")
+		setSettings(*d.saved)
+		d.saved = nil
+		return
+	}
+	s := settings()
+	d.saved = &s
+	log.Println("Debug mode on")
+	setSettings(RuntimeSettings{Verbose: true, DebugHeaders: true, LogSampling: false})
+}
+
+// SettingsHandler serves the runtime settings as JSON, and changes those
+// given in the JSON body of PATCH requests.
+func SettingsHandler() http.Handler {
+	var mu sync.Mutex
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead:
+		case http.MethodPatch:
+			mu.Lock()
+			s := settings()
+			// Fields missing from the body are left as they are
+			err := json.NewDecoder(io.LimitReader(r.Body, 4096)).Decode(&s)
+			if err == nil {
+				setSettings(s)
+			}
+			mu.Unlock()
+			if err != nil {
+				http.Error(w, "Invalid settings: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		default:
+			w.Header().Set("Allow", "GET, HEAD, PATCH")
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-cache")
+		json.NewEncoder(w).Encode(settings())
+	})
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/xml"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SitemapGenerator periodically walks a directory for HTML files and serves
+// a sitemap.xml describing them. With watchInterval set, the directories
+// walked are also watched, so that pages added or removed appear promptly.
+type SitemapGenerator struct {
+	root    string   // directory to walk
+	prefix  string   // URL path the directory is served under
+	baseURL string   // scheme and host (empty=taken from request)
+	exclude []string // glob patterns of paths to leave out
+
+	maxDepth int // levels of directories walked (0=unlimited)
+
+	mu      sync.RWMutex
+	entries []sitemapEntry
+
+	done chan struct{} // closed to stop regenerating
+
+	watchMu   sync.Mutex
+	watched   []string // directories watched for changes
+	stopWatch func()
+}
+
+type sitemapEntry struct {
+	path    string
+	modTime time.Time
+}
+
+// NewSitemapGenerator creates a generator for the HTML files within root,
+// served under the URL prefix. Directories more than maxDepth levels below
+// root aren't walked, unless it's 0. The sitemap is generated immediately
+// and then regenerated at the given interval, until the generator is stopped.
+func NewSitemapGenerator(root, prefix, baseURL string, exclude []string, maxDepth int, interval time.Duration) *SitemapGenerator {
+	g := &SitemapGenerator{
+		root:     root,
+		prefix:   prefix,
+		baseURL:  strings.TrimSuffix(baseURL, "/"),
+		exclude:  exclude,
+		maxDepth: maxDepth,
+		done:     make(chan struct{}),
+	}
+	g.generate()
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				g.generate()
+			case <-g.done:
+				return
+			}
+		}
+	}()
+	return g
+}
+
+// Stop stops regenerating the sitemap.
+func (g *SitemapGenerator) Stop() {
+	g.watchMu.Lock()
+	defer g.watchMu.Unlock()
+	close(g.done)
+	if g.stopWatch != nil {
+		g.stopWatch()
+	}
+}
+
+// watch watches the directories for changes, unless they're those already
+// watched or the generator has been stopped.
+func (g *SitemapGenerator) watch(dirs []string) {
+	g.watchMu.Lock()
+	defer g.watchMu.Unlock()
+	select {
+	case <-g.done:
+		return
+	default:
+	}
+	if strings.Join(dirs, "\x00") == strings.Join(g.watched, "\x00") {
+		return
+	}
+	if g.stopWatch != nil {
+		g.stopWatch()
+	}
+	g.watched = dirs
+	g.stopWatch = WatchFiles(dirs, func() error {
+		g.generate()
+		return nil
+	})
+}
+
+func (g *SitemapGenerator) generate() {
+	entries := []sitemapEntry{}
+	var dirs []string
+	err := filepath.Walk(g.root, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		rel, err := filepath.Rel(g.root, p)
+		if err != nil {
+			return nil
+		}
+		rel = filepath.ToSlash(rel)
+		if rel != "." && matchAny(g.exclude, rel) ||
+			fi.IsDir() && g.maxDepth > 0 && pathDepth(rel) > g.maxDepth {
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if fi.IsDir() {
+			dirs = append(dirs, p)
+			return nil
+		}
+		if !strings.HasSuffix(fi.Name(), ".html") {
+			return nil
+		}
+		urlPath := path.Join(g.prefix, rel)
+		if path.Base(urlPath) == "index.html" {
+			urlPath = strings.TrimSuffix(urlPath, "index.html")
+		}
+		entries = append(entries, sitemapEntry{urlPath, fi.ModTime()})
+		return nil
+	})
+	if err != nil {
+		log.Printf("Couldn't generate sitemap for %s: %s", g.root, err)
+		return
+	}
+
+	g.mu.Lock()
+	g.entries = entries
+	g.mu.Unlock()
+	g.watch(dirs)
+}
+
+type sitemapURLSet struct {
+	XMLName xml.Name     `xml:"urlset"`
+	XMLNS   string       `xml:"xmlns,attr"`
+	URLs    []sitemapURL `xml:"url"`
+}
+
+type sitemapURL struct {
+	Loc     string `xml:"loc"`
+	LastMod string `xml:"lastmod"`
+}
+
+func (g *SitemapGenerator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	base := g.baseURL
+	if base == "" {
+		base = requestScheme(r) + "://" + r.Host
+	}
+
+	set := sitemapURLSet{XMLNS: "http://www.sitemaps.org/schemas/sitemap/0.9"}
+	g.mu.RLock()
+	for _, e := range g.entries {
+		set.URLs = append(set.URLs, sitemapURL{
+			Loc:     base + (&url.URL{Path: e.path}).EscapedPath(),
+			LastMod: e.modTime.UTC().Format(time.RFC3339),
+		})
+	}
+	g.mu.RUnlock()
+
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.Write([]byte(xml.Header))
+	xml.NewEncoder(w).Encode(set)
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"path"
+	"time"
+)
+
+// fileStat is the metadata of a file served for `?stat` requests.
+type fileStat struct {
+	Name        string            `json:"name"`
+	Dir         bool              `json:"dir,omitempty"`
+	Size        int64             `json:"size"`
+	Modified    time.Time         `json:"modified"`
+	ContentType string            `json:"content_type,omitempty"`
+	ETag        string            `json:"etag,omitempty"`
+	Checksums   map[string]string `json:"checksums,omitempty"` // hex, by algorithm
+}
+
+// contentTypeKey is the context key of the content type a ContentTypeHandler
+// would send, for handlers that describe files rather than serve them.
+type contentTypeKey struct{}
+
+// metadataQuery returns true if the request asks for metadata about a file,
+// rather than its content.
+func metadataQuery(r *http.Request) bool {
+	q := r.URL.Query()
+	return q.Has("stat") || q.Has("checksum")
+}
+
+// headerRecorder records the header and status of a response, discarding its
+// body.
+type headerRecorder struct {
+	header http.Header
+	status int
+}
+
+func (w *headerRecorder) Header() http.Header {
+	return w.header
+}
+
+func (w *headerRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *headerRecorder) Write(b []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return len(b), nil
+}
+
+// StatHandler responds to requests with a `stat` query with JSON metadata of
+// the file: its size, modification time, and the content type and ETag it's
+// served with, as found by passing a HEAD request for it to the handler,
+// along with any of its digests already known to the cache, which may be
+// nil. This lets sync tools decide cheaply whether to download a file again.
+func StatHandler(h http.Handler, fs http.FileSystem, digests *DigestCache) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !r.URL.Query().Has("stat") || (r.Method != http.MethodGet && r.Method != http.MethodHead) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		name := path.Clean("/" + r.URL.Path)
+		f, err := requestFileSystem(fs, r).Open(name)
+		if err != nil {
+			h.ServeHTTP(w, r)
+			return
+		}
+		fi, err := f.Stat()
+		f.Close()
+		if err != nil {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		st := fileStat{
+			Name:     path.Base(name),
+			Dir:      fi.IsDir(),
+			Modified: fi.ModTime().UTC(),
+		}
+		if !fi.IsDir() {
+			st.Size = fi.Size()
+			st.ContentType, st.ETag = describe(h, r)
+			if ctype, ok := r.Context().Value(contentTypeKey{}).(string); ok {
+				st.ContentType = ctype
+			}
+			if digests != nil {
+				for alg := range digestAlgorithms {
+					if sum := digests.cached(name, fi, alg); sum != nil {
+						if st.Checksums == nil {
+							st.Checksums = make(map[string]string)
+						}
+						st.Checksums[alg] = hex.EncodeToString(sum)
+					}
+				}
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-cache")
+		if r.Method == http.MethodHead {
+			return
+		}
+		json.NewEncoder(w).Encode(st)
+	})
+}
+
+// describe returns the content type and ETag the handler responds to an
+// unconditional HEAD request for the same path with.
+func describe(h http.Handler, r *http.Request) (contentType, etag string) {
+	rec := headRequest(h, r, r.URL.Path)
+	if rec.status != http.StatusOK {
+		return "", ""
+	}
+	return rec.header.Get("Content-Type"), rec.header.Get("ETag")
+}
+
+// headRequest passes an unconditional HEAD request for the path to the
+// handler, with the credentials of the original request, returning the
+// response's header and status.
+func headRequest(h http.Handler, r *http.Request, p string) *headerRecorder {
+	head := r.Clone(context.WithValue(r.Context(), gzipOptionsKey{}, nil))
+	head.Method = http.MethodHead
+	head.URL.Path, head.URL.RawPath, head.URL.RawQuery = p, "", ""
+	head.Header = http.Header{"Accept": {"*/*"}}
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		head.Header.Set("Authorization", auth)
+	}
+	if cookie := r.Header.Get("Cookie"); cookie != "" {
+		head.Header.Set("Cookie", cookie)
+	}
+	head.Body, head.ContentLength = http.NoBody, 0
+	rec := &headerRecorder{header: make(http.Header)}
+	h.ServeHTTP(rec, head)
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	return rec
+}
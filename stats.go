@@ -0,0 +1,137 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	maxStatsPaths    = 10000 // distinct paths counted for the top paths
+	maxRecentErrors  = 20
+	statsRateSeconds = 60 // period the request rate is averaged over
+)
+
+// stats, if set, is told about every response so that the admin dashboard
+// can summarise recent activity.
+var stats *Stats
+
+// Stats accumulates counts of the requests served.
+type Stats struct {
+	mu       sync.Mutex
+	started  time.Time
+	total    uint64
+	statuses map[int]uint64
+	paths    map[string]uint64
+	errors   []StatsError // most recent last
+
+	// requests per second over the last statsRateSeconds, indexed by the
+	// unix time modulo statsRateSeconds
+	rate     [statsRateSeconds]uint64
+	rateTime [statsRateSeconds]int64
+}
+
+// StatsError records a request that resulted in a 4xx or 5xx status.
+type StatsError struct {
+	Time   time.Time
+	Status int
+	Method string
+	Path   string
+}
+
+// StatsCount is a key with its count, for sorted output.
+type StatsCount struct {
+	Key   string `json:"key"`
+	Count uint64 `json:"count"`
+}
+
+// NewStats creates an empty Stats.
+func NewStats() *Stats {
+	return &Stats{
+		started:  time.Now(),
+		statuses: make(map[int]uint64),
+		paths:    make(map[string]uint64),
+	}
+}
+
+// record counts a response to the request.
+func (s *Stats) record(r *http.Request, status int) {
+	now := time.Now()
+	sec := now.Unix()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.total++
+	s.statuses[status]++
+	if _, ok := s.paths[r.URL.Path]; ok || len(s.paths) < maxStatsPaths {
+		s.paths[r.URL.Path]++
+	}
+	if status >= 400 {
+		if len(s.errors) == maxRecentErrors {
+			s.errors = s.errors[1:]
+		}
+		s.errors = append(s.errors, StatsError{now, status, r.Method, r.URL.Path})
+	}
+
+	i := sec % statsRateSeconds
+	if s.rateTime[i] != sec {
+		s.rateTime[i] = sec
+		s.rate[i] = 0
+	}
+	s.rate[i]++
+}
+
+// StatsSnapshot is a consistent copy of the stats at a moment in time.
+type StatsSnapshot struct {
+	Uptime   time.Duration
+	Total    uint64
+	Rate     float64 // requests per second
+	Statuses []StatsCount
+	TopPaths []StatsCount
+	Errors   []StatsError // most recent first
+}
+
+// snapshot returns the current stats, with at most top paths.
+func (s *Stats) snapshot(top int) StatsSnapshot {
+	now := time.Now().Unix()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	snap := StatsSnapshot{
+		Uptime: time.Since(s.started).Truncate(time.Second),
+		Total:  s.total,
+	}
+
+	var recent uint64
+	for i := range s.rate {
+		if now-s.rateTime[i] < statsRateSeconds {
+			recent += s.rate[i]
+		}
+	}
+	period := time.Since(s.started).Seconds()
+	if period > statsRateSeconds {
+		period = statsRateSeconds
+	}
+	if period > 0 {
+		snap.Rate = float64(recent) / period
+	}
+
+	for status, n := range s.statuses {
+		key := strconv.Itoa(status) + " " + http.StatusText(status)
+		snap.Statuses = append(snap.Statuses, StatsCount{key, n})
+	}
+	sort.Slice(snap.Statuses, func(i, j int) bool {
+		return snap.Statuses[i].Key < snap.Statuses[j].Key
+	})
+
+	snap.TopPaths = topCounts(s.paths, top)
+
+	for i := len(s.errors) - 1; i >= 0; i-- {
+		snap.Errors = append(snap.Errors, s.errors[i])
+	}
+	return snap
+}
@@ -0,0 +1,17 @@
+//go:build windows || plan9
+
+package main
+
+import (
+	"errors"
+	"io"
+)
+
+// syslogSupported is true if logs may be written to syslog on this platform.
+const syslogSupported = false
+
+// newSyslogWriter returns an error, as syslog is unsupported on this
+// platform.
+func newSyslogWriter(tag string) (io.Writer, error) {
+	return nil, errors.New("syslog is not supported on this platform")
+}
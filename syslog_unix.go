@@ -0,0 +1,16 @@
+//go:build !windows && !plan9
+
+package main
+
+import (
+	"io"
+	"log/syslog"
+)
+
+// syslogSupported is true if logs may be written to syslog on this platform.
+const syslogSupported = true
+
+// newSyslogWriter returns a writer logging to the local syslog daemon.
+func newSyslogWriter(tag string) (io.Writer, error) {
+	return syslog.New(syslog.LOG_NOTICE|syslog.LOG_DAEMON, tag)
+}
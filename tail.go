@@ -0,0 +1,418 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tail, if set, passes log events to admin clients following the logs.
+var tail *LogTail
+
+// tailBacklog is the number of recent events kept for clients that connect.
+const tailBacklog = 100
+
+// tailBuffer is the number of events queued for each following client before
+// further events are dropped, so that slow clients can't hold up requests.
+const tailBuffer = 256
+
+// Log event types.
+const (
+	EventAccess = "access" // a request was served
+	EventError  = "error"  // a line was written to the error log
+)
+
+// LogEvent is an access or error log entry sent to clients following the
+// logs.
+type LogEvent struct {
+	Time     time.Time `json:"time"`
+	Type     string    `json:"type"`
+	Client   string    `json:"client,omitempty"`
+	Host     string    `json:"host,omitempty"`
+	Method   string    `json:"method,omitempty"`
+	URI      string    `json:"uri,omitempty"`
+	Status   int       `json:"status,omitempty"`
+	Size     int       `json:"size,omitempty"`
+	Duration float64   `json:"duration_ms,omitempty"`
+	Message  string    `json:"message,omitempty"`
+}
+
+// String formats the event as a log line.
+func (e LogEvent) String() string {
+	t := e.Time.Local().Format(time.RFC3339)
+	if e.Type == EventError {
+		return fmt.Sprintf("%s error %s", t, e.Message)
+	}
+	return fmt.Sprintf("%s %s %s %s %d %d %.1fms", t, e.Client, e.Host,
+		strconv.Quote(e.Method+" "+e.URI), e.Status, e.Size, e.Duration)
+}
+
+// LogTail keeps the most recent log events, and passes new ones to the
+// clients following them.
+type LogTail struct {
+	mu     sync.Mutex
+	recent []LogEvent
+	next   int  // index the next event is written to
+	full   bool // whether recent has wrapped
+	subs   map[chan LogEvent]bool
+}
+
+// NewLogTail creates a LogTail remembering up to size events.
+func NewLogTail(size int) *LogTail {
+	return &LogTail{
+		recent: make([]LogEvent, size),
+		subs:   make(map[chan LogEvent]bool),
+	}
+}
+
+// publish remembers the event and passes it to every following client that
+// has room for it.
+func (t *LogTail) publish(e LogEvent) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.recent[t.next] = e
+	t.next = (t.next + 1) % len(t.recent)
+	if t.next == 0 {
+		t.full = true
+	}
+	for ch := range t.subs {
+		select {
+		case ch <- e:
+		default: // client is behind; drop the event
+		}
+	}
+}
+
+// record publishes an access event for the request.
+func (t *LogTail) record(req *http.Request, status, size int, d time.Duration, anonymize string) {
+	client, _, _ := net.SplitHostPort(req.RemoteAddr)
+	if anonymize != "" {
+		client = anonymizeIP(client, anonymize)
+	}
+	t.publish(LogEvent{
+		Time:     time.Now(),
+		Type:     EventAccess,
+		Client:   client,
+		Host:     req.Host,
+		Method:   req.Method,
+		URI:      redactToken(req.RequestURI),
+		Status:   status,
+		Size:     size,
+		Duration: float64(d) / float64(time.Millisecond),
+	})
+}
+
+// Write publishes an error event for each line written, so the LogTail can
+// be added to the standard logger's output.
+func (t *LogTail) Write(p []byte) (int, error) {
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		t.publish(LogEvent{Time: time.Now(), Type: EventError, Message: line})
+	}
+	return len(p), nil
+}
+
+// subscribe returns the recent events, oldest first, and a channel receiving
+// new ones until unsubscribe is called with it.
+func (t *LogTail) subscribe() ([]LogEvent, chan LogEvent) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var recent []LogEvent
+	if t.full {
+		recent = append(recent, t.recent[t.next:]...)
+	}
+	recent = append(recent, t.recent[:t.next]...)
+	ch := make(chan LogEvent, tailBuffer)
+	t.subs[ch] = true
+	return recent, ch
+}
+
+func (t *LogTail) unsubscribe(ch chan LogEvent) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.subs, ch)
+}
+
+// ServeHTTP writes the recent events matching the `filter` query parameter
+// as JSON lines. With `follow=1`, it then streams new events as server-sent
+// events until the client disconnects.
+func (t *LogTail) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseTailFilter(r.URL.Query().Get("filter"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	n := tailBacklog
+	if s := r.URL.Query().Get("n"); s != "" {
+		if n, err = strconv.Atoi(s); err != nil || n < 0 {
+			http.Error(w, "Invalid n", http.StatusBadRequest)
+			return
+		}
+	}
+	recent, ch := t.subscribe()
+	defer t.unsubscribe(ch)
+
+	var backlog []LogEvent
+	for _, e := range recent {
+		if filter.match(e) {
+			backlog = append(backlog, e)
+		}
+	}
+	if len(backlog) > n {
+		backlog = backlog[len(backlog)-n:]
+	}
+
+	w.Header().Set("Cache-Control", "no-cache")
+	if r.URL.Query().Get("follow") != "1" {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		enc := json.NewEncoder(w)
+		for _, e := range backlog {
+			enc.Encode(e)
+		}
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	send := func(e LogEvent) {
+		b, _ := json.Marshal(e)
+		fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, b)
+	}
+	for _, e := range backlog {
+		send(e)
+	}
+	flusher.Flush()
+	keepalive := time.NewTicker(15 * time.Second)
+	defer keepalive.Stop()
+	for {
+		select {
+		case e := <-ch:
+			if filter.match(e) {
+				send(e)
+				flusher.Flush()
+			}
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// tailCondition is a single term of a filter expression, comparing a field
+// of an event to a value.
+type tailCondition struct {
+	field string
+	op    string
+	value string
+}
+
+// tailFilter is a filter expression, matching events that satisfy all of its
+// terms.
+type tailFilter []tailCondition
+
+// tailOps are the comparison operators, longest first so that ">=" isn't
+// mistaken for ">" where both are found at the same place.
+var tailOps = []string{"!=", ">=", "<=", "=", ">", "<"}
+
+// parseTailFilter parses a filter expression of space-separated terms such as
+// `status>=500`, `method!=GET`, `path=/api` or `type=error`. String fields
+// (type, client, host, method, path and message) are compared with = and !=
+// against glob patterns, with a path also covering everything below it.
+// Status, size and duration (e.g. `duration>1s`) may also be compared with
+// <, <=, > and >=, and status with patterns such as `status=5xx`.
+func parseTailFilter(expr string) (tailFilter, error) {
+	var f tailFilter
+	for _, term := range strings.Fields(expr) {
+		var c tailCondition
+		at := len(term)
+		for _, op := range tailOps {
+			if i := strings.Index(term, op); i > 0 && i < at {
+				c = tailCondition{term[:i], op, term[i+len(op):]}
+				at = i
+			}
+		}
+		if c.op == "" {
+			return nil, fmt.Errorf("invalid filter term `%s`", term)
+		}
+		switch c.field {
+		case "type", "client", "host", "method", "path", "message":
+			if c.op != "=" && c.op != "!=" {
+				return nil, fmt.Errorf("%s can only be compared with = or !=", c.field)
+			}
+			if _, err := path.Match(c.value, ""); err != nil {
+				return nil, fmt.Errorf("invalid pattern `%s`", c.value)
+			}
+		case "status":
+			if validStatusPattern(c.value) && (c.op == "=" || c.op == "!=") {
+				break
+			}
+			if _, err := strconv.Atoi(c.value); err != nil {
+				return nil, fmt.Errorf("invalid status `%s`", c.value)
+			}
+		case "size":
+			if _, err := strconv.Atoi(c.value); err != nil {
+				return nil, fmt.Errorf("invalid size `%s`", c.value)
+			}
+		case "duration":
+			if _, err := time.ParseDuration(c.value); err != nil {
+				return nil, fmt.Errorf("invalid duration `%s`", c.value)
+			}
+		default:
+			return nil, fmt.Errorf("unknown filter field `%s`", c.field)
+		}
+		f = append(f, c)
+	}
+	return f, nil
+}
+
+// match returns true if the event satisfies every term of the filter.
+func (f tailFilter) match(e LogEvent) bool {
+	for _, c := range f {
+		if !c.match(e) {
+			return false
+		}
+	}
+	return true
+}
+
+func (c tailCondition) match(e LogEvent) bool {
+	var s string
+	switch c.field {
+	case "status":
+		if validStatusPattern(c.value) {
+			return e.Status != 0 && matchStatus(c.value, e.Status) == (c.op == "=")
+		}
+		v, _ := strconv.Atoi(c.value)
+		return compare(float64(e.Status), c.op, float64(v))
+	case "size":
+		v, _ := strconv.Atoi(c.value)
+		return compare(float64(e.Size), c.op, float64(v))
+	case "duration":
+		d, _ := time.ParseDuration(c.value)
+		return compare(e.Duration, c.op, float64(d)/float64(time.Millisecond))
+	case "path":
+		u, _ := url.ParseRequestURI(e.URI)
+		if u == nil {
+			return c.op == "!="
+		}
+		return matchPathPrefix([]string{c.value}, u.Path) == (c.op == "=")
+	case "type":
+		s = e.Type
+	case "client":
+		s = e.Client
+	case "host":
+		s = e.Host
+	case "method":
+		s = e.Method
+	case "message":
+		s = e.Message
+	}
+	m, _ := path.Match(c.value, s)
+	return m == (c.op == "=")
+}
+
+// compare returns the result of comparing a to b with the operator.
+func compare(a float64, op string, b float64) bool {
+	switch op {
+	case "=":
+		return a == b
+	case "!=":
+		return a != b
+	case "<":
+		return a < b
+	case "<=":
+		return a <= b
+	case ">":
+		return a > b
+	case ">=":
+		return a >= b
+	}
+	return false
+}
+
+// runLogs implements the `logs` subcommand, which prints recent log events
+// from the admin listener, and with -f, follows new ones.
+func runLogs(args []string) int {
+	fs := flag.NewFlagSet("logs", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: goserve logs [flags] [filter terms]")
+		fmt.Fprintln(os.Stderr, "e.g. goserve logs -f status>=500 path=/api")
+		fs.PrintDefaults()
+	}
+	admin := fs.String("admin", "127.0.0.1:9090", "Address of the admin listener")
+	token := fs.String("token", os.Getenv("GOSERVE_ADMIN_TOKEN"), "Admin token (default $GOSERVE_ADMIN_TOKEN)")
+	follow := fs.Bool("f", false, "Follow new events as they happen")
+	n := fs.Int("n", tailBacklog, "Number of recent events to print first")
+	asJSON := fs.Bool("json", false, "Print events as JSON")
+	fs.Parse(args)
+
+	q := url.Values{}
+	q.Set("filter", strings.Join(fs.Args(), " "))
+	q.Set("n", strconv.Itoa(*n))
+	if *follow {
+		q.Set("follow", "1")
+	}
+	req, _ := http.NewRequest("GET", fmt.Sprintf("http://%s/logs?%s", *admin, q.Encode()), nil)
+	if *token != "" {
+		req.Header.Set("Authorization", "Bearer "+*token)
+	}
+	client := http.Client{}
+	if !*follow {
+		client.Timeout = 10 * time.Second
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Couldn't fetch logs:", err)
+		return 1
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		fmt.Fprintf(os.Stderr, "Couldn't fetch logs: %s: %s\n", resp.Status, bytes.TrimSpace(msg))
+		return 1
+	}
+
+	sc := bufio.NewScanner(resp.Body)
+	sc.Buffer(nil, 1<<20)
+	for sc.Scan() {
+		line := sc.Text()
+		if *follow {
+			if !strings.HasPrefix(line, "data: ") {
+				continue // event names, separators and keepalives
+			}
+			line = strings.TrimPrefix(line, "data: ")
+		}
+		if *asJSON {
+			fmt.Println(line)
+			continue
+		}
+		var e LogEvent
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			fmt.Fprintln(os.Stderr, "Couldn't read event:", err)
+			return 1
+		}
+		fmt.Println(e)
+	}
+	if err := sc.Err(); err != nil {
+		fmt.Fprintln(os.Stderr, "Couldn't read logs:", err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"gopkg.in/v1/yaml"
+
+	"bytes"
+	"encoding/json"
+	"html/template"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Serve types.
+const (
+	ServeFiles    = ""         // serve files as they are
+	ServeTemplate = "template" // render .html files as Go templates
+)
+
+// templateData is the data templates are executed with.
+type templateData struct {
+	Data    map[string]interface{} // contents of data files, by base name
+	Request templateRequest
+}
+
+// templateRequest describes the request a template is rendered for.
+type templateRequest struct {
+	Method string
+	Host   string
+	Path   string
+	Query  url.Values
+	Header http.Header
+}
+
+type cachedDataFile struct {
+	modTime time.Time
+	value   interface{}
+}
+
+type cachedTemplate struct {
+	modTime time.Time // latest of the page and its partials
+	tmpl    *template.Template
+}
+
+// templates renders pages, caching parsed templates and data files until
+// they change.
+type templates struct {
+	fs        http.FileSystem
+	dataFiles []string
+
+	mu    sync.Mutex
+	data  map[string]cachedDataFile
+	pages map[string]cachedTemplate
+}
+
+// isPartial returns true if the name is of a partial template, which is
+// available to every page but isn't served itself.
+func isPartial(name string) bool {
+	return strings.HasPrefix(path.Base(name), "_") && path.Ext(name) == ".html"
+}
+
+// readData returns the contents of the data files, by base name, re-reading
+// those that have changed.
+func (t *templates) readData() (map[string]interface{}, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	data := make(map[string]interface{}, len(t.dataFiles))
+	for _, file := range t.dataFiles {
+		fi, err := os.Stat(file)
+		if err != nil {
+			return nil, err
+		}
+		c, ok := t.data[file]
+		if !ok || !c.modTime.Equal(fi.ModTime()) {
+			b, err := ioutil.ReadFile(file)
+			if err != nil {
+				return nil, err
+			}
+			var v interface{}
+			if filepath.Ext(file) == ".json" {
+				err = json.Unmarshal(b, &v)
+			} else {
+				err = yaml.Unmarshal(b, &v)
+			}
+			if err != nil {
+				return nil, err
+			}
+			c = cachedDataFile{fi.ModTime(), v}
+			t.data[file] = c
+		}
+		base := filepath.Base(file)
+		data[strings.TrimSuffix(base, filepath.Ext(base))] = c.value
+	}
+	return data, nil
+}
+
+// readFile returns the contents and modification time of a file.
+func readFile(fs http.FileSystem, name string) ([]byte, time.Time, error) {
+	f, err := fs.Open(name)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	b, err := ioutil.ReadAll(f)
+	return b, fi.ModTime(), err
+}
+
+// isFile returns true if the name is of a regular file.
+func isFile(fs http.FileSystem, name string) bool {
+	f, err := fs.Open(name)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	return err == nil && !fi.IsDir()
+}
+
+// page returns the parsed template of the page, along with the partials in
+// the root directory, re-parsing it if any of them have changed.
+func (t *templates) page(fs http.FileSystem, name string) (*template.Template, error) {
+	src, modTime, err := readFile(fs, name)
+	if err != nil {
+		return nil, err
+	}
+	partials := map[string][]byte{}
+	if root, err := fs.Open("/"); err == nil {
+		fis, _ := root.Readdir(-1)
+		root.Close()
+		for _, fi := range fis {
+			if !fi.IsDir() && isPartial(fi.Name()) {
+				b, m, err := readFile(fs, "/"+fi.Name())
+				if err != nil {
+					return nil, err
+				}
+				partials[fi.Name()] = b
+				if m.After(modTime) {
+					modTime = m
+				}
+			}
+		}
+	}
+
+	t.mu.Lock()
+	c, ok := t.pages[name]
+	t.mu.Unlock()
+	if ok && c.modTime.Equal(modTime) {
+		return c.tmpl, nil
+	}
+	tmpl, err := template.New(path.Base(name)).Parse(string(src))
+	if err != nil {
+		return nil, err
+	}
+	for n, b := range partials {
+		if _, err := tmpl.New(n).Parse(string(b)); err != nil {
+			return nil, err
+		}
+	}
+	t.mu.Lock()
+	if len(t.pages) >= maxCachedListings {
+		t.pages = make(map[string]cachedTemplate)
+	}
+	t.pages[name] = cachedTemplate{modTime, tmpl}
+	t.mu.Unlock()
+	return tmpl, nil
+}
+
+// TemplateHandler renders requested .html files, and index.html files of
+// requested directories, as Go templates, executed with the contents of the
+// data files and details of the request. Partial templates, whose names
+// start with an underscore, may be used by any page but aren't served.
+// Other requests are passed to the handler.
+func TemplateHandler(h http.Handler, fs http.FileSystem, dataFiles []string) http.Handler {
+	t := &templates{
+		fs:        fs,
+		dataFiles: dataFiles,
+		data:      make(map[string]cachedDataFile),
+		pages:     make(map[string]cachedTemplate),
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := path.Clean("/" + r.URL.Path)
+		if isPartial(name) {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if strings.HasSuffix(r.URL.Path, "/") || name == "/" {
+			name = path.Join(name, "index.html")
+		} else if strings.HasSuffix(name, "/index.html") {
+			h.ServeHTTP(w, r) // redirected to the directory
+			return
+		}
+		if path.Ext(name) != ".html" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		rfs := requestFileSystem(t.fs, r)
+		if !isFile(rfs, name) {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		tmpl, err := t.page(rfs, name)
+		var data map[string]interface{}
+		if err == nil {
+			data, err = t.readData()
+		}
+		// The serve's prefix has been stripped from the URL
+		reqPath := r.URL.Path
+		if u, err := url.ParseRequestURI(r.RequestURI); err == nil {
+			reqPath = u.Path
+		}
+		var buf bytes.Buffer
+		if err == nil {
+			err = tmpl.Execute(&buf, templateData{data, templateRequest{
+				Method: r.Method,
+				Host:   r.Host,
+				Path:   reqPath,
+				Query:  r.URL.Query(),
+				Header: r.Header,
+			}})
+		}
+		if err != nil {
+			log.Printf("Couldn't render template %s: %s", name, err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError),
+				http.StatusInternalServerError)
+			return
+		}
+
+		wh := w.Header()
+		wh.Set("Content-Type", "text/html; charset=utf-8")
+		wh.Set("Content-Length", strconv.Itoa(buf.Len()))
+		wh.Set("Cache-Control", "no-cache")
+		if r.Method == http.MethodHead {
+			return
+		}
+		w.Write(buf.Bytes())
+	})
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"encoding/gob"
+	"html"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// maxIndexedFileSize is the largest file whose text will be indexed.
+const maxIndexedFileSize = 4 << 20
+
+// snippetRadius is the number of characters shown either side of a match.
+const snippetRadius = 80
+
+// textDoc is the extracted text of an indexed file.
+type textDoc struct {
+	Rel     string // slash-separated path relative to the root
+	Size    int64
+	ModTime time.Time
+	Title   string
+	Text    string
+}
+
+// TextIndex is a full-text index of the files within a directory that match
+// a set of glob patterns. It's updated from the results of walking the
+// directory, so only changed files are re-read, and may be persisted to disk
+// so it needn't be rebuilt from scratch on restart.
+type TextIndex struct {
+	include []string // glob patterns of files to index
+	file    string   // where the index is persisted (empty=not persisted)
+
+	mu       sync.RWMutex
+	docs     []textDoc
+	postings map[string]map[int]int // term -> document -> occurrences
+}
+
+// NewTextIndex creates an index of files matching the include patterns,
+// loading it from the given file if it exists.
+func NewTextIndex(include []string, file string) *TextIndex {
+	t := &TextIndex{include: include, file: file}
+	if file == "" {
+		return t
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return t
+	}
+	defer f.Close()
+	var docs []textDoc
+	if err := gob.NewDecoder(f).Decode(&docs); err != nil {
+		log.Printf("Couldn't load search index %s: %s", file, err)
+		return t
+	}
+	t.docs, t.postings = docs, buildPostings(docs)
+	return t
+}
+
+// update re-indexes files from the walk of root that are new or have
+// changed, and drops those that no longer exist.
+func (t *TextIndex) update(root string, entries []searchEntry) {
+	t.mu.RLock()
+	old := make(map[string]textDoc, len(t.docs))
+	for _, d := range t.docs {
+		old[d.Rel] = d
+	}
+	t.mu.RUnlock()
+
+	changed := false
+	var docs []textDoc
+	for _, e := range entries {
+		if e.dir || e.size > maxIndexedFileSize || !matchAny(t.include, e.rel) {
+			continue
+		}
+		if d, ok := old[e.rel]; ok && d.Size == e.size && d.ModTime.Equal(e.modTime) {
+			docs = append(docs, d)
+			delete(old, e.rel)
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(root, filepath.FromSlash(e.rel)))
+		if err != nil {
+			continue
+		}
+		title, text := extractText(e.rel, string(data))
+		docs = append(docs, textDoc{e.rel, e.size, e.modTime, title, text})
+		delete(old, e.rel)
+		changed = true
+	}
+	if !changed && len(old) == 0 {
+		return
+	}
+
+	postings := buildPostings(docs)
+	t.mu.Lock()
+	t.docs, t.postings = docs, postings
+	t.mu.Unlock()
+	t.save(docs)
+}
+
+// save writes the documents to the index file, atomically.
+func (t *TextIndex) save(docs []textDoc) {
+	if t.file == "" {
+		return
+	}
+	err := os.MkdirAll(filepath.Dir(t.file), 0755)
+	var tmp *os.File
+	if err == nil {
+		tmp, err = ioutil.TempFile(filepath.Dir(t.file), ".tmp-")
+	}
+	if err == nil {
+		err = gob.NewEncoder(tmp).Encode(docs)
+		tmp.Close()
+		if err == nil {
+			err = os.Rename(tmp.Name(), t.file)
+		}
+		if err != nil {
+			os.Remove(tmp.Name())
+		}
+	}
+	if err != nil {
+		log.Printf("Couldn't save search index %s: %s", t.file, err)
+	}
+}
+
+// terms splits text into lower-case words.
+func terms(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+func buildPostings(docs []textDoc) map[string]map[int]int {
+	postings := make(map[string]map[int]int)
+	for i, d := range docs {
+		for _, term := range terms(d.Title + " " + d.Text) {
+			p := postings[term]
+			if p == nil {
+				p = make(map[int]int)
+				postings[term] = p
+			}
+			p[i]++
+		}
+	}
+	return postings
+}
+
+// extractText returns the title and plain text of a file. Tags, scripts
+// and styles are removed from HTML; other files are used as they are.
+func extractText(name, data string) (title, text string) {
+	switch strings.ToLower(path.Ext(name)) {
+	case ".html", ".htm":
+		return extractHTMLText(data)
+	case ".md", ".markdown":
+		for _, line := range strings.Split(data, "\n") {
+			if strings.HasPrefix(line, "# ") {
+				title = strings.TrimSpace(line[2:])
+				break
+			}
+		}
+	}
+	if title == "" {
+		title = path.Base(name)
+	}
+	return title, strings.Join(strings.Fields(data), " ")
+}
+
+// extractHTMLText returns the content of an HTML document's title element,
+// and the text of the document without tags, scripts or styles.
+func extractHTMLText(data string) (title, text string) {
+	var b strings.Builder
+	lower := strings.ToLower(data)
+	for i := 0; i < len(data); {
+		if data[i] != '<' {
+			j := strings.IndexByte(data[i:], '<')
+			if j < 0 {
+				j = len(data) - i
+			}
+			b.WriteString(data[i : i+j])
+			i += j
+			continue
+		}
+		end := strings.IndexByte(data[i:], '>')
+		if end < 0 {
+			break
+		}
+		tag := lower[i+1 : i+end]
+		i += end + 1
+		for _, skip := range []string{"script", "style", "title"} {
+			if !strings.HasPrefix(tag, skip) {
+				continue
+			}
+			close := strings.Index(lower[i:], "</"+skip)
+			if close < 0 {
+				close = len(data) - i
+			}
+			if skip == "title" {
+				title = strings.Join(strings.Fields(html.UnescapeString(data[i:i+close])), " ")
+			}
+			i += close
+			break
+		}
+		b.WriteByte(' ')
+	}
+	return title, strings.Join(strings.Fields(html.UnescapeString(b.String())), " ")
+}
+
+// textResult is a document matching a search.
+type textResult struct {
+	doc     textDoc
+	score   float64
+	snippet string
+}
+
+// search returns the documents containing all the words of the query,
+// ranked by how often they contain them relative to other documents, with
+// matches in the title counting for more.
+func (t *TextIndex) search(q string, limit int) (results []textResult, truncated bool) {
+	words := terms(q)
+	if len(words) == 0 {
+		return nil, false
+	}
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	re := wordsPattern(words)
+	scores := make(map[int]float64)
+	for i, word := range words {
+		p := t.postings[word]
+		idf := math.Log(1 + float64(len(t.docs))/float64(len(p)+1))
+		next := make(map[int]float64)
+		for doc, n := range p {
+			if _, ok := scores[doc]; !ok && i > 0 {
+				continue
+			}
+			score := (1 + math.Log(float64(n))) * idf
+			if strings.Contains(strings.ToLower(t.docs[doc].Title), word) {
+				score += 2 * idf
+			}
+			next[doc] = scores[doc] + score
+		}
+		scores = next
+	}
+
+	for doc, score := range scores {
+		results = append(results, textResult{doc: t.docs[doc], score: score})
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].score != results[j].score {
+			return results[i].score > results[j].score
+		}
+		return results[i].doc.Rel < results[j].doc.Rel
+	})
+	if len(results) > limit {
+		results, truncated = results[:limit], true
+	}
+	for i := range results {
+		results[i].snippet = snippet(results[i].doc.Text, re)
+	}
+	return results, truncated
+}
+
+// wordsPattern returns a pattern matching any of the words, ignoring case.
+func wordsPattern(words []string) *regexp.Regexp {
+	quoted := make([]string, len(words))
+	for i, w := range words {
+		quoted[i] = regexp.QuoteMeta(w)
+	}
+	return regexp.MustCompile("(?i)" + strings.Join(quoted, "|"))
+}
+
+// snippet returns the text surrounding the first match of the pattern, or
+// the start of the text if there are none.
+func snippet(text string, re *regexp.Regexp) string {
+	start, end := 0, 2*snippetRadius
+	if m := re.FindStringIndex(text); m != nil {
+		start, end = m[0]-snippetRadius, m[0]+snippetRadius
+	}
+	prefix, suffix := "…", "…"
+	if start <= 0 {
+		start, prefix = 0, ""
+	}
+	if end >= len(text) {
+		end, suffix = len(text), ""
+	}
+	// Don't split multi-byte characters
+	for start > 0 && !utf8.RuneStart(text[start]) {
+		start--
+	}
+	for end < len(text) && !utf8.RuneStart(text[end]) {
+		end++
+	}
+	return prefix + text[start:end] + suffix
+}
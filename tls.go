@@ -0,0 +1,332 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Client certificate requirements.
+const (
+	ClientAuthNone    = "none"    // don't ask for a certificate
+	ClientAuthRequest = "request" // verify a certificate if one is given
+	ClientAuthRequire = "require" // refuse connections without a valid certificate
+)
+
+// validClientAuth returns true if the mode is one of the ClientAuth* modes.
+func validClientAuth(mode string) bool {
+	switch mode {
+	case "", ClientAuthNone, ClientAuthRequest, ClientAuthRequire:
+		return true
+	}
+	return false
+}
+
+// tlsClientAuth returns the crypto/tls equivalent of the mode.
+func tlsClientAuth(mode string) tls.ClientAuthType {
+	switch mode {
+	case ClientAuthRequest:
+		return tls.VerifyClientCertIfGiven
+	case ClientAuthRequire:
+		return tls.RequireAndVerifyClientCert
+	}
+	return tls.NoClientCert
+}
+
+// loadCertPool reads a PEM bundle of CA certificates.
+func loadCertPool(file string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %s", file)
+	}
+	return pool, nil
+}
+
+// matchHost returns true if the host matches the pattern, which is either a
+// host name or a wildcard such as "*.example.com".
+func matchHost(pattern, host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	pattern = strings.ToLower(pattern)
+	if strings.HasPrefix(pattern, "*.") {
+		return strings.HasSuffix(host, pattern[1:])
+	}
+	return host == pattern
+}
+
+// HostPolicy holds the security settings for the hosts matching a pattern.
+type HostPolicy struct {
+	Pattern    string
+	ClientAuth string
+	ClientCAs  *x509.CertPool
+	HSTS       string // Strict-Transport-Security value (empty=not sent)
+	Headers    Headers
+}
+
+// HostPolicies finds the policy for a host, falling back to a default.
+type HostPolicies struct {
+	Default HostPolicy
+	Hosts   []HostPolicy
+}
+
+// lookup returns the first policy matching the host, or the default.
+func (p *HostPolicies) lookup(host string) *HostPolicy {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	for i := range p.Hosts {
+		if matchHost(p.Hosts[i].Pattern, host) {
+			return &p.Hosts[i]
+		}
+	}
+	return &p.Default
+}
+
+// TLSConfig returns a TLS config serving the certificate, which applies each
+// host's client certificate requirements according to the server name the
+// client asks for.
+func (p *HostPolicies) TLSConfig(cert tls.Certificate) *tls.Config {
+	base := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tlsClientAuth(p.Default.ClientAuth),
+		ClientCAs:    p.Default.ClientCAs,
+	}
+	if len(p.Hosts) == 0 {
+		return base
+	}
+	base.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		hp := p.lookup(hello.ServerName)
+		c := base.Clone()
+		c.GetConfigForClient = nil
+		c.ClientAuth = tlsClientAuth(hp.ClientAuth)
+		c.ClientCAs = hp.ClientCAs
+		return c, nil
+	}
+	return base
+}
+
+// HostPolicyHandler adds the HSTS and security headers of the policy
+// matching each request's Host. As a client may ask for one server name
+// during the handshake and another in the Host header, requests to hosts
+// requiring a client certificate are refused if none was presented.
+func HostPolicyHandler(h http.Handler, p *HostPolicies) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hp := p.lookup(r.Host)
+		if hp.ClientAuth == ClientAuthRequire &&
+			(r.TLS == nil || len(r.TLS.PeerCertificates) == 0) {
+			setDenyRule(r, "client certificate required for "+hp.Pattern)
+			audit(r, "tls", AuditDeny, "client certificate required", "")
+			http.Error(w, http.StatusText(http.StatusForbidden),
+				http.StatusForbidden)
+			return
+		}
+		wh := w.Header()
+		if hp.HSTS != "" && r.TLS != nil {
+			wh.Set("Strict-Transport-Security", hp.HSTS)
+		}
+		hp.Headers.serve(w, r, h)
+	})
+}
+
+// maxTicketKeys is how many session ticket keys are kept, so that tickets
+// issued with recently retired keys can still be used for resumption.
+const maxTicketKeys = 3
+
+// TicketKeyRotator periodically replaces the session ticket keys of a TLS
+// config. Keys are either generated randomly, or read from a file of one or
+// more 32-byte keys (most recent first) so that instances sharing the file
+// can resume each other's sessions.
+type TicketKeyRotator struct {
+	config *tls.Config
+	file   string
+	keys   [][32]byte // most recent first
+	done   chan struct{}
+	once   sync.Once
+}
+
+// NewTicketKeyRotator sets the initial session ticket keys of the config
+// and then rotates them at the given interval, until stopped.
+func NewTicketKeyRotator(config *tls.Config, file string, interval time.Duration) (*TicketKeyRotator, error) {
+	k := &TicketKeyRotator{config: config, file: file, done: make(chan struct{})}
+	if err := k.rotate(); err != nil {
+		return nil, err
+	}
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+			case <-k.done:
+				return
+			}
+			if err := k.rotate(); err != nil {
+				log.Println("Couldn't rotate session ticket keys:", err)
+			}
+		}
+	}()
+	return k, nil
+}
+
+// Stop stops rotating the keys, leaving the current ones in place.
+func (k *TicketKeyRotator) Stop() {
+	k.once.Do(func() { close(k.done) })
+}
+
+// rotate installs a new session ticket key, keeping the previous ones for
+// decrypting existing tickets.
+func (k *TicketKeyRotator) rotate() error {
+	if k.file != "" {
+		keys, err := readTicketKeys(k.file)
+		if err != nil {
+			return err
+		}
+		k.keys = keys
+	} else {
+		var key [32]byte
+		if _, err := rand.Read(key[:]); err != nil {
+			return err
+		}
+		k.keys = append([][32]byte{key}, k.keys...)
+	}
+	if len(k.keys) > maxTicketKeys {
+		k.keys = k.keys[:maxTicketKeys]
+	}
+	k.config.SetSessionTicketKeys(k.keys)
+	return nil
+}
+
+// readTicketKeys reads concatenated 32-byte session ticket keys from a file.
+func readTicketKeys(file string) ([][32]byte, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 || len(data)%32 != 0 {
+		return nil, fmt.Errorf("%s must contain one or more 32-byte keys", file)
+	}
+	keys := make([][32]byte, len(data)/32)
+	for i := range keys {
+		copy(keys[i][:], data[i*32:])
+	}
+	return keys, nil
+}
+
+// readPassphrase returns the passphrase described by the spec, which is
+// either "env:NAME" to read it from an environment variable, "file:PATH" to
+// read it from a file, or "prompt" to ask for it on the terminal.
+func readPassphrase(spec, keyFile string) (string, error) {
+	switch {
+	case strings.HasPrefix(spec, "env:"):
+		name := strings.TrimPrefix(spec, "env:")
+		pass := os.Getenv(name)
+		if pass == "" {
+			return "", fmt.Errorf("environment variable %s is empty", name)
+		}
+		return pass, nil
+	case strings.HasPrefix(spec, "file:"):
+		data, err := ioutil.ReadFile(strings.TrimPrefix(spec, "file:"))
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	case spec == "prompt":
+		return promptPassphrase("Passphrase for " + keyFile + ": ")
+	}
+	return "", fmt.Errorf("invalid passphrase source `%s`", spec)
+}
+
+// validPassphraseSpec returns true if the spec is understood by
+// readPassphrase.
+func validPassphraseSpec(spec string) bool {
+	return spec == "" || spec == "prompt" ||
+		strings.HasPrefix(spec, "env:") || strings.HasPrefix(spec, "file:")
+}
+
+// loadKeyPair loads a certificate and its key from the sources understood
+// by readPEM, decrypting the key with the passphrase described by the spec
+// if one is given. Only keys encrypted in the traditional PEM format (e.g.
+// by `openssl rsa -aes256`) are supported.
+func loadKeyPair(certFile, keyFile, spec string) (tls.Certificate, error) {
+	certPEM, err := readPEM(certFile)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	keyPEM, err := readPEM(keyFile)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	if spec == "" {
+		return tls.X509KeyPair(certPEM, keyPEM)
+	}
+	keyFile = pemLabel(keyFile)
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return tls.Certificate{}, fmt.Errorf("no key found in %s", keyFile)
+	}
+	if block.Type == "ENCRYPTED PRIVATE KEY" {
+		return tls.Certificate{}, fmt.Errorf("%s is an encrypted PKCS#8 key, "+
+			"which is unsupported; convert it to a traditional encrypted key "+
+			"with `openssl pkey -traditional -aes256`", keyFile)
+	}
+	if !x509.IsEncryptedPEMBlock(block) {
+		return tls.X509KeyPair(certPEM, keyPEM)
+	}
+	pass, err := readPassphrase(spec, keyFile)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	der, err := x509.DecryptPEMBlock(block, []byte(pass))
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("couldn't decrypt %s: %s", keyFile, err)
+	}
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: block.Type, Bytes: der})
+	return tls.X509KeyPair(certPEM, keyPEM)
+}
+
+// Request headers identifying the client certificate.
+const (
+	ClientCertSubjectHeader     = "X-Client-Cert-Subject"
+	ClientCertFingerprintHeader = "X-Client-Cert-Fingerprint"
+)
+
+// clientCert returns the subject and SHA-256 fingerprint of the verified
+// certificate presented by the client, if any.
+func clientCert(r *http.Request) (subject, fingerprint string, ok bool) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return "", "", false
+	}
+	cert := r.TLS.VerifiedChains[0][0]
+	sum := sha256.Sum256(cert.Raw)
+	return cert.Subject.String(), hex.EncodeToString(sum[:]), true
+}
+
+// ClientCertHeadersHandler sets request headers identifying the client
+// certificate, for the benefit of upstream servers. Any such headers sent by
+// the client are removed so they can't be forged.
+func ClientCertHeadersHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Header.Del(ClientCertSubjectHeader)
+		r.Header.Del(ClientCertFingerprintHeader)
+		if subject, fp, ok := clientCert(r); ok {
+			r.Header.Set(ClientCertSubjectHeader, subject)
+			r.Header.Set(ClientCertFingerprintHeader, fp)
+		}
+		h.ServeHTTP(w, r)
+	})
+}
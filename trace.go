@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Cache statuses recorded for a request.
+const (
+	CacheHit    = "HIT"
+	CacheMiss   = "MISS"
+	CacheBypass = "BYPASS" // the serve has no cache, or the file is too large
+)
+
+type requestTraceKey struct{}
+
+// requestTrace records where time was spent serving a request, and whether
+// it was served from the cache.
+type requestTrace struct {
+	mu       sync.Mutex
+	start    time.Time
+	route    time.Duration // until the serve's handler was reached
+	open     time.Duration // opening and inspecting files
+	compress time.Duration // compressing the response
+	cache    string        // one of the Cache* statuses, if files were opened
+	serve    string        // path of the serve that handled the request
+}
+
+// withRequestTrace returns the request with a new trace, unless it already
+// has one.
+func withRequestTrace(r *http.Request) (*http.Request, *requestTrace) {
+	if t := traceFrom(r); t != nil {
+		return r, t
+	}
+	t := &requestTrace{start: time.Now()}
+	return r.WithContext(context.WithValue(r.Context(), requestTraceKey{}, t)), t
+}
+
+// traceFrom returns the request's trace, or nil if it isn't being traced.
+func traceFrom(r *http.Request) *requestTrace {
+	t, _ := r.Context().Value(requestTraceKey{}).(*requestTrace)
+	return t
+}
+
+// routed records that the request reached the handler of the serve.
+func (t *requestTrace) routed(serve string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.serve == "" {
+		t.route = time.Since(t.start)
+		t.serve = serve
+	}
+}
+
+// opened adds time spent opening a file, and how the cache was used.
+func (t *requestTrace) opened(d time.Duration, cache string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.open += d
+	// A miss on any file counts as a miss for the request
+	if t.cache == "" || cache == CacheMiss ||
+		(cache == CacheHit && t.cache == CacheBypass) {
+		t.cache = cache
+	}
+}
+
+// compressed adds time spent compressing the response.
+func (t *requestTrace) compressed(d time.Duration) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	t.compress += d
+	t.mu.Unlock()
+}
+
+// cacheStatus returns how the cache was used, if at all.
+func (t *requestTrace) cacheStatus() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.cache
+}
+
+// servedBy returns the path of the serve that handled the request.
+func (t *requestTrace) servedBy() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.serve
+}
+
+// timingMetric formats a Server-Timing metric with a duration.
+func timingMetric(name string, d time.Duration) string {
+	return fmt.Sprintf("%s;dur=%.3f", name, float64(d)/float64(time.Millisecond))
+}
+
+// headerTiming returns the Server-Timing metrics known when the response
+// header is written.
+func (t *requestTrace) headerTiming() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	metrics := []string{timingMetric("route", t.route)}
+	if t.open > 0 {
+		metrics = append(metrics, timingMetric("open", t.open))
+	}
+	if t.cache != "" {
+		metrics = append(metrics, `cache;desc="`+strings.ToLower(t.cache)+`"`)
+	}
+	return strings.Join(metrics, ", ")
+}
+
+// trailerTiming returns the Server-Timing metrics only known once the
+// response has been sent, given when the header was written.
+func (t *requestTrace) trailerTiming(headerAt time.Time) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var metrics []string
+	if t.compress > 0 {
+		metrics = append(metrics, timingMetric("compress", t.compress))
+	}
+	if !headerAt.IsZero() {
+		metrics = append(metrics, timingMetric("transfer", time.Since(headerAt)))
+	}
+	metrics = append(metrics, timingMetric("total", time.Since(t.start)))
+	return strings.Join(metrics, ", ")
+}
+
+// ServerTimingHandler adds a Server-Timing header describing the time taken
+// to route the request and open files, and whether the cache was hit. As
+// compression and transfer times are only known once the response has been
+// sent, they're added as a trailer, which is only sent with chunked
+// responses.
+func ServerTimingHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r, t := withRequestTrace(r)
+		var headerAt time.Time
+		hw := &headerHookResponseWriter{ResponseWriter: w, hook: func(int) {
+			headerAt = time.Now()
+			w.Header().Set("Server-Timing", t.headerTiming())
+		}}
+		h.ServeHTTP(hw, r)
+		if hw.written {
+			w.Header().Set(http.TrailerPrefix+"Server-Timing", t.trailerTiming(headerAt))
+		}
+	})
+}
+
+// tracedFileSystem records the time taken to open files, and whether they
+// came from the cache, in a request's trace.
+type tracedFileSystem struct {
+	fs    http.FileSystem
+	trace *requestTrace
+}
+
+// requestFileSystem returns the file system, traced if the request is, and
+// noting file system timeouts if the request is handled by FSTimeoutHandler.
+// Caches stop filling if the request is cancelled.
+func requestFileSystem(fs http.FileSystem, r *http.Request) http.FileSystem {
+	if c, ok := fs.(*FileCache); ok {
+		fs = requestFileCache{c, r.Context()}
+	}
+	if t := traceFrom(r); t != nil {
+		fs = tracedFileSystem{fs, t}
+	}
+	if timedOut, ok := r.Context().Value(fsTimeoutKey{}).(*int32); ok {
+		fs = fsTimeoutFileSystem{fs, timedOut}
+	}
+	return fs
+}
+
+func (fs tracedFileSystem) Open(name string) (http.File, error) {
+	start := time.Now()
+	if c, ok := fs.fs.(requestFileCache); ok {
+		f, status, err := c.open(name)
+		if err == nil {
+			fs.trace.opened(time.Since(start), status)
+		}
+		return f, err
+	}
+	f, err := fs.fs.Open(name)
+	if err == nil {
+		fs.trace.opened(time.Since(start), CacheBypass)
+	}
+	return f, err
+}
+
+// DebugHeader is the request header that must carry the debug secret for
+// debug headers to be added to the response.
+const DebugHeader = "X-Goserve-Debug"
+
+// DebugHeadersHandler adds X-Cache, X-Serve and X-Served-By headers to
+// responses, stating whether the cache was hit, which serve handled the
+// request, and the host name of this instance. Unless `always` is set, or
+// debug headers are turned on in the runtime settings, they are only added
+// to requests carrying the secret in the DebugHeader header.
+func DebugHeadersHandler(h http.Handler, always bool, secret string) http.Handler {
+	host, _ := os.Hostname()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		given := r.Header.Get(DebugHeader)
+		r.Header.Del(DebugHeader) // don't pass the secret upstream
+		if !always && !settings().DebugHeaders && (secret == "" ||
+			subtle.ConstantTimeCompare([]byte(given), []byte(secret)) != 1) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		r, t := withRequestTrace(r)
+		hw := &headerHookResponseWriter{ResponseWriter: w, hook: func(int) {
+			wh := w.Header()
+			if cache := t.cacheStatus(); cache != "" {
+				wh.Set("X-Cache", cache)
+			}
+			if serve := t.servedBy(); serve != "" {
+				wh.Set("X-Serve", serve)
+			}
+			if host != "" {
+				wh.Set("X-Served-By", host)
+			}
+		}}
+		h.ServeHTTP(hw, r)
+	})
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultReleaseFeed lists the latest release and its assets.
+const defaultReleaseFeed = "https://api.github.com/repos/johnsto/goserve/releases/latest"
+
+// updateKey is the base64 ed25519 public key release checksums are signed
+// with, set at build time with -ldflags "-X main.updateKey=...".
+var updateKey = ""
+
+// maxReleaseAsset limits the size of downloaded release assets.
+const maxReleaseAsset = 256 << 20
+
+// releaseFeed is the latest release in the feed, in the form of GitHub's
+// releases API.
+type releaseFeed struct {
+	Tag    string `json:"tag_name"`
+	Assets []struct {
+		Name string `json:"name"`
+		URL  string `json:"browser_download_url"`
+	} `json:"assets"`
+}
+
+// asset returns the download URL of the release asset with the name.
+func (f releaseFeed) asset(name string) (string, error) {
+	for _, a := range f.Assets {
+		if a.Name == name {
+			return a.URL, nil
+		}
+	}
+	return "", fmt.Errorf("release %s has no %s", f.Tag, name)
+}
+
+// fetch returns the body of a URL, which must be no larger than max.
+func fetch(client *http.Client, url string, max int64) ([]byte, error) {
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, max+1))
+	if err == nil && int64(len(b)) > max {
+		err = fmt.Errorf("%s: larger than %d bytes", url, max)
+	}
+	return b, err
+}
+
+// signedChecksums returns what the signature of a release's checksums
+// covers: a "goserve <version>" line followed by the checksums file, so that
+// the checksums of one release can't be passed off as another's.
+func signedChecksums(version string, checksums []byte) []byte {
+	return append([]byte("goserve "+version+"\n"), checksums...)
+}
+
+// verifyChecksums checks the base64 ed25519 signature of the checksums file
+// of the release version, and returns the hex SHA-256 sum it lists for the
+// named file.
+func verifyChecksums(version string, checksums, sig []byte, key ed25519.PublicKey, name string) (string, error) {
+	s, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(sig)))
+	if err != nil || !ed25519.Verify(key, signedChecksums(version, checksums), s) {
+		return "", errors.New("invalid checksums signature")
+	}
+	// Lines are in the form of sha256sum's output
+	sc := bufio.NewScanner(bytes.NewReader(checksums))
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) == 2 && strings.TrimPrefix(fields[1], "*") == name {
+			return strings.ToLower(fields[0]), nil
+		}
+	}
+	return "", fmt.Errorf("no checksum for %s", name)
+}
+
+// parseVersion returns the numbers of a version such as "1.2.0" or
+// "v1.3.0-rc1", and its pre-release suffix, or false if it isn't numbered.
+func parseVersion(v string) (nums []int, pre string, ok bool) {
+	v = strings.TrimPrefix(v, "v")
+	if i := strings.Index(v, "-"); i >= 0 {
+		v, pre = v[:i], v[i+1:]
+	}
+	for _, part := range strings.Split(v, ".") {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return nil, "", false
+		}
+		nums = append(nums, n)
+	}
+	return nums, pre, true
+}
+
+// newerVersion returns true if version a is newer than version b. Versions
+// that aren't numbered, such as "dev", are older than any that are, and
+// pre-releases are older than the release they precede.
+func newerVersion(a, b string) bool {
+	an, apre, aok := parseVersion(a)
+	bn, bpre, bok := parseVersion(b)
+	if !aok || !bok {
+		return aok && !bok
+	}
+	for i := 0; i < len(an) || i < len(bn); i++ {
+		var x, y int
+		if i < len(an) {
+			x = an[i]
+		}
+		if i < len(bn) {
+			y = bn[i]
+		}
+		if x != y {
+			return x > y
+		}
+	}
+	if apre == "" || bpre == "" {
+		return apre == "" && bpre != ""
+	}
+	return apre > bpre
+}
+
+// replaceBinary atomically replaces the file with the contents, keeping its
+// permissions.
+func replaceBinary(name string, contents []byte) error {
+	fi, err := os.Stat(name)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(name), ".goserve-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // if not renamed
+	_, err = tmp.Write(contents)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), fi.Mode().Perm()); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), name)
+}
+
+// runUpgrade implements the `upgrade` subcommand, which replaces the binary
+// with the latest release for the platform. The release's checksums file
+// must be signed with the update key, and the downloaded binary must match
+// its checksum, before anything is replaced.
+func runUpgrade(args []string) int {
+	fs := flag.NewFlagSet("upgrade", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: goserve upgrade [flags]")
+		fs.PrintDefaults()
+	}
+	feed := fs.String("feed", defaultReleaseFeed, "URL of the latest release")
+	key := fs.String("key", updateKey, "Base64 ed25519 public key checksums are signed with")
+	checkOnly := fs.Bool("check", false, "Only report whether a newer release is available")
+	force := fs.Bool("force", false, "Install the release even if it isn't newer than the running version")
+	binary := fs.String("binary", "", "Binary to replace (default: the running one)")
+	timeout := fs.Duration("timeout", 5*time.Minute, "Timeout for downloads")
+	fs.Parse(args)
+
+	client := &http.Client{Timeout: *timeout}
+	b, err := fetch(client, *feed, 1<<20)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Couldn't fetch release feed:", err)
+		return 1
+	}
+	var rel releaseFeed
+	if err := json.Unmarshal(b, &rel); err != nil || rel.Tag == "" {
+		fmt.Fprintln(os.Stderr, "Invalid release feed:", *feed)
+		return 1
+	}
+	latest := strings.TrimPrefix(rel.Tag, "v")
+	if !newerVersion(latest, version) && !*force {
+		// Never downgrade, even to a release that's still validly signed
+		fmt.Printf("goserve %s is up to date (latest release: %s)\n", version, latest)
+		return 0
+	}
+	if *checkOnly {
+		fmt.Printf("goserve %s is available (running %s)\n", latest, version)
+		return 0
+	}
+
+	pub, err := base64.StdEncoding.DecodeString(*key)
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		fmt.Fprintln(os.Stderr, "A valid -key is required to verify releases")
+		return 1
+	}
+	name := fmt.Sprintf("goserve_%s_%s", runtime.GOOS, runtime.GOARCH)
+	if runtime.GOOS == "windows" {
+		name += ".exe"
+	}
+	var binURL, sumsURL, sigURL string
+	if binURL, err = rel.asset(name); err == nil {
+		if sumsURL, err = rel.asset("checksums.txt"); err == nil {
+			sigURL, err = rel.asset("checksums.txt.sig")
+		}
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	sums, err := fetch(client, sumsURL, 1<<20)
+	var sig []byte
+	if err == nil {
+		sig, err = fetch(client, sigURL, 1<<10)
+	}
+	var want string
+	if err == nil {
+		want, err = verifyChecksums(latest, sums, sig, ed25519.PublicKey(pub), name)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Couldn't verify release:", err)
+		return 1
+	}
+	bin, err := fetch(client, binURL, maxReleaseAsset)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Couldn't download release:", err)
+		return 1
+	}
+	if sum := sha256.Sum256(bin); hex.EncodeToString(sum[:]) != want {
+		fmt.Fprintf(os.Stderr, "Checksum mismatch for %s\n", name)
+		return 1
+	}
+
+	target := *binary
+	if target == "" {
+		if target, err = os.Executable(); err == nil {
+			target, err = filepath.EvalSymlinks(target)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Couldn't find the running binary:", err)
+			return 1
+		}
+	}
+	if err := replaceBinary(target, bin); err != nil {
+		fmt.Fprintf(os.Stderr, "Couldn't replace %s: %s\n", target, err)
+		return 1
+	}
+	fmt.Printf("Upgraded %s from %s to %s; restart goserve to use it\n",
+		target, version, latest)
+	return 0
+}
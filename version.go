@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+)
+
+// Build details, set at build time with e.g.
+//
+//	go build -ldflags "-X main.version=1.2.0 -X main.commit=abc123 -X main.buildDate=2024-01-02"
+//
+// Unset details are taken from the VCS information Go embeds, where present.
+var (
+	version   = "dev"
+	commit    = ""
+	buildDate = ""
+)
+
+// BuildInfo describes the build of the running binary.
+type BuildInfo struct {
+	Version   string   `json:"version"`
+	Commit    string   `json:"commit,omitempty"`
+	Date      string   `json:"date,omitempty"`
+	GoVersion string   `json:"go_version"`
+	Platform  string   `json:"platform"`
+	Features  []string `json:"features"` // optional features supported by this build
+}
+
+// buildInfo returns the details of the running binary's build.
+func buildInfo() BuildInfo {
+	b := BuildInfo{
+		Version:   version,
+		Commit:    commit,
+		Date:      buildDate,
+		GoVersion: runtime.Version(),
+		Platform:  runtime.GOOS + "/" + runtime.GOARCH,
+		Features:  []string{},
+	}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		if b.Version == "dev" && bi.Main.Version != "" && bi.Main.Version != "(devel)" {
+			b.Version = bi.Main.Version
+		}
+		for _, s := range bi.Settings {
+			switch {
+			case s.Key == "vcs.revision" && b.Commit == "":
+				b.Commit = s.Value
+			case s.Key == "vcs.time" && b.Date == "":
+				b.Date = s.Value
+			case s.Key == "vcs.modified" && s.Value == "true" && commit == "":
+				b.Commit += "-dirty"
+			}
+		}
+	}
+	if mmapSupported {
+		b.Features = append(b.Features, "mmap")
+	}
+	if syslogSupported {
+		b.Features = append(b.Features, "syslog")
+	}
+	return b
+}
+
+// VersionHandler serves the details of the running binary's build as JSON.
+func VersionHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-cache")
+		json.NewEncoder(w).Encode(buildInfo())
+	})
+}
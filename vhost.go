@@ -0,0 +1,93 @@
+package main
+
+import (
+	"container/list"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+// hostPlaceholder is replaced in a serve's target by the host of each
+// request, e.g. /srv/sites/%host%/public.
+const hostPlaceholder = "%host%"
+
+// maxHostTargets limits the number of hosts whose handlers are kept, the
+// least recently requested being dropped first.
+const maxHostTargets = 1000
+
+// expandEnv replaces $NAME and ${NAME} with the values of environment
+// variables, leaving references to undefined variables as ${NAME}.
+func expandEnv(s string) string {
+	return os.Expand(s, func(name string) string {
+		if v, ok := os.LookupEnv(name); ok {
+			return v
+		}
+		return "${" + name + "}"
+	})
+}
+
+// targetHost returns the host of the request, lower case and without any
+// port, or "" if it isn't a host name that may safely be used in a path.
+func targetHost(r *http.Request) string {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if host == "" || host[0] == '.' || host[0] == '-' || strings.Contains(host, "..") {
+		return ""
+	}
+	for _, c := range host {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '.' || c == '-') {
+			return ""
+		}
+	}
+	return host
+}
+
+// hostTarget is the handler kept for a host's directory.
+type hostTarget struct {
+	host    string
+	handler http.Handler
+}
+
+// HostTargetHandler serves each request from the directory named by
+// replacing %host% in the target with the request's host, so that many sites
+// can be served following a directory convention. Requests for hosts without
+// a directory receive "404 Not Found".
+func HostTargetHandler(target string, serve func(dir http.Dir) http.Handler) http.Handler {
+	var mu sync.Mutex
+	handlers := make(map[string]*list.Element)
+	lru := list.New() // of *hostTarget, most recently used first
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := targetHost(r)
+		if host == "" {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		dir := strings.Replace(target, hostPlaceholder, host, -1)
+		if fi, err := os.Stat(dir); err != nil || !fi.IsDir() {
+			http.NotFound(w, r)
+			return
+		}
+
+		mu.Lock()
+		var h http.Handler
+		if el := handlers[host]; el != nil {
+			lru.MoveToFront(el)
+			h = el.Value.(*hostTarget).handler
+		} else {
+			if lru.Len() >= maxHostTargets {
+				// Forget the least recently requested host
+				old := lru.Remove(lru.Back()).(*hostTarget)
+				delete(handlers, old.host)
+			}
+			h = serve(http.Dir(dir))
+			handlers[host] = lru.PushFront(&hostTarget{host, h})
+		}
+		mu.Unlock()
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// watchInterval is how often watched files are checked for changes (0=they
+// aren't watched).
+var watchInterval time.Duration
+
+// fileState identifies the version of a file, following any symlinks to it.
+type fileState struct {
+	path string      // with symlinks resolved
+	info os.FileInfo // of the resolved file
+}
+
+// statFile returns the state of the named file.
+func statFile(name string) (fileState, error) {
+	p, err := filepath.EvalSymlinks(name)
+	if err != nil {
+		return fileState{}, err
+	}
+	fi, err := os.Stat(p)
+	if err != nil {
+		return fileState{}, err
+	}
+	return fileState{p, fi}, nil
+}
+
+// changed returns true if the file is a different one, or has been modified.
+// Kubernetes updates mounted ConfigMaps and Secrets by pointing a symlink at
+// a new directory, which changes the resolved path even when the file's own
+// path and modification time don't.
+func (s fileState) changed(t fileState) bool {
+	return s.path != t.path || !os.SameFile(s.info, t.info) ||
+		!s.info.ModTime().Equal(t.info.ModTime()) || s.info.Size() != t.info.Size()
+}
+
+// WatchFiles calls reload whenever any of the files changes, checking every
+// watchInterval, until the function returned is called. If reload fails, as
+// when only some of the files have been updated, it's called again at the
+// next check. Nothing is watched if watchInterval is 0. Directories may be
+// watched too, noticing files being added to or removed from them.
+func WatchFiles(names []string, reload func() error) (stop func()) {
+	if watchInterval <= 0 || len(names) == 0 {
+		return func() {}
+	}
+	states := make([]fileState, len(names))
+	for i, name := range names {
+		states[i], _ = statFile(name)
+	}
+	label := strings.Join(names, ", ")
+	if len(names) > 3 {
+		label = fmt.Sprintf("%s and %d more", strings.Join(names[:3], ", "), len(names)-3)
+	}
+	done := make(chan struct{})
+	go func() {
+		t := time.NewTicker(watchInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+			case <-done:
+				return
+			}
+			next := make([]fileState, len(names))
+			changed := false
+			for i, name := range names {
+				s, err := statFile(name)
+				if err != nil {
+					// Possibly mid-update; check again next time
+					changed = false
+					break
+				}
+				next[i] = s
+				changed = changed || states[i].info == nil || states[i].changed(s)
+			}
+			if !changed {
+				continue
+			}
+			if err := reload(); err != nil {
+				log.Printf("Couldn't reload %s: %s", label, err)
+				continue // retried until the files are consistent
+			}
+			log.Printf("Reloaded %s", label)
+			states = next
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(done) })
+	}
+}